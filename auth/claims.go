@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"encoding/json"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the claims of the tokens generated by a TokenManager. They are decoded into their
+// types, so that the user ID isn't a float64 which loses the precision of the large IDs.
+type Claims struct {
+	// Authorized is always true, it is kept for the clients reading it
+	Authorized bool `json:"authorized"`
+	// UserID is the ID of the user the token authenticates
+	UserID uint `json:"id"`
+	// OrgID is the organization scoping what the user can see, nil if the user has none
+	OrgID *uint `json:"org,omitempty"`
+	// MustChangePassword tells the clients to ask for a new password, the AuthMiddleware only allows changing it
+	MustChangePassword bool `json:"chpwd,omitempty"`
+	// Permissions and PermissionsVersion are only set with the permissions of the user, see PermissionsFromClaims
+	Permissions        []string `json:"perms,omitempty"`
+	PermissionsVersion *uint    `json:"pv,omitempty"`
+	// Custom are the claims of the ClaimsEnricher, they are merged with the others in the token
+	Custom map[string]any `json:"-"`
+	jwt.RegisteredClaims
+}
+
+// claimsFields has the fields of Claims without its JSON methods, to encode and decode them as usual
+type claimsFields Claims
+
+// MarshalJSON encodes the claims, along with the Custom ones which aren't reserved.
+func (c Claims) MarshalJSON() ([]byte, error) {
+	encoded, err := json.Marshal(claimsFields(c))
+	if err != nil || len(c.Custom) == 0 {
+		return encoded, err
+	}
+
+	// Kept raw, so that the numbers aren't decoded as float64
+	merged := map[string]json.RawMessage{}
+	if err := json.Unmarshal(encoded, &merged); err != nil {
+		return nil, err
+	}
+	for name, value := range c.Custom {
+		if reservedClaims[name] {
+			continue
+		}
+		if merged[name], err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(merged)
+}
+
+// UnmarshalJSON decodes the claims, the ones which aren't reserved being set in Custom.
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*claimsFields)(c)); err != nil {
+		return err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	c.Custom = nil
+	for name, value := range all {
+		if reservedClaims[name] {
+			continue
+		}
+		var custom any
+		if err := json.Unmarshal(value, &custom); err != nil {
+			return err
+		}
+		if c.Custom == nil {
+			c.Custom = map[string]any{}
+		}
+		c.Custom[name] = custom
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+/*
+Package auth issues and validates the jwt used to authenticate the users.
+
+It has no dependency on gin nor on the database, so it can be embedded in any
+application, along with the services of the service package:
+
+	tokens := auth.NewTokenManager(secret, auth.DefaultTokenTTL, auth.TokenOptions{Issuer: "my-service"})
+	signed, claims, err := tokens.Generate(user)
+	claims, err = tokens.Parse(signed)
+	userID := claims.UserID
+*/
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/kjk/betterguid"
+)
+
+// DefaultTokenTTL is the lifetime of the generated jwt, sessions are then extended with the refresh tokens
+const DefaultTokenTTL = 5 * time.Minute
+
+// ErrTokenExpired is returned by Parse, wrapped, for a valid but expired token
+var ErrTokenExpired = jwt.ErrTokenExpired
+
+// IsTokenError reports whether err, returned by Parse, rejects the token itself: malformed, badly
+// signed, expired or with invalid claims.
+func IsTokenError(err error) bool {
+	return errors.Is(err, jwt.ErrTokenMalformed) || errors.Is(err, jwt.ErrTokenUnverifiable) ||
+		errors.Is(err, jwt.ErrTokenSignatureInvalid) || errors.Is(err, jwt.ErrTokenInvalidClaims) ||
+		errors.Is(err, jwt.ErrTokenRequiredClaimMissing)
+}
+
+// ClaimsEnricher returns custom claims to embed in the tokens of user, e.g. a tenant ID or permissions.
+type ClaimsEnricher func(user *model.User) map[string]any
+
+// reservedClaims are set by Generate or registered by RFC 7519, a ClaimsEnricher can't override them
+var reservedClaims = map[string]bool{
+	"authorized": true,
+	"id":         true,
+	"iss":        true,
+	"sub":        true,
+	"aud":        true,
+	"exp":        true,
+	"nbf":        true,
+	"iat":        true,
+	"jti":        true,
+	"org":        true,
+	"chpwd":      true,
+	"perms":      true,
+	"pv":         true,
+}
+
+// TokenOptions are the optional settings of a TokenManager.
+type TokenOptions struct {
+	// Issuer is set as the iss claim and required when parsing, if not empty
+	Issuer string
+	// Audience is set as the aud claim and required when parsing, if not empty
+	Audience string
+	// Leeway tolerates clock differences between instances when validating the time based claims (exp, nbf, iat)
+	Leeway time.Duration
+	// ClaimsEnricher adds custom claims to the generated tokens, if not nil
+	ClaimsEnricher ClaimsEnricher
+	// KeyID is set as the kid header of the generated tokens, if not empty
+	KeyID string
+	// PreviousKeys are retired secrets by kid. They don't sign anything anymore, but still verify
+	// the tokens that name them in their kid header, so that rotating the secret logs nobody out
+	PreviousKeys map[string]string
+}
+
+// TokenManager generates and validates HS256 signed jwt. The tokens are signed with the current
+// secret, and verified with the key their kid header names, see TokenOptions.PreviousKeys.
+type TokenManager struct {
+	secret  []byte
+	ttl     time.Duration
+	options TokenOptions
+}
+
+/*
+NewTokenManager returns a TokenManager signing the tokens with secret.
+
+Parameters:
+- secret (string): The HMAC secret, at least 32 bytes long.
+- ttl (time.Duration): The lifetime of the generated tokens.
+- options (TokenOptions): The optional claims and validation settings.
+
+Returns:
+- (*TokenManager): A pointer to the newly created TokenManager instance.
+*/
+func NewTokenManager(secret string, ttl time.Duration, options TokenOptions) *TokenManager {
+	return &TokenManager{
+		secret:  []byte(secret),
+		ttl:     ttl,
+		options: options,
+	}
+}
+
+/*
+SetClaimsEnricher sets the ClaimsEnricher of the generated tokens. It isn't safe to call
+while tokens are generated, set it before serving the requests.
+
+Parameters:
+- enricher (ClaimsEnricher): The function returning the custom claims, nil to remove it.
+*/
+func (m *TokenManager) SetClaimsEnricher(enricher ClaimsEnricher) {
+	m.options.ClaimsEnricher = enricher
+}
+
+/*
+Generate generates a signed jwt for the user. The custom claims of the ClaimsEnricher are
+merged with the standard ones, a custom claim named like a reserved one is ignored.
+
+Parameters:
+- user (*model.User): The user the token authenticates.
+
+Returns:
+- (string): The signed token.
+- (*Claims): The claims of the token, e.g. to keep track of its jti.
+- (error): An error if one occurred during the signing.
+*/
+func (m *TokenManager) Generate(user *model.User) (string, *Claims, error) {
+	now := time.Now()
+	claims := &Claims{
+		Authorized:         true,
+		UserID:             user.ID,
+		OrgID:              user.OrgID,
+		MustChangePassword: user.MustChangePassword,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        betterguid.New(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(m.ttl)),
+			Issuer:    m.options.Issuer,
+		},
+	}
+	if m.options.ClaimsEnricher != nil {
+		claims.Custom = m.options.ClaimsEnricher(user)
+	}
+	// The permissions spare a query per request, they are trusted while pv matches the user's
+	// PermissionsVersion, see PermissionsFromClaims
+	if user.Permissions != nil {
+		version := user.PermissionsVersion
+		claims.Permissions = user.Permissions
+		claims.PermissionsVersion = &version
+	}
+	if m.options.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{m.options.Audience}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if m.options.KeyID != "" {
+		token.Header["kid"] = m.options.KeyID
+	}
+
+	signed, err := token.SignedString(m.secret)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return signed, claims, nil
+}
+
+/*
+PermissionsFromClaims returns the permissions set in the perms and pv claims by Generate.
+
+Parameters:
+- claims (*Claims): The claims of a token.
+
+Returns:
+- ([]string): The names of the permissions of the user when the token was issued.
+- (uint): The PermissionsVersion of the user when the token was issued.
+- (bool): false if the token has no permissions, they must then be loaded.
+*/
+func PermissionsFromClaims(claims *Claims) ([]string, uint, bool) {
+	if claims.PermissionsVersion == nil {
+		return nil, 0, false
+	}
+	// An empty perms claim is left out of the token
+	if claims.Permissions == nil {
+		return []string{}, *claims.PermissionsVersion, true
+	}
+
+	return claims.Permissions, *claims.PermissionsVersion, true
+}
+
+/*
+Parse verifies the signature and the time based claims of a token, with the configured
+leeway, and its issuer and audience when they are configured, so that a token minted by
+another deployment is rejected. A token used before its nbf claim is rejected.
+
+The signature is verified with the key named by the kid header, the current secret or one
+of the PreviousKeys. A token without kid, issued before the key IDs were configured, is
+verified with the current secret.
+
+Parameters:
+- raw (string): The signed token.
+
+Returns:
+- (*Claims): The claims of the token. They are also returned for an expired token, so that it can be refreshed.
+- (error): An error if the token is invalid, wrapping ErrTokenExpired if it is only expired.
+*/
+func (m *TokenManager) Parse(raw string) (*Claims, error) {
+	parserOptions := []jwt.ParserOption{jwt.WithIssuedAt(), jwt.WithLeeway(m.options.Leeway)}
+	if m.options.Issuer != "" {
+		parserOptions = append(parserOptions, jwt.WithIssuer(m.options.Issuer))
+	}
+	if m.options.Audience != "" {
+		parserOptions = append(parserOptions, jwt.WithAudience(m.options.Audience))
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return m.verificationKey(token)
+	}, parserOptions...)
+	if token == nil {
+		return nil, err
+	}
+
+	return claims, err
+}
+
+// verificationKey returns the secret the token has been signed with, according to its kid header.
+func (m *TokenManager) verificationKey(token *jwt.Token) ([]byte, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" || kid == m.options.KeyID {
+		return m.secret, nil
+	}
+
+	if secret, ok := m.options.PreviousKeys[kid]; ok {
+		return []byte(secret), nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
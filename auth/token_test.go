@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oldSecret     = "old-secret-at-least-32-bytes-long!!"
+	currentSecret = "current-secret-at-least-32-bytes-long"
+)
+
+func TestKeyRotation(t *testing.T) {
+	user := &model.User{}
+	user.ID = 1
+
+	// The manager of the deployment after the rotation, from "old" to "current"
+	rotated := NewTokenManager(currentSecret, time.Minute, TokenOptions{
+		KeyID:        "current",
+		PreviousKeys: map[string]string{"old": oldSecret},
+	})
+
+	tests := []struct {
+		name    string
+		issuer  *TokenManager
+		wantErr bool
+	}{
+		{
+			name:   "signed with the current key",
+			issuer: rotated,
+		},
+		{
+			name:   "signed with a previous key",
+			issuer: NewTokenManager(oldSecret, time.Minute, TokenOptions{KeyID: "old"}),
+		},
+		{
+			name:   "signed before the key IDs, with the current secret",
+			issuer: NewTokenManager(currentSecret, time.Minute, TokenOptions{}),
+		},
+		{
+			name:    "signed with a removed key",
+			issuer:  NewTokenManager("removed-secret-at-least-32-bytes-long", time.Minute, TokenOptions{KeyID: "removed"}),
+			wantErr: true,
+		},
+		{
+			name:    "naming a previous key it isn't signed with",
+			issuer:  NewTokenManager(currentSecret, time.Minute, TokenOptions{KeyID: "old"}),
+			wantErr: true,
+		},
+		{
+			name:    "signed before the key IDs, with a previous secret",
+			issuer:  NewTokenManager(oldSecret, time.Minute, TokenOptions{}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, _, err := tt.issuer.Generate(user)
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+
+			claims, err := rotated.Parse(signed)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && claims.UserID != 1 {
+				t.Errorf("Parse() id claim = %v, want 1", claims.UserID)
+			}
+		})
+	}
+}
+
+func TestGenerateSetsKid(t *testing.T) {
+	for kid, want := range map[string]any{"current": "current", "": nil} {
+		signed, _, err := NewTokenManager(currentSecret, time.Minute, TokenOptions{KeyID: kid}).Generate(&model.User{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, _, err := jwt.NewParser().ParseUnverified(signed, jwt.MapClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := token.Header["kid"]; got != want {
+			t.Errorf("kid header = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestParseExpired(t *testing.T) {
+	m := NewTokenManager(currentSecret, -time.Minute, TokenOptions{})
+	signed, _, err := m.Generate(&model.User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := m.Parse(signed)
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("Parse() error = %v, want ErrTokenExpired", err)
+	}
+	if claims == nil {
+		t.Error("Parse() must return the claims of an expired token, to refresh it")
+	}
+}
+
+func TestPermissionsFromClaims(t *testing.T) {
+	m := NewTokenManager(currentSecret, time.Minute, TokenOptions{})
+
+	tests := []struct {
+		name        string
+		permissions []string
+		wantOK      bool
+	}{
+		{name: "not loaded", permissions: nil, wantOK: false},
+		{name: "none", permissions: []string{}, wantOK: true},
+		{name: "some", permissions: []string{"users:export", "users:read"}, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &model.User{Permissions: tt.permissions, PermissionsVersion: 3}
+			signed, _, err := m.Generate(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := m.Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			permissions, version, ok := PermissionsFromClaims(claims)
+			if ok != tt.wantOK {
+				t.Fatalf("PermissionsFromClaims() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if version != 3 {
+				t.Errorf("PermissionsFromClaims() version = %d, want 3", version)
+			}
+			if len(permissions) != len(tt.permissions) {
+				t.Fatalf("PermissionsFromClaims() = %v, want %v", permissions, tt.permissions)
+			}
+			for i := range permissions {
+				if permissions[i] != tt.permissions[i] {
+					t.Errorf("PermissionsFromClaims() = %v, want %v", permissions, tt.permissions)
+				}
+			}
+		})
+	}
+}
+
+func TestClaimsRoundTrip(t *testing.T) {
+	// Above 2^53, a float64 can't hold the ID exactly
+	const largeID = 1<<53 + 1
+	org := uint(largeID + 2)
+	user := &model.User{OrgID: &org, MustChangePassword: true}
+	user.ID = largeID
+
+	m := NewTokenManager(currentSecret, time.Minute, TokenOptions{
+		Issuer:   "issuer",
+		Audience: "audience",
+		ClaimsEnricher: func(user *model.User) map[string]any {
+			return map[string]any{"tenant": "acme", "id": "overridden"}
+		},
+	})
+	signed, generated, err := m.Generate(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := m.Parse(signed)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if claims.UserID != largeID || generated.UserID != largeID {
+		t.Errorf("Parse() id claim = %d, want %d", claims.UserID, uint(largeID))
+	}
+	if claims.OrgID == nil || *claims.OrgID != org {
+		t.Errorf("Parse() org claim = %v, want %d", claims.OrgID, org)
+	}
+	if !claims.MustChangePassword || !claims.Authorized {
+		t.Errorf("Parse() chpwd, authorized claims = %v, %v, want true, true", claims.MustChangePassword, claims.Authorized)
+	}
+	if claims.ID == "" || claims.ID != generated.ID || claims.Issuer != "issuer" || claims.ExpiresAt == nil {
+		t.Errorf("Parse() registered claims = %+v, want those of Generate", claims.RegisteredClaims)
+	}
+	// A custom claim can't override a reserved one
+	if claims.Custom["tenant"] != "acme" || len(claims.Custom) != 1 {
+		t.Errorf("Parse() custom claims = %v, want only the tenant", claims.Custom)
+	}
+}
+
+func TestParseMapClaimsToken(t *testing.T) {
+	// The tokens signed before the Claims type, with a float encoded id, still parse
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"authorized": true,
+		"id":         42,
+		"jti":        "jti",
+		"iat":        time.Now().Unix(),
+		"exp":        time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte(currentSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := NewTokenManager(currentSecret, time.Minute, TokenOptions{}).Parse(signed)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if claims.UserID != 42 || claims.ID != "jti" || claims.OrgID != nil || claims.Custom != nil {
+		t.Errorf("Parse() = %+v, want the user 42 only", claims)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"gorm.io/gorm"
+)
+
+// The commands of the binary
+const (
+	// commandServe runs the API, the default
+	commandServe = "serve"
+	// commandMigrate applies the schema changes and exits
+	commandMigrate = "migrate"
+	// commandReencrypt encrypts the encrypted columns with the current FIELD_ENCRYPTION_KEY and exits
+	commandReencrypt = "reencrypt"
+)
+
+// command is the parsed command line
+type command struct {
+	name string
+	// skipMigrate starts serve without migrating, the schema being applied by migrate beforehand
+	skipMigrate bool
+}
+
+/*
+parseCommand parses the command line arguments:
+
+	user-api [-skip-migrate] [serve|migrate|reencrypt]
+
+Parameters:
+- args ([]string): The arguments, without the program name.
+- output (io.Writer): Where the usage and the errors are written.
+
+Returns:
+- (*command): The command to run, serve when none is given.
+- (error): An error for an unknown flag or command, flag.ErrHelp for -h.
+*/
+func parseCommand(args []string, output io.Writer) (*command, error) {
+	flags := flag.NewFlagSet("user-api", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = func() {
+		fmt.Fprintln(output, "Usage: user-api [-skip-migrate] [serve|migrate|reencrypt]")
+		fmt.Fprintln(output, "  serve\truns the API, migrating the database first unless -skip-migrate is set (default)")
+		fmt.Fprintln(output, "  migrate\tapplies the schema changes to the database and exits")
+		fmt.Fprintln(output, "  reencrypt\tencrypts the encrypted columns with the current FIELD_ENCRYPTION_KEY, migrating first unless -skip-migrate is set, and exits")
+		flags.PrintDefaults()
+	}
+	cmd := &command{name: commandServe}
+	flags.BoolVar(&cmd.skipMigrate, "skip-migrate", false, "start serve without migrating the database")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		cmd.name = flags.Arg(0)
+	default:
+		flags.Usage()
+		return nil, fmt.Errorf("expected a single command, got %q", flags.Args())
+	}
+	if cmd.name != commandServe && cmd.name != commandMigrate && cmd.name != commandReencrypt {
+		flags.Usage()
+		return nil, fmt.Errorf("unknown command %q", cmd.name)
+	}
+
+	return cmd, nil
+}
+
+// seedAdmin creates the admin of ADMIN_EMAIL if there is no admin yet. A failure is logged, the server still starts
+func seedAdmin(userService *service.UserService, conf *config.Config, logger *slog.Logger) {
+	admin, err := userService.SeedAdmin(context.Background(), conf.ADMIN_EMAIL, conf.ADMIN_PASSWORD)
+	switch {
+	case err != nil:
+		logger.Error("failed to seed the admin", "email", conf.ADMIN_EMAIL, "error", err)
+	case admin == nil:
+		logger.Debug("an admin already exists, ADMIN_EMAIL isn't seeded")
+	default:
+		logger.Warn("seeded the admin from ADMIN_EMAIL, change its password and unset ADMIN_PASSWORD", "id", admin.ID, "email", admin.Email)
+	}
+}
+
+// reencrypt encrypts the plaintext and the previous key values of the users with the current key
+func reencrypt(userService *service.UserService, logger *slog.Logger) error {
+	if model.FieldEncryption == nil {
+		return errors.New("FIELD_ENCRYPTION_KEY is not set, there is no key to encrypt with")
+	}
+	count, err := userService.ReencryptFields(context.Background(), model.FieldEncryption)
+	if err != nil {
+		return err
+	}
+	logger.Info("re-encrypted the users", "count", count)
+
+	return nil
+}
+
+// migrate creates and alters the tables of every model, see model.Models
+func migrate(db *gorm.DB) error {
+	return db.AutoMigrate(model.Models()...)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name            string
+		args            []string
+		wantName        string
+		wantSkipMigrate bool
+		wantErr         bool
+	}{
+		{"default", nil, commandServe, false, false},
+		{"serve", []string{"serve"}, commandServe, false, false},
+		{"serve without migrating", []string{"-skip-migrate", "serve"}, commandServe, true, false},
+		{"skip migrate alone", []string{"-skip-migrate"}, commandServe, true, false},
+		{"migrate", []string{"migrate"}, commandMigrate, false, false},
+		{"reencrypt without migrating", []string{"-skip-migrate", "reencrypt"}, commandReencrypt, true, false},
+		{"unknown command", []string{"seed"}, "", false, true},
+		{"several commands", []string{"migrate", "serve"}, "", false, true},
+		{"unknown flag", []string{"-migrate"}, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := parseCommand(tt.args, io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCommand(%q) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cmd.name != tt.wantName || cmd.skipMigrate != tt.wantSkipMigrate {
+				t.Errorf("parseCommand(%q) = %+v, want %s with skipMigrate %v", tt.args, *cmd, tt.wantName, tt.wantSkipMigrate)
+			}
+		})
+	}
+
+	if _, err := parseCommand([]string{"-h"}, io.Discard); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("parseCommand(-h) error = %v, want flag.ErrHelp", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:migrate?mode=memory&cache=shared"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	// Migrating an up to date schema again must be a no-op
+	for i := 0; i < 2; i++ {
+		if err := migrate(db); err != nil {
+			t.Fatalf("migrate() run %d error = %v", i+1, err)
+		}
+	}
+	for _, m := range model.Models() {
+		if !db.Migrator().HasTable(m) {
+			t.Errorf("the table of %T wasn't created", m)
+		}
+	}
+}
@@ -2,27 +2,42 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
 
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
 /*
-InitDB initializes a GORM database connection using the provided Config.
+InitDB initializes a GORM database connection using the provided Config, and sizes its
+connection pool with DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS and DB_CONN_MAX_LIFETIME.
 
 Parameters:
 - config (*Config): A pointer to the Config struct containing database connection details.
+- logger (*slog.Logger): The application logger the SQL logs are written to, as allowed by DB_LOG_LEVEL.
 
 Returns:
 - (*gorm.DB): A pointer to the GORM database object.
 - (error): An error object if the connection fails, nil otherwise.
 */
-func InitDB(config *Config) (*gorm.DB, error) {
+func InitDB(config *Config, logger *slog.Logger) (*gorm.DB, error) {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local", config.DB_USER, config.DB_PASS, config.DB_HOST, config.DB_PORT, config.DB_NAME)
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+		// Translate driver specific errors to gorm's, e.g. gorm.ErrDuplicatedKey on unique constraint violations
+		TranslateError: true,
+		Logger:         NewGormLogger(logger, ParseGormLogLevel(config.DB_LOG_LEVEL), config.DB_SLOW_QUERY_THRESHOLD),
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(config.DB_MAX_OPEN_CONNS)
+	sqlDB.SetMaxIdleConns(config.DB_MAX_IDLE_CONNS)
+	sqlDB.SetConnMaxLifetime(config.DB_CONN_MAX_LIFETIME)
+
 	return db, nil
 }
@@ -1,9 +1,26 @@
 package config
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/MohammadBnei/gorm-user-auth/model"
 	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Config struct {
@@ -12,19 +29,887 @@ type Config struct {
 	DB_PASS string
 	DB_PORT string
 	DB_NAME string
+	// DB_LOG_LEVEL is the gorm log level (silent, error, warn or info), queries slower than DB_SLOW_QUERY_THRESHOLD are logged from warn
+	DB_LOG_LEVEL            string
+	DB_SLOW_QUERY_THRESHOLD time.Duration
+	// DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS and DB_CONN_MAX_LIFETIME tune the connection pool
+	DB_MAX_OPEN_CONNS    int
+	DB_MAX_IDLE_CONNS    int
+	DB_CONN_MAX_LIFETIME time.Duration
 
 	JWT_SECRET string
+	// JWT_KID identifies JWT_SECRET in the kid header of the tokens. JWT_PREVIOUS_KEYS are
+	// kid:secret pairs of retired secrets, still accepted to verify the tokens signed before a rotation
+	JWT_KID           string
+	JWT_PREVIOUS_KEYS []string
+	// JWT_ISSUER and JWT_AUDIENCE are set as the iss and aud claims, and required from the received tokens when set
+	JWT_ISSUER   string
+	JWT_AUDIENCE string
+	// JWT_LEEWAY tolerates clock differences between instances when validating exp, nbf and iat
+	JWT_LEEWAY time.Duration
+
+	// LINK_SIGNING_KEY signs the tokens of the emailed links (password reset, email verification),
+	// derived from JWT_SECRET when empty. Changing it invalidates the links already sent
+	LINK_SIGNING_KEY string
+
+	// FIELD_ENCRYPTION_KEY encrypts the sensitive columns at rest with AES-GCM, like the last login IP,
+	// they are stored in plaintext when it is empty. It is the base64 of a 16, 24 or 32 bytes key,
+	// whose FIELD_ENCRYPTION_KEY_VERSION is stored with the values. FIELD_ENCRYPTION_PREVIOUS_KEYS are
+	// version:key pairs of the retired keys, still decrypting the values encrypted before a rotation
+	FIELD_ENCRYPTION_KEY           string
+	FIELD_ENCRYPTION_KEY_VERSION   string
+	FIELD_ENCRYPTION_PREVIOUS_KEYS []string
+
+	LOG_LEVEL string
+
+	// ENV is the deployment environment, production or development. The error details of the 5xx
+	// responses are only returned in development, or with DEBUG, and always logged
+	ENV   string
+	DEBUG bool
+
+	// PASSWORD_HASHER hashes the new passwords: bcrypt or argon2id. The existing hashes of the other
+	// algorithm are still checked, and rehashed on the next login
+	PASSWORD_HASHER string
+	// BCRYPT_COST is the bcrypt work factor, 12 by default. A value out of the bcrypt range or not a
+	// number is a startup error
+	BCRYPT_COST int
+	// ARGON2_MEMORY (in KiB), ARGON2_ITERATIONS and ARGON2_PARALLELISM are the argon2id parameters
+	ARGON2_MEMORY      int
+	ARGON2_ITERATIONS  int
+	ARGON2_PARALLELISM int
+	// PASSWORD_HISTORY is the number of previous passwords that can't be reused, 0 to allow any
+	PASSWORD_HISTORY int
+
+	// RT_SESSION_EXPIRY is the lifetime of a refresh token, RT_REMEMBER_ME_EXPIRY when logging in with remember me
+	RT_SESSION_EXPIRY     time.Duration
+	RT_REMEMBER_ME_EXPIRY time.Duration
+	// RT_IDLE_EXPIRY expires the sessions unused for that long, each refresh pushing their expiry back. 0 disables the sliding window
+	RT_IDLE_EXPIRY time.Duration
+	// RT_ABSOLUTE_EXPIRY caps the lifetime of a session since the login, however active it is. 0 for no cap
+	RT_ABSOLUTE_EXPIRY time.Duration
+	// MAX_SESSIONS_PER_USER caps the active sessions of a user, 0 for no cap. At the cap, a new login
+	// either evicts the oldest session or is rejected, as set by SESSION_LIMIT_POLICY: evict-oldest or reject
+	MAX_SESSIONS_PER_USER int
+	SESSION_LIMIT_POLICY  string
+
+	// CORS_ALLOWED_ORIGINS are the origins allowed to call the API from a browser, "*" for any. The
+	// credentialed requests of CORS_ALLOW_CREDENTIALS require the origins to be listed, not "*"
+	CORS_ALLOWED_ORIGINS   []string
+	CORS_ALLOWED_METHODS   []string
+	CORS_ALLOWED_HEADERS   []string
+	CORS_ALLOW_CREDENTIALS bool
+
+	// SMTP_* configure the mail delivery, emails are only logged when SMTP_HOST is empty
+	SMTP_HOST string
+	SMTP_PORT int
+	SMTP_USER string
+	SMTP_PASS string
+	MAIL_FROM string
+	// MAIL_TEMPLATES_DIR holds <name>.tmpl files overriding the default email templates
+	MAIL_TEMPLATES_DIR string
+	// APP_URL is the base URL of the front-end, used to build the links sent by email
+	APP_URL string
+
+	// TOKEN_SOURCES are where the AuthMiddleware reads the tokens from, in order: cookie (jwt and rt cookies)
+	// and/or header (Authorization and X-Refresh-Token). Without cookie, the cookies are never read nor written
+	TOKEN_SOURCES []string
+	// TOKEN_IN_BODY returns the jwt and the refresh token in the login responses and the X-New-Token header.
+	// Turned off, they only live in the HttpOnly cookies, out of reach of the scripts of the page
+	TOKEN_IN_BODY bool
+	// LOGIN_RESPONSE_USER embeds the user in the login responses. Turned off, the clients get it from GET /auth/me
+	LOGIN_RESPONSE_USER bool
+
+	// MAX_BODY_BYTES caps the size of the request bodies
+	MAX_BODY_BYTES int64
+
+	// CSRF_ENABLED requires the X-CSRF-Token header on the mutating requests authenticated by cookie
+	CSRF_ENABLED bool
+
+	// REGISTRATION_ENABLED allows the public signup, through /auth/register and the first OAuth login.
+	// The admins can create users either way
+	REGISTRATION_ENABLED bool
+	// DEFAULT_ROLE is the role of the new users, unless an admin creating one picks another. It can't be admin,
+	// the public signup would make everyone an admin
+	DEFAULT_ROLE string
+	// CHECK_EMAIL_RATE_LIMIT is the number of email checks allowed per minute and client IP, so that
+	// GET /user/check-email can't be used to enumerate the accounts. 0 disables the limit
+	CHECK_EMAIL_RATE_LIMIT int
+	// INVITATION_TTL is the lifetime of the invitations, which let their recipient register either way
+	INVITATION_TTL time.Duration
+	// RESET_TOKEN_TTL and VERIFY_TOKEN_TTL are the lifetimes of the emailed tokens resetting a forgotten
+	// password and confirming an email change. Each token is single use either way
+	RESET_TOKEN_TTL  time.Duration
+	VERIFY_TOKEN_TTL time.Duration
+	// ADMIN_EMAIL and ADMIN_PASSWORD create the first admin at startup, as long as there is no admin yet
+	ADMIN_EMAIL    string
+	ADMIN_PASSWORD string
+
+	// PASSWORD_CHANGE_GATE restricts the users flagged with MustChangePassword to the password change
+	PASSWORD_CHANGE_GATE bool
+
+	// COMPRESSION_ENABLED gzips the responses of at least COMPRESSION_MIN_SIZE bytes, for the clients accepting it
+	COMPRESSION_ENABLED  bool
+	COMPRESSION_MIN_SIZE int
+
+	// REQUEST_TIMEOUT is the deadline of the requests, after which their context is cancelled and a 503 returned.
+	// 0 disables it
+	REQUEST_TIMEOUT time.Duration
+
+	// METRICS_ENABLED exposes the Prometheus metrics on GET /metrics
+	METRICS_ENABLED bool
+
+	// GRPC_ENABLED serves the gRPC API, for the internal services, on GRPC_ADDR alongside the REST API
+	GRPC_ENABLED bool
+	GRPC_ADDR    string
+
+	// SWAGGER_ENABLED serves the swagger UI on /swagger/, behind basic auth when SWAGGER_USER and SWAGGER_PASS are set
+	SWAGGER_ENABLED bool
+	SWAGGER_USER    string
+	SWAGGER_PASS    string
+
+	// STORAGE_DRIVER stores the uploaded files, the avatars: local or s3. The local files are written
+	// to STORAGE_LOCAL_DIR and served on /uploads/. STORAGE_PUBLIC_URL is the base URL of the stored
+	// files, /uploads or S3_ENDPOINT/S3_BUCKET when empty, e.g. to serve them through a CDN
+	STORAGE_DRIVER     string
+	STORAGE_LOCAL_DIR  string
+	STORAGE_PUBLIC_URL string
+	// S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY configure the s3 STORAGE_DRIVER,
+	// any S3-compatible service (AWS, MinIO, R2...) addressed with path-style URLs
+	S3_ENDPOINT   string
+	S3_REGION     string
+	S3_BUCKET     string
+	S3_ACCESS_KEY string
+	S3_SECRET_KEY string
+	// AVATAR_MAX_BYTES caps the size of the uploaded avatar images
+	AVATAR_MAX_BYTES int64
+
+	// USER_BATCH_MAX caps the number of IDs looked up at once by GET /user?ids=
+	USER_BATCH_MAX int
+
+	// COOKIE_PREFIX is prepended to every cookie name and COOKIE_PATH scopes the cookies, so that
+	// several instances can share a domain without clobbering each other's cookies
+	COOKIE_PREFIX string
+	COOKIE_PATH   string
+	// COOKIE_SAMESITE is the SameSite attribute of the cookies: lax, strict or none. none, needed by a
+	// front-end on another site, forces COOKIE_SECURE as the browsers reject the insecure ones
+	COOKIE_SAMESITE string
+	// COOKIE_SECURE restricts the cookies to HTTPS
+	COOKIE_SECURE bool
+
+	// TRUSTED_PROXIES are the IPs or CIDRs of the load balancers allowed to set X-Forwarded-For.
+	// Empty by default, the client IP is then the address of the TCP peer
+	TRUSTED_PROXIES []string
+	// ADMIN_ALLOWED_CIDRS are the IPs or CIDRs the admin routes can be reached from, IPv4 or IPv6.
+	// Empty by default, the admin routes are then reachable from anywhere
+	ADMIN_ALLOWED_CIDRS []string
+
+	// RESPONSE_ENVELOPE wraps every response body in {"data", "error", "meta"}. Disabled by
+	// default, the bodies are then the objects themselves and the failures {"error": message}
+	RESPONSE_ENVELOPE bool
+
+	// WEBHOOK_URLS receive the auth events, signed with WEBHOOK_SECRET
+	WEBHOOK_URLS   []string
+	WEBHOOK_SECRET string
+
+	OAUTH_GOOGLE_CLIENT_ID     string
+	OAUTH_GOOGLE_CLIENT_SECRET string
+	OAUTH_GOOGLE_REDIRECT_URL  string
+	OAUTH_GITHUB_CLIENT_ID     string
+	OAUTH_GITHUB_CLIENT_SECRET string
+	OAUTH_GITHUB_REDIRECT_URL  string
+
+	// parseErrors are the variables set by InitConfig to a value that isn't parsable, reported by Validate
+	parseErrors []error
 }
 
-func InitConfig() *Config {
-	godotenv.Load()
+const (
+	// TokenSourceCookie reads the tokens from the jwt and rt cookies
+	TokenSourceCookie = "cookie"
+	// TokenSourceHeader reads the tokens from the Authorization and X-Refresh-Token headers
+	TokenSourceHeader = "header"
+)
 
-	return &Config{
-		DB_HOST:    os.Getenv("DB_HOST"),
-		DB_USER:    os.Getenv("DB_USER"),
-		DB_PASS:    os.Getenv("DB_PASS"),
-		DB_PORT:    os.Getenv("DB_PORT"),
-		DB_NAME:    os.Getenv("DB_NAME"),
-		JWT_SECRET: os.Getenv("JWT_SECRET"),
+// The values of ENV
+const (
+	EnvProduction  = "production"
+	EnvDevelopment = "development"
+)
+
+// The values of PASSWORD_HASHER
+const (
+	PasswordHasherBcrypt   = "bcrypt"
+	PasswordHasherArgon2id = "argon2id"
+)
+
+// The values of SESSION_LIMIT_POLICY
+const (
+	SessionLimitEvictOldest = "evict-oldest"
+	SessionLimitReject      = "reject"
+)
+
+// The values of STORAGE_DRIVER
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// LocalStoragePath is the path the files of the local STORAGE_DRIVER are served on
+const LocalStoragePath = "/uploads"
+
+// The values of COOKIE_SAMESITE
+const (
+	CookieSameSiteLax    = "lax"
+	CookieSameSiteStrict = "strict"
+	CookieSameSiteNone   = "none"
+)
+
+// cookieNameSeparators can't appear in a cookie name, see RFC 6265
+const cookieNameSeparators = " \t()<>@,;:\\\"/[]?={}"
+
+// minArgon2Memory is the minimum of ARGON2_MEMORY, in KiB
+const minArgon2Memory = 8 * 1024
+
+// maxPasswordHistory is the maximum of PASSWORD_HISTORY
+const maxPasswordHistory = 24
+
+// minJWTSecretLength is the minimum length of JWT_SECRET, HS256 needs a key of at least 256 bits
+const minJWTSecretLength = 32
+
+/*
+InitConfig loads the configuration from the environment. A .env file in the working
+directory is loaded first for local development, without overriding the variables
+that are already set.
+
+Returns:
+- (*Config): A pointer to the loaded Config, nil if it is invalid.
+- (error): An error listing every missing or invalid field, nil if the configuration is valid.
+*/
+func InitConfig() (*Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env file: %w", err)
 	}
+
+	// The values set but malformed are reported by Validate, with the other problems
+	env := &envParser{}
+	config := &Config{
+		DB_HOST:          os.Getenv("DB_HOST"),
+		DB_USER:          os.Getenv("DB_USER"),
+		DB_PASS:          os.Getenv("DB_PASS"),
+		DB_PORT:          os.Getenv("DB_PORT"),
+		DB_NAME:          os.Getenv("DB_NAME"),
+		JWT_SECRET:       os.Getenv("JWT_SECRET"),
+		LINK_SIGNING_KEY: os.Getenv("LINK_SIGNING_KEY"),
+		LOG_LEVEL:        getEnv("LOG_LEVEL", "info"),
+
+		ENV:   strings.ToLower(getEnv("ENV", EnvProduction)),
+		DEBUG: env.getEnvBool("DEBUG", false),
+
+		DB_LOG_LEVEL:            getEnv("DB_LOG_LEVEL", "warn"),
+		DB_SLOW_QUERY_THRESHOLD: env.getEnvDuration("DB_SLOW_QUERY_THRESHOLD", 200*time.Millisecond),
+		DB_MAX_OPEN_CONNS:       env.getEnvInt("DB_MAX_OPEN_CONNS", 25),
+		DB_MAX_IDLE_CONNS:       env.getEnvInt("DB_MAX_IDLE_CONNS", 25),
+		DB_CONN_MAX_LIFETIME:    env.getEnvDuration("DB_CONN_MAX_LIFETIME", 5*time.Minute),
+
+		JWT_KID:           os.Getenv("JWT_KID"),
+		JWT_PREVIOUS_KEYS: getEnvList("JWT_PREVIOUS_KEYS", nil),
+
+		FIELD_ENCRYPTION_KEY:           os.Getenv("FIELD_ENCRYPTION_KEY"),
+		FIELD_ENCRYPTION_KEY_VERSION:   getEnv("FIELD_ENCRYPTION_KEY_VERSION", "1"),
+		FIELD_ENCRYPTION_PREVIOUS_KEYS: getEnvList("FIELD_ENCRYPTION_PREVIOUS_KEYS", nil),
+
+		JWT_ISSUER:   os.Getenv("JWT_ISSUER"),
+		JWT_AUDIENCE: os.Getenv("JWT_AUDIENCE"),
+		JWT_LEEWAY:   env.getEnvDuration("JWT_LEEWAY", 10*time.Second),
+
+		PASSWORD_HASHER:    strings.ToLower(getEnv("PASSWORD_HASHER", PasswordHasherBcrypt)),
+		BCRYPT_COST:        env.getEnvInt("BCRYPT_COST", 12),
+		ARGON2_MEMORY:      env.getEnvInt("ARGON2_MEMORY", 19*1024),
+		ARGON2_ITERATIONS:  env.getEnvInt("ARGON2_ITERATIONS", 2),
+		ARGON2_PARALLELISM: env.getEnvInt("ARGON2_PARALLELISM", 1),
+		PASSWORD_HISTORY:   env.getEnvInt("PASSWORD_HISTORY", 0),
+
+		RT_SESSION_EXPIRY:     env.getEnvDuration("RT_SESSION_EXPIRY", 24*time.Hour),
+		RT_REMEMBER_ME_EXPIRY: env.getEnvDuration("RT_REMEMBER_ME_EXPIRY", 30*24*time.Hour),
+		RT_IDLE_EXPIRY:        env.getEnvDuration("RT_IDLE_EXPIRY", 0),
+		RT_ABSOLUTE_EXPIRY:    env.getEnvDuration("RT_ABSOLUTE_EXPIRY", 0),
+		MAX_SESSIONS_PER_USER: env.getEnvInt("MAX_SESSIONS_PER_USER", 0),
+		SESSION_LIMIT_POLICY:  strings.ToLower(getEnv("SESSION_LIMIT_POLICY", SessionLimitEvictOldest)),
+
+		SMTP_HOST:          os.Getenv("SMTP_HOST"),
+		SMTP_PORT:          env.getEnvInt("SMTP_PORT", 587),
+		SMTP_USER:          os.Getenv("SMTP_USER"),
+		SMTP_PASS:          os.Getenv("SMTP_PASS"),
+		MAIL_FROM:          os.Getenv("MAIL_FROM"),
+		MAIL_TEMPLATES_DIR: os.Getenv("MAIL_TEMPLATES_DIR"),
+		APP_URL:            strings.TrimSuffix(os.Getenv("APP_URL"), "/"),
+
+		TOKEN_SOURCES: getEnvList("TOKEN_SOURCES", []string{TokenSourceCookie, TokenSourceHeader}),
+		TOKEN_IN_BODY: env.getEnvBool("TOKEN_IN_BODY", true),
+
+		LOGIN_RESPONSE_USER: env.getEnvBool("LOGIN_RESPONSE_USER", true),
+
+		MAX_BODY_BYTES: int64(env.getEnvInt("MAX_BODY_BYTES", 1<<20)),
+
+		CSRF_ENABLED: env.getEnvBool("CSRF_ENABLED", true),
+
+		REGISTRATION_ENABLED: env.getEnvBool("REGISTRATION_ENABLED", true),
+		DEFAULT_ROLE:         strings.ToLower(getEnv("DEFAULT_ROLE", model.RoleUser)),
+		INVITATION_TTL:       env.getEnvDuration("INVITATION_TTL", 7*24*time.Hour),
+		RESET_TOKEN_TTL:      env.getEnvDuration("RESET_TOKEN_TTL", time.Hour),
+		VERIFY_TOKEN_TTL:     env.getEnvDuration("VERIFY_TOKEN_TTL", 24*time.Hour),
+
+		ADMIN_EMAIL:    os.Getenv("ADMIN_EMAIL"),
+		ADMIN_PASSWORD: os.Getenv("ADMIN_PASSWORD"),
+
+		CHECK_EMAIL_RATE_LIMIT: env.getEnvInt("CHECK_EMAIL_RATE_LIMIT", 10),
+
+		PASSWORD_CHANGE_GATE: env.getEnvBool("PASSWORD_CHANGE_GATE", true),
+
+		COMPRESSION_ENABLED:  env.getEnvBool("COMPRESSION_ENABLED", false),
+		COMPRESSION_MIN_SIZE: env.getEnvInt("COMPRESSION_MIN_SIZE", 1024),
+
+		REQUEST_TIMEOUT: env.getEnvDuration("REQUEST_TIMEOUT", 30*time.Second),
+
+		METRICS_ENABLED: env.getEnvBool("METRICS_ENABLED", false),
+
+		GRPC_ENABLED: env.getEnvBool("GRPC_ENABLED", false),
+		GRPC_ADDR:    getEnv("GRPC_ADDR", ":9090"),
+
+		SWAGGER_ENABLED: env.getEnvBool("SWAGGER_ENABLED", true),
+		SWAGGER_USER:    os.Getenv("SWAGGER_USER"),
+		SWAGGER_PASS:    os.Getenv("SWAGGER_PASS"),
+
+		STORAGE_DRIVER:     strings.ToLower(getEnv("STORAGE_DRIVER", StorageLocal)),
+		STORAGE_LOCAL_DIR:  getEnv("STORAGE_LOCAL_DIR", "uploads"),
+		STORAGE_PUBLIC_URL: os.Getenv("STORAGE_PUBLIC_URL"),
+		S3_ENDPOINT:        os.Getenv("S3_ENDPOINT"),
+		S3_REGION:          getEnv("S3_REGION", "us-east-1"),
+		S3_BUCKET:          os.Getenv("S3_BUCKET"),
+		S3_ACCESS_KEY:      os.Getenv("S3_ACCESS_KEY"),
+		S3_SECRET_KEY:      os.Getenv("S3_SECRET_KEY"),
+		AVATAR_MAX_BYTES:   int64(env.getEnvInt("AVATAR_MAX_BYTES", 2<<20)),
+
+		USER_BATCH_MAX: env.getEnvInt("USER_BATCH_MAX", 100),
+
+		COOKIE_PREFIX: os.Getenv("COOKIE_PREFIX"),
+		COOKIE_PATH:   getEnv("COOKIE_PATH", "/"),
+
+		COOKIE_SAMESITE: strings.ToLower(getEnv("COOKIE_SAMESITE", CookieSameSiteLax)),
+		COOKIE_SECURE:   env.getEnvBool("COOKIE_SECURE", false),
+
+		TRUSTED_PROXIES:     getEnvList("TRUSTED_PROXIES", nil),
+		ADMIN_ALLOWED_CIDRS: getEnvList("ADMIN_ALLOWED_CIDRS", nil),
+
+		RESPONSE_ENVELOPE: env.getEnvBool("RESPONSE_ENVELOPE", false),
+
+		WEBHOOK_URLS:   getEnvList("WEBHOOK_URLS", nil),
+		WEBHOOK_SECRET: os.Getenv("WEBHOOK_SECRET"),
+
+		OAUTH_GOOGLE_CLIENT_ID:     os.Getenv("OAUTH_GOOGLE_CLIENT_ID"),
+		OAUTH_GOOGLE_CLIENT_SECRET: os.Getenv("OAUTH_GOOGLE_CLIENT_SECRET"),
+		OAUTH_GOOGLE_REDIRECT_URL:  os.Getenv("OAUTH_GOOGLE_REDIRECT_URL"),
+		OAUTH_GITHUB_CLIENT_ID:     os.Getenv("OAUTH_GITHUB_CLIENT_ID"),
+		OAUTH_GITHUB_CLIENT_SECRET: os.Getenv("OAUTH_GITHUB_CLIENT_SECRET"),
+		OAUTH_GITHUB_REDIRECT_URL:  os.Getenv("OAUTH_GITHUB_REDIRECT_URL"),
+
+		CORS_ALLOWED_ORIGINS:   getEnvList("CORS_ALLOWED_ORIGINS", nil),
+		CORS_ALLOWED_METHODS:   getEnvList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}),
+		CORS_ALLOWED_HEADERS:   getEnvList("CORS_ALLOWED_HEADERS", []string{"Origin", "Content-Type", "Authorization", "X-Refresh-Token", "X-Request-ID", "Idempotency-Key", "X-CSRF-Token", "If-None-Match", "X-API-Key"}),
+		CORS_ALLOW_CREDENTIALS: env.getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+	}
+	config.parseErrors = env.errs
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+/*
+LinkSigningKey returns the key of the emailed links, LINK_SIGNING_KEY or, when it is empty, a
+key derived from JWT_SECRET so that a leaked link key never signs a jwt.
+
+Returns:
+- (string): The HMAC key of the links.
+*/
+func (config *Config) LinkSigningKey() string {
+	if config.LINK_SIGNING_KEY != "" {
+		return config.LINK_SIGNING_KEY
+	}
+
+	mac := hmac.New(sha256.New, []byte(config.JWT_SECRET))
+	mac.Write([]byte("link signing key"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+PreviousJWTKeys returns the retired secrets of JWT_PREVIOUS_KEYS by kid.
+
+Returns:
+- (map[string]string): The secrets mapped by kid, empty if there is none.
+*/
+func (config *Config) PreviousJWTKeys() map[string]string {
+	keys := make(map[string]string, len(config.JWT_PREVIOUS_KEYS))
+	for _, key := range config.JWT_PREVIOUS_KEYS {
+		if kid, secret, ok := strings.Cut(key, ":"); ok {
+			keys[kid] = secret
+		}
+	}
+
+	return keys
+}
+
+/*
+FieldEncryptionKeys returns the decoded keys of FIELD_ENCRYPTION_KEY and FIELD_ENCRYPTION_PREVIOUS_KEYS by version.
+
+Returns:
+- (map[string][]byte): The keys mapped by version, empty without FIELD_ENCRYPTION_KEY.
+*/
+func (config *Config) FieldEncryptionKeys() map[string][]byte {
+	keys := make(map[string][]byte, len(config.FIELD_ENCRYPTION_PREVIOUS_KEYS)+1)
+	if config.FIELD_ENCRYPTION_KEY == "" {
+		return keys
+	}
+	for _, key := range config.FIELD_ENCRYPTION_PREVIOUS_KEYS {
+		if version, encoded, ok := strings.Cut(key, ":"); ok {
+			keys[version], _ = base64.StdEncoding.DecodeString(encoded)
+		}
+	}
+	keys[config.FIELD_ENCRYPTION_KEY_VERSION], _ = base64.StdEncoding.DecodeString(config.FIELD_ENCRYPTION_KEY)
+
+	return keys
+}
+
+/*
+AdminAllowedNetworks returns the networks of ADMIN_ALLOWED_CIDRS, a single IP being a network of one address.
+
+Returns:
+- ([]*net.IPNet): The networks, empty if the admin routes are reachable from anywhere.
+*/
+func (config *Config) AdminAllowedNetworks() []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(config.ADMIN_ALLOWED_CIDRS))
+	for _, cidr := range config.ADMIN_ALLOWED_CIDRS {
+		if network := parseNetwork(cidr); network != nil {
+			networks = append(networks, network)
+		}
+	}
+
+	return networks
+}
+
+// validAESKey reports whether the base64 encoded key is an AES-128, AES-192 or AES-256 key.
+func validAESKey(encoded string) bool {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+
+	return err == nil && (len(key) == 16 || len(key) == 24 || len(key) == 32)
+}
+
+// parseNetwork parses a CIDR or a single IP, nil if it is neither.
+func parseNetwork(cidr string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(cidr); err == nil {
+		return network
+	}
+
+	ip := net.ParseIP(cidr)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+/*
+CookieSameSite returns the SameSite attribute of the cookies, from COOKIE_SAMESITE.
+
+Returns:
+- (http.SameSite): The attribute, http.SameSiteLaxMode when COOKIE_SAMESITE is invalid.
+*/
+func (config *Config) CookieSameSite() http.SameSite {
+	switch config.COOKIE_SAMESITE {
+	case CookieSameSiteStrict:
+		return http.SameSiteStrictMode
+	case CookieSameSiteNone:
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+/*
+CookieSecure reports whether the cookies are restricted to HTTPS, with COOKIE_SECURE or
+because COOKIE_SAMESITE is none.
+
+Returns:
+- (bool): Whether the cookies have the Secure attribute.
+*/
+func (config *Config) CookieSecure() bool {
+	return config.COOKIE_SECURE || config.COOKIE_SAMESITE == CookieSameSiteNone
+}
+
+/*
+StoragePublicURL returns the base URL of the stored files: STORAGE_PUBLIC_URL, or by default
+LocalStoragePath for the local STORAGE_DRIVER and the bucket URL for s3.
+
+Returns:
+- (string): The base URL, without a trailing slash.
+*/
+func (config *Config) StoragePublicURL() string {
+	switch {
+	case config.STORAGE_PUBLIC_URL != "":
+		return strings.TrimSuffix(config.STORAGE_PUBLIC_URL, "/")
+	case config.STORAGE_DRIVER == StorageS3:
+		return strings.TrimSuffix(config.S3_ENDPOINT, "/") + "/" + config.S3_BUCKET
+	default:
+		return LocalStoragePath
+	}
+}
+
+/*
+ErrorDetails reports whether the details of the internal errors are returned to the clients,
+with DEBUG or in the development ENV.
+
+Returns:
+- (bool): Whether the 5xx responses carry the error message rather than a generic one.
+*/
+func (config *Config) ErrorDetails() bool {
+	return config.DEBUG || config.ENV == EnvDevelopment
+}
+
+// getEnv returns the value of the environment variable named by key, or fallback if it is unset or empty.
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// envParser reads the typed environment variables, and records the ones which are set but can't be parsed.
+type envParser struct {
+	errs []error
+}
+
+// getEnvInt returns the integer value of the environment variable named by key, or fallback if it is unset or not an integer.
+func (p *envParser) getEnvInt(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		p.errs = append(p.errs, fmt.Errorf("%s must be an integer, got %q", key, raw))
+		return fallback
+	}
+
+	return value
+}
+
+// getEnvDuration returns the duration value (e.g. 15m, 24h) of the environment variable named by key, or fallback if it is unset or not a duration.
+func (p *envParser) getEnvDuration(key string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		p.errs = append(p.errs, fmt.Errorf("%s must be a duration with its unit, e.g. 30s or 15m, got %q", key, raw))
+		return fallback
+	}
+
+	return value
+}
+
+// getEnvList returns the comma separated values of the environment variable named by key, or fallback if it is unset or empty.
+func getEnvList(key string, fallback []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// getEnvBool returns the boolean value of the environment variable named by key, or fallback if it is unset or not a boolean.
+func (p *envParser) getEnvBool(key string, fallback bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		p.errs = append(p.errs, fmt.Errorf("%s must be a boolean, true or false, got %q", key, raw))
+		return fallback
+	}
+
+	return value
+}
+
+/*
+Validate checks the configuration values, so that the server fails fast at startup on a misconfiguration.
+Every problem is reported at once instead of stopping at the first one.
+
+Returns:
+- (error): An error joining every missing or invalid value, nil if the configuration is valid.
+*/
+func (config *Config) Validate() error {
+	// The variables which couldn't be parsed hold their default, which must not hide the mistake
+	errs := append([]error(nil), config.parseErrors...)
+
+	required := []struct {
+		key   string
+		value string
+	}{
+		{"DB_HOST", config.DB_HOST},
+		{"DB_PORT", config.DB_PORT},
+		{"DB_USER", config.DB_USER},
+		{"DB_NAME", config.DB_NAME},
+		{"JWT_SECRET", config.JWT_SECRET},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", field.key))
+		}
+	}
+
+	if config.DB_MAX_OPEN_CONNS <= 0 {
+		errs = append(errs, fmt.Errorf("DB_MAX_OPEN_CONNS must be positive, got %d", config.DB_MAX_OPEN_CONNS))
+	}
+	if config.DB_MAX_IDLE_CONNS < 0 || config.DB_MAX_IDLE_CONNS > config.DB_MAX_OPEN_CONNS {
+		errs = append(errs, fmt.Errorf("DB_MAX_IDLE_CONNS must be between 0 and DB_MAX_OPEN_CONNS, got %d", config.DB_MAX_IDLE_CONNS))
+	}
+	if config.DB_CONN_MAX_LIFETIME < 0 {
+		errs = append(errs, fmt.Errorf("DB_CONN_MAX_LIFETIME must not be negative, got %s", config.DB_CONN_MAX_LIFETIME))
+	}
+
+	if config.JWT_SECRET != "" && len(config.JWT_SECRET) < minJWTSecretLength {
+		errs = append(errs, fmt.Errorf("JWT_SECRET must be at least %d bytes long, got %d", minJWTSecretLength, len(config.JWT_SECRET)))
+	}
+
+	if config.LINK_SIGNING_KEY != "" && len(config.LINK_SIGNING_KEY) < minJWTSecretLength {
+		errs = append(errs, fmt.Errorf("LINK_SIGNING_KEY must be at least %d bytes long, got %d", minJWTSecretLength, len(config.LINK_SIGNING_KEY)))
+	}
+
+	if len(config.JWT_PREVIOUS_KEYS) > 0 && config.JWT_KID == "" {
+		errs = append(errs, errors.New("JWT_KID is required with JWT_PREVIOUS_KEYS, the tokens must tell which key signed them"))
+	}
+	kids := map[string]bool{config.JWT_KID: true}
+	for _, key := range config.JWT_PREVIOUS_KEYS {
+		kid, secret, ok := strings.Cut(key, ":")
+		switch {
+		case !ok || kid == "":
+			errs = append(errs, errors.New("JWT_PREVIOUS_KEYS must only contain kid:secret pairs"))
+		case kids[kid]:
+			errs = append(errs, fmt.Errorf("JWT_PREVIOUS_KEYS must not reuse the kid %s", kid))
+		case len(secret) < minJWTSecretLength:
+			errs = append(errs, fmt.Errorf("the secret of the %s kid of JWT_PREVIOUS_KEYS must be at least %d bytes long, got %d", kid, minJWTSecretLength, len(secret)))
+		}
+		kids[kid] = true
+	}
+
+	if config.FIELD_ENCRYPTION_KEY == "" && len(config.FIELD_ENCRYPTION_PREVIOUS_KEYS) > 0 {
+		errs = append(errs, errors.New("FIELD_ENCRYPTION_KEY is required with FIELD_ENCRYPTION_PREVIOUS_KEYS, the new values must be encrypted with a current key"))
+	}
+	if config.FIELD_ENCRYPTION_KEY != "" {
+		if config.FIELD_ENCRYPTION_KEY_VERSION == "" || strings.Contains(config.FIELD_ENCRYPTION_KEY_VERSION, ":") {
+			errs = append(errs, fmt.Errorf("FIELD_ENCRYPTION_KEY_VERSION must be set and must not contain a colon, got %q", config.FIELD_ENCRYPTION_KEY_VERSION))
+		}
+		if !validAESKey(config.FIELD_ENCRYPTION_KEY) {
+			errs = append(errs, errors.New("FIELD_ENCRYPTION_KEY must be the base64 of a 16, 24 or 32 bytes key"))
+		}
+	}
+	versions := map[string]bool{config.FIELD_ENCRYPTION_KEY_VERSION: true}
+	for _, key := range config.FIELD_ENCRYPTION_PREVIOUS_KEYS {
+		version, encoded, ok := strings.Cut(key, ":")
+		switch {
+		case !ok || version == "":
+			errs = append(errs, errors.New("FIELD_ENCRYPTION_PREVIOUS_KEYS must only contain version:key pairs"))
+		case versions[version]:
+			errs = append(errs, fmt.Errorf("FIELD_ENCRYPTION_PREVIOUS_KEYS must not reuse the version %s", version))
+		case !validAESKey(encoded):
+			errs = append(errs, fmt.Errorf("the key of the %s version of FIELD_ENCRYPTION_PREVIOUS_KEYS must be the base64 of a 16, 24 or 32 bytes key", version))
+		}
+		versions[version] = true
+	}
+
+	if config.JWT_LEEWAY < 0 || config.JWT_LEEWAY > time.Minute {
+		errs = append(errs, fmt.Errorf("JWT_LEEWAY must be between 0 and 1m, got %s", config.JWT_LEEWAY))
+	}
+
+	if config.BCRYPT_COST < bcrypt.MinCost || config.BCRYPT_COST > bcrypt.MaxCost {
+		errs = append(errs, fmt.Errorf("BCRYPT_COST must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, config.BCRYPT_COST))
+	}
+
+	if config.ENV != EnvProduction && config.ENV != EnvDevelopment {
+		errs = append(errs, fmt.Errorf("ENV must be production or development, got %q", config.ENV))
+	}
+
+	if config.PASSWORD_HASHER != PasswordHasherBcrypt && config.PASSWORD_HASHER != PasswordHasherArgon2id {
+		errs = append(errs, fmt.Errorf("PASSWORD_HASHER must be bcrypt or argon2id, got %q", config.PASSWORD_HASHER))
+	}
+	// Below 8 MiB, argon2id is weaker than bcrypt. The parallelism is stored on a byte
+	if config.ARGON2_MEMORY < minArgon2Memory {
+		errs = append(errs, fmt.Errorf("ARGON2_MEMORY must be at least %d KiB, got %d", minArgon2Memory, config.ARGON2_MEMORY))
+	}
+	if config.ARGON2_ITERATIONS < 1 {
+		errs = append(errs, fmt.Errorf("ARGON2_ITERATIONS must be at least 1, got %d", config.ARGON2_ITERATIONS))
+	}
+	if config.ARGON2_PARALLELISM < 1 || config.ARGON2_PARALLELISM > 255 {
+		errs = append(errs, fmt.Errorf("ARGON2_PARALLELISM must be between 1 and 255, got %d", config.ARGON2_PARALLELISM))
+	}
+
+	if config.USER_BATCH_MAX < 1 {
+		errs = append(errs, fmt.Errorf("USER_BATCH_MAX must be at least 1, got %d", config.USER_BATCH_MAX))
+	}
+
+	if config.COMPRESSION_MIN_SIZE < 0 {
+		errs = append(errs, fmt.Errorf("COMPRESSION_MIN_SIZE must not be negative, got %d", config.COMPRESSION_MIN_SIZE))
+	}
+
+	if config.CHECK_EMAIL_RATE_LIMIT < 0 {
+		errs = append(errs, fmt.Errorf("CHECK_EMAIL_RATE_LIMIT must not be negative, got %d", config.CHECK_EMAIL_RATE_LIMIT))
+	}
+
+	if config.REQUEST_TIMEOUT < 0 {
+		errs = append(errs, fmt.Errorf("REQUEST_TIMEOUT must not be negative, got %s", config.REQUEST_TIMEOUT))
+	}
+
+	// Every remembered password is compared with its hasher on each change, the history must stay short
+	if config.PASSWORD_HISTORY < 0 || config.PASSWORD_HISTORY > maxPasswordHistory {
+		errs = append(errs, fmt.Errorf("PASSWORD_HISTORY must be between 0 and %d, got %d", maxPasswordHistory, config.PASSWORD_HISTORY))
+	}
+
+	if _, _, err := net.SplitHostPort(config.GRPC_ADDR); config.GRPC_ENABLED && err != nil {
+		errs = append(errs, fmt.Errorf("GRPC_ADDR must be a host:port address, got %q", config.GRPC_ADDR))
+	}
+
+	if (config.SWAGGER_USER == "") != (config.SWAGGER_PASS == "") {
+		errs = append(errs, errors.New("SWAGGER_USER and SWAGGER_PASS must be set together"))
+	}
+
+	switch config.STORAGE_DRIVER {
+	case StorageLocal:
+		if config.STORAGE_LOCAL_DIR == "" {
+			errs = append(errs, errors.New("STORAGE_LOCAL_DIR is required by the local STORAGE_DRIVER"))
+		}
+	case StorageS3:
+		if endpoint, err := url.Parse(config.S3_ENDPOINT); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			errs = append(errs, fmt.Errorf("S3_ENDPOINT must be an http or https URL, got %q", config.S3_ENDPOINT))
+		}
+		if config.S3_REGION == "" || config.S3_BUCKET == "" || config.S3_ACCESS_KEY == "" || config.S3_SECRET_KEY == "" {
+			errs = append(errs, errors.New("S3_REGION, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required by the s3 STORAGE_DRIVER"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("STORAGE_DRIVER must be local or s3, got %q", config.STORAGE_DRIVER))
+	}
+	if config.AVATAR_MAX_BYTES <= 0 {
+		errs = append(errs, fmt.Errorf("AVATAR_MAX_BYTES must be positive, got %d", config.AVATAR_MAX_BYTES))
+	}
+
+	if (config.ADMIN_EMAIL == "") != (config.ADMIN_PASSWORD == "") {
+		errs = append(errs, errors.New("ADMIN_EMAIL and ADMIN_PASSWORD must be set together"))
+	}
+	if _, err := mail.ParseAddress(config.ADMIN_EMAIL); config.ADMIN_EMAIL != "" && err != nil {
+		errs = append(errs, fmt.Errorf("ADMIN_EMAIL must be an email address, got %q", config.ADMIN_EMAIL))
+	}
+
+	if !model.ValidRole(config.DEFAULT_ROLE) || model.ElevatedRole(config.DEFAULT_ROLE) {
+		errs = append(errs, fmt.Errorf("DEFAULT_ROLE must be a role without elevated privileges, got %q", config.DEFAULT_ROLE))
+	}
+	if config.INVITATION_TTL <= 0 {
+		errs = append(errs, errors.New("INVITATION_TTL must be a positive duration"))
+	}
+	if config.RESET_TOKEN_TTL <= 0 || config.VERIFY_TOKEN_TTL <= 0 {
+		errs = append(errs, errors.New("RESET_TOKEN_TTL and VERIFY_TOKEN_TTL must be positive durations"))
+	}
+
+	if config.RT_SESSION_EXPIRY <= 0 || config.RT_REMEMBER_ME_EXPIRY <= 0 {
+		errs = append(errs, errors.New("RT_SESSION_EXPIRY and RT_REMEMBER_ME_EXPIRY must be positive durations"))
+	}
+	if config.RT_IDLE_EXPIRY < 0 || config.RT_ABSOLUTE_EXPIRY < 0 {
+		errs = append(errs, errors.New("RT_IDLE_EXPIRY and RT_ABSOLUTE_EXPIRY can't be negative, use 0 to disable them"))
+	}
+	if config.RT_IDLE_EXPIRY > 0 && config.RT_ABSOLUTE_EXPIRY > 0 && config.RT_IDLE_EXPIRY > config.RT_ABSOLUTE_EXPIRY {
+		errs = append(errs, errors.New("RT_IDLE_EXPIRY can't be longer than RT_ABSOLUTE_EXPIRY"))
+	}
+	if config.MAX_SESSIONS_PER_USER < 0 {
+		errs = append(errs, fmt.Errorf("MAX_SESSIONS_PER_USER must not be negative, got %d", config.MAX_SESSIONS_PER_USER))
+	}
+	if config.SESSION_LIMIT_POLICY != SessionLimitEvictOldest && config.SESSION_LIMIT_POLICY != SessionLimitReject {
+		errs = append(errs, fmt.Errorf("SESSION_LIMIT_POLICY must be evict-oldest or reject, got %q", config.SESSION_LIMIT_POLICY))
+	}
+
+	if config.MAX_BODY_BYTES <= 0 {
+		errs = append(errs, fmt.Errorf("MAX_BODY_BYTES must be positive, got %d", config.MAX_BODY_BYTES))
+	}
+
+	if len(config.TOKEN_SOURCES) == 0 {
+		errs = append(errs, errors.New("TOKEN_SOURCES must contain cookie and/or header"))
+	}
+	for _, source := range config.TOKEN_SOURCES {
+		if source != TokenSourceCookie && source != TokenSourceHeader {
+			errs = append(errs, fmt.Errorf("TOKEN_SOURCES must only contain cookie or header, got %s", source))
+		}
+	}
+	if !config.TOKEN_IN_BODY && !slices.Contains(config.TOKEN_SOURCES, TokenSourceCookie) {
+		errs = append(errs, errors.New("TOKEN_IN_BODY can only be turned off with the cookie TOKEN_SOURCES, the clients would get no token"))
+	}
+
+	if strings.ContainsAny(config.COOKIE_PREFIX, cookieNameSeparators) {
+		errs = append(errs, fmt.Errorf("COOKIE_PREFIX must only contain characters allowed in a cookie name, got %q", config.COOKIE_PREFIX))
+	}
+	if !strings.HasPrefix(config.COOKIE_PATH, "/") || strings.ContainsAny(config.COOKIE_PATH, ";\r\n") {
+		errs = append(errs, fmt.Errorf("COOKIE_PATH must be an absolute path, got %q", config.COOKIE_PATH))
+	}
+	switch config.COOKIE_SAMESITE {
+	case CookieSameSiteLax, CookieSameSiteStrict:
+	case CookieSameSiteNone:
+		// The Secure cookies are never sent over plain HTTP, the sessions would silently break
+		if appURL, err := url.Parse(config.APP_URL); err != nil || appURL.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("COOKIE_SAMESITE=none requires Secure cookies, APP_URL must be an https URL to confirm the deployment is served over HTTPS, got %q", config.APP_URL))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("COOKIE_SAMESITE must be lax, strict or none, got %q", config.COOKIE_SAMESITE))
+	}
+
+	// Any site could otherwise read the API with the cookies of its visitors
+	if config.CORS_ALLOW_CREDENTIALS && slices.Contains(config.CORS_ALLOWED_ORIGINS, "*") {
+		errs = append(errs, errors.New("CORS_ALLOWED_ORIGINS can't be * when CORS_ALLOW_CREDENTIALS is set, list the allowed origins"))
+	}
+
+	for _, proxy := range config.TRUSTED_PROXIES {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			errs = append(errs, fmt.Errorf("TRUSTED_PROXIES must only contain IPs or CIDRs, got %s", proxy))
+		}
+	}
+	for _, cidr := range config.ADMIN_ALLOWED_CIDRS {
+		if parseNetwork(cidr) == nil {
+			errs = append(errs, fmt.Errorf("ADMIN_ALLOWED_CIDRS must only contain IPs or CIDRs, got %s", cidr))
+		}
+	}
+
+	if len(config.WEBHOOK_URLS) > 0 && config.WEBHOOK_SECRET == "" {
+		errs = append(errs, errors.New("WEBHOOK_SECRET is required when WEBHOOK_URLS is set"))
+	}
+	for _, webhookURL := range config.WEBHOOK_URLS {
+		if u, err := url.Parse(webhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("WEBHOOK_URLS must only contain http(s) URLs, got %s", webhookURL))
+		}
+	}
+
+	if config.SMTP_HOST != "" && config.MAIL_FROM == "" {
+		errs = append(errs, errors.New("MAIL_FROM is required when SMTP_HOST is set"))
+	}
+
+	return errors.Join(errs...)
 }
@@ -0,0 +1,256 @@
+package config
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+)
+
+func TestCookieSameSite(t *testing.T) {
+	tests := []struct {
+		name         string
+		sameSite     string
+		secure       bool
+		appURL       string
+		wantSameSite http.SameSite
+		wantSecure   bool
+		wantErr      bool
+	}{
+		{"lax", CookieSameSiteLax, false, "http://localhost:8080", http.SameSiteLaxMode, false, false},
+		{"strict and secure", CookieSameSiteStrict, true, "http://localhost:8080", http.SameSiteStrictMode, true, false},
+		{"none forces secure", CookieSameSiteNone, false, "https://app.example.com", http.SameSiteNoneMode, true, false},
+		{"none without https", CookieSameSiteNone, false, "http://app.example.com", http.SameSiteNoneMode, true, true},
+		{"none without APP_URL", CookieSameSiteNone, true, "", http.SameSiteNoneMode, true, true},
+		{"invalid", "relaxed", false, "", http.SameSiteLaxMode, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{COOKIE_SAMESITE: tt.sameSite, COOKIE_SECURE: tt.secure, APP_URL: tt.appURL}
+
+			if got := config.CookieSameSite(); got != tt.wantSameSite {
+				t.Errorf("CookieSameSite() = %v, want %v", got, tt.wantSameSite)
+			}
+			if got := config.CookieSecure(); got != tt.wantSecure {
+				t.Errorf("CookieSecure() = %v, want %v", got, tt.wantSecure)
+			}
+
+			// The config is otherwise invalid, only the COOKIE_SAMESITE errors matter
+			err := config.Validate()
+			if gotErr := err != nil && strings.Contains(err.Error(), "COOKIE_SAMESITE"); gotErr != tt.wantErr {
+				t.Errorf("Validate() error = %v, want a COOKIE_SAMESITE error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestErrorDetails(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		debug   bool
+		want    bool
+		wantErr bool
+	}{
+		{"production", EnvProduction, false, false, false},
+		{"production with debug", EnvProduction, true, true, false},
+		{"development", EnvDevelopment, false, true, false},
+		{"invalid", "staging", false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{ENV: tt.env, DEBUG: tt.debug}
+
+			if got := config.ErrorDetails(); got != tt.want {
+				t.Errorf("ErrorDetails() = %v, want %v", got, tt.want)
+			}
+
+			// The config is otherwise invalid, only the ENV errors matter
+			err := config.Validate()
+			if gotErr := err != nil && strings.Contains(err.Error(), "ENV must"); gotErr != tt.wantErr {
+				t.Errorf("Validate() error = %v, want an ENV error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStoragePublicURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		want    string
+		wantErr bool
+	}{
+		{"local", Config{STORAGE_DRIVER: StorageLocal, STORAGE_LOCAL_DIR: "uploads"}, LocalStoragePath, false},
+		{"local behind a CDN", Config{STORAGE_DRIVER: StorageLocal, STORAGE_LOCAL_DIR: "uploads", STORAGE_PUBLIC_URL: "https://cdn.example.com/"}, "https://cdn.example.com", false},
+		{"s3", Config{STORAGE_DRIVER: StorageS3, S3_ENDPOINT: "https://s3.example.com/", S3_REGION: "us-east-1", S3_BUCKET: "media", S3_ACCESS_KEY: "key", S3_SECRET_KEY: "secret"}, "https://s3.example.com/media", false},
+		{"s3 without credentials", Config{STORAGE_DRIVER: StorageS3, S3_ENDPOINT: "https://s3.example.com", S3_REGION: "us-east-1", S3_BUCKET: "media"}, "https://s3.example.com/media", true},
+		{"s3 without endpoint", Config{STORAGE_DRIVER: StorageS3, S3_REGION: "us-east-1", S3_BUCKET: "media", S3_ACCESS_KEY: "key", S3_SECRET_KEY: "secret"}, "/media", true},
+		{"invalid", Config{STORAGE_DRIVER: "ftp"}, LocalStoragePath, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.StoragePublicURL(); got != tt.want {
+				t.Errorf("StoragePublicURL() = %q, want %q", got, tt.want)
+			}
+
+			// The config is otherwise invalid, only the storage errors matter
+			err := tt.config.Validate()
+			if gotErr := err != nil && (strings.Contains(err.Error(), "STORAGE_") || strings.Contains(err.Error(), "S3_")); gotErr != tt.wantErr {
+				t.Errorf("Validate() error = %v, want a storage error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFieldEncryptionKeys(t *testing.T) {
+	const (
+		current  = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+		previous = "ZmVkY2JhOTg3NjU0MzIxMA=="
+	)
+	tests := []struct {
+		name         string
+		config       Config
+		wantVersions []string
+		wantErr      bool
+	}{
+		{"disabled", Config{FIELD_ENCRYPTION_KEY_VERSION: "1"}, nil, false},
+		{"current key", Config{FIELD_ENCRYPTION_KEY: current, FIELD_ENCRYPTION_KEY_VERSION: "2"}, []string{"2"}, false},
+		{"rotated", Config{FIELD_ENCRYPTION_KEY: current, FIELD_ENCRYPTION_KEY_VERSION: "2", FIELD_ENCRYPTION_PREVIOUS_KEYS: []string{"1:" + previous}}, []string{"1", "2"}, false},
+		{"previous keys without a key", Config{FIELD_ENCRYPTION_KEY_VERSION: "2", FIELD_ENCRYPTION_PREVIOUS_KEYS: []string{"1:" + previous}}, nil, true},
+		{"reused version", Config{FIELD_ENCRYPTION_KEY: current, FIELD_ENCRYPTION_KEY_VERSION: "1", FIELD_ENCRYPTION_PREVIOUS_KEYS: []string{"1:" + previous}}, []string{"1"}, true},
+		{"short key", Config{FIELD_ENCRYPTION_KEY: "c2hvcnQ=", FIELD_ENCRYPTION_KEY_VERSION: "1"}, []string{"1"}, true},
+		{"not base64", Config{FIELD_ENCRYPTION_KEY: "not base64!", FIELD_ENCRYPTION_KEY_VERSION: "1"}, []string{"1"}, true},
+		{"no version", Config{FIELD_ENCRYPTION_KEY: current}, []string{""}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := tt.config.FieldEncryptionKeys()
+			if len(keys) != len(tt.wantVersions) {
+				t.Errorf("FieldEncryptionKeys() = %v, want the versions %v", keys, tt.wantVersions)
+			}
+			for _, version := range tt.wantVersions {
+				if _, ok := keys[version]; !ok {
+					t.Errorf("FieldEncryptionKeys() = %v, want the version %q", keys, version)
+				}
+			}
+
+			// The config is otherwise invalid, only the field encryption errors matter
+			err := tt.config.Validate()
+			if gotErr := err != nil && strings.Contains(err.Error(), "FIELD_ENCRYPTION_"); gotErr != tt.wantErr {
+				t.Errorf("Validate() error = %v, want a field encryption error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInitConfigMalformedValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{"integer", "MAX_SESSIONS_PER_USER", "5", false},
+		{"not an integer", "MAX_SESSIONS_PER_USER", "five", true},
+		{"boolean", "CSRF_ENABLED", "false", false},
+		{"not a boolean", "CSRF_ENABLED", "flase", true},
+		{"duration", "REQUEST_TIMEOUT", "30s", false},
+		{"duration without unit", "REQUEST_TIMEOUT", "30", true},
+		{"unset", "REQUEST_TIMEOUT", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.key, tt.value)
+
+			// The config is otherwise invalid, only the errors of the variable matter
+			_, err := InitConfig()
+			if gotErr := err != nil && strings.Contains(err.Error(), tt.key); gotErr != tt.wantErr {
+				t.Errorf("InitConfig() error = %v, want a %s error: %v", err, tt.key, tt.wantErr)
+			}
+		})
+	}
+
+	// Every malformed value is reported at once
+	t.Setenv("MAX_SESSIONS_PER_USER", "five")
+	t.Setenv("CSRF_ENABLED", "flase")
+	_, err := InitConfig()
+	if err == nil || !strings.Contains(err.Error(), "MAX_SESSIONS_PER_USER") || !strings.Contains(err.Error(), "CSRF_ENABLED") {
+		t.Errorf("InitConfig() error = %v, want both malformed values", err)
+	}
+}
+
+func TestBcryptCost(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"default", "", false},
+		{"in range", "10", false},
+		{"too low", "3", true},
+		{"too high", "32", true},
+		{"not a number", "abc", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BCRYPT_COST", tt.value)
+
+			// The config is otherwise invalid, only the BCRYPT_COST errors matter
+			_, err := InitConfig()
+			if gotErr := err != nil && strings.Contains(err.Error(), "BCRYPT_COST"); gotErr != tt.wantErr {
+				t.Errorf("InitConfig() error = %v, want a BCRYPT_COST error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		credentials bool
+		wantErr     bool
+	}{
+		{"wildcard without credentials", []string{"*"}, false, false},
+		{"listed origins with credentials", []string{"https://app.example.com"}, true, false},
+		{"wildcard with credentials", []string{"*"}, true, true},
+		{"wildcard among listed origins with credentials", []string{"https://app.example.com", "*"}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{CORS_ALLOWED_ORIGINS: tt.origins, CORS_ALLOW_CREDENTIALS: tt.credentials}
+
+			// The config is otherwise invalid, only the CORS errors matter
+			err := config.Validate()
+			if gotErr := err != nil && strings.Contains(err.Error(), "CORS_ALLOWED_ORIGINS"); gotErr != tt.wantErr {
+				t.Errorf("Validate() error = %v, want a CORS_ALLOWED_ORIGINS error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDefaultRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    string
+		wantErr bool
+	}{
+		{"user", model.RoleUser, false},
+		{"admin", model.RoleAdmin, true},
+		{"unknown", "superuser", true},
+		{"empty", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{DEFAULT_ROLE: tt.role}
+
+			// The config is otherwise invalid, only the DEFAULT_ROLE errors matter
+			err := config.Validate()
+			if gotErr := err != nil && strings.Contains(err.Error(), "DEFAULT_ROLE"); gotErr != tt.wantErr {
+				t.Errorf("Validate() error = %v, want a DEFAULT_ROLE error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// gormLogger routes the gorm logs through the application's structured logger.
+type gormLogger struct {
+	logger        *slog.Logger
+	level         gormlogger.LogLevel
+	slowThreshold time.Duration
+}
+
+/*
+NewGormLogger returns a gorm logger writing to logger.
+
+Errors are logged at the error level (record not found excepted), queries slower than
+slowThreshold at the warn level and every query at the info level, as allowed by level.
+
+Parameters:
+- logger (*slog.Logger): The application logger.
+- level (gormlogger.LogLevel): The most verbose gorm level to log.
+- slowThreshold (time.Duration): The duration above which a query is logged as slow, 0 to disable it.
+
+Returns:
+- (gormlogger.Interface): The gorm logger.
+*/
+func NewGormLogger(logger *slog.Logger, level gormlogger.LogLevel, slowThreshold time.Duration) gormlogger.Interface {
+	return &gormLogger{
+		logger:        logger.With(slog.String("component", "gorm")),
+		level:         level,
+		slowThreshold: slowThreshold,
+	}
+}
+
+func (l *gormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	clone := *l
+	clone.level = level
+
+	return &clone
+}
+
+func (l *gormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Info {
+		l.logger.InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Warn {
+		l.logger.WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Error {
+		l.logger.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if l.level <= gormlogger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	attrs := func() []any {
+		sql, rows := fc()
+		return []any{slog.String("sql", sql), slog.Int64("rows", rows), slog.Duration("elapsed", elapsed)}
+	}
+
+	switch {
+	case err != nil && l.level >= gormlogger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		l.logger.ErrorContext(ctx, "query failed", append(attrs(), slog.String("error", err.Error()))...)
+	case l.slowThreshold > 0 && elapsed > l.slowThreshold && l.level >= gormlogger.Warn:
+		l.logger.WarnContext(ctx, "slow query", append(attrs(), slog.Duration("threshold", l.slowThreshold))...)
+	case l.level >= gormlogger.Info:
+		l.logger.InfoContext(ctx, "query", attrs()...)
+	}
+}
+
+// ParseGormLogLevel converts a textual level (silent, error, warn, info) to its gorm level, defaulting to warn.
+func ParseGormLogLevel(level string) gormlogger.LogLevel {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "silent":
+		return gormlogger.Silent
+	case "error":
+		return gormlogger.Error
+	case "info":
+		return gormlogger.Info
+	default:
+		return gormlogger.Warn
+	}
+}
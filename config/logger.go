@@ -0,0 +1,39 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+/*
+InitLogger creates the application's structured JSON logger and sets it as the default slog logger.
+
+Parameters:
+- config (*Config): A pointer to the Config struct containing the LOG_LEVEL (debug, info, warn or error).
+
+Returns:
+- (*slog.Logger): The configured logger. Unknown levels fall back to info.
+*/
+func InitLogger(config *Config) *slog.Logger {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: ParseLogLevel(config.LOG_LEVEL),
+	}))
+	slog.SetDefault(logger)
+
+	return logger
+}
+
+// ParseLogLevel converts a textual level (debug, info, warn, error) to its slog.Level, defaulting to info.
+func ParseLogLevel(level string) slog.Level {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
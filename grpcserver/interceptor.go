@@ -0,0 +1,164 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/auth"
+	"github.com/MohammadBnei/gorm-user-auth/handler"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	userauthv1 "github.com/MohammadBnei/gorm-user-auth/proto/userauth/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// publicMethods are the calls which aren't authenticated with a jwt
+var publicMethods = map[string]bool{
+	userauthv1.UserAuthService_Login_FullMethodName:         true,
+	userauthv1.UserAuthService_Refresh_FullMethodName:       true,
+	userauthv1.UserAuthService_ValidateToken_FullMethodName: true,
+}
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	claimsKey
+)
+
+/*
+LoggingInterceptor logs every call once it has been handled, like the RequestLogger of the
+REST API, and turns a panic into an Internal error.
+
+Parameters:
+- logger (*slog.Logger): The application logger.
+
+Returns:
+- grpc.UnaryServerInterceptor: The interceptor.
+*/
+func LoggingInterceptor(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (resp any, err error) {
+		start := time.Now()
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logger.Error("panic recovered", "method", info.FullMethod, "panic", recovered)
+				err = status.Error(codes.Internal, "internal error")
+			}
+			logger.Info("call handled",
+				slog.String("method", info.FullMethod),
+				slog.String("code", status.Code(err).String()),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("clientIp", clientIP(ctx)),
+			)
+		}()
+
+		return next(ctx, req)
+	}
+}
+
+/*
+AuthInterceptor is the AuthMiddleware of the gRPC API. The jwt is read from the authorization
+metadata, "Bearer <jwt>", and checked with handler.AuthHandler.Authenticate: an invalid, expired
+or revoked one is rejected with Unauthenticated, a suspended user or one which must change its
+password with PermissionDenied, and a failure to check it is logged and returned as Internal. The
+user and the claims are then set in the context, read them with CurrentUser and CurrentClaims. An
+expired jwt isn't refreshed, the clients call Refresh.
+
+Parameters:
+- authHandler (*handler.AuthHandler): The auth handler of the REST API, its services and TokenManager are shared.
+- logger (*slog.Logger): The application logger.
+
+Returns:
+- grpc.UnaryServerInterceptor: The interceptor.
+*/
+func AuthInterceptor(authHandler *handler.AuthHandler, logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (any, error) {
+		if publicMethods[info.FullMethod] {
+			return next(ctx, req)
+		}
+
+		token := bearerToken(ctx)
+		if token == "" {
+			return nil, status.Error(codes.Unauthenticated, "no token provided")
+		}
+
+		user, claims, err := authHandler.Authenticate(ctx, token)
+		if err != nil {
+			return nil, authError(logger, err)
+		}
+		if authHandler.PasswordChangeRequired(user, false) {
+			return nil, status.Error(codes.PermissionDenied, handler.ErrPasswordChangeRequired.Error())
+		}
+
+		ctx = context.WithValue(ctx, userKey, user)
+		ctx = context.WithValue(ctx, claimsKey, claims)
+
+		return next(ctx, req)
+	}
+}
+
+// CurrentUser returns the user authenticated by the AuthInterceptor, false for the public calls.
+func CurrentUser(ctx context.Context) (*model.User, bool) {
+	user, ok := ctx.Value(userKey).(*model.User)
+
+	return user, ok
+}
+
+// CurrentClaims returns the claims of the jwt authenticated by the AuthInterceptor, false for the public calls.
+func CurrentClaims(ctx context.Context) (*auth.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*auth.Claims)
+
+	return claims, ok
+}
+
+// bearerToken returns the jwt of the authorization metadata, empty if there is none.
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, value := range md.Get("authorization") {
+		if scheme, token, found := strings.Cut(value, " "); found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+
+	return ""
+}
+
+// clientIP returns the IP of the peer of the call, empty if it is unknown.
+func clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+// authError returns the status of a rejected jwt or session. Any other error is a failure to check
+// them, it is logged and returned as Internal without its details.
+func authError(logger *slog.Logger, err error) error {
+	switch {
+	case errors.Is(err, handler.ErrAccountSuspended), errors.Is(err, handler.ErrPasswordChangeRequired):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, auth.ErrTokenExpired):
+		return status.Error(codes.Unauthenticated, "token expired, refresh the session")
+	case handler.IsAuthError(err):
+		return status.Error(codes.Unauthenticated, err.Error())
+	default:
+		logger.Error("failed to authenticate", "error", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+}
@@ -0,0 +1,273 @@
+// Package grpcserver serves the user and auth operations of the REST API over gRPC, for the internal
+// services. It shares the services and the TokenManager of the handler.AuthHandler, the sessions and
+// the tokens are the same on both APIs.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/MohammadBnei/gorm-user-auth/handler"
+	"github.com/MohammadBnei/gorm-user-auth/metrics"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	userauthv1 "github.com/MohammadBnei/gorm-user-auth/proto/userauth/v1"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/webhook"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+const invalidCredentialsMessage = "invalid credentials"
+
+// Server implements the userauthv1.UserAuthServiceServer.
+type Server struct {
+	userauthv1.UnimplementedUserAuthServiceServer
+
+	auth   *handler.AuthHandler
+	logger *slog.Logger
+}
+
+/*
+New returns a gRPC server serving the UserAuthService, with the LoggingInterceptor and the
+AuthInterceptor.
+
+Parameters:
+- authHandler (*handler.AuthHandler): The auth handler of the REST API, its services and TokenManager are shared.
+- logger (*slog.Logger): The application logger.
+- opts (...grpc.ServerOption): The options of the server, e.g. its TLS credentials.
+
+Returns:
+- (*grpc.Server): The server, to Serve on a listener.
+*/
+func New(authHandler *handler.AuthHandler, logger *slog.Logger, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ChainUnaryInterceptor(LoggingInterceptor(logger), AuthInterceptor(authHandler, logger)))
+	server := grpc.NewServer(opts...)
+	userauthv1.RegisterUserAuthServiceServer(server, &Server{auth: authHandler, logger: logger})
+
+	return server
+}
+
+// Login checks the credentials like POST /auth/login and opens a session.
+func (s *Server) Login(ctx context.Context, req *userauthv1.LoginRequest) (*userauthv1.LoginResponse, error) {
+	loginDTO := &model.LoginDTO{Identifier: req.GetIdentifier(), Password: req.GetPassword(), RememberMe: req.GetRememberMe()}
+	loginDTO.Canonicalize()
+	if loginDTO.Identifier == "" || loginDTO.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "identifier and password are required")
+	}
+	ip := clientIP(ctx)
+
+	// An unknown identifier and a wrong password get the same response, in about the same time
+	invalidCredentials := func(userID int, detail string) error {
+		metrics.LoginAttempts.WithLabelValues(metrics.Result(false)).Inc()
+		s.recordAudit(ctx, userID, model.AuditLoginFailed, detail, ip)
+		return status.Error(codes.Unauthenticated, invalidCredentialsMessage)
+	}
+
+	user, err := s.auth.UserService.GetUserByIdentifier(ctx, loginDTO.Identifier)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		model.CheckDummyPassword(loginDTO.Password)
+		// The identifier is left out of the audit trail, it may be a password typed in the wrong field
+		return nil, invalidCredentials(0, "unknown identifier")
+	}
+	if err != nil {
+		return nil, s.internalError("failed to get user by identifier", err)
+	}
+
+	err = user.CheckPassword(loginDTO.Password)
+	if err == model.ErrPasswordMismatch {
+		return nil, invalidCredentials(int(user.ID), "wrong password")
+	}
+	if err != nil {
+		return nil, s.internalError("password check failed", err)
+	}
+
+	// Only checked once the password is, so that the status isn't disclosed to anyone
+	if user.IsSuspended() {
+		metrics.LoginAttempts.WithLabelValues(metrics.Result(false)).Inc()
+		s.recordAudit(ctx, int(user.ID), model.AuditLoginFailed, "account suspended", ip)
+		return nil, status.Error(codes.PermissionDenied, handler.ErrAccountSuspended.Error())
+	}
+
+	// The last login and the rehash are only logged on failure, they must not prevent the login
+	if loginAt, err := s.auth.UserService.RecordLogin(ctx, int(user.ID), ip); err != nil {
+		s.logger.Error("failed to record last login", "error", err)
+	} else {
+		user.LastLoginAt = &loginAt
+		user.LastLoginIP = model.EncryptedString(ip)
+	}
+	if user.NeedsRehash() {
+		if err := s.auth.UserService.RehashPassword(ctx, int(user.ID), loginDTO.Password); err != nil {
+			s.logger.Error("failed to rehash the password", "error", err)
+		}
+	}
+
+	session, err := s.auth.OpenSession(ctx, s.logger, ip, user, loginDTO.RememberMe)
+	if errors.Is(err, service.ErrTooManySessions) {
+		metrics.LoginAttempts.WithLabelValues(metrics.Result(false)).Inc()
+		s.recordAudit(ctx, int(user.ID), model.AuditLoginFailed, "too many sessions", ip)
+		return nil, status.Error(codes.ResourceExhausted, "too many active sessions, log out from another device first")
+	}
+	if err != nil {
+		metrics.LoginAttempts.WithLabelValues(metrics.Result(false)).Inc()
+		return nil, s.internalError("failed to create session", err)
+	}
+	metrics.LoginAttempts.WithLabelValues(metrics.Result(true)).Inc()
+	s.recordAudit(ctx, int(user.ID), model.AuditLogin, "grpc", ip)
+	s.auth.Webhooks.Send(webhook.EventUserLogin, map[string]any{
+		"userId": user.ID,
+		"ip":     ip,
+	})
+
+	return &userauthv1.LoginResponse{
+		Token:                 session.Token,
+		RefreshToken:          session.RefreshToken,
+		RefreshTokenExpiresAt: timestamppb.New(session.RefreshTokenExpiresAt),
+		SessionId:             uint64(session.SessionID),
+		User:                  toUser(user),
+	}, nil
+}
+
+// Refresh returns a new jwt for the refresh token, like the automatic refresh of the AuthMiddleware.
+func (s *Server) Refresh(ctx context.Context, req *userauthv1.RefreshRequest) (*userauthv1.RefreshResponse, error) {
+	user, token, _, err := s.auth.RefreshSession(ctx, s.logger, strings.TrimSpace(req.GetRefreshToken()), false)
+	metrics.TokenRefreshes.WithLabelValues(metrics.Result(err == nil)).Inc()
+	if err != nil {
+		return nil, authError(s.logger, err)
+	}
+
+	return &userauthv1.RefreshResponse{Token: token, User: toUser(user)}, nil
+}
+
+// ValidateToken checks the jwt of another client, e.g. forwarded by an internal service, and returns its claims.
+// The permissions are the current ones of the user, like the introspection of the REST API.
+func (s *Server) ValidateToken(ctx context.Context, req *userauthv1.ValidateTokenRequest) (*userauthv1.ValidateTokenResponse, error) {
+	user, claims, err := s.auth.Authenticate(ctx, strings.TrimSpace(req.GetToken()))
+	if err != nil {
+		return nil, authError(s.logger, err)
+	}
+	permissions, err := s.auth.EffectivePermissions(ctx, user, claims)
+	if err != nil {
+		return nil, s.internalError("failed to load permissions", err)
+	}
+
+	response := &userauthv1.ValidateTokenResponse{
+		UserId:             uint64(user.ID),
+		Role:               user.Role,
+		Permissions:        permissions,
+		MustChangePassword: claims.MustChangePassword,
+		TokenId:            claims.ID,
+		IssuedAt:           timestamppb.New(claims.IssuedAt.Time),
+	}
+	if claims.OrgID != nil {
+		orgID := uint64(*claims.OrgID)
+		response.OrgId = &orgID
+	}
+	if claims.ExpiresAt != nil {
+		response.ExpiresAt = timestamppb.New(claims.ExpiresAt.Time)
+	}
+
+	return response, nil
+}
+
+// GetUser returns a user like GET /user/{id}: users can only get themselves, admins any user of their organization.
+func (s *Server) GetUser(ctx context.Context, req *userauthv1.GetUserRequest) (*userauthv1.GetUserResponse, error) {
+	currentUser, _ := CurrentUser(ctx)
+	if uint64(currentUser.ID) != req.GetId() && !currentUser.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "you can only access your own user")
+	}
+
+	user, err := s.auth.UserService.GetUserInOrg(ctx, int(req.GetId()), callerOrgScope(ctx))
+	if errors.Is(err, service.ErrUserNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, s.internalError("failed to get user", err)
+	}
+
+	return &userauthv1.GetUserResponse{User: toUser(user)}, nil
+}
+
+// CreateUser creates a user like POST /user. Admin only, the user joins the organization of the admin.
+func (s *Server) CreateUser(ctx context.Context, req *userauthv1.CreateUserRequest) (*userauthv1.CreateUserResponse, error) {
+	if currentUser, _ := CurrentUser(ctx); !currentUser.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "admin role required")
+	}
+
+	data := &model.UserCreateDTO{Email: req.GetEmail(), Password: req.GetPassword(), Username: req.Username}
+	data.Canonicalize()
+	if err := data.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	data.OrgID = callerOrgScope(ctx).OrgID
+
+	user, err := s.auth.UserService.CreateUser(ctx, data)
+	if errors.Is(err, service.ErrEmailTaken) {
+		return nil, status.Error(codes.AlreadyExists, "a user with this email already exists")
+	}
+	if errors.Is(err, service.ErrUsernameTaken) {
+		return nil, status.Error(codes.AlreadyExists, "a user with this username already exists")
+	}
+	if err != nil {
+		return nil, s.internalError("failed to create user", err)
+	}
+	s.auth.Webhooks.Send(webhook.EventUserCreated, user.ToResponse())
+
+	return &userauthv1.CreateUserResponse{User: toUser(user)}, nil
+}
+
+// internalError logs the error and returns an Internal status, its details stay in the logs.
+func (s *Server) internalError(message string, err error) error {
+	s.logger.Error(message, "error", err)
+
+	return status.Error(codes.Internal, "internal error")
+}
+
+// recordAudit records an entry of the audit trail, a failure is only logged.
+func (s *Server) recordAudit(ctx context.Context, userID int, action, detail, ip string) {
+	if err := s.auth.AuditService.Record(ctx, userID, action, detail, ip); err != nil {
+		s.logger.Error("failed to record audit log", "action", action, "error", err)
+	}
+}
+
+// callerOrgScope returns the organization of the caller, from its jwt.
+func callerOrgScope(ctx context.Context) *model.OrgScope {
+	if claims, ok := CurrentClaims(ctx); ok {
+		return &model.OrgScope{OrgID: claims.OrgID}
+	}
+
+	return &model.OrgScope{}
+}
+
+// toUser returns the message of the user, with the fields of its REST response.
+func toUser(user *model.User) *userauthv1.User {
+	response := user.ToResponse()
+	message := &userauthv1.User{
+		Id:                 uint64(response.ID),
+		Email:              response.Email,
+		Username:           response.Username,
+		Role:               response.Role,
+		Status:             response.Status,
+		CreatedAt:          timestamppb.New(response.CreatedAt),
+		UpdatedAt:          timestamppb.New(response.UpdatedAt),
+		MustChangePassword: response.MustChangePassword,
+		DisplayName:        response.DisplayName,
+		AvatarUrl:          response.AvatarURL,
+		Locale:             response.Locale,
+		Timezone:           response.Timezone,
+		Bio:                response.Bio,
+	}
+	if response.OrgID != nil {
+		orgID := uint64(*response.OrgID)
+		message.OrgId = &orgID
+	}
+	if response.LastLoginAt != nil {
+		message.LastLoginAt = timestamppb.New(*response.LastLoginAt)
+	}
+
+	return message
+}
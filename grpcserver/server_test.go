@@ -0,0 +1,298 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/handler"
+	"github.com/MohammadBnei/gorm-user-auth/mailer"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	userauthv1 "github.com/MohammadBnei/gorm-user-auth/proto/userauth/v1"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gorm.io/gorm"
+)
+
+// testServer is the gRPC server wired like main does, served in process on top of a test database
+type testServer struct {
+	db     *gorm.DB
+	auth   *handler.AuthHandler
+	client userauthv1.UserAuthServiceClient
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	db := testutil.NewDB(t)
+	templates, err := mailer.LoadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userService := service.NewUserService(db)
+	authHandler := handler.NewAuthHandler(service.NewRTService(db), userService, service.NewRevokedTokenService(db), service.NewIdempotencyService(db), service.NewTxService(db), mailer.NewLogMailer(nil), templates, nil, service.NewAuditService(db), service.NewPermissionService(db), testutil.Config())
+
+	listener := bufconn.Listen(1 << 20)
+	server := New(authHandler, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testServer{db: db, auth: authHandler, client: userauthv1.NewUserAuthServiceClient(conn)}
+}
+
+// seedUser seeds the user of the fixture and returns it with a valid jwt.
+func (s *testServer) seedUser(t *testing.T, fixture testutil.UserFixture) (*model.User, string) {
+	t.Helper()
+
+	user := testutil.SeedUser(t, s.db, fixture)
+	token, err := s.auth.GenerateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, token
+}
+
+// withToken returns a context authenticating the calls with the jwt.
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func expectCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+
+	if got := status.Code(err); got != want {
+		t.Fatalf("code = %s (%v), want %s", got, err, want)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com", Username: "alice"})
+	testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "suspended@example.com", Status: model.StatusSuspended})
+
+	tests := []struct {
+		name       string
+		identifier string
+		password   string
+		want       codes.Code
+	}{
+		{"email", "alice@example.com", testutil.DefaultPassword, codes.OK},
+		{"username is trimmed", " alice ", testutil.DefaultPassword, codes.OK},
+		{"wrong password", "alice", "wrong password", codes.Unauthenticated},
+		{"unknown user", "nobody@example.com", testutil.DefaultPassword, codes.Unauthenticated},
+		{"suspended user", "suspended@example.com", testutil.DefaultPassword, codes.PermissionDenied},
+		{"missing password", "alice", "", codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := s.client.Login(context.Background(), &userauthv1.LoginRequest{Identifier: tt.identifier, Password: tt.password})
+			expectCode(t, err, tt.want)
+			if tt.want != codes.OK {
+				return
+			}
+			if response.Token == "" || response.RefreshToken == "" || response.SessionId == 0 || response.User.GetEmail() != "alice@example.com" {
+				t.Errorf("Login() = %v, want the session of alice", response)
+			}
+
+			// The jwt authenticates the other calls
+			got, err := s.client.GetUser(withToken(response.Token), &userauthv1.GetUserRequest{Id: response.User.Id})
+			expectCode(t, err, codes.OK)
+			if got.User.GetUsername() != "alice" {
+				t.Errorf("GetUser() = %v, want alice", got)
+			}
+		})
+	}
+
+	// The unknown identifier is kept out of the audit trail
+	var failed model.AuditLog
+	if err := s.db.Where("action = ? AND user_id = 0", model.AuditLoginFailed).First(&failed).Error; err != nil {
+		t.Fatal(err)
+	}
+	if failed.Detail != "unknown identifier" {
+		t.Errorf("audit detail = %q, want no identifier", failed.Detail)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	s := newTestServer(t)
+	testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+
+	login, err := s.client.Login(context.Background(), &userauthv1.LoginRequest{Identifier: "alice@example.com", Password: testutil.DefaultPassword})
+	expectCode(t, err, codes.OK)
+
+	response, err := s.client.Refresh(context.Background(), &userauthv1.RefreshRequest{RefreshToken: login.RefreshToken})
+	expectCode(t, err, codes.OK)
+	if response.Token == "" || response.User.GetId() != login.User.GetId() {
+		t.Errorf("Refresh() = %v, want a new jwt of alice", response)
+	}
+	validated, err := s.client.ValidateToken(context.Background(), &userauthv1.ValidateTokenRequest{Token: response.Token})
+	expectCode(t, err, codes.OK)
+	if validated.UserId != login.User.GetId() {
+		t.Errorf("ValidateToken() = %v, want alice", validated)
+	}
+
+	_, err = s.client.Refresh(context.Background(), &userauthv1.RefreshRequest{RefreshToken: "unknown"})
+	expectCode(t, err, codes.Unauthenticated)
+	if got := status.Convert(err).Message(); got != handler.ErrSessionExpired.Error() {
+		t.Errorf("message = %q, want %q", got, handler.ErrSessionExpired.Error())
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	s := newTestServer(t)
+	alice, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+	_, suspendedToken := s.seedUser(t, testutil.UserFixture{Email: "suspended@example.com", Status: model.StatusSuspended})
+
+	response, err := s.client.ValidateToken(context.Background(), &userauthv1.ValidateTokenRequest{Token: aliceToken})
+	expectCode(t, err, codes.OK)
+	if response.UserId != uint64(alice.ID) || response.Role != model.RoleUser || response.TokenId == "" || response.ExpiresAt == nil {
+		t.Errorf("ValidateToken() = %v, want the claims of alice", response)
+	}
+
+	_, err = s.client.ValidateToken(context.Background(), &userauthv1.ValidateTokenRequest{Token: "not a jwt"})
+	expectCode(t, err, codes.Unauthenticated)
+	_, err = s.client.ValidateToken(context.Background(), &userauthv1.ValidateTokenRequest{Token: suspendedToken})
+	expectCode(t, err, codes.PermissionDenied)
+}
+
+func TestValidateTokenPermissions(t *testing.T) {
+	s := newTestServer(t)
+	alice := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+	ctx := context.Background()
+	if err := s.auth.PermissionService.GrantToUser(ctx, int(alice.ID), "users:export"); err != nil {
+		t.Fatal(err)
+	}
+	login, err := s.client.Login(ctx, &userauthv1.LoginRequest{Identifier: "alice@example.com", Password: testutil.DefaultPassword})
+	expectCode(t, err, codes.OK)
+
+	response, err := s.client.ValidateToken(ctx, &userauthv1.ValidateTokenRequest{Token: login.Token})
+	expectCode(t, err, codes.OK)
+	if !slices.Contains(response.Permissions, "users:export") {
+		t.Errorf("permissions = %v, want users:export", response.Permissions)
+	}
+
+	// The jwt still embeds the revoked permission, its version tells it is stale
+	if err := s.auth.PermissionService.RevokeFromUser(ctx, int(alice.ID), "users:export"); err != nil {
+		t.Fatal(err)
+	}
+	response, err = s.client.ValidateToken(ctx, &userauthv1.ValidateTokenRequest{Token: login.Token})
+	expectCode(t, err, codes.OK)
+	if slices.Contains(response.Permissions, "users:export") {
+		t.Errorf("permissions = %v, want users:export revoked", response.Permissions)
+	}
+}
+
+func TestAuthInterceptor(t *testing.T) {
+	s := newTestServer(t)
+	alice, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+	bob, _ := s.seedUser(t, testutil.UserFixture{Email: "bob@example.com"})
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+	_, suspendedToken := s.seedUser(t, testutil.UserFixture{Email: "suspended@example.com", Status: model.StatusSuspended})
+	mustChange := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "carol@example.com"})
+	if err := s.db.Model(mustChange).Update("must_change_password", true).Error; err != nil {
+		t.Fatal(err)
+	}
+	mustChangeToken, err := s.auth.GenerateToken(mustChange)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		id   uint
+		want codes.Code
+	}{
+		{"no token", context.Background(), alice.ID, codes.Unauthenticated},
+		{"invalid token", withToken("not a jwt"), alice.ID, codes.Unauthenticated},
+		{"itself", withToken(aliceToken), alice.ID, codes.OK},
+		{"another user", withToken(aliceToken), bob.ID, codes.PermissionDenied},
+		{"admin", withToken(adminToken), bob.ID, codes.OK},
+		{"admin on an unknown user", withToken(adminToken), 999, codes.NotFound},
+		{"suspended user", withToken(suspendedToken), alice.ID, codes.PermissionDenied},
+		{"password change required", withToken(mustChangeToken), mustChange.ID, codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.client.GetUser(tt.ctx, &userauthv1.GetUserRequest{Id: uint64(tt.id)})
+			expectCode(t, err, tt.want)
+		})
+	}
+}
+
+func TestAuthenticateDatabaseFailure(t *testing.T) {
+	s := newTestServer(t)
+	alice, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+	login, err := s.client.Login(context.Background(), &userauthv1.LoginRequest{Identifier: "alice@example.com", Password: testutil.DefaultPassword})
+	expectCode(t, err, codes.OK)
+	err = s.db.Callback().Query().Before("gorm:query").Register("test:fail", func(tx *gorm.DB) {
+		tx.AddError(errors.New("database is locked"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure isn't a rejection of the jwt, and its message stays in the logs
+	_, getErr := s.client.GetUser(withToken(aliceToken), &userauthv1.GetUserRequest{Id: uint64(alice.ID)})
+	_, validateErr := s.client.ValidateToken(context.Background(), &userauthv1.ValidateTokenRequest{Token: aliceToken})
+	_, refreshErr := s.client.Refresh(context.Background(), &userauthv1.RefreshRequest{RefreshToken: login.RefreshToken})
+	for _, err := range []error{getErr, validateErr, refreshErr} {
+		expectCode(t, err, codes.Internal)
+		if strings.Contains(status.Convert(err).Message(), "database is locked") {
+			t.Errorf("error = %v, want the database error hidden", err)
+		}
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	s := newTestServer(t)
+	_, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+	username := " Bob "
+
+	tests := []struct {
+		name  string
+		token string
+		req   *userauthv1.CreateUserRequest
+		want  codes.Code
+	}{
+		{"not an admin", aliceToken, &userauthv1.CreateUserRequest{Email: "bob@example.com", Password: "password"}, codes.PermissionDenied},
+		{"admin", adminToken, &userauthv1.CreateUserRequest{Email: "bob@example.com", Password: "password", Username: &username}, codes.OK},
+		{"duplicate email", adminToken, &userauthv1.CreateUserRequest{Email: "alice@example.com", Password: "password"}, codes.AlreadyExists},
+		{"invalid email", adminToken, &userauthv1.CreateUserRequest{Email: "carol", Password: "password"}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := s.client.CreateUser(withToken(tt.token), tt.req)
+			expectCode(t, err, tt.want)
+			if tt.want == codes.OK && (response.User.GetEmail() != "bob@example.com" || response.User.GetUsername() != "bob") {
+				t.Errorf("CreateUser() = %v, want bob", response)
+			}
+		})
+	}
+
+	// The created user logs in like any other
+	_, err := s.client.Login(context.Background(), &userauthv1.LoginRequest{Identifier: "bob", Password: "password"})
+	expectCode(t, err, codes.OK)
+}
@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ApiKeyHeader carries the API key of the server-to-server requests
+	ApiKeyHeader = "X-API-Key"
+
+	// apiKeyKey is the context key of the API key the request was authenticated with
+	apiKeyKey = "apiKey"
+)
+
+type ApiKeyHandler struct {
+	apiKeyService *service.ApiKeyService
+}
+
+func NewApiKeyHandler(apiKeyService *service.ApiKeyService) *ApiKeyHandler {
+	return &ApiKeyHandler{
+		apiKeyService: apiKeyService,
+	}
+}
+
+// CreateApiKey godoc
+// @Summary      Create an API key
+// @Description  create an API key acting on behalf of the current user. The plaintext key is only returned in this response
+// @Tags         ApiKey
+// @Accept       json
+// @Produce      json
+// @Param        apiKey  body      model.ApiKeyCreateDTO  true  "Name, scopes and optional expiry"
+// @Success      201     {object}  model.ApiKeyCreatedResponseDTO
+// @Failure      400     {object}  ErrorResponse
+// @Failure      401     {object}  ErrorResponse
+// @Router       /auth/api-keys [post]
+func (h *ApiKeyHandler) CreateApiKey(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+
+	var data model.ApiKeyCreateDTO
+	if !bindJSON(c, &data) {
+		return
+	}
+	if err := data.Validate(); err != nil {
+		respondError(c, 400, err.Error())
+		return
+	}
+
+	key, err := h.apiKeyService.Create(c.Request.Context(), int(user.ID), &data)
+	if err != nil {
+		respondInternalError(c, "failed to create api key", err)
+		return
+	}
+
+	respond(c, http.StatusCreated, &model.ApiKeyCreatedResponseDTO{
+		ApiKeyResponseDTO: *key.ToResponse(),
+		Key:               key.Key,
+	})
+}
+
+// ListApiKeys godoc
+// @Summary      List the API keys
+// @Description  get the API keys of the current user, without their plaintext
+// @Tags         ApiKey
+// @Produce      json
+// @Success      200  {array}   model.ApiKeyResponseDTO
+// @Failure      401  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /auth/api-keys [get]
+func (h *ApiKeyHandler) ListApiKeys(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+
+	keys, err := h.apiKeyService.ListForUser(c.Request.Context(), int(user.ID))
+	if err != nil {
+		respondInternalError(c, "failed to list api keys", err)
+		return
+	}
+
+	responses := make([]*model.ApiKeyResponseDTO, 0, len(keys))
+	for _, key := range keys {
+		responses = append(responses, key.ToResponse())
+	}
+
+	respond(c, 200, responses)
+}
+
+// RevokeApiKey godoc
+// @Summary      Revoke an API key
+// @Description  delete an API key of the current user, it can't authenticate anymore
+// @Tags         ApiKey
+// @Produce      json
+// @Param        id   path      int  true  "API key ID"
+// @Success      200  {object}  MessageResponse
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse
+// @Router       /auth/api-keys/{id} [delete]
+func (h *ApiKeyHandler) RevokeApiKey(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+
+	id, ok := parseIDParam(c, "id")
+	if !ok {
+		return
+	}
+
+	err := h.apiKeyService.Revoke(c.Request.Context(), int(user.ID), uint(id))
+	if errors.Is(err, service.ErrApiKeyNotFound) {
+		respondError(c, 404, err.Error())
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to revoke api key", err)
+		return
+	}
+
+	respond(c, 200, gin.H{
+		"message": "api key revoked",
+	})
+}
+
+/*
+ApiKeyMiddleware authenticates the request with the API key of the X-API-Key header, and
+sets its owner in the context like the AuthMiddleware does.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware. It aborts with a 401 if the
+key is missing, unknown or expired, and with a 500 if it can't be checked.
+*/
+func (h *ApiKeyHandler) ApiKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		returnErrorWithAbort := curryReturnUnauthorized(c)
+
+		raw := c.GetHeader(ApiKeyHeader)
+		if raw == "" {
+			returnErrorWithAbort(errors.New("no api key provided"))
+			return
+		}
+
+		key, err := h.apiKeyService.Authenticate(c.Request.Context(), raw)
+		if errors.Is(err, service.ErrInvalidApiKey) {
+			returnErrorWithAbort(err)
+			return
+		}
+		// A failure to check the key isn't a rejection of it
+		if err != nil {
+			GetLogger(c).Error("failed to authenticate api key", "error", err)
+			abortWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if key.User.IsSuspended() {
+			abortAccountSuspended(c)
+			return
+		}
+
+		c.Set(userKey, &key.User)
+		c.Set(apiKeyKey, key)
+
+		c.Next()
+	}
+}
+
+/*
+ApiKeyOr authenticates the requests carrying an X-API-Key header with the ApiKeyMiddleware,
+and the other ones with next, e.g. the AuthMiddleware.
+
+Parameters:
+- next (gin.HandlerFunc): The middleware authenticating the requests without API key.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func (h *ApiKeyHandler) ApiKeyOr(next gin.HandlerFunc) gin.HandlerFunc {
+	apiKeyMiddleware := h.ApiKeyMiddleware()
+
+	return func(c *gin.Context) {
+		if c.GetHeader(ApiKeyHeader) != "" {
+			apiKeyMiddleware(c)
+			return
+		}
+
+		next(c)
+	}
+}
+
+/*
+RequireScope is a middleware that only lets the API keys granted scope through. The requests
+authenticated by a jwt act as the user itself and aren't restricted.
+
+Parameters:
+- scope (string): The scope the API key must have, e.g. model.ScopeUserRead.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware. It aborts with a 403 if the
+API key lacks the scope.
+*/
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key, ok := CurrentApiKey(c); ok && !key.HasScope(scope) {
+			abortWithError(c, http.StatusForbidden, "api key lacks the "+scope+" scope")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// CurrentApiKey returns the API key the request was authenticated with by the ApiKeyMiddleware, if any.
+func CurrentApiKey(c *gin.Context) (*model.ApiKey, bool) {
+	value, exists := c.Get(apiKeyKey)
+	if !exists {
+		return nil, false
+	}
+
+	key, ok := value.(*model.ApiKey)
+
+	return key, ok && key != nil
+}
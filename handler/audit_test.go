@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+func TestAuditTrail(t *testing.T) {
+	s := newTestServer(t, nil)
+	admin, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+	alice, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+	bob, _ := s.seedUser(t, testutil.UserFixture{Email: "bob@example.com"})
+	// The expected entries below refer to the users by ID
+	if admin.ID != 1 || alice.ID != 2 || bob.ID != 3 {
+		t.Fatalf("unexpected user ids %d, %d, %d", admin.ID, alice.ID, bob.ID)
+	}
+
+	expectStatus(t, s.do(t, "POST", "/api/v1/auth/login", "", model.LoginDTO{Email: "nobody@example.com", Password: "password"}), http.StatusUnauthorized)
+	expectStatus(t, s.do(t, "POST", "/api/v1/auth/login", "", model.LoginDTO{Email: "alice@example.com", Password: "wrong password"}), http.StatusUnauthorized)
+	token := login(t, s, "alice@example.com", testutil.DefaultPassword)
+	expectStatus(t, s.do(t, "POST", "/api/v1/auth/logout", token, nil), http.StatusOK)
+	expectStatus(t, s.do(t, "PUT", "/api/v1/auth/password", aliceToken, model.PasswordChangeDTO{CurrentPassword: testutil.DefaultPassword, NewPassword: "new password"}), http.StatusOK)
+	expectStatus(t, s.do(t, "DELETE", fmt.Sprintf("/api/v1/user/%d", bob.ID), adminToken, nil), http.StatusOK)
+
+	list := func(t *testing.T, query string) []model.AuditLog {
+		t.Helper()
+
+		w := s.do(t, "GET", "/api/v1/audit"+query, adminToken, nil)
+		expectStatus(t, w, http.StatusOK)
+		var logs []model.AuditLog
+		testutil.DecodeJSON(t, w, &logs)
+
+		return logs
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"most recent first", "", []string{"user.deleted 3 deleted by user 1", "user.password_changed 2 changed by the user", "session.revoked 2 logout", "user.login 2 password", "user.login_failed 2 wrong password", "user.login_failed 0 unknown email"}},
+		{"by user", fmt.Sprintf("?userId=%d", alice.ID), []string{"user.password_changed 2 changed by the user", "session.revoked 2 logout", "user.login 2 password", "user.login_failed 2 wrong password"}},
+		{"by action", "?action=user.login_failed", []string{"user.login_failed 2 wrong password", "user.login_failed 0 unknown email"}},
+		{"paginated", "?page=2&pageSize=4", []string{"user.login_failed 2 wrong password", "user.login_failed 0 unknown email"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, log := range list(t, tt.query) {
+				got = append(got, fmt.Sprintf("%s %d %s", log.Action, log.UserId, log.Detail))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("audit logs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The trail is for the admins only
+	expectStatus(t, s.do(t, "GET", "/api/v1/audit", login(t, s, "alice@example.com", "new password"), nil), http.StatusForbidden)
+	expectStatus(t, s.do(t, "GET", "/api/v1/audit?pageSize=1000", adminToken, nil), http.StatusUnprocessableEntity)
+}
@@ -1,34 +1,129 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/MohammadBnei/gorm-user-auth/auth"
 	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/mailer"
+	"github.com/MohammadBnei/gorm-user-auth/metrics"
 	"github.com/MohammadBnei/gorm-user-auth/model"
 	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/tokenutil"
+	"github.com/MohammadBnei/gorm-user-auth/webhook"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
+const (
+	// RefreshTokenHeader carries the refresh token for clients that don't use cookies
+	RefreshTokenHeader = "X-Refresh-Token"
+	// NewTokenHeader carries the jwt minted by the AuthMiddleware auto-refresh
+	NewTokenHeader = "X-New-Token"
+
+	invalidCredentialsMessage = "invalid credentials"
+	registrationClosedMessage = "registration is closed, ask an administrator for an account"
+	tooManySessionsMessage    = "too many active sessions, log out from another device first"
+
+	// userKey is the context key of the authenticated *model.User, read it with CurrentUser
+	userKey = "user"
+	// claimsKey is the context key of the *auth.Claims of the jwt of the request, read them with CurrentClaims
+	claimsKey = "claims"
+	// passwordChangeKey marks the routes allowed to the users who must change their password, see AllowPasswordChange
+	passwordChangeKey = "passwordChange"
+	// permissionsKey caches the effective permissions of the user for the request, see RequirePermission
+	permissionsKey = "permissions"
+)
+
+// ErrAccountSuspended is returned when a suspended user tries to authenticate, whatever its credentials
+var ErrAccountSuspended = errors.New("account suspended")
+
+// ErrSessionExpired is returned for an expired jwt whose refresh token is missing, unknown or expired
+var ErrSessionExpired = errors.New("session expired, please log in again")
+
+// ErrTokenRevoked is returned for a jwt logged out, or issued before a log out everywhere or a password change
+var ErrTokenRevoked = errors.New("token revoked")
+
+// ErrSessionRevoked is returned for a refresh token issued before a log out everywhere or a password change
+var ErrSessionRevoked = errors.New("session revoked")
+
+// ErrAccountInactive is returned when refreshing the session of a user who isn't active
+var ErrAccountInactive = errors.New("account is not active, the session can't be refreshed")
+
+// errInvalidVerificationToken is returned for an emailed token that is tampered, expired or already used
+var errInvalidVerificationToken = errors.New("invalid or expired verification token")
+
+// ErrPasswordChangeRequired is returned to a user flagged with MustChangePassword, on any route but the password change
+var ErrPasswordChangeRequired = errors.New("password change required, set a new password with PUT /api/v1/auth/password")
+
 type AuthHandler struct {
-	RTService   *service.RTService
-	UserService *service.UserService
+	RTService           *service.RTService
+	UserService         *service.UserService
+	RevokedTokenService *service.RevokedTokenService
+	IdempotencyService  *service.IdempotencyService
+	TxService           *service.TxService
+	// Mailer sends the emails rendered from MailTemplates (email verification, password reset)
+	Mailer        mailer.Mailer
+	MailTemplates *mailer.Templates
+	// Webhooks are notified of the logins, registrations, password changes and logouts
+	Webhooks *webhook.WebhookService
+	// AuditService records the logins, failed logins, password changes, logouts and account deletions
+	AuditService *service.AuditService
+	// PermissionService loads the permissions embedded in the jwt and checked by RequirePermission
+	PermissionService *service.PermissionService
+	// TokenManager generates and validates the jwt
+	TokenManager *auth.TokenManager
+	// LinkSigner signs the tokens of the emailed links (password reset, email verification), with LinkSigningKey
+	LinkSigner *tokenutil.Signer
 	*config.Config
 }
 
-func NewAuthHandler(rTService *service.RTService, userService *service.UserService, config *config.Config) *AuthHandler {
+func NewAuthHandler(rTService *service.RTService, userService *service.UserService, revokedTokenService *service.RevokedTokenService, idempotencyService *service.IdempotencyService, txService *service.TxService, m mailer.Mailer, mailTemplates *mailer.Templates, webhooks *webhook.WebhookService, auditService *service.AuditService, permissionService *service.PermissionService, config *config.Config) *AuthHandler {
 	return &AuthHandler{
-		RTService:   rTService,
-		UserService: userService,
-		Config:      config,
+		RTService:           rTService,
+		UserService:         userService,
+		RevokedTokenService: revokedTokenService,
+		IdempotencyService:  idempotencyService,
+		TxService:           txService,
+		Mailer:              m,
+		MailTemplates:       mailTemplates,
+		Webhooks:            webhooks,
+		AuditService:        auditService,
+		PermissionService:   permissionService,
+		TokenManager: auth.NewTokenManager(config.JWT_SECRET, auth.DefaultTokenTTL, auth.TokenOptions{
+			Issuer:   config.JWT_ISSUER,
+			Audience: config.JWT_AUDIENCE,
+			Leeway:   config.JWT_LEEWAY,
+
+			KeyID:        config.JWT_KID,
+			PreviousKeys: config.PreviousJWTKeys(),
+		}),
+		LinkSigner: tokenutil.NewSigner(config.LinkSigningKey()),
+		Config:     config,
 	}
 }
 
+/*
+SetClaimsEnricher registers a function adding custom claims to every jwt generated for the
+users, at login, registration and refresh. The reserved claims (id, exp, jti...) can't be
+overwritten by it. It must be called before serving the requests.
+
+Args:
+
+	enricher (auth.ClaimsEnricher): The function returning the custom claims of a user.
+*/
+func (authHandler *AuthHandler) SetClaimsEnricher(enricher auth.ClaimsEnricher) {
+	authHandler.TokenManager.SetClaimsEnricher(enricher)
+}
+
 /*
 GenerateToken generates a JWT token for a given user.
 
@@ -43,24 +138,44 @@ Returns:
 	error: An error if one occurred during the generation process.
 */
 func (authHandler *AuthHandler) GenerateToken(user *model.User) (string, error) {
+	token, _, err := authHandler.generateToken(context.Background(), user)
 
-	claims := jwt.MapClaims{}
-	claims["authorized"] = true
-	claims["id"] = user.ID
-	claims["exp"] = time.Now().Add(time.Minute * 5).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token, err
+}
 
-	return token.SignedString([]byte(authHandler.JWT_SECRET))
+// generateToken generates a signed JWT for the user and also returns its claims, so callers can keep track of the jti.
+// The permissions of the user are embedded in it, except for the admins who hold them all.
+func (authHandler *AuthHandler) generateToken(ctx context.Context, user *model.User) (string, *auth.Claims, error) {
+	if !user.IsAdmin() {
+		if err := authHandler.PermissionService.Load(ctx, user); err != nil {
+			return "", nil, err
+		}
+	}
 
+	return authHandler.TokenManager.Generate(user)
 }
 
+// Login godoc
+// @Summary      Log in
+// @Description  authenticate with an identifier, the email or the username, and the password. The email field is still accepted in place of the identifier. The jwt and refresh token are returned in the body and set as cookies, along with the user unless tokensOnly is set or LOGIN_RESPONSE_USER is off. A user flagged with mustChangePassword gets a chpwd claim and can only change its password until it does
+// @Tags         Auth
+// @Accept       json
+// @Produce      json
+// @Param        credentials  body      model.LoginDTO  true  "User credentials"
+// @Success      200          {object}  model.LoginResponseDTO
+// @Failure      400          {object}  ErrorResponse
+// @Failure      401          {object}  ErrorResponse
+// @Failure      403          {object}  ErrorResponse
+// @Failure      422          {object}  ValidationErrorResponse
+// @Router       /auth/login [post]
 /*
 Login handles the login request. It parses the request body into a LoginDTO struct
-and attempts to retrieve a user from the UserService instance with the email provided
-in the LoginDTO. If a user is found, the password is checked against the user's hashed
+and attempts to retrieve a user from the UserService instance with the identifier, email
+or username, provided in the LoginDTO. If a user is found, the password is checked against the user's hashed
 password. If the password matches, a JWT is generated and set as a cookie in the response.
 A refresh token is also generated and set as a cookie in the response. Finally, a JSON
-response is returned with the JWT, the refresh token, and the user object.
+response is returned with the JWT, the refresh token, and the user object, which is left out
+with tokensOnly or LOGIN_RESPONSE_USER off.
 
 @param authHandler *AuthHandler: an instance of the AuthHandler struct
 @param c *gin.Context: the current request context
@@ -70,178 +185,1322 @@ response is returned with the JWT, the refresh token, and the user object.
 func (authHandler *AuthHandler) Login(c *gin.Context) {
 	var loginDTO *model.LoginDTO
 
-	returnError := curryReturnError(c, false)
+	internalError := func(message string, err error) {
+		metrics.LoginAttempts.WithLabelValues(metrics.Result(false)).Inc()
+		respondInternalError(c, message, err)
+	}
 
-	if err := c.ShouldBindJSON(&loginDTO); err != nil {
-		fmt.Println(err)
-		returnError(err)
+	if !bindJSON(c, &loginDTO) {
 		return
 	}
 
-	user, err := authHandler.UserService.GetUserByEmail(loginDTO.Email)
+	// An unknown email and a wrong password get the same response, in about the same time
+	invalidCredentials := func(userID int, detail string) {
+		metrics.LoginAttempts.WithLabelValues(metrics.Result(false)).Inc()
+		recordAudit(c, authHandler.AuditService, userID, model.AuditLoginFailed, detail)
+		respondError(c, http.StatusUnauthorized, invalidCredentialsMessage)
+	}
+
+	identifier := loginDTO.LoginIdentifier()
+	user, err := authHandler.UserService.GetUserByIdentifier(c.Request.Context(), identifier)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		model.CheckDummyPassword(loginDTO.Password)
+		// The identifier is left out of the audit trail, it may be a password typed in the wrong field
+		if strings.Contains(identifier, "@") {
+			invalidCredentials(0, "unknown email")
+		} else {
+			invalidCredentials(0, "unknown username")
+		}
+		return
+	}
 	if err != nil {
-		fmt.Println(err)
-		returnError(err)
+		internalError("failed to get user by identifier", err)
 		return
 	}
 
 	err = user.CheckPassword(loginDTO.Password)
+	if err == model.ErrPasswordMismatch {
+		GetLogger(c).Warn("password check failed", "error", err)
+		invalidCredentials(int(user.ID), "wrong password")
+		return
+	}
 	if err != nil {
-		fmt.Println(err)
-		if err == bcrypt.ErrMismatchedHashAndPassword {
-			returnError(errors.New("incorrect password"))
-		} else {
-			returnError(err)
+		internalError("password check failed", err)
+		return
+	}
+
+	// Only checked once the password is, so that the status isn't disclosed to anyone
+	if user.IsSuspended() {
+		metrics.LoginAttempts.WithLabelValues(metrics.Result(false)).Inc()
+		recordAudit(c, authHandler.AuditService, int(user.ID), model.AuditLoginFailed, "account suspended")
+		writeAccountSuspended(c)
+		return
+	}
+
+	authHandler.recordLogin(c, user)
+	authHandler.rehashPassword(c, user, loginDTO.Password)
+
+	response, err := authHandler.createSession(c, authHandler.RTService, user, loginDTO.RememberMe)
+	if errors.Is(err, service.ErrTooManySessions) {
+		metrics.LoginAttempts.WithLabelValues(metrics.Result(false)).Inc()
+		recordAudit(c, authHandler.AuditService, int(user.ID), model.AuditLoginFailed, "too many sessions")
+		respondError(c, http.StatusForbidden, tooManySessionsMessage)
+		return
+	}
+	if err != nil {
+		internalError("failed to create session", err)
+		return
+	}
+	authHandler.setSessionCookies(c, response, loginDTO.RememberMe)
+	if loginDTO.TokensOnly || !authHandler.LOGIN_RESPONSE_USER {
+		response.User = nil
+	}
+	metrics.LoginAttempts.WithLabelValues(metrics.Result(true)).Inc()
+	recordAudit(c, authHandler.AuditService, int(user.ID), model.AuditLogin, "password")
+	authHandler.Webhooks.Send(webhook.EventUserLogin, gin.H{
+		"userId": user.ID,
+		"ip":     c.ClientIP(),
+	})
+
+	respond(c, 200, response)
+}
+
+// Register godoc
+// @Summary      Register
+// @Description  create a new user and log it in. The jwt and refresh token are returned in the body and set as cookies. A request retried with the same Idempotency-Key logs in the user created the first time.
+// @Description  With an invite, the email must be the invited one and the user joins the organization of the inviter. An unknown invite gets a 404, an accepted one a 409 and an expired one a 410
+// @Tags         Auth
+// @Accept       json
+// @Produce      json
+// @Param        Idempotency-Key  header    string               false  "Key making retries safe"
+// @Param        invite           query     string               false  "Invitation token, required when the registration is closed"
+// @Param        user             body      model.UserCreateDTO  true   "User to create"
+// @Success      201              {object}  model.LoginResponseDTO
+// @Failure      400              {object}  ErrorResponse
+// @Failure      403              {object}  ErrorResponse
+// @Failure      404              {object}  ErrorResponse
+// @Failure      409              {object}  ErrorResponse
+// @Failure      410              {object}  ErrorResponse
+// @Failure      422              {object}  ErrorResponse
+// @Router       /auth/register [post]
+/*
+Register creates a new user from the UserCreateDTO in the request body and, on success,
+logs it in exactly like Login does: a JWT and a refresh token are generated, set as cookies
+and returned in the JSON response along with the user.
+
+The user and its refresh token are created in a single transaction: if the session can't
+be created, the user is rolled back and the client can safely retry.
+
+When an Idempotency-Key header is sent, a retry of a request that did succeed gets a new
+session for the same user instead of a conflict. The password is checked again, so that
+knowing the key alone isn't enough to log in.
+
+With an invite query parameter, the invitation is accepted in the same transaction, so that
+it can only be used once. With REGISTRATION_ENABLED off, the requests without one are
+rejected with a 403, retries included.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) Register(c *gin.Context) {
+	var data *model.UserCreateDTO
+
+	invite := c.Query("invite")
+	if !authHandler.REGISTRATION_ENABLED && invite == "" {
+		respondError(c, http.StatusForbidden, registrationClosedMessage)
+		return
+	}
+
+	if !bindJSON(c, &data) {
+		return
+	}
+	// Whatever the payload, the signup can't pick its role, let alone an elevated one: it gets model.DefaultRole
+	data.Role = nil
+
+	fingerprint := idempotencyFingerprint(data)
+	existing, ok := lookupIdempotentUser(c, authHandler.IdempotencyService, authHandler.UserService, idempotencyEndpointRegister, fingerprint)
+	if !ok {
+		return
+	}
+	if existing != nil {
+		if err := existing.CheckPassword(data.Password); err != nil {
+			respondError(c, http.StatusUnprocessableEntity, "the Idempotency-Key has already been used for another request")
+			return
+		}
+		if existing.IsSuspended() {
+			writeAccountSuspended(c)
+			return
 		}
+
+		response, err := authHandler.createSession(c, authHandler.RTService, existing, false)
+		if err != nil {
+			respondInternalError(c, "failed to create session", err)
+			return
+		}
+		authHandler.setSessionCookies(c, response, false)
+
+		respond(c, http.StatusCreated, response)
 		return
 	}
 
-	jwt, err := authHandler.GenerateToken(user)
+	var response *model.LoginResponseDTO
+	err := authHandler.TxService.Transaction(c.Request.Context(), func(tx *service.TxServices) error {
+		if invite != "" {
+			invitation, err := tx.InvitationService.Accept(c.Request.Context(), invite, data.Email)
+			if err != nil {
+				return err
+			}
+			data.OrgID = invitation.OrgID
+		}
+
+		user, err := tx.UserService.CreateUser(c.Request.Context(), data)
+		if err != nil {
+			return err
+		}
+
+		if err := saveIdempotencyKey(c, tx.IdempotencyService, idempotencyEndpointRegister, fingerprint, user); err != nil {
+			return err
+		}
+
+		response, err = authHandler.createSession(c, tx.RTService, user, false)
+		return err
+	})
+	if writeIdempotencyConflict(c, err) || writeInvitationError(c, err) {
+		return
+	}
+	if errors.Is(err, service.ErrEmailTaken) {
+		respondError(c, http.StatusConflict, emailTakenMessage)
+		return
+	}
+	if errors.Is(err, service.ErrUsernameTaken) {
+		respondError(c, http.StatusConflict, usernameTakenMessage)
+		return
+	}
 	if err != nil {
-		fmt.Println(err)
-		returnError(err)
+		respondInternalError(c, "failed to register user", err)
 		return
 	}
+	authHandler.setSessionCookies(c, response, false)
+	authHandler.Webhooks.Send(webhook.EventUserCreated, response.User)
+
+	respond(c, http.StatusCreated, response)
+}
 
-	rt, err := authHandler.RTService.CreateRT(c.ClientIP(), int(user.ID))
+// recordLogin stores the last login of the user and updates it in place. A failure is only
+// logged, it must not prevent the user from logging in.
+func (authHandler *AuthHandler) recordLogin(c *gin.Context, user *model.User) {
+	ip := c.ClientIP()
+	loginAt, err := authHandler.UserService.RecordLogin(c.Request.Context(), int(user.ID), ip)
 	if err != nil {
-		fmt.Println(err)
-		returnError(err)
+		GetLogger(c).Error("failed to record last login", "error", err)
 		return
 	}
 
-	c.SetCookie("jwt", jwt, 3600, "/", "*", false, true)
-	c.SetCookie("rt", rt.Hash, 3600, "/", "*", false, true)
+	user.LastLoginAt = &loginAt
+	user.LastLoginIP = model.EncryptedString(ip)
+}
 
-	c.JSON(200, gin.H{
-		"token":        jwt,
-		"refreshToken": rt.Hash,
-		"user":         user,
-	})
+// rehashPassword migrates the user's password to the configured PASSWORD_HASHER once it has been checked.
+// A failure is only logged, the old hash still works and the next login retries.
+func (authHandler *AuthHandler) rehashPassword(c *gin.Context, user *model.User, password string) {
+	if !user.NeedsRehash() {
+		return
+	}
+
+	if err := authHandler.UserService.RehashPassword(c.Request.Context(), int(user.ID), password); err != nil {
+		GetLogger(c).Error("failed to rehash the password", "error", err)
+		return
+	}
+	GetLogger(c).Info("rehashed the password", "userId", user.ID)
+}
+
+// createSession generates a jwt and a refresh token, created through rtService, for the user and returns the login response.
+// With rememberMe, the refresh token lives RT_REMEMBER_ME_EXPIRY instead of RT_SESSION_EXPIRY, and
+// at most RT_IDLE_EXPIRY and RT_ABSOLUTE_EXPIRY when they are set. At MAX_SESSIONS_PER_USER, see limitSessions,
+// service.ErrTooManySessions is returned.
+func (authHandler *AuthHandler) createSession(c *gin.Context, rtService *service.RTService, user *model.User, rememberMe bool) (*model.LoginResponseDTO, error) {
+	return authHandler.openSession(c.Request.Context(), GetLogger(c), rtService, c.ClientIP(), user, rememberMe)
 }
 
 /*
-AuthMiddleware is a middleware function that handles user authentication using JWT tokens.
+OpenSession logs the user in outside of an HTTP request, e.g. from the gRPC API: it generates a jwt
+and a refresh token like the login does, under the same MAX_SESSIONS_PER_USER. The credentials of
+the user must have been checked before.
 
 Parameters:
-- authHandler (*AuthHandler): A pointer to an AuthHandler instance containing JWT_SECRET.
-- c (*gin.Context): A pointer to the gin.Context instance.
+- ctx (context.Context): The context of the call.
+- logger (*slog.Logger): The logger of the call.
+- ip (string): The IP of the client, recorded with the session.
+- user (*model.User): The user logging in.
+- rememberMe (bool): Whether the refresh token lives RT_REMEMBER_ME_EXPIRY instead of RT_SESSION_EXPIRY.
 
 Returns:
-- gin.HandlerFunc: A function that handles the middleware.
+- (*model.LoginResponseDTO): The tokens of the new session, along with the user.
+- (error): service.ErrTooManySessions at MAX_SESSIONS_PER_USER with the reject SESSION_LIMIT_POLICY.
 */
-func (authHandler *AuthHandler) AuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// before request
+func (authHandler *AuthHandler) OpenSession(ctx context.Context, logger *slog.Logger, ip string, user *model.User, rememberMe bool) (*model.LoginResponseDTO, error) {
+	return authHandler.openSession(ctx, logger, authHandler.RTService, ip, user, rememberMe)
+}
 
-		returnErrorWithAbort := curryReturnError(c, true)
-		returnError := curryReturnError(c, false)
+// openSession is createSession, for the context of any call
+func (authHandler *AuthHandler) openSession(ctx context.Context, logger *slog.Logger, rtService *service.RTService, ip string, user *model.User, rememberMe bool) (*model.LoginResponseDTO, error) {
+	if err := authHandler.limitSessions(ctx, logger, rtService, ip, user); err != nil {
+		return nil, err
+	}
 
-		// First, trying to extract the jwt from the cookie
-		jwtToken, err := c.Cookie("jwt")
+	jwt, _, err := authHandler.generateToken(ctx, user)
+	if err != nil {
+		logger.Error("failed to generate token", "error", err)
+		return nil, err
+	}
 
-		// If not present, proceed to extract it from the Authorization header
-		if err != nil && err != http.ErrNoCookie {
-			returnError(err)
-			return
+	ttl := authHandler.RT_SESSION_EXPIRY
+	if rememberMe {
+		ttl = authHandler.RT_REMEMBER_ME_EXPIRY
+	}
+	// The session is idle from its creation, the refreshes then slide its expiry, see RTService.ExtendRT
+	for _, limit := range []time.Duration{authHandler.RT_IDLE_EXPIRY, authHandler.RT_ABSOLUTE_EXPIRY} {
+		if limit > 0 && limit < ttl {
+			ttl = limit
 		}
+	}
+
+	rt, err := rtService.CreateRT(ctx, ip, int(user.ID), ttl)
+	if err != nil {
+		logger.Error("failed to create refresh token", "error", err)
+		return nil, err
+	}
 
-		if err == http.ErrNoCookie {
+	return &model.LoginResponseDTO{
+		Token:                 jwt,
+		RefreshToken:          rt.Token,
+		RefreshTokenExpiresAt: rt.ExpiresAt,
+		SessionID:             rt.ID,
+		User:                  user.ToResponse(),
+	}, nil
+}
 
-			authHeader := c.GetHeader("Authorization")
-			// Using Bearer prefix
-			splitToken := strings.Split(authHeader, "Bearer ")
-			if len(splitToken) != 2 {
-				returnErrorWithAbort(errors.New("no token provided"))
-				return
-			}
-			jwtToken = splitToken[1]
+// limitSessions makes room for a new session of the user under MAX_SESSIONS_PER_USER: the oldest sessions
+// are revoked, or service.ErrTooManySessions returned with the reject SESSION_LIMIT_POLICY.
+func (authHandler *AuthHandler) limitSessions(ctx context.Context, logger *slog.Logger, rtService *service.RTService, ip string, user *model.User) error {
+	limit := authHandler.MAX_SESSIONS_PER_USER
+	if limit <= 0 {
+		return nil
+	}
 
-			if jwtToken == "" {
-				returnErrorWithAbort(errors.New("no token provided"))
-				return
-			}
+	if authHandler.SESSION_LIMIT_POLICY == config.SessionLimitReject {
+		count, err := rtService.CountForUser(ctx, int(user.ID), ip)
+		if err != nil {
+			logger.Error("failed to count sessions", "error", err)
+			return err
 		}
+		if count >= int64(limit) {
+			logger.Warn("session limit reached", "userId", user.ID, "count", count)
+			return service.ErrTooManySessions
+		}
+		return nil
+	}
 
-		// Parsing the token
-		token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-			// This is just an example of specific token verification
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
+	evicted, err := rtService.RevokeOldestForUser(ctx, int(user.ID), ip, limit-1)
+	if err != nil {
+		logger.Error("failed to evict the oldest sessions", "error", err)
+		return err
+	}
+	if evicted > 0 {
+		logger.Info("evicted the oldest sessions", "userId", user.ID, "count", evicted)
+	}
 
-			// Only this part is required
-			return []byte(authHandler.JWT_SECRET), nil
-		})
+	return nil
+}
 
-		if err != nil && !errors.Is(err, jwt.ErrTokenExpired) {
-			returnError(err)
+// setSessionCookies sets the jwt and refresh token of the login response as cookies, unless cookies are disabled.
+// Without rememberMe they are session cookies, dropped when the browser is closed. With TOKEN_IN_BODY off,
+// the tokens are then removed from the response, the cookies being their only copy.
+func (authHandler *AuthHandler) setSessionCookies(c *gin.Context, response *model.LoginResponseDTO, rememberMe bool) {
+	if !authHandler.cookiesEnabled() {
+		return
+	}
+
+	jwtMaxAge, rtMaxAge := 0, 0
+	if rememberMe {
+		jwtMaxAge = 3600
+		rtMaxAge = int(time.Until(response.RefreshTokenExpiresAt).Seconds())
+	}
+
+	authHandler.setCookie(c, jwtCookie, response.Token, jwtMaxAge, true)
+	authHandler.setCookie(c, rtCookie, response.RefreshToken, rtMaxAge, true)
+	if !authHandler.TOKEN_IN_BODY {
+		response.Token = ""
+		response.RefreshToken = ""
+	}
+
+	if authHandler.CSRF_ENABLED {
+		csrfToken, err := randomToken()
+		if err != nil {
+			GetLogger(c).Error("failed to generate csrf token", "error", err)
 			return
 		}
+		// Not HttpOnly, the front-end reads it to send it back in the X-CSRF-Token header
+		authHandler.setCookie(c, csrfCookie, csrfToken, rtMaxAge, false)
+	}
+}
 
-		err = func(c *gin.Context) error {
-			// If the token is expired, let's try to update it with the refresh token
-			if !errors.Is(err, jwt.ErrTokenExpired) {
-				return err
-			}
-			// This time, only getting the refresh token from the cookie. No header
-			rtToken, err := c.Cookie("rt")
+// clearSessionCookies expires the jwt and refresh token cookies, unless cookies are disabled.
+func (authHandler *AuthHandler) clearSessionCookies(c *gin.Context) {
+	if !authHandler.cookiesEnabled() {
+		return
+	}
 
-			if err != nil {
-				return err
-			}
-			// If we get a token, this part will handle all the logic. It means that it does not return to the main part.
-			rt, err := authHandler.RTService.GetRT(rtToken)
-			if err != nil {
-				return err
-			}
+	authHandler.setCookie(c, jwtCookie, "", -1, true)
+	authHandler.setCookie(c, rtCookie, "", -1, true)
+	authHandler.setCookie(c, csrfCookie, "", -1, false)
+}
 
-			// By default, without using the Preload method, the user will be an empty struct
-			if rt.User.ID == 0 {
-				return errors.New("token expired, unable to automatically refresh. Something went wrong retrieving the user")
-			}
+// cookiesEnabled reports whether the jwt and rt cookies are used, i.e. whether cookie is one of the TOKEN_SOURCES.
+func (authHandler *AuthHandler) cookiesEnabled() bool {
+	for _, source := range authHandler.TOKEN_SOURCES {
+		if source == config.TokenSourceCookie {
+			return true
+		}
+	}
 
-			c.Set("user", rt.User)
+	return false
+}
 
-			// Regenerating the cookie and putting it in the response's cookies
-			newJwt, err := authHandler.GenerateToken(&rt.User)
-			if err != nil {
-				fmt.Println(err)
-				return err
-			}
+// readToken returns the first token found in the TOKEN_SOURCES, in their configured order:
+// the named cookie, or the header read by fromHeader. It returns an empty string if there is none.
+func (authHandler *AuthHandler) readToken(c *gin.Context, cookie string, fromHeader func(c *gin.Context) string) string {
+	token, _ := authHandler.readTokenWithSource(c, cookie, fromHeader)
 
-			c.SetCookie("jwt", newJwt, 3600, "/", "*", false, true)
+	return token
+}
 
-			c.Next()
+// readTokenWithSource is readToken, also returning the source the token has been read from.
+func (authHandler *AuthHandler) readTokenWithSource(c *gin.Context, cookie string, fromHeader func(c *gin.Context) string) (string, string) {
+	for _, source := range authHandler.TOKEN_SOURCES {
+		var token string
+		switch source {
+		case config.TokenSourceCookie:
+			token = authHandler.cookie(c, cookie)
+		case config.TokenSourceHeader:
+			token = fromHeader(c)
+		}
+		if token != "" {
+			return token, source
+		}
+	}
 
-			return nil
-		}(c)
+	return "", ""
+}
 
-		if err != nil {
-			returnErrorWithAbort(err)
-			return
+// bearerToken returns the token of the Authorization header, using the Bearer prefix.
+func bearerToken(c *gin.Context) string {
+	splitToken := strings.Split(c.GetHeader("Authorization"), "Bearer ")
+	if len(splitToken) != 2 {
+		return ""
+	}
+
+	return splitToken[1]
+}
+
+// refreshTokenHeader returns the refresh token of the X-Refresh-Token header.
+func refreshTokenHeader(c *gin.Context) string {
+	return c.GetHeader(RefreshTokenHeader)
+}
+
+// ChangePassword godoc
+// @Summary      Change the password
+// @Description  change the current user's password. Every session of the user is revoked, it has to log in again. The current password and the PASSWORD_HISTORY previous ones can't be reused
+// @Tags         Auth
+// @Accept       json
+// @Produce      json
+// @Param        passwords  body      model.PasswordChangeDTO  true  "Current and new passwords"
+// @Success      200        {object}  MessageResponse
+// @Failure      400        {object}  ErrorResponse
+// @Failure      401        {object}  ErrorResponse
+// @Failure      422        {object}  ErrorResponse
+// @Router       /auth/password [put]
+/*
+ChangePassword checks the current password of the authenticated user, then updates it
+and revokes all the user's refresh tokens in a single transaction, so that the password
+is never changed while the old sessions remain. The current jwt is revoked and the
+cookies are cleared.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) ChangePassword(c *gin.Context) {
+	returnError := curryReturnError(c, false)
+
+	user, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+
+	var data *model.PasswordChangeDTO
+	if !bindJSON(c, &data) {
+		return
+	}
+
+	if data.NewPassword == "" {
+		returnError(errors.New("new password is required"))
+		return
+	}
+
+	if err := user.CheckPassword(data.CurrentPassword); err != nil {
+		respondError(c, http.StatusUnauthorized, "incorrect password")
+		return
+	}
+
+	err := authHandler.TxService.Transaction(c.Request.Context(), func(tx *service.TxServices) error {
+		if err := tx.UserService.UpdatePassword(c.Request.Context(), int(user.ID), data.NewPassword); err != nil {
+			return err
 		}
 
-		userId := token.Claims.(jwt.MapClaims)["id"].(float64)
-		user, err := authHandler.UserService.GetUser(int(userId))
-		if err != nil {
-			returnErrorWithAbort(err)
-			return
+		_, err := tx.RTService.RevokeAllForUser(c.Request.Context(), int(user.ID))
+		return err
+	})
+	if errors.Is(err, service.ErrPasswordReused) {
+		respondError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to change password", err)
+		return
+	}
+
+	authHandler.revokeCurrentToken(c)
+	authHandler.clearSessionCookies(c)
+	authHandler.Webhooks.Send(webhook.EventUserPasswordChanged, gin.H{
+		"userId": user.ID,
+	})
+	recordAudit(c, authHandler.AuditService, int(user.ID), model.AuditPasswordChanged, "changed by the user")
+
+	respond(c, 200, gin.H{
+		"message": "Password changed successfully, please log in again",
+	})
+}
+
+// DeleteMe godoc
+// @Summary      Delete the current User
+// @Description  delete the authenticated user's own account. The password is required, every session is revoked and the cookies are cleared
+// @Tags         Auth
+// @Accept       json
+// @Produce      json
+// @Param        confirmation  body      model.AccountDeleteDTO  true  "Password confirmation"
+// @Success      200           {object}  MessageResponse
+// @Failure      400           {object}  ErrorResponse
+// @Failure      401           {object}  ErrorResponse
+// @Router       /auth/me [delete]
+/*
+DeleteMe lets the authenticated user delete its own account. Re-entering the password is
+required so that a forged request or a stolen session can't delete the account. The user is
+soft deleted and all its refresh tokens are revoked in a single transaction, then the
+current jwt is revoked and the cookies are cleared.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) DeleteMe(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+
+	var data *model.AccountDeleteDTO
+	if !bindJSON(c, &data) {
+		return
+	}
+
+	if err := user.CheckPassword(data.Password); err != nil {
+		respondError(c, http.StatusUnauthorized, "incorrect password")
+		return
+	}
+
+	err := authHandler.TxService.Transaction(c.Request.Context(), func(tx *service.TxServices) error {
+		if _, err := tx.RTService.RevokeAllForUser(c.Request.Context(), int(user.ID)); err != nil {
+			return err
 		}
 
-		c.Set("user", user)
+		return tx.UserService.DeleteUser(c.Request.Context(), int(user.ID))
+	})
+	if err != nil {
+		respondInternalError(c, "failed to delete account", err)
+		return
+	}
+
+	authHandler.revokeCurrentToken(c)
+	authHandler.clearSessionCookies(c)
+	recordAudit(c, authHandler.AuditService, int(user.ID), model.AuditUserDeleted, "deleted by the user")
 
-		c.Next()
+	respond(c, 200, gin.H{
+		"message": "Account deleted successfully",
+	})
+}
 
-		// after request
+// revokeCurrentToken adds the jwt of the request to the denylist. Failures are logged, the jwt expires shortly anyway.
+func (authHandler *AuthHandler) revokeCurrentToken(c *gin.Context) {
+	claims, ok := CurrentClaims(c)
+	if !ok || claims.ID == "" || claims.ExpiresAt == nil {
+		return
+	}
+
+	if err := authHandler.RevokedTokenService.Revoke(c.Request.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+		GetLogger(c).Error("failed to revoke token", "error", err)
 	}
 }
 
-func curryReturnError(c *gin.Context, abort bool) func(err error) {
-	return func(err error) {
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+// Me godoc
+// @Summary      Get the current User
+// @Description  get the user authenticated by the jwt (cookie or bearer token)
+// @Tags         Auth
+// @Produce      json
+// @Success      200  {object}  model.UserResponseDTO
+// @Failure      401  {object}  ErrorResponse
+// @Router       /auth/me [get]
+/*
+Me returns the user set in the context by the AuthMiddleware, both on the normal jwt
+path and on the auto-refresh path.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) Me(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+
+	respond(c, 200, user.ToResponse())
+}
+
+// Logout godoc
+// @Summary      Log out
+// @Description  revoke the current jwt and refresh token, and clear the auth cookies
+// @Tags         Auth
+// @Produce      json
+// @Success      200  {object}  MessageResponse
+// @Failure      400  {object}  ErrorResponse
+// @Router       /auth/logout [post]
+/*
+Logout closes the current session. The jwt's jti is added to the denylist until the
+token's expiry so it is rejected immediately by the AuthMiddleware, the refresh token
+(from the cookie or the X-Refresh-Token header) is deleted and the cookies are cleared.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) Logout(c *gin.Context) {
+	returnError := curryReturnError(c, false)
+
+	claims, ok := CurrentClaims(c)
+	if !ok || claims.ID == "" {
+		returnError(errors.New("no token in the context"))
+		return
+	}
+
+	if claims.ExpiresAt == nil {
+		returnError(errors.New("token has no expiry"))
+		return
+	}
+
+	if err := authHandler.RevokedTokenService.Revoke(c.Request.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+		respondInternalError(c, "failed to revoke token", err)
+		return
+	}
+
+	if rtToken := authHandler.readToken(c, rtCookie, refreshTokenHeader); rtToken != "" {
+		if err := authHandler.RTService.DeleteRT(c.Request.Context(), rtToken); err != nil {
+			respondInternalError(c, "failed to delete refresh token", err)
+			return
+		}
+	}
+
+	authHandler.clearSessionCookies(c)
+	if user, ok := CurrentUser(c); ok {
+		authHandler.Webhooks.Send(webhook.EventSessionRevoked, gin.H{
+			"userId": user.ID,
+			"all":    false,
+		})
+		recordAudit(c, authHandler.AuditService, int(user.ID), model.AuditSessionRevoked, "logout")
+	}
+
+	respond(c, 200, gin.H{
+		"message": "Logged out successfully",
+	})
+}
+
+// ListSessions godoc
+// @Summary      List the sessions
+// @Description  list a page of the active sessions of the current user, the newest first, the refresh tokens themselves are never returned. The total count is set in the X-Total-Count header
+// @Tags         Auth
+// @Produce      json
+// @Param        page      query     integer  false  "Page number, from 1"
+// @Param        pageSize  query     integer  false  "Page size, up to 100"
+// @Success      200  {array}   model.SessionResponseDTO
+// @Header       200  {integer}  X-Total-Count  "Total number of active sessions"
+// @Failure      401  {object}  ErrorResponse
+// @Failure      422  {object}  ValidationErrorResponse
+// @Router       /auth/sessions [get]
+/*
+ListSessions lists the active sessions of the authenticated user, so that a device can be
+told apart and revoked with RevokeSession. The session of the refresh token sent with the
+request, if any, is flagged as current.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) ListSessions(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+
+	pagination := &model.PaginationQuery{}
+	if !bindQuery(c, pagination) {
+		return
+	}
+
+	tokens, total, err := authHandler.RTService.ListForUser(c.Request.Context(), int(user.ID), pagination.Options())
+	if err != nil {
+		respondInternalError(c, "failed to list sessions", err)
+		return
+	}
+
+	var currentHash string
+	if rtToken := authHandler.readToken(c, rtCookie, refreshTokenHeader); rtToken != "" {
+		currentHash = service.HashToken(rtToken)
+	}
+	sessions := make([]*model.SessionResponseDTO, 0, len(tokens))
+	for _, token := range tokens {
+		sessions = append(sessions, token.ToSessionResponse(token.Hash == currentHash))
+	}
+
+	c.Header(TotalCountHeader, strconv.FormatInt(total, 10))
+	setMeta(c, "total", total)
+	setMeta(c, "page", pagination.Page)
+	setMeta(c, "pageSize", pagination.PageSize)
+	respond(c, 200, sessions)
+}
+
+// RevokeSession godoc
+// @Summary      Log out a session
+// @Description  delete a refresh token of the current user by its session ID, clearing the auth cookies if it is the current one
+// @Tags         Auth
+// @Produce      json
+// @Param        id   path      int  true  "Session ID"
+// @Success      200  {object}  MessageResponse
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse
+// @Router       /auth/sessions/{id} [delete]
+/*
+RevokeSession closes one session of the authenticated user, e.g. a lost device listed by
+ListSessions. Its refresh token is deleted, so it can't refresh its jwt anymore, which then
+expires on its own. Revoking the current session also revokes the jwt of the request and
+clears the cookies, like Logout. The sessions of the other users are a 404.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) RevokeSession(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+	id, ok := parseIDParam(c, "id")
+	if !ok {
+		return
+	}
+
+	// Read before the deletion, the session can't be told apart afterwards
+	current := false
+	if rtToken := authHandler.readToken(c, rtCookie, refreshTokenHeader); rtToken != "" {
+		if rt, err := authHandler.RTService.GetRT(c.Request.Context(), rtToken); err == nil {
+			current = int(rt.ID) == id
+		}
+	}
+
+	err := authHandler.RTService.DeleteForUser(c.Request.Context(), int(user.ID), id)
+	if errors.Is(err, service.ErrSessionNotFound) {
+		respondError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to revoke session", err)
+		return
+	}
+
+	if current {
+		authHandler.revokeCurrentToken(c)
+		authHandler.clearSessionCookies(c)
+	}
+	authHandler.Webhooks.Send(webhook.EventSessionRevoked, gin.H{
+		"userId":    user.ID,
+		"sessionId": id,
+		"all":       false,
+	})
+	recordAudit(c, authHandler.AuditService, int(user.ID), model.AuditSessionRevoked, fmt.Sprintf("session %d", id))
+
+	respond(c, 200, gin.H{
+		"message": "Session revoked successfully",
+	})
+}
+
+// RevokeAllSessions godoc
+// @Summary      Log out everywhere
+// @Description  delete every refresh token of the current user, invalidate its jwt and clear the auth cookies
+// @Tags         Auth
+// @Produce      json
+// @Success      200  {object}  model.SessionsRevokedResponseDTO
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Router       /auth/sessions [delete]
+/*
+RevokeAllSessions logs the authenticated user out of every device. Its refresh tokens are
+deleted, and the stateless jwt issued so far are rejected by the AuthMiddleware from now on,
+through the user's TokensValidAfter. Both happen in a single transaction.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) RevokeAllSessions(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+
+	var revoked int64
+	err := authHandler.TxService.Transaction(c.Request.Context(), func(tx *service.TxServices) error {
+		if err := tx.UserService.InvalidateTokens(c.Request.Context(), int(user.ID)); err != nil {
+			return err
+		}
+
+		var err error
+		revoked, err = tx.RTService.RevokeAllForUser(c.Request.Context(), int(user.ID))
+		return err
+	})
+	if err != nil {
+		respondInternalError(c, "failed to revoke sessions", err)
+		return
+	}
+
+	// A token issued in the current second isn't caught by TokensValidAfter
+	authHandler.revokeCurrentToken(c)
+	authHandler.clearSessionCookies(c)
+	authHandler.Webhooks.Send(webhook.EventSessionRevoked, gin.H{
+		"userId": user.ID,
+		"all":    true,
+	})
+	recordAudit(c, authHandler.AuditService, int(user.ID), model.AuditSessionRevoked, fmt.Sprintf("all sessions, %d revoked", revoked))
+
+	respond(c, 200, &model.SessionsRevokedResponseDTO{
+		Message:         "Logged out of every session",
+		RevokedSessions: revoked,
+	})
+}
+
+/*
+AuthMiddleware is a middleware function that handles user authentication using JWT tokens.
+
+Parameters:
+- authHandler (*AuthHandler): A pointer to an AuthHandler instance containing the TokenManager.
+- c (*gin.Context): A pointer to the gin.Context instance.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func (authHandler *AuthHandler) AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// before request
+
+		// Every rejection aborts with a 401, and a failure to check the token with a 500, nothing after
+		// this middleware must run for an unauthenticated request
+		returnErrorWithAbort := curryReturnUnauthorized(c)
+
+		// The jwt is read from the jwt cookie and/or the Authorization header, as configured by TOKEN_SOURCES
+		jwtToken, source := authHandler.readTokenWithSource(c, jwtCookie, bearerToken)
+		if jwtToken == "" {
+			returnErrorWithAbort(errors.New("no token provided"))
+			return
+		}
+		c.Set(tokenSourceKey, source)
+
+		// A token expired for less than JWT_LEEWAY is still valid, only a genuine expiry beyond it goes through the auto refresh
+		claims, err := authHandler.parseToken(c.Request.Context(), jwtToken)
+		if err != nil && !errors.Is(err, auth.ErrTokenExpired) {
+			abortAuthError(c, err)
+			return
+		}
+
+		// An expired jwt is replaced by a new one if the refresh token of the session is still valid
+		if errors.Is(err, auth.ErrTokenExpired) {
+			user, newClaims, err := authHandler.refreshSession(c)
+			if err != nil {
+				metrics.TokenRefreshes.WithLabelValues(metrics.Result(false)).Inc()
+				switch {
+				case errors.Is(err, ErrAccountSuspended):
+					abortAccountSuspended(c)
+				case errors.Is(err, ErrPasswordChangeRequired):
+					abortWithError(c, http.StatusForbidden, err.Error())
+				default:
+					abortAuthError(c, err)
+				}
+				return
+			}
+			metrics.TokenRefreshes.WithLabelValues(metrics.Result(true)).Inc()
+
+			c.Set(userKey, user)
+			c.Set(claimsKey, newClaims)
+			c.Next()
+			return
+		}
+
+		user, err := authHandler.userOfClaims(c.Request.Context(), claims)
+		if errors.Is(err, ErrAccountSuspended) {
+			abortAccountSuspended(c)
+			return
+		}
+		if err != nil {
+			abortAuthError(c, err)
+			return
+		}
+		if authHandler.passwordChangeBlocks(c, user) {
+			abortWithError(c, http.StatusForbidden, ErrPasswordChangeRequired.Error())
+			return
+		}
+
+		c.Set(userKey, user)
+		c.Set(claimsKey, claims)
+
+		c.Next()
+
+		// after request
+	}
+}
+
+/*
+Authenticate checks a jwt like the AuthMiddleware, outside of an HTTP request, e.g. from the gRPC API:
+the token must be valid and not revoked, and its user still allowed to log in. An expired jwt isn't
+refreshed, the caller refreshes the session with RefreshSession.
+
+Parameters:
+- ctx (context.Context): The context of the call.
+- token (string): The signed jwt.
+
+Returns:
+- (*model.User): The user authenticated by the jwt.
+- (*auth.Claims): The claims of the jwt.
+- (error): The reason the jwt is rejected, e.g. auth.ErrTokenExpired or ErrAccountSuspended.
+*/
+func (authHandler *AuthHandler) Authenticate(ctx context.Context, token string) (*model.User, *auth.Claims, error) {
+	claims, err := authHandler.parseToken(ctx, token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := authHandler.userOfClaims(ctx, claims)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, claims, nil
+}
+
+// parseToken parses the jwt and checks that it isn't revoked. An expired one still returns its claims,
+// with auth.ErrTokenExpired.
+func (authHandler *AuthHandler) parseToken(ctx context.Context, token string) (*auth.Claims, error) {
+	claims, err := authHandler.TokenManager.Parse(token)
+	if err != nil && !errors.Is(err, auth.ErrTokenExpired) {
+		return nil, err
+	}
+
+	// A revoked token is rejected even if it could be refreshed, as the session has been logged out
+	if claims != nil && claims.ID != "" {
+		revoked, revokedErr := authHandler.RevokedTokenService.IsRevoked(ctx, claims.ID)
+		if revokedErr != nil {
+			return nil, revokedErr
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	return claims, err
+}
+
+// userOfClaims loads the user of the claims of a valid jwt, which must have been issued after its
+// last log out everywhere. ErrAccountSuspended is returned for a suspended user.
+func (authHandler *AuthHandler) userOfClaims(ctx context.Context, claims *auth.Claims) (*model.User, error) {
+	user, err := authHandler.UserService.GetUser(ctx, int(claims.UserID))
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.IssuedAt == nil || !user.AcceptsTokenIssuedAt(claims.IssuedAt.Time) {
+		return nil, ErrTokenRevoked
+	}
+	// A still valid jwt must not outlive the suspension
+	if user.IsSuspended() {
+		return nil, ErrAccountSuspended
+	}
+
+	return user, nil
+}
+
+/*
+refreshSession authenticates the request of an expired jwt with the refresh token of its session,
+read from the rt cookie and/or the X-Refresh-Token header for the clients that don't use cookies
+(mobile, native...). The session is extended and a new jwt is set as a cookie and/or in the
+X-New-Token header, before the handlers run so that their response keeps them.
+
+Parameters:
+- c (*gin.Context): A pointer to the gin.Context instance.
+
+Returns:
+- (*model.User): The user of the session, a *model.User like the one of a valid jwt.
+- (*auth.Claims): The claims of the new jwt.
+- (error): ErrSessionExpired if the refresh token is missing, unknown or expired, otherwise the
+reason the session can't be refreshed, e.g. ErrAccountSuspended.
+*/
+func (authHandler *AuthHandler) refreshSession(c *gin.Context) (*model.User, *auth.Claims, error) {
+	rtToken := authHandler.readToken(c, rtCookie, refreshTokenHeader)
+	user, newJwt, claims, err := authHandler.RefreshSession(c.Request.Context(), GetLogger(c), rtToken, c.GetBool(passwordChangeKey))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if authHandler.cookiesEnabled() {
+		authHandler.setCookie(c, jwtCookie, newJwt, 3600, true)
+	}
+	// Header based clients can't read the cookie, so the new token is also sent as a header. A client
+	// sending its jwt as a bearer token holds it anyway, it always gets the new one
+	if authHandler.TOKEN_IN_BODY || c.GetString(tokenSourceKey) == config.TokenSourceHeader {
+		c.Header(NewTokenHeader, newJwt)
+	}
+
+	return user, claims, nil
+}
+
+/*
+RefreshSession extends the session of the refresh token and generates a new jwt for its user, outside
+of an HTTP request, e.g. from the gRPC API. It is the refresh of the AuthMiddleware, without the cookies.
+
+Parameters:
+- ctx (context.Context): The context of the call.
+- logger (*slog.Logger): The logger of the call.
+- rtToken (string): The refresh token of the session.
+- allowPasswordChange (bool): Whether the session is refreshed to change the password, the users
+flagged with MustChangePassword are otherwise rejected with PASSWORD_CHANGE_GATE.
+
+Returns:
+- (*model.User): The user of the session.
+- (string): The new jwt.
+- (*auth.Claims): The claims of the new jwt.
+- (error): ErrSessionExpired if the refresh token is missing, unknown or expired, otherwise the
+reason the session can't be refreshed, e.g. ErrAccountSuspended, or a query error, see IsAuthError.
+*/
+func (authHandler *AuthHandler) RefreshSession(ctx context.Context, logger *slog.Logger, rtToken string, allowPasswordChange bool) (*model.User, string, *auth.Claims, error) {
+	if rtToken == "" {
+		return nil, "", nil, ErrSessionExpired
+	}
+	rt, err := authHandler.RTService.GetRT(ctx, rtToken)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", nil, ErrSessionExpired
+	}
+	// A failure to look the session up isn't its expiry, the callers answer it as an internal error
+	if err != nil {
+		return nil, "", nil, err
+	}
+	// The user is preloaded by GetRT, it is only empty if it has been deleted meanwhile
+	if rt.User.ID == 0 {
+		return nil, "", nil, ErrSessionExpired
+	}
+	user := &rt.User
+
+	// The sessions opened before a log out everywhere or a password change are closed
+	if !user.AcceptsTokenIssuedAt(rt.CreatedAt) {
+		return nil, "", nil, ErrSessionRevoked
+	}
+	// The tokens created before RT_ABSOLUTE_EXPIRY was set aren't capped by their expiry
+	if authHandler.RT_ABSOLUTE_EXPIRY > 0 && time.Since(rt.CreatedAt) > authHandler.RT_ABSOLUTE_EXPIRY {
+		return nil, "", nil, ErrSessionExpired
+	}
+	if user.IsSuspended() {
+		return nil, "", nil, ErrAccountSuspended
+	}
+	if !user.IsActive() {
+		return nil, "", nil, ErrAccountInactive
+	}
+	if authHandler.PasswordChangeRequired(user, allowPasswordChange) {
+		return nil, "", nil, ErrPasswordChangeRequired
+	}
+
+	if err := authHandler.RTService.ExtendRT(ctx, rt, authHandler.RT_IDLE_EXPIRY, authHandler.RT_ABSOLUTE_EXPIRY); err != nil {
+		logger.Error("failed to extend refresh token", "error", err)
+		return nil, "", nil, err
+	}
+
+	newJwt, claims, err := authHandler.generateToken(ctx, user)
+	if err != nil {
+		logger.Error("failed to regenerate token", "error", err)
+		return nil, "", nil, err
+	}
+
+	return user, newJwt, claims, nil
+}
+
+/*
+AllowPasswordChange is a middleware marking the route as the one changing the password, it must
+be used before the AuthMiddleware. The users flagged with MustChangePassword, e.g. after an admin
+reset, are rejected with a 403 by the AuthMiddleware on every other route while PASSWORD_CHANGE_GATE
+is enabled. Changing the password clears the flag.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func (authHandler *AuthHandler) AllowPasswordChange() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(passwordChangeKey, true)
+		c.Next()
+	}
+}
+
+// passwordChangeBlocks reports whether the user must change its password before using this route.
+func (authHandler *AuthHandler) passwordChangeBlocks(c *gin.Context, user *model.User) bool {
+	return authHandler.PasswordChangeRequired(user, c.GetBool(passwordChangeKey))
+}
+
+// PasswordChangeRequired reports whether the user is held back by PASSWORD_CHANGE_GATE until it changes its
+// password, unless allowed is set for the calls changing it.
+func (authHandler *AuthHandler) PasswordChangeRequired(user *model.User, allowed bool) bool {
+	return authHandler.PASSWORD_CHANGE_GATE && user.MustChangePassword && !allowed
+}
+
+/*
+RequireAdmin is a middleware that only lets admin users through. It must be used after
+the AuthMiddleware, which sets the user in the context.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware. It aborts with a 401 if there
+is no user in the context, and a 403 if the user is not an admin.
+*/
+func (authHandler *AuthHandler) RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := CurrentUser(c)
+		if !ok {
+			abortWithError(c, http.StatusUnauthorized, "no user in the context")
+			return
+		}
+
+		if !user.IsAdmin() {
+			abortWithError(c, http.StatusForbidden, "admin role required")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+/*
+RequirePermission is a middleware that only lets through the users holding the permission,
+granted to them or to their role, and the admins. It must be used after the AuthMiddleware.
+
+The permissions embedded in the jwt are used while they are up to date, a grant or a revoke
+bumps the PermissionsVersion of the users it affects and their permissions are then loaded
+from the database until their token is renewed. They are cached for the rest of the request,
+so that several RequirePermission cost a single load.
+
+Parameters:
+- permission (string): The name of the required permission, e.g. "users:export".
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware. It aborts with a 401 if there
+is no user in the context, and a 403 if the user lacks the permission.
+*/
+func (authHandler *AuthHandler) RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := CurrentUser(c)
+		if !ok {
+			abortWithError(c, http.StatusUnauthorized, "no user in the context")
+			return
+		}
+
+		if user.IsAdmin() {
+			c.Next()
+			return
+		}
+
+		permissions, err := authHandler.permissions(c, user)
+		if err != nil {
+			GetLogger(c).Error("failed to load permissions", "error", err)
+			abortWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if !slices.Contains(permissions, permission) {
+			abortWithError(c, http.StatusForbidden, fmt.Sprintf("%s permission required", permission))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// permissions returns the effective permissions of the user, from the claims of its token when
+// they match its PermissionsVersion, otherwise from the database, and caches them in the context.
+func (authHandler *AuthHandler) permissions(c *gin.Context, user *model.User) ([]string, error) {
+	if value, ok := c.Get(permissionsKey); ok {
+		return value.([]string), nil
+	}
+
+	claims, _ := CurrentClaims(c)
+	permissions, err := authHandler.EffectivePermissions(c.Request.Context(), user, claims)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(permissionsKey, permissions)
+
+	return permissions, nil
+}
+
+/*
+EffectivePermissions returns the permissions of the user authenticated by claims: those embedded in
+the jwt while they match the PermissionsVersion of the user, otherwise those of the database, so that
+a grant or a revoke is applied without waiting for the jwt to expire.
+
+Parameters:
+- ctx (context.Context): The context of the call.
+- user (*model.User): The authenticated user.
+- claims (*auth.Claims): The claims of its jwt, nil for the credentials without them, e.g. an API key.
+
+Returns:
+- ([]string): The names of the permissions of the user.
+- (error): An error if the permissions had to be loaded and the query failed.
+*/
+func (authHandler *AuthHandler) EffectivePermissions(ctx context.Context, user *model.User, claims *auth.Claims) ([]string, error) {
+	if claims != nil {
+		if permissions, version, ok := auth.PermissionsFromClaims(claims); ok && version == user.PermissionsVersion {
+			return permissions, nil
+		}
+	}
+
+	return authHandler.PermissionService.GetPermissions(ctx, user)
+}
+
+/*
+CurrentUser returns the user set in the context by the AuthMiddleware.
+
+Parameters:
+- c (*gin.Context): A pointer to the gin.Context instance.
+
+Returns:
+- (*model.User): The authenticated user, nil if there is none.
+- (bool): Whether a user is set in the context.
+*/
+func CurrentUser(c *gin.Context) (*model.User, bool) {
+	value, exists := c.Get(userKey)
+	if !exists {
+		return nil, false
+	}
+
+	user, ok := value.(*model.User)
+	if !ok || user == nil {
+		return nil, false
+	}
+
+	return user, true
+}
+
+/*
+CurrentClaims returns the claims of the jwt of the request, set in the context by the AuthMiddleware.
+After an automatic refresh, they are the claims of the new jwt.
+
+Parameters:
+- c (*gin.Context): A pointer to the gin.Context instance.
+
+Returns:
+- (*auth.Claims): The claims, nil if there are none.
+- (bool): Whether claims are set in the context, they aren't for an API key.
+*/
+func CurrentClaims(c *gin.Context) (*auth.Claims, bool) {
+	value, exists := c.Get(claimsKey)
+	if !exists {
+		return nil, false
+	}
+
+	claims, ok := value.(*auth.Claims)
+	if !ok || claims == nil {
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// writeAccountSuspended answers the authentication attempt of a suspended user with a 403.
+func writeAccountSuspended(c *gin.Context) {
+	respondError(c, http.StatusForbidden, ErrAccountSuspended.Error())
+}
+
+// abortAccountSuspended is writeAccountSuspended for the middlewares, nothing after them runs.
+func abortAccountSuspended(c *gin.Context) {
+	abortWithError(c, http.StatusForbidden, ErrAccountSuspended.Error())
+}
+
+/*
+IsAuthError reports whether err, returned by Authenticate or RefreshSession, rejects the credentials:
+an invalid, expired or revoked jwt or session, or a user who no longer exists or isn't active. The
+other errors are failures to check them, e.g. of the database, whose message isn't for the clients.
+*/
+func IsAuthError(err error) bool {
+	return auth.IsTokenError(err) || errors.Is(err, ErrTokenRevoked) || errors.Is(err, ErrSessionRevoked) ||
+		errors.Is(err, ErrSessionExpired) || errors.Is(err, ErrAccountInactive) || errors.Is(err, service.ErrUserNotFound)
+}
+
+// abortAuthError aborts the authentication with a 401 for a rejected jwt or session, and logs any other
+// error and aborts with a 500 like respondInternalError.
+func abortAuthError(c *gin.Context, err error) {
+	if IsAuthError(err) {
+		abortWithError(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+	GetLogger(c).Error("failed to authenticate", "error", err)
+	abortWithError(c, http.StatusInternalServerError, err.Error())
+}
+
+func curryReturnUnauthorized(c *gin.Context) func(err error) {
+	return func(err error) {
+		abortWithError(c, http.StatusUnauthorized, err.Error())
+	}
+}
+
+// curryReturnError answers the errors caused by the request with a 400 and their message. The
+// unexpected failures go through respondInternalError instead, their message isn't for the clients.
+func curryReturnError(c *gin.Context, abort bool) func(err error) {
+	return func(err error) {
+		respondError(c, 400, err.Error())
 
 		if abort {
 			c.Abort()
@@ -0,0 +1,829 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/auth"
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       any
+		wantStatus int
+	}{
+		{
+			name:       "valid credentials",
+			body:       model.LoginDTO{Email: "alice@example.com", Password: testutil.DefaultPassword},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "email as identifier",
+			body:       model.LoginDTO{Identifier: "alice@example.com", Password: testutil.DefaultPassword},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "username as identifier",
+			body:       model.LoginDTO{Identifier: "alice", Password: testutil.DefaultPassword},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "username is normalized",
+			body:       model.LoginDTO{Identifier: " Alice", Password: testutil.DefaultPassword},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "identifier takes precedence over email",
+			body:       model.LoginDTO{Identifier: "alice", Email: "nobody@example.com", Password: testutil.DefaultPassword},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unknown username",
+			body:       model.LoginDTO{Identifier: "nobody", Password: testutil.DefaultPassword},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong password with username",
+			body:       model.LoginDTO{Identifier: "alice", Password: "wrong password"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing identifier",
+			body:       gin.H{"password": testutil.DefaultPassword},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "wrong password",
+			body:       model.LoginDTO{Email: "alice@example.com", Password: "wrong password"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "unknown email",
+			body:       model.LoginDTO{Email: "nobody@example.com", Password: testutil.DefaultPassword},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "suspended user",
+			body:       model.LoginDTO{Email: "suspended@example.com", Password: testutil.DefaultPassword},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "email is trimmed",
+			body:       model.LoginDTO{Email: " alice@example.com ", Password: testutil.DefaultPassword},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "identifier is trimmed",
+			body:       model.LoginDTO{Identifier: "alice@example.com\t", Password: testutil.DefaultPassword},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "password isn't trimmed",
+			body:       model.LoginDTO{Email: "alice@example.com", Password: testutil.DefaultPassword + " "},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing password",
+			body:       gin.H{"email": "alice@example.com"},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "malformed body",
+			body:       `{"email":`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com", Username: "alice"})
+			testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "suspended@example.com", Status: model.StatusSuspended})
+
+			w := s.do(t, "POST", "/api/v1/auth/login", "", tt.body)
+			expectStatus(t, w, tt.wantStatus)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var response model.LoginResponseDTO
+			testutil.DecodeJSON(t, w, &response)
+			if response.Token == "" || response.RefreshToken == "" || response.User.Email != "alice@example.com" {
+				t.Errorf("login response = %+v, want the tokens of alice", response)
+			}
+
+			// The issued jwt authenticates the user
+			w = s.do(t, "GET", "/api/v1/auth/me", response.Token, nil)
+			expectStatus(t, w, http.StatusOK)
+		})
+	}
+}
+
+func TestJSONContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		wantStatus  int
+	}{
+		{"json", "POST", "/api/v1/auth/login", "application/json", http.StatusOK},
+		{"json with charset", "POST", "/api/v1/auth/login", "application/json; charset=utf-8", http.StatusOK},
+		{"no content type", "POST", "/api/v1/auth/login", "", http.StatusUnsupportedMediaType},
+		{"plain text", "POST", "/api/v1/auth/login", "text/plain", http.StatusUnsupportedMediaType},
+		{"form", "POST", "/api/v1/auth/login", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"update without content type", "PUT", "/api/v1/user/:id", "", http.StatusUnsupportedMediaType},
+		{"update as plain text", "PUT", "/api/v1/user/:id", "text/plain", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			user, token := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+
+			body := fmt.Sprintf(`{"email":"alice@example.com","password":%q}`, testutil.DefaultPassword)
+			req := httptest.NewRequest(tt.method, strings.Replace(tt.path, ":id", fmt.Sprint(user.ID), 1), strings.NewReader(body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			testutil.WithBearer(req, token)
+
+			w := testutil.Do(s.router, req)
+			expectStatus(t, w, tt.wantStatus)
+		})
+	}
+}
+
+func TestLoginTokensOnly(t *testing.T) {
+	tests := []struct {
+		name       string
+		userInBody bool
+		tokensOnly bool
+		wantUser   bool
+	}{
+		{"default", true, false, true},
+		{"tokensOnly requested", true, true, false},
+		{"LOGIN_RESPONSE_USER off", false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(conf *config.Config) { conf.LOGIN_RESPONSE_USER = tt.userInBody })
+			testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+
+			w := s.do(t, "POST", "/api/v1/auth/login", "", model.LoginDTO{Email: "alice@example.com", Password: testutil.DefaultPassword, TokensOnly: tt.tokensOnly})
+			expectStatus(t, w, http.StatusOK)
+			var response map[string]any
+			testutil.DecodeJSON(t, w, &response)
+			if _, gotUser := response["user"]; gotUser != tt.wantUser {
+				t.Errorf("login response = %v, want the user: %v", response, tt.wantUser)
+			}
+			token, _ := response["token"].(string)
+			if token == "" || response["refreshToken"] == "" || response["sessionId"] == nil {
+				t.Fatalf("login response = %v, want the tokens and the session", response)
+			}
+
+			// The user is still one request away
+			w = s.do(t, "GET", "/api/v1/auth/me", token, nil)
+			expectStatus(t, w, http.StatusOK)
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	s := newTestServer(t, nil)
+	testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com", Username: "alice"})
+
+	tests := []struct {
+		name       string
+		body       any
+		wantStatus int
+	}{
+		{"new user", gin.H{"email": "bob@example.com", "password": "password", "username": "Bob"}, http.StatusCreated},
+		{"duplicate email", gin.H{"email": "alice@example.com", "password": "password"}, http.StatusConflict},
+		{"duplicate username", gin.H{"email": "carol@example.com", "password": "password", "username": " ALICE "}, http.StatusConflict},
+		{"invalid username", gin.H{"email": "carol@example.com", "password": "password", "username": "a"}, http.StatusUnprocessableEntity},
+		{"invalid email", gin.H{"email": "carol", "password": "password"}, http.StatusUnprocessableEntity},
+		// bcrypt can't hash more than 72 bytes, whatever the characters
+		{"password too long", gin.H{"email": "carol@example.com", "password": strings.Repeat("a", 73)}, http.StatusUnprocessableEntity},
+		{"multibyte password too long", gin.H{"email": "carol@example.com", "password": strings.Repeat("é", 37)}, http.StatusUnprocessableEntity},
+		{"multibyte password", gin.H{"email": "dave@example.com", "password": strings.Repeat("é", 36)}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do(t, "POST", "/api/v1/auth/register", "", tt.body)
+			expectStatus(t, w, tt.wantStatus)
+		})
+	}
+
+	// The registered user can log in with its password
+	w := s.do(t, "POST", "/api/v1/auth/login", "", model.LoginDTO{Email: "bob@example.com", Password: "password"})
+	expectStatus(t, w, http.StatusOK)
+	var response model.LoginResponseDTO
+	testutil.DecodeJSON(t, w, &response)
+	if response.User.Username == nil || *response.User.Username != "bob" {
+		t.Errorf("username = %v, want the normalized bob", response.User.Username)
+	}
+}
+
+func TestEmailCanonicalForm(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	// The emails are stored lowercased, and every lookup lowercases them too rather than relying on the collation
+	w := s.do(t, "POST", "/api/v1/auth/register", "", gin.H{"email": " Carol@Example.COM", "password": "password"})
+	expectStatus(t, w, http.StatusCreated)
+	var user model.User
+	if err := s.db.First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "carol@example.com" {
+		t.Errorf("email = %q, want carol@example.com", user.Email)
+	}
+
+	expectStatus(t, s.do(t, "POST", "/api/v1/auth/register", "", gin.H{"email": "carol@EXAMPLE.com", "password": "password"}), http.StatusConflict)
+
+	w = s.do(t, "GET", "/api/v1/user/check-email?email=CAROL@example.com", "", nil)
+	expectStatus(t, w, http.StatusOK)
+	var availability model.EmailAvailabilityDTO
+	testutil.DecodeJSON(t, w, &availability)
+	if availability.Available || availability.Email != user.Email {
+		t.Errorf("check-email = %+v, want the stored email unavailable", availability)
+	}
+
+	for _, login := range []model.LoginDTO{{Email: "CAROL@example.com", Password: "password"}, {Identifier: "Carol@Example.com", Password: "password"}} {
+		expectStatus(t, s.do(t, "POST", "/api/v1/auth/login", "", login), http.StatusOK)
+	}
+}
+
+func TestRegisterDefaultRole(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		role     string
+		wantRole string
+	}{
+		{"signup without role", "/api/v1/auth/register", "", "", model.DefaultRole},
+		{"signup as admin", "/api/v1/auth/register", "", model.RoleAdmin, model.DefaultRole},
+		{"created by an admin", "/api/v1/user/", adminToken, "", model.DefaultRole},
+		{"created as admin by an admin", "/api/v1/user/", adminToken, model.RoleAdmin, model.RoleAdmin},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := gin.H{"email": fmt.Sprintf("user%d@example.com", i), "password": "password"}
+			if tt.role != "" {
+				body["role"] = tt.role
+			}
+			w := s.do(t, "POST", tt.path, tt.token, body)
+			if w.Code != http.StatusCreated && w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want the user created, body: %s", w.Code, w.Body.String())
+			}
+
+			user, err := s.auth.UserService.GetUserByEmail(context.Background(), body["email"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Role != tt.wantRole {
+				t.Errorf("role = %q, want %q", user.Role, tt.wantRole)
+			}
+		})
+	}
+}
+
+func TestRegistrationDisabled(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) { conf.REGISTRATION_ENABLED = false })
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+
+	w := s.do(t, "POST", "/api/v1/auth/register", "", gin.H{"email": "bob@example.com", "password": "password"})
+	expectStatus(t, w, http.StatusForbidden)
+
+	// The admins still create the accounts
+	w = s.do(t, "POST", "/api/v1/user/", adminToken, gin.H{"email": "bob@example.com", "password": "password"})
+	expectStatus(t, w, http.StatusOK)
+	login(t, s, "bob@example.com", "password")
+}
+
+func TestAuthMiddlewareRefresh(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.JWT_LEEWAY = 0
+	})
+	user := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+
+	rt, err := s.auth.RTService.CreateRT(context.Background(), "192.0.2.1", int(user.ID), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredRT, err := s.auth.RTService.CreateRT(context.Background(), "192.0.2.2", int(user.ID), -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := auth.NewTokenManager(testutil.JWTSecret, -time.Minute, auth.TokenOptions{}).Generate(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		refreshToken string
+		wantStatus   int
+	}{
+		{"valid refresh token", rt.Token, http.StatusOK},
+		{"no refresh token", "", http.StatusUnauthorized},
+		{"unknown refresh token", "unknown", http.StatusUnauthorized},
+		{"expired refresh token", expiredRT.Token, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := testutil.WithBearer(testutil.JSONRequest(t, "GET", "/api/v1/auth/me", nil), expired)
+			if tt.refreshToken != "" {
+				req.Header.Set(RefreshTokenHeader, tt.refreshToken)
+			}
+
+			w := testutil.Do(s.router, req)
+			expectStatus(t, w, tt.wantStatus)
+			if tt.wantStatus != http.StatusOK {
+				// The parse error of the expired jwt isn't leaked
+				var got ErrorResponse
+				testutil.DecodeJSON(t, w, &got)
+				if got.Error != ErrSessionExpired.Error() {
+					t.Errorf("error = %q, want %q", got.Error, ErrSessionExpired.Error())
+				}
+				return
+			}
+
+			// The new jwt is usable on its own
+			newToken := w.Header().Get(NewTokenHeader)
+			if newToken == "" {
+				t.Fatalf("no %s header in the refreshed response", NewTokenHeader)
+			}
+			expectStatus(t, s.do(t, "GET", "/api/v1/auth/me", newToken, nil), http.StatusOK)
+		})
+	}
+
+	// The handlers after the middleware run once for a refreshed request, with the user of the session
+	calls := 0
+	s.router.GET("/refreshed", s.auth.AuthMiddleware(), func(c *gin.Context) {
+		calls++
+		if current, ok := CurrentUser(c); !ok || current.ID != user.ID {
+			t.Errorf("current user = %v, want %d", current, user.ID)
+		}
+		c.Status(http.StatusNoContent)
+	})
+	req := testutil.WithBearer(testutil.JSONRequest(t, "GET", "/refreshed", nil), expired)
+	req.Header.Set(RefreshTokenHeader, rt.Token)
+	expectStatus(t, testutil.Do(s.router, req), http.StatusNoContent)
+	if calls != 1 {
+		t.Errorf("the handler ran %d times, want once", calls)
+	}
+}
+
+func TestAuthMiddlewareRefreshedContext(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.JWT_LEEWAY = 0
+		conf.TOKEN_IN_BODY = false
+	})
+	user, valid := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+	expired, _, err := auth.NewTokenManager(testutil.JWTSecret, -time.Minute, auth.TokenOptions{}).Generate(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotUser any
+	s.router.GET("/context", s.auth.AuthMiddleware(), func(c *gin.Context) {
+		gotUser, _ = c.Get(userKey)
+		c.Status(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name          string
+		jwt           string
+		cookies       bool
+		wantNewHeader bool
+	}{
+		{"valid bearer jwt", valid, false, false},
+		{"refreshed bearer jwt", expired, false, true},
+		{"valid jwt cookie", valid, true, false},
+		// Without TOKEN_IN_BODY, the cookie clients only get the new jwt as a cookie
+		{"refreshed jwt cookie", expired, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, err := s.auth.RTService.CreateRT(context.Background(), "192.0.2.1", int(user.ID), time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotUser = nil
+			req := testutil.JSONRequest(t, "GET", "/context", nil)
+			if tt.cookies {
+				req.AddCookie(&http.Cookie{Name: jwtCookie, Value: tt.jwt})
+				req.AddCookie(&http.Cookie{Name: rtCookie, Value: rt.Token})
+			} else {
+				testutil.WithBearer(req, tt.jwt)
+				req.Header.Set(RefreshTokenHeader, rt.Token)
+			}
+			w := testutil.Do(s.router, req)
+			expectStatus(t, w, http.StatusNoContent)
+
+			if current, ok := gotUser.(*model.User); !ok || current.ID != user.ID {
+				t.Errorf("context user = %#v, want the *model.User %d", gotUser, user.ID)
+			}
+			newToken := w.Header().Get(NewTokenHeader)
+			if (newToken != "") != tt.wantNewHeader {
+				t.Fatalf("%s header = %q, want it set: %v", NewTokenHeader, newToken, tt.wantNewHeader)
+			}
+			if newToken != "" {
+				expectStatus(t, s.do(t, "GET", "/api/v1/auth/me", newToken, nil), http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareRejectsInvalidTokens(t *testing.T) {
+	s := newTestServer(t, nil)
+	user := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+	forged, _, err := auth.NewTokenManager("another-secret-at-least-32-bytes-long", time.Hour, auth.TokenOptions{}).Generate(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{"no token": "", "malformed token": "not a jwt", "forged token": forged} {
+		t.Run(name, func(t *testing.T) {
+			expectStatus(t, s.do(t, "GET", "/api/v1/auth/me", token, nil), http.StatusUnauthorized)
+		})
+	}
+}
+
+func TestAuthMiddlewareDatabaseFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		table      string
+		credential string
+	}{
+		{"revocation check", "revoked_tokens", "jwt"},
+		{"user lookup", "users", "jwt"},
+		{"refresh token lookup", "refresh_tokens", "expired jwt"},
+		{"api key lookup", "api_keys", "api key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(conf *config.Config) {
+				conf.JWT_LEEWAY = 0
+			})
+			user, token := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+			req := testutil.WithBearer(testutil.JSONRequest(t, "GET", fmt.Sprintf("/api/v1/user/%d", user.ID), nil), token)
+			switch tt.credential {
+			case "expired jwt":
+				rt, err := s.auth.RTService.CreateRT(context.Background(), "192.0.2.1", int(user.ID), time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expired, _, err := auth.NewTokenManager(testutil.JWTSecret, -time.Minute, auth.TokenOptions{}).Generate(user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req = testutil.WithBearer(testutil.JSONRequest(t, "GET", fmt.Sprintf("/api/v1/user/%d", user.ID), nil), expired)
+				req.Header.Set(RefreshTokenHeader, rt.Token)
+			case "api key":
+				key, err := service.NewApiKeyService(s.db).Create(context.Background(), int(user.ID), &model.ApiKeyCreateDTO{Name: "reader", Scopes: []string{model.ScopeUserRead}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				req = testutil.JSONRequest(t, "GET", fmt.Sprintf("/api/v1/user/%d", user.ID), nil)
+				req.Header.Set(ApiKeyHeader, key.Key)
+			}
+
+			err := s.db.Callback().Query().Before("gorm:query").Register("test:fail", func(tx *gorm.DB) {
+				if tx.Statement.Table == tt.table {
+					tx.AddError(errors.New("database is locked"))
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The failure isn't a rejection of the credentials, and its message stays in the logs
+			w := testutil.Do(s.router, req)
+			expectStatus(t, w, http.StatusInternalServerError)
+			if strings.Contains(w.Body.String(), "database is locked") {
+				t.Errorf("body = %s, want the database error hidden", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	s := newTestServer(t, nil)
+	ok := func(c *gin.Context) { respond(c, http.StatusOK, gin.H{}) }
+	s.router.GET("/export", s.auth.AuthMiddleware(), s.auth.RequirePermission("users:export"), ok)
+	s.router.GET("/report", s.auth.AuthMiddleware(), s.auth.RequirePermission("reports:read"), s.auth.RequirePermission("users:export"), ok)
+	permissions := s.auth.PermissionService
+	ctx := context.Background()
+
+	alice := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+	bob := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "bob@example.com"})
+	testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+	if err := permissions.GrantToUser(ctx, int(alice.ID), "users:export"); err != nil {
+		t.Fatal(err)
+	}
+	if err := permissions.GrantToRole(ctx, model.RoleUser, "reports:read"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		email      string
+		path       string
+		wantStatus int
+	}{
+		{"granted to the user", "alice@example.com", "/export", http.StatusOK},
+		{"granted to the user and the role", "alice@example.com", "/report", http.StatusOK},
+		{"not granted", "bob@example.com", "/export", http.StatusForbidden},
+		{"granted to the role only", "bob@example.com", "/report", http.StatusForbidden},
+		{"admin", "admin@example.com", "/report", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, s.do(t, "GET", tt.path, login(t, s, tt.email, testutil.DefaultPassword), nil), tt.wantStatus)
+		})
+	}
+
+	t.Run("embedded in the jwt", func(t *testing.T) {
+		token := login(t, s, "alice@example.com", testutil.DefaultPassword)
+		// Removing the grant behind the service's back doesn't bump the version, the claims are still trusted
+		if err := s.db.Exec("DELETE FROM user_permissions").Error; err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(t, s.do(t, "GET", "/export", token, nil), http.StatusOK)
+		if err := permissions.GrantToUser(ctx, int(alice.ID), "users:export"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("stale jwt after a revoke", func(t *testing.T) {
+		token := login(t, s, "alice@example.com", testutil.DefaultPassword)
+		if err := permissions.RevokeFromUser(ctx, int(alice.ID), "users:export"); err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(t, s.do(t, "GET", "/export", token, nil), http.StatusForbidden)
+	})
+
+	t.Run("stale jwt after a grant", func(t *testing.T) {
+		token := login(t, s, "bob@example.com", testutil.DefaultPassword)
+		if err := permissions.GrantToUser(ctx, int(bob.ID), "users:export"); err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(t, s.do(t, "GET", "/export", token, nil), http.StatusOK)
+	})
+
+	t.Run("stale jwt after a role revoke", func(t *testing.T) {
+		token := login(t, s, "bob@example.com", testutil.DefaultPassword)
+		expectStatus(t, s.do(t, "GET", "/report", token, nil), http.StatusOK)
+		if err := permissions.RevokeFromRole(ctx, model.RoleUser, "reports:read"); err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(t, s.do(t, "GET", "/report", token, nil), http.StatusForbidden)
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		expectStatus(t, s.do(t, "GET", "/export", "", nil), http.StatusUnauthorized)
+	})
+}
+
+func TestAuthMiddlewareSessionExpiry(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.JWT_LEEWAY = 0
+		conf.RT_IDLE_EXPIRY = time.Hour
+		conf.RT_ABSOLUTE_EXPIRY = 4 * time.Hour
+	})
+	user := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+	expired, _, err := auth.NewTokenManager(testutil.JWTSecret, -time.Minute, auth.TokenOptions{}).Generate(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The session is idle from the login, its refresh token first lives RT_IDLE_EXPIRY
+	w := s.do(t, "POST", "/api/v1/auth/login", "", model.LoginDTO{Email: "alice@example.com", Password: testutil.DefaultPassword, RememberMe: true})
+	expectStatus(t, w, http.StatusOK)
+	var response model.LoginResponseDTO
+	testutil.DecodeJSON(t, w, &response)
+	if until := time.Until(response.RefreshTokenExpiresAt); until > time.Hour || until < 59*time.Minute {
+		t.Errorf("refresh token expires in %v, want RT_IDLE_EXPIRY", until)
+	}
+
+	tests := []struct {
+		name string
+		// age is how long ago the session was opened, idle how long ago the token was last refreshed
+		age, idle  time.Duration
+		wantStatus int
+		// wantExpiry is how long the refreshed session has left
+		wantExpiry time.Duration
+	}{
+		{"active session", 2 * time.Hour, 10 * time.Minute, http.StatusOK, time.Hour},
+		{"idle timeout", 2 * time.Hour, 90 * time.Minute, http.StatusUnauthorized, 0},
+		{"capped by the absolute expiry", 210 * time.Minute, 10 * time.Minute, http.StatusOK, 30 * time.Minute},
+		{"past the absolute expiry", 5 * time.Hour, 10 * time.Minute, http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, err := s.auth.RTService.CreateRT(context.Background(), "192.0.2.1", int(user.ID), time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.db.Model(rt).UpdateColumns(map[string]any{
+				"created_at": time.Now().Add(-tt.age),
+				"expires_at": time.Now().Add(time.Hour - tt.idle),
+			}).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := testutil.WithBearer(testutil.JSONRequest(t, "GET", "/api/v1/auth/me", nil), expired)
+			req.Header.Set(RefreshTokenHeader, rt.Token)
+			expectStatus(t, testutil.Do(s.router, req), tt.wantStatus)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			refreshed := &model.RefreshToken{}
+			if err := s.db.First(refreshed, rt.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if until := time.Until(refreshed.ExpiresAt); until > tt.wantExpiry || until < tt.wantExpiry-time.Minute {
+				t.Errorf("refreshed session expires in %v, want %v", until, tt.wantExpiry)
+			}
+		})
+	}
+}
+
+func TestMaxSessionsPerUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		// ips are the addresses of the successive logins, the last one being checked
+		ips        []string
+		wantStatus int
+		// wantEvicted is the index of the login whose session is gone, -1 for none
+		wantEvicted int
+	}{
+		{"under the limit", config.SessionLimitReject, []string{"192.0.2.1", "192.0.2.2"}, http.StatusOK, -1},
+		{"reject at the limit", config.SessionLimitReject, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, http.StatusForbidden, -1},
+		{"reject replaces the session of the same ip", config.SessionLimitReject, []string{"192.0.2.1", "192.0.2.2", "192.0.2.2"}, http.StatusOK, 1},
+		{"evict under the limit", config.SessionLimitEvictOldest, []string{"192.0.2.1", "192.0.2.2"}, http.StatusOK, -1},
+		{"evict the oldest at the limit", config.SessionLimitEvictOldest, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(conf *config.Config) {
+				conf.MAX_SESSIONS_PER_USER = 2
+				conf.SESSION_LIMIT_POLICY = tt.policy
+			})
+			testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+
+			var refreshTokens []string
+			var w *httptest.ResponseRecorder
+			for _, ip := range tt.ips {
+				req := testutil.JSONRequest(t, "POST", "/api/v1/auth/login", model.LoginDTO{Email: "alice@example.com", Password: testutil.DefaultPassword})
+				req.RemoteAddr = ip + ":12345"
+				w = testutil.Do(s.router, req)
+
+				var response model.LoginResponseDTO
+				testutil.DecodeJSON(t, w, &response)
+				refreshTokens = append(refreshTokens, response.RefreshToken)
+			}
+			expectStatus(t, w, tt.wantStatus)
+
+			for i, token := range refreshTokens[:len(refreshTokens)-1] {
+				_, err := s.auth.RTService.GetRT(context.Background(), token)
+				if evicted := err != nil; evicted != (i == tt.wantEvicted) {
+					t.Errorf("session %d evicted = %v, want %v", i, evicted, i == tt.wantEvicted)
+				}
+			}
+		})
+	}
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		wantStatus int
+		wantPrefix string
+	}{
+		{"bcrypt hash migrated", testutil.DefaultPassword, http.StatusOK, "$argon2id$"},
+		{"wrong password left alone", "wrong password", http.StatusUnauthorized, "$2a$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			// Seeded with bcrypt, as before PASSWORD_HASHER=argon2id
+			user, _ := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+			previous := model.PasswordHasher
+			model.PasswordHasher = model.Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}
+			t.Cleanup(func() { model.PasswordHasher = previous })
+
+			w := s.do(t, "POST", "/api/v1/auth/login", "", model.LoginDTO{Email: "alice@example.com", Password: tt.password})
+			expectStatus(t, w, tt.wantStatus)
+
+			var stored model.User
+			if err := s.db.First(&stored, user.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(stored.Password, tt.wantPrefix) {
+				t.Errorf("stored password = %q, want the %q prefix", stored.Password, tt.wantPrefix)
+			}
+			if !stored.UpdatedAt.Equal(user.UpdatedAt) {
+				t.Errorf("updated_at = %v, want it unchanged %v", stored.UpdatedAt, user.UpdatedAt)
+			}
+
+			// The migrated hash still logs in
+			login(t, s, "alice@example.com", testutil.DefaultPassword)
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := newTestServer(t, nil)
+	testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+	_, bobToken := s.seedUser(t, testutil.UserFixture{Email: "bob@example.com"})
+
+	// Two devices, the sessions of a same IP replacing each other
+	var logins []model.LoginResponseDTO
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		req := testutil.JSONRequest(t, "POST", "/api/v1/auth/login", model.LoginDTO{Email: "alice@example.com", Password: testutil.DefaultPassword})
+		req.RemoteAddr = ip + ":12345"
+		w := testutil.Do(s.router, req)
+		expectStatus(t, w, http.StatusOK)
+
+		var response model.LoginResponseDTO
+		testutil.DecodeJSON(t, w, &response)
+		if response.SessionID == 0 {
+			t.Fatal("the login response has no sessionId")
+		}
+		logins = append(logins, response)
+	}
+	current, other := logins[0], logins[1]
+
+	req := testutil.WithBearer(testutil.JSONRequest(t, "GET", "/api/v1/auth/sessions", nil), current.Token)
+	req.Header.Set(RefreshTokenHeader, current.RefreshToken)
+	w := testutil.Do(s.router, req)
+	expectStatus(t, w, http.StatusOK)
+	if body := w.Body.String(); strings.Contains(body, current.RefreshToken) || strings.Contains(body, other.RefreshToken) {
+		t.Errorf("the sessions listing returned a refresh token: %s", body)
+	}
+	var sessions []model.SessionResponseDTO
+	testutil.DecodeJSON(t, w, &sessions)
+	if len(sessions) != 2 || sessions[0].ID != other.SessionID || sessions[1].ID != current.SessionID {
+		t.Fatalf("sessions = %+v, want %d then %d", sessions, other.SessionID, current.SessionID)
+	}
+	if sessions[0].Current || !sessions[1].Current {
+		t.Errorf("current flags = %v, %v, want false, true", sessions[0].Current, sessions[1].Current)
+	}
+
+	w = s.do(t, "GET", "/api/v1/auth/sessions?page=2&pageSize=1", current.Token, nil)
+	expectStatus(t, w, http.StatusOK)
+	testutil.DecodeJSON(t, w, &sessions)
+	if len(sessions) != 1 || sessions[0].ID != current.SessionID || w.Header().Get(TotalCountHeader) != "2" {
+		t.Errorf("second page = %+v with a total of %q, want %d with a total of 2", sessions, w.Header().Get(TotalCountHeader), current.SessionID)
+	}
+	expectStatus(t, s.do(t, "GET", "/api/v1/auth/sessions?pageSize=1000", current.Token, nil), http.StatusUnprocessableEntity)
+
+	tests := []struct {
+		name       string
+		token      string
+		path       string
+		wantStatus int
+	}{
+		{"session of another user", bobToken, fmt.Sprintf("/api/v1/auth/sessions/%d", other.SessionID), http.StatusNotFound},
+		{"unknown session", current.Token, "/api/v1/auth/sessions/9999", http.StatusNotFound},
+		{"invalid id", current.Token, "/api/v1/auth/sessions/first", http.StatusBadRequest},
+		{"own session", current.Token, fmt.Sprintf("/api/v1/auth/sessions/%d", other.SessionID), http.StatusOK},
+		{"already revoked", current.Token, fmt.Sprintf("/api/v1/auth/sessions/%d", other.SessionID), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, s.do(t, "DELETE", tt.path, tt.token, nil), tt.wantStatus)
+		})
+	}
+
+	if _, err := s.auth.RTService.GetRT(context.Background(), other.RefreshToken); err == nil {
+		t.Error("the revoked session can still refresh")
+	}
+	if _, err := s.auth.RTService.GetRT(context.Background(), current.RefreshToken); err != nil {
+		t.Errorf("the current session was revoked too: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/kjk/betterguid"
+)
+
+const (
+	// AvatarPath is the upload route, BodyLimit must leave it to the handler which caps it with AVATAR_MAX_BYTES
+	AvatarPath = "/api/v1/user/avatar"
+
+	avatarField     = "avatar"
+	avatarKeyPrefix = "avatars/"
+	// avatarFormOverhead is allowed on top of AVATAR_MAX_BYTES for the multipart boundaries and headers
+	avatarFormOverhead = 16 << 10
+
+	avatarTypeMessage = "avatar must be a PNG, JPEG, GIF or WebP image"
+)
+
+// avatarExtensions are the extensions of the accepted image types, sniffed from the content
+var avatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+type AvatarHandler struct {
+	userService *service.UserService
+	storage     storage.Storage
+	conf        *config.Config
+}
+
+func NewAvatarHandler(userService *service.UserService, files storage.Storage, conf *config.Config) *AvatarHandler {
+	return &AvatarHandler{
+		userService: userService,
+		storage:     files,
+		conf:        conf,
+	}
+}
+
+// UploadAvatar godoc
+// @Summary      Upload the avatar
+// @Description  set the avatar of the authenticated user from an image, sent as the avatar field of a multipart form. The type is checked from the content: PNG, JPEG, GIF or WebP, up to AVATAR_MAX_BYTES. The avatarUrl of the user is set to the stored image, the previous uploaded one is deleted
+// @Tags         User
+// @Accept       multipart/form-data
+// @Produce      json
+// @Param        avatar  formData  file  true  "Avatar image"
+// @Success      200     {object}  model.UserResponseDTO
+// @Failure      400     {object}  ErrorResponse
+// @Failure      401     {object}  ErrorResponse
+// @Failure      413     {object}  ErrorResponse
+// @Failure      415     {object}  ErrorResponse
+// @Failure      500     {object}  ErrorResponse
+// @Router       /user/avatar [post]
+func (h *AvatarHandler) UploadAvatar(c *gin.Context) {
+	currentUser, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, 401, "no user in the context")
+		return
+	}
+
+	content, ok := h.readAvatar(c)
+	if !ok {
+		return
+	}
+
+	// The declared content type is up to the client, only the content tells what the file is
+	contentType := http.DetectContentType(content)
+	extension, ok := avatarExtensions[contentType]
+	if !ok {
+		respondError(c, http.StatusUnsupportedMediaType, avatarTypeMessage)
+		return
+	}
+
+	// A new key per upload, the caches of the previous URL don't serve a stale image
+	key := fmt.Sprintf("%s%d-%s%s", avatarKeyPrefix, currentUser.ID, strings.ToLower(betterguid.New()), extension)
+	if err := h.storage.Put(c.Request.Context(), key, contentType, content); err != nil {
+		respondInternalError(c, "failed to store the avatar", err)
+		return
+	}
+
+	avatarURL := h.storage.URL(key)
+	user, err := h.userService.UpdateUser(c.Request.Context(), int(currentUser.ID), &model.UserUpdateDTO{AvatarURL: &avatarURL})
+	if err != nil {
+		h.deleteAvatar(c, key)
+		if errors.Is(err, service.ErrUserNotFound) {
+			respondError(c, 404, err.Error())
+			return
+		}
+		respondInternalError(c, "failed to update user", err)
+		return
+	}
+
+	// Only the avatars uploaded here by this user are deleted, not an external URL set through the
+	// profile: the avatarUrl is up to the user, it may point at the avatar of another one
+	ownPrefix := fmt.Sprintf("%s%d-", avatarKeyPrefix, currentUser.ID)
+	if previous, found := strings.CutPrefix(currentUser.AvatarURL, h.storage.URL(ownPrefix)); found && previous != "" && !strings.Contains(previous, "/") {
+		h.deleteAvatar(c, ownPrefix+previous)
+	}
+
+	respond(c, 200, user.ToResponse())
+}
+
+/*
+readAvatar reads the content of the avatar field of the multipart body, up to AVATAR_MAX_BYTES.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+
+Returns:
+  - ([]byte): the content of the file
+  - (bool): false if the body is invalid, in which case a 400 (no file), 413 (too large) or
+    415 (not multipart) has been written
+*/
+func (h *AvatarHandler) readAvatar(c *gin.Context) ([]byte, bool) {
+	if c.Request.Body == nil {
+		respondError(c, http.StatusBadRequest, "request body is required")
+		return nil, false
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.conf.AVATAR_MAX_BYTES+avatarFormOverhead)
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		respondError(c, http.StatusUnsupportedMediaType, "the avatar must be sent as multipart/form-data")
+		return nil, false
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			respondError(c, http.StatusBadRequest, "avatar file is required")
+			return nil, false
+		}
+		if err != nil {
+			return nil, h.invalidForm(c, err)
+		}
+		if part.FormName() != avatarField || part.FileName() == "" {
+			continue
+		}
+
+		content, err := io.ReadAll(io.LimitReader(part, h.conf.AVATAR_MAX_BYTES+1))
+		if err != nil {
+			return nil, h.invalidForm(c, err)
+		}
+		if int64(len(content)) > h.conf.AVATAR_MAX_BYTES {
+			respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("avatar must not exceed %d bytes", h.conf.AVATAR_MAX_BYTES))
+			return nil, false
+		}
+		if len(content) == 0 {
+			respondError(c, http.StatusBadRequest, "avatar file is empty")
+			return nil, false
+		}
+
+		return content, true
+	}
+}
+
+// invalidForm answers a multipart body which can't be read, always false.
+func (h *AvatarHandler) invalidForm(c *gin.Context, err error) bool {
+	GetLogger(c).Warn("invalid avatar upload", "error", err)
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("avatar must not exceed %d bytes", h.conf.AVATAR_MAX_BYTES))
+		return false
+	}
+
+	respondError(c, http.StatusBadRequest, "invalid multipart body")
+	return false
+}
+
+// deleteAvatar deletes a stored avatar, a failure only leaves an orphan file and is logged.
+func (h *AvatarHandler) deleteAvatar(c *gin.Context, key string) {
+	if err := h.storage.Delete(c.Request.Context(), key); err != nil {
+		GetLogger(c).Warn("failed to delete an avatar", "key", key, "error", err)
+	}
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+// pngHeader is the signature of a PNG file, enough for the content sniffing
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// uploadAvatar POSTs content as the named file field of a multipart form, authenticated by token.
+func uploadAvatar(t *testing.T, s *testServer, token, field string, content []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile(field, "avatar.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(content)
+	form.Close()
+
+	req := httptest.NewRequest("POST", AvatarPath, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	return testutil.Do(s.router, testutil.WithBearer(req, token))
+}
+
+func TestUploadAvatar(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) { conf.AVATAR_MAX_BYTES = 1024 })
+	alice, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+
+	w := uploadAvatar(t, s, aliceToken, "avatar", pngHeader)
+	expectStatus(t, w, http.StatusOK)
+	var first model.UserResponseDTO
+	testutil.DecodeJSON(t, w, &first)
+	prefix := fmt.Sprintf("https://files.example.com/avatars/%d-", alice.ID)
+	if !strings.HasPrefix(first.AvatarURL, prefix) || !strings.HasSuffix(first.AvatarURL, ".png") {
+		t.Fatalf("avatarUrl = %q, want a png under %s", first.AvatarURL, prefix)
+	}
+	key := strings.TrimPrefix(first.AvatarURL, "https://files.example.com/")
+	if object, ok := s.files.Get(key); !ok || object.ContentType != "image/png" || !bytes.Equal(object.Content, pngHeader) {
+		t.Errorf("stored %s = %+v, %v, want the uploaded png", key, object, ok)
+	}
+
+	// The new upload replaces the stored file of the previous one
+	w = uploadAvatar(t, s, aliceToken, "avatar", append(pngHeader, 0))
+	expectStatus(t, w, http.StatusOK)
+	var second model.UserResponseDTO
+	testutil.DecodeJSON(t, w, &second)
+	if keys := s.files.Keys(); second.AvatarURL == first.AvatarURL || len(keys) != 1 || !strings.HasSuffix(second.AvatarURL, keys[0]) {
+		t.Errorf("avatarUrl = %q, stored %v, want only the new avatar", second.AvatarURL, keys)
+	}
+
+	tests := []struct {
+		name       string
+		field      string
+		content    []byte
+		wantStatus int
+	}{
+		{"not an image", "avatar", []byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"), http.StatusUnsupportedMediaType},
+		{"too large", "avatar", append(append([]byte(nil), pngHeader...), make([]byte, 1024)...), http.StatusRequestEntityTooLarge},
+		{"empty", "avatar", nil, http.StatusBadRequest},
+		{"no avatar field", "image", pngHeader, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, uploadAvatar(t, s, aliceToken, tt.field, tt.content), tt.wantStatus)
+
+			// The avatar is left as it was
+			w := s.do(t, "GET", fmt.Sprintf("/api/v1/user/%d", alice.ID), aliceToken, nil)
+			var got model.UserResponseDTO
+			testutil.DecodeJSON(t, w, &got)
+			if got.AvatarURL != second.AvatarURL || len(s.files.Keys()) != 1 {
+				t.Errorf("avatarUrl = %q, stored %v, want %q only", got.AvatarURL, s.files.Keys(), second.AvatarURL)
+			}
+		})
+	}
+
+	t.Run("avatar of another user", func(t *testing.T) {
+		_, bobToken := s.seedUser(t, testutil.UserFixture{Email: "bob@example.com"})
+		w := uploadAvatar(t, s, bobToken, "avatar", pngHeader)
+		expectStatus(t, w, http.StatusOK)
+		var bob model.UserResponseDTO
+		testutil.DecodeJSON(t, w, &bob)
+		bobKey := strings.TrimPrefix(bob.AvatarURL, "https://files.example.com/")
+
+		// Alice points her avatarUrl at the file of bob, her upload must not delete it
+		expectStatus(t, s.do(t, "PUT", fmt.Sprintf("/api/v1/user/%d", alice.ID), aliceToken, map[string]string{"avatarUrl": bob.AvatarURL}), http.StatusOK)
+		expectStatus(t, uploadAvatar(t, s, aliceToken, "avatar", pngHeader), http.StatusOK)
+		if _, ok := s.files.Get(bobKey); !ok {
+			t.Errorf("stored %v, want the avatar of bob %s kept", s.files.Keys(), bobKey)
+		}
+	})
+	t.Run("not multipart", func(t *testing.T) {
+		expectStatus(t, s.do(t, "POST", AvatarPath, aliceToken, map[string]string{"avatar": "x"}), http.StatusUnsupportedMediaType)
+	})
+	t.Run("unauthenticated", func(t *testing.T) {
+		expectStatus(t, uploadAvatar(t, s, "", "avatar", pngHeader), http.StatusUnauthorized)
+	})
+}
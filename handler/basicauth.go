@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+BasicAuth is a middleware requiring the HTTP basic credentials user and password, e.g. to
+keep the swagger UI private. The other requests are rejected with a 401 and a
+WWW-Authenticate header, so that browsers prompt for the credentials.
+
+Parameters:
+- realm (string): The realm shown by the browsers' prompt.
+- user (string): The expected user. Empty, with password, to disable the middleware.
+- password (string): The expected password.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func BasicAuth(realm, user, password string) gin.HandlerFunc {
+	// The digests have the same length, the comparison doesn't leak the length of the credentials
+	wantUser, wantPassword := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(password))
+
+	return func(c *gin.Context) {
+		if user == "" && password == "" {
+			c.Next()
+			return
+		}
+
+		gotUser, gotPassword, ok := c.Request.BasicAuth()
+		if ok {
+			userDigest, passwordDigest := sha256.Sum256([]byte(gotUser)), sha256.Sum256([]byte(gotPassword))
+			userOK := subtle.ConstantTimeCompare(userDigest[:], wantUser[:])
+			passwordOK := subtle.ConstantTimeCompare(passwordDigest[:], wantPassword[:])
+			if userOK&passwordOK == 1 {
+				c.Next()
+				return
+			}
+			GetLogger(c).Warn("basic auth failed", "user", gotUser)
+		}
+
+		c.Header("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+		abortWithError(c, http.StatusUnauthorized, "authentication required")
+	}
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+func TestSwagger(t *testing.T) {
+	tests := []struct {
+		name string
+		// enabled, user and pass are the SWAGGER_* config
+		enabled    bool
+		user, pass string
+		// credentials are sent as basic auth unless empty
+		credentials [2]string
+		wantStatus  int
+	}{
+		{"public", true, "", "", [2]string{}, http.StatusOK},
+		{"disabled", false, "", "", [2]string{}, http.StatusNotFound},
+		{"protected without credentials", true, "docs", "s3cret", [2]string{}, http.StatusUnauthorized},
+		{"protected with a wrong password", true, "docs", "s3cret", [2]string{"docs", "wrong"}, http.StatusUnauthorized},
+		{"protected with a wrong user", true, "docs", "s3cret", [2]string{"admin", "s3cret"}, http.StatusUnauthorized},
+		{"protected with the credentials", true, "docs", "s3cret", [2]string{"docs", "s3cret"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(conf *config.Config) {
+				conf.SWAGGER_ENABLED = tt.enabled
+				conf.SWAGGER_USER = tt.user
+				conf.SWAGGER_PASS = tt.pass
+			})
+
+			req := testutil.JSONRequest(t, "GET", "/swagger/index.html", nil)
+			if tt.credentials[0] != "" {
+				req.SetBasicAuth(tt.credentials[0], tt.credentials[1])
+			}
+			w := testutil.Do(s.router, req)
+			expectStatus(t, w, tt.wantStatus)
+
+			if challenge := w.Header().Get("WWW-Authenticate"); (tt.wantStatus == http.StatusUnauthorized) != (challenge != "") {
+				t.Errorf("WWW-Authenticate = %q with a %d", challenge, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+func init() {
+	// The validation errors are reported by JSON field name, as the clients know them
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return field.Name
+			}
+			return name
+		})
+		// An empty username means none, it removes the username on update
+		v.RegisterValidation("username", func(fl validator.FieldLevel) bool {
+			username := model.NormalizeUsername(fl.Field().String())
+			return username == "" || model.ValidUsername(username)
+		})
+		// The new passwords are bounded in bytes, not characters, as bcrypt is
+		v.RegisterValidation("password", func(fl validator.FieldLevel) bool {
+			return model.ValidPassword(fl.Field().String())
+		})
+		v.RegisterValidation("avatar_url", func(fl validator.FieldLevel) bool {
+			return model.ValidAvatarURL(fl.Field().String())
+		})
+		v.RegisterValidation("locale", func(fl validator.FieldLevel) bool {
+			return model.ValidLocale(fl.Field().String())
+		})
+	}
+}
+
+/*
+BodyLimit is a middleware capping the size of the request bodies. Reading past the limit
+fails, and bindJSON answers it with a 413.
+
+Parameters:
+- limit (int64): The maximum size of a body, in bytes.
+- excludedPrefixes (...string): The paths left alone, e.g. the uploads capping their bodies themselves.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func BodyLimit(limit int64, excludedPrefixes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, prefix := range excludedPrefixes {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) {
+				c.Next()
+				return
+			}
+		}
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		}
+
+		c.Next()
+	}
+}
+
+/*
+bindJSON strictly decodes the JSON body of the request into obj: a body which isn't sent as
+application/json is rejected with a 415 rather than a confusing decoding error, and unknown
+fields are rejected, so that a typo in a payload isn't silently ignored. A decoded struct is then
+canonicalized, see model.Canonicalizer, and checked against its binding tags, the failures
+are reported field by field:
+
+	{"error": "validation failed", "fields": {"email": "must be a valid email"}}
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - obj (any): a pointer to the value to decode into
+
+Returns:
+  - (bool): false if the body is invalid, in which case a 415 (not JSON), 413 (too large),
+    422 (unknown field or validation failure) or 400 (malformed) has been written
+*/
+func bindJSON(c *gin.Context, obj any) bool {
+	if c.Request.Body == nil {
+		respondError(c, http.StatusBadRequest, "request body is required")
+		return false
+	}
+	// ContentType drops the parameters, application/json; charset=utf-8 is accepted
+	if c.ContentType() != binding.MIMEJSON {
+		GetLogger(c).Warn("unsupported request content type", "contentType", c.GetHeader("Content-Type"))
+		respondError(c, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return false
+	}
+
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(obj)
+	if err == nil {
+		canonicalize(reflect.ValueOf(obj))
+		return validateStruct(c, obj)
+	}
+	GetLogger(c).Warn("invalid request body", "error", err)
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		respondError(c, http.StatusRequestEntityTooLarge, "request body too large")
+	// encoding/json has no typed error for unknown fields
+	case strings.HasPrefix(err.Error(), "json: unknown field"):
+		respondError(c, http.StatusUnprocessableEntity, err.Error())
+	default:
+		respondError(c, http.StatusBadRequest, err.Error())
+	}
+
+	return false
+}
+
+// canonicalize canonicalizes the model.Canonicalizer behind value, through the pointers, or each one of a slice
+func canonicalize(value reflect.Value) {
+	for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return
+		}
+		if canonicalizer, ok := value.Interface().(model.Canonicalizer); ok {
+			canonicalizer.Canonicalize()
+			return
+		}
+		value = value.Elem()
+	}
+
+	switch {
+	case value.Kind() == reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			canonicalize(value.Index(i))
+		}
+	// The elements of a slice of structs are canonicalized in place
+	case value.Kind() == reflect.Struct && value.CanAddr():
+		if canonicalizer, ok := value.Addr().Interface().(model.Canonicalizer); ok {
+			canonicalizer.Canonicalize()
+		}
+	}
+}
+
+/*
+parseIDParam reads the ID in the path parameter name, e.g. "id" for /user/:id.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - name (string): the name of the path parameter
+
+Returns:
+  - (int): the ID, a positive integer
+  - (bool): false if the parameter isn't a positive integer, in which case a 400 has been
+    written and the request aborted
+*/
+func parseIDParam(c *gin.Context, name string) (int, bool) {
+	id, err := strconv.Atoi(c.Param(name))
+	if err != nil || id < 1 {
+		GetLogger(c).Warn("invalid id path parameter", "name", name, "value", c.Param(name))
+		abortWithError(c, http.StatusBadRequest, name+" must be a positive integer")
+		return 0, false
+	}
+
+	return id, true
+}
+
+/*
+validateStruct checks the struct obj points to against its binding tags. Slices aren't
+checked, their elements are validated one by one by the handlers to report every failure.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - obj (any): a pointer, possibly to another pointer, to the decoded value
+
+Returns:
+  - (bool): false if obj is invalid, in which case a 422 (validation failure) or 400 (null
+    body) has been written
+*/
+func validateStruct(c *gin.Context, obj any) bool {
+	value := reflect.ValueOf(obj)
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			respondError(c, http.StatusBadRequest, "request body is required")
+			return false
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return true
+	}
+
+	err := binding.Validator.ValidateStruct(value.Addr().Interface())
+	if err == nil {
+		return true
+	}
+
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return false
+	}
+
+	respondValidationError(c, validationFields(validationErrs))
+
+	return false
+}
+
+/*
+bindQuery binds the query parameters of the request into obj with its form tags, e.g.
+model.PaginationQuery, and checks it against its binding tags. A parameter which isn't of
+the type of its field, like a page which isn't a number, and a validation failure are both a
+422, the latter reported field by field like bindJSON.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - obj (any): a pointer to the struct to bind into
+
+Returns:
+  - (bool): false if the query is invalid, in which case a 422 has been written
+*/
+func bindQuery(c *gin.Context, obj any) bool {
+	return bindValues(c, obj, binding.Query, "query")
+}
+
+// bindForm is bindQuery for a application/x-www-form-urlencoded body, e.g. of the OAuth style endpoints.
+func bindForm(c *gin.Context, obj any) bool {
+	return bindValues(c, obj, binding.Form, "form")
+}
+
+// bindValues binds the form values read by b into obj, see bindQuery, source naming them in the errors
+func bindValues(c *gin.Context, obj any, b binding.Binding, source string) bool {
+	err := c.ShouldBindWith(obj, b)
+	if err == nil {
+		return true
+	}
+	GetLogger(c).Warn("invalid "+source, "error", err)
+
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		respondValidationError(c, validationFields(validationErrs))
+	} else {
+		respondError(c, http.StatusUnprocessableEntity, "invalid "+source+": "+err.Error())
+	}
+
+	return false
+}
+
+// validationFields maps the name of each invalid field to the reason of its failure.
+func validationFields(validationErrs validator.ValidationErrors) map[string]string {
+	fields := make(map[string]string, len(validationErrs))
+	for _, fieldErr := range validationErrs {
+		fields[fieldErr.Field()] = validationReason(fieldErr)
+	}
+
+	return fields
+}
+
+// validEmail reports whether email passes the same email rule as the request bodies.
+func validEmail(email string) bool {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	return ok && v.Var(email, "required,email") == nil
+}
+
+// validationReason describes the failed rule of a field in words a form can display.
+func validationReason(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required", "required_without":
+		return "is required"
+	case "email":
+		return "must be a valid email"
+	case "oneof":
+		return "must be one of " + strings.Join(strings.Fields(fieldErr.Param()), ", ")
+	case "min":
+		if isNumber(fieldErr.Kind()) {
+			return "must be at least " + fieldErr.Param()
+		}
+		return fmt.Sprintf("must have at least %s elements or characters", fieldErr.Param())
+	case "max":
+		if isNumber(fieldErr.Kind()) {
+			return "must be at most " + fieldErr.Param()
+		}
+		return fmt.Sprintf("must have at most %s elements or characters", fieldErr.Param())
+	case "username":
+		return usernameInvalidReason
+	case "password":
+		return fmt.Sprintf("must be at most %d bytes", model.PasswordMaxBytes)
+	case "avatar_url":
+		return "must be an http or https URL"
+	case "locale":
+		return "must be a BCP 47 language tag, e.g. en-US"
+	case "timezone":
+		return "must be an IANA time zone, e.g. Europe/Paris"
+	default:
+		return "failed the " + fieldErr.Tag() + " rule"
+	}
+}
+
+// isNumber reports whether the kind is a number, whose min and max bound the value rather than the length.
+func isNumber(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+/*
+Compression is a middleware gzipping the responses of the clients sending an Accept-Encoding
+header allowing it. The body is buffered until it reaches minSize bytes: a smaller response is
+sent as is, compressing it would cost more than it saves.
+
+Parameters:
+- minSize (int): The size, in bytes, from which the responses are compressed.
+- excludedPrefixes (...string): The paths left alone, e.g. the ones compressing their own responses.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func Compression(minSize int, excludedPrefixes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		for _, prefix := range excludedPrefixes {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) {
+				c.Next()
+				return
+			}
+		}
+
+		writer := &gzipResponseWriter{ResponseWriter: c.Writer, minSize: minSize}
+		c.Writer = writer
+		handled := false
+		defer func() {
+			// On a panic, the buffered response is dropped and the Recovery writes its error uncompressed
+			if !handled {
+				c.Writer = writer.ResponseWriter
+			}
+		}()
+
+		// The response differs by Accept-Encoding, even when it ends up small
+		c.Header("Vary", "Accept-Encoding")
+
+		c.Next()
+		handled = true
+		writer.finish()
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header lists gzip, without a q=0 weight.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, encoding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.TrimSpace(name) != "gzip" && strings.TrimSpace(name) != "*" {
+			continue
+		}
+
+		return strings.ReplaceAll(params, " ", "") != "q=0"
+	}
+
+	return false
+}
+
+// gzipResponseWriter buffers the body until it reaches minSize, then forwards it gzipped
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	minSize int
+	buffer  bytes.Buffer
+	gz      *gzip.Writer
+	// passthrough is set once the body is known to be sent uncompressed
+	passthrough bool
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	switch {
+	case w.gz != nil:
+		return w.gz.Write(data)
+	case w.passthrough:
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.buffer.Write(data)
+	if w.buffer.Len() < w.minSize {
+		return len(data), nil
+	}
+
+	// A handler may have encoded the body itself
+	if w.Header().Get("Content-Encoding") != "" {
+		w.passthrough = true
+		return len(data), w.flushBuffer()
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+	if _, err := w.gz.Write(w.buffer.Bytes()); err != nil {
+		return 0, err
+	}
+	w.buffer.Reset()
+
+	return len(data), nil
+}
+
+func (w *gzipResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// WriteHeaderNow is delayed to finish, the headers depend on the size of the body
+func (w *gzipResponseWriter) WriteHeaderNow() {}
+
+// Written also reports a buffered body, so that nothing else gets written after it
+func (w *gzipResponseWriter) Written() bool {
+	return w.gz != nil || w.buffer.Len() > 0 || w.ResponseWriter.Written()
+}
+
+func (w *gzipResponseWriter) flushBuffer() error {
+	if w.buffer.Len() == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buffer.Bytes())
+	w.buffer.Reset()
+
+	return err
+}
+
+// finish writes what remains: the gzip footer, or the small buffered body as is.
+func (w *gzipResponseWriter) finish() {
+	if w.gz != nil {
+		w.gz.Close()
+		w.gz.Reset(nil)
+		gzipWriters.Put(w.gz)
+		return
+	}
+
+	w.flushBuffer()
+	w.ResponseWriter.WriteHeaderNow()
+}
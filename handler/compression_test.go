@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCompression(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.COMPRESSION_ENABLED = true
+	})
+	admin, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+	for i := 0; i < 50; i++ {
+		testutil.SeedUser(t, s.db, testutil.UserFixture{Email: fmt.Sprintf("user%d@example.com", i)})
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{"large list accepting gzip", "/api/v1/user/", "gzip, deflate, br", true},
+		{"large list without Accept-Encoding", "/api/v1/user/", "", false},
+		{"large list refusing gzip", "/api/v1/user/", "gzip;q=0, deflate", false},
+		{"small response accepting gzip", fmt.Sprintf("/api/v1/user/%d", admin.ID), "gzip", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := testutil.WithBearer(testutil.JSONRequest(t, "GET", tt.path, nil), adminToken)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			w := testutil.Do(s.router, req)
+			expectStatus(t, w, http.StatusOK)
+			if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip %v", w.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+
+			var body any
+			if tt.wantGzip {
+				reader, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = json.NewDecoder(reader).Decode(&body)
+				if err != nil {
+					t.Fatalf("invalid gzipped JSON: %v", err)
+				}
+			} else {
+				testutil.DecodeJSON(t, w, &body)
+			}
+
+			if users, ok := body.([]any); ok && len(users) != 51 {
+				t.Errorf("%d users, want 51", len(users))
+			}
+		})
+	}
+}
+
+func TestCompressionKeepsStatusAndEncodedBodies(t *testing.T) {
+	r := gin.New()
+	r.Use(Compression(10))
+	r.GET("/created", func(c *gin.Context) {
+		c.JSON(http.StatusCreated, gin.H{"message": "a body larger than the minimum size"})
+	})
+	r.GET("/encoded", func(c *gin.Context) {
+		c.Header("Content-Encoding", "br")
+		c.Data(http.StatusOK, "application/octet-stream", []byte("already encoded with brotli"))
+	})
+	r.GET("/empty", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		path         string
+		wantStatus   int
+		wantEncoding string
+	}{
+		{"/created", http.StatusCreated, "gzip"},
+		{"/encoded", http.StatusOK, "br"},
+		{"/empty", http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := testutil.JSONRequest(t, "GET", tt.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+
+			w := testutil.Do(r, req)
+			expectStatus(t, w, tt.wantStatus)
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+		})
+	}
+}
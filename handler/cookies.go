@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// The cookie names, before the COOKIE_PREFIX
+const (
+	jwtCookie        = "jwt"
+	rtCookie         = "rt"
+	csrfCookie       = "csrf"
+	oauthStateCookie = "oauth_state"
+)
+
+// cookieName returns the name of the cookie with the COOKIE_PREFIX, as it is sent to the browser.
+func (authHandler *AuthHandler) cookieName(name string) string {
+	return authHandler.COOKIE_PREFIX + name
+}
+
+/*
+setCookie sets the cookie with the COOKIE_PREFIX and on the COOKIE_PATH, with the SameSite
+and Secure attributes of COOKIE_SAMESITE and COOKIE_SECURE. Every cookie of the service must
+go through it, so that the cookies are read back with the same name and path.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - name (string): the cookie name, before the prefix, e.g. jwtCookie
+  - value (string): the value of the cookie
+  - maxAge (int): the lifetime in seconds, 0 for a session cookie and a negative value to delete it
+  - httpOnly (bool): whether the cookie is hidden from the front-end scripts
+*/
+func (authHandler *AuthHandler) setCookie(c *gin.Context, name, value string, maxAge int, httpOnly bool) {
+	c.SetSameSite(authHandler.CookieSameSite())
+	c.SetCookie(authHandler.cookieName(name), value, maxAge, authHandler.COOKIE_PATH, "", authHandler.CookieSecure(), httpOnly)
+}
+
+// cookie returns the value of the cookie set by setCookie, empty if there is none.
+func (authHandler *AuthHandler) cookie(c *gin.Context, name string) string {
+	value, _ := c.Cookie(authHandler.cookieName(name))
+
+	return value
+}
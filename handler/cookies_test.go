@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+func TestCookieAttributes(t *testing.T) {
+	tests := []struct {
+		name         string
+		sameSite     string
+		secure       bool
+		wantSameSite http.SameSite
+		wantSecure   bool
+	}{
+		{"lax", config.CookieSameSiteLax, false, http.SameSiteLaxMode, false},
+		{"strict", config.CookieSameSiteStrict, false, http.SameSiteStrictMode, false},
+		{"lax and secure", config.CookieSameSiteLax, true, http.SameSiteLaxMode, true},
+		{"none forces secure", config.CookieSameSiteNone, false, http.SameSiteNoneMode, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(conf *config.Config) {
+				conf.COOKIE_SAMESITE = tt.sameSite
+				conf.COOKIE_SECURE = tt.secure
+			})
+			s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+
+			w := s.do(t, "POST", "/api/v1/auth/login", "", model.LoginDTO{Email: "alice@example.com", Password: testutil.DefaultPassword})
+			expectStatus(t, w, http.StatusOK)
+
+			cookies := w.Result().Cookies()
+			if len(cookies) == 0 {
+				t.Fatal("no cookie set on login")
+			}
+			for _, cookie := range cookies {
+				if cookie.SameSite != tt.wantSameSite || cookie.Secure != tt.wantSecure {
+					t.Errorf("cookie %s: SameSite = %v, Secure = %v, want %v, %v", cookie.Name, cookie.SameSite, cookie.Secure, tt.wantSameSite, tt.wantSecure)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenInBody(t *testing.T) {
+	for _, tokenInBody := range []bool{true, false} {
+		s := newTestServer(t, func(conf *config.Config) { conf.TOKEN_IN_BODY = tokenInBody })
+		s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+
+		requests := map[string]*http.Request{
+			"login":    testutil.JSONRequest(t, "POST", "/api/v1/auth/login", model.LoginDTO{Email: "alice@example.com", Password: testutil.DefaultPassword}),
+			"register": testutil.JSONRequest(t, "POST", "/api/v1/auth/register", model.UserCreateDTO{Email: "bob@example.com", Password: testutil.DefaultPassword}),
+		}
+		for name, req := range requests {
+			t.Run(fmt.Sprintf("%s with TOKEN_IN_BODY=%v", name, tokenInBody), func(t *testing.T) {
+				w := testutil.Do(s.router, req)
+				if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+					t.Fatalf("status = %d, body: %s", w.Code, w.Body.String())
+				}
+
+				var body map[string]any
+				testutil.DecodeJSON(t, w, &body)
+				for _, field := range []string{"token", "refreshToken"} {
+					if _, ok := body[field]; ok != tokenInBody {
+						t.Errorf("%s in the body = %v, want %v", field, ok, tokenInBody)
+					}
+				}
+				if body["user"] == nil {
+					t.Error("the body must hold the user")
+				}
+
+				// The cookies alone authenticate the user
+				me := testutil.JSONRequest(t, "GET", "/api/v1/auth/me", nil)
+				for _, cookie := range w.Result().Cookies() {
+					me.AddCookie(cookie)
+				}
+				expectStatus(t, testutil.Do(s.router, me), http.StatusOK)
+			})
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/gin-gonic/gin"
+)
+
+// corsExposedHeaders are the response headers browsers are allowed to read on cross origin requests
+var corsExposedHeaders = []string{NewTokenHeader, RequestIDHeader, TotalCountHeader, "ETag"}
+
+/*
+CORS is a middleware handling Cross-Origin Resource Sharing, configured from the
+CORS_* fields of the config.
+
+When no origin is configured, no CORS header is sent and browsers fall back to the
+same-origin policy. An origin of "*" allows every origin, never with credentials: the
+config rejects "*" alongside CORS_ALLOW_CREDENTIALS, the credentialed origins must be
+listed. Preflight requests are answered directly with a 204.
+
+Parameters:
+- conf (*config.Config): A pointer to the Config struct containing the CORS configuration.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func CORS(conf *config.Config) gin.HandlerFunc {
+	allowAll := false
+	allowedOrigins := make(map[string]bool, len(conf.CORS_ALLOWED_ORIGINS))
+	for _, origin := range conf.CORS_ALLOWED_ORIGINS {
+		if origin == "*" {
+			allowAll = true
+		}
+		allowedOrigins[strings.ToLower(origin)] = true
+	}
+
+	allowedMethods := strings.Join(conf.CORS_ALLOWED_METHODS, ", ")
+	allowedHeaders := strings.Join(conf.CORS_ALLOWED_HEADERS, ", ")
+	exposedHeaders := strings.Join(corsExposedHeaders, ", ")
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		if !allowAll && !allowedOrigins[strings.ToLower(origin)] {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		header := c.Writer.Header()
+		header.Add("Vary", "Origin")
+		if allowAll {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		// Rejected by the config, a wildcard must never let any site send credentialed requests
+		if conf.CORS_ALLOW_CREDENTIALS && !allowAll {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		header.Set("Access-Control-Expose-Headers", exposedHeaders)
+
+		if preflight {
+			header.Set("Access-Control-Allow-Methods", allowedMethods)
+			header.Set("Access-Control-Allow-Headers", allowedHeaders)
+			header.Set("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
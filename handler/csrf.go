@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// CSRFTokenHeader must repeat the csrf cookie on the mutating requests authenticated by cookie
+	CSRFTokenHeader = "X-CSRF-Token"
+
+	// tokenSourceKey is the context key of the source the AuthMiddleware read the jwt from
+	tokenSourceKey = "tokenSource"
+)
+
+/*
+CSRFMiddleware protects the cookie based sessions against cross-site request forgery,
+with a double-submit token: the login sets a csrf cookie readable by the front-end, which
+must send its value in the X-CSRF-Token header of every POST, PUT, PATCH and DELETE request.
+A forged request from another site can't read the cookie, and so can't set the header.
+
+It must be used after the AuthMiddleware. Requests authenticated by the Authorization header
+aren't checked, as browsers never add it on their own. It does nothing if CSRF_ENABLED is false.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware. It aborts with a 403 if the
+header is missing or doesn't match the cookie.
+*/
+func (authHandler *AuthHandler) CSRFMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authHandler.CSRF_ENABLED || c.GetString(tokenSourceKey) != config.TokenSourceCookie {
+			c.Next()
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			c.Next()
+			return
+		}
+
+		cookie := authHandler.cookie(c, csrfCookie)
+		header := c.GetHeader(CSRFTokenHeader)
+		if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) != 1 {
+			abortWithError(c, http.StatusForbidden, "missing or invalid csrf token")
+			return
+		}
+
+		c.Next()
+	}
+}
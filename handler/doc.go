@@ -0,0 +1,6 @@
+/*
+Package handler is the gin adapter of the service and auth packages. Its handlers only
+bind the requests, call the services and write the responses, so applications that don't
+use gin can rely on the service and auth packages directly.
+*/
+package handler
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/mailer"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/tokenutil"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ChangeEmail godoc
+// @Summary      Request an email change
+// @Description  store the new email as pending and send a verification token to it. The email is only changed once confirmed through POST /user/email/confirm
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        email  body      model.EmailChangeDTO  true  "New email and current password"
+// @Success      202    {object}  MessageResponse
+// @Failure      400    {object}  ErrorResponse
+// @Failure      401    {object}  ErrorResponse
+// @Failure      409    {object}  ErrorResponse
+// @Failure      500    {object}  ErrorResponse
+// @Router       /user/email [put]
+/*
+ChangeEmail starts the email change of the authenticated user. The current password is
+required, so that a stolen session can't move the account to an address controlled by an
+attacker. The new email is stored as pending and a verification token is sent to it, the
+current email stays in use until the token is confirmed.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) ChangeEmail(c *gin.Context) {
+	returnError := curryReturnError(c, false)
+
+	user, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+
+	var data *model.EmailChangeDTO
+	if !bindJSON(c, &data) {
+		return
+	}
+
+	if err := data.Validate(); err != nil {
+		returnError(err)
+		return
+	}
+
+	if err := user.CheckPassword(data.Password); err != nil {
+		respondError(c, http.StatusUnauthorized, "incorrect password")
+		return
+	}
+
+	_, err := authHandler.UserService.GetUserByEmail(c.Request.Context(), data.Email)
+	if err == nil {
+		respondError(c, http.StatusConflict, emailTakenMessage)
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		respondInternalError(c, "failed to get user by email", err)
+		return
+	}
+
+	// Bound to the pending email, the token is used up once it is confirmed or replaced by another request
+	token, err := authHandler.LinkSigner.Sign(tokenutil.Payload{UserID: user.ID, Purpose: model.PurposeEmailChange}, authHandler.VERIFY_TOKEN_TTL, data.Email)
+	if err != nil {
+		respondInternalError(c, "failed to sign the verification token", err)
+		return
+	}
+
+	if err := authHandler.UserService.SetPendingEmail(c.Request.Context(), int(user.ID), data.Email); err != nil {
+		respondInternalError(c, "failed to request email change", err)
+		return
+	}
+
+	err = authHandler.sendEmail(mailer.EmailVerificationTemplate, data.Email, token)
+	if err != nil {
+		GetLogger(c).Error("failed to send the verification email", "error", err)
+		respondError(c, http.StatusInternalServerError, "failed to send the verification email")
+		return
+	}
+
+	respond(c, http.StatusAccepted, gin.H{
+		"message": "A verification token has been sent to the new email",
+	})
+}
+
+// ConfirmEmail godoc
+// @Summary      Confirm an email change
+// @Description  swap the pending email in, using the verification token sent to it
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        token  body      model.EmailConfirmDTO  true  "Verification token"
+// @Success      200    {object}  model.UserResponseDTO
+// @Failure      400    {object}  ErrorResponse
+// @Failure      409    {object}  ErrorResponse
+// @Router       /user/email/confirm [post]
+/*
+ConfirmEmail verifies the token and replaces the user's email by the pending one it was
+issued for, in a single transaction. The token is recorded as used in the transaction, and the
+pending email cleared.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) ConfirmEmail(c *gin.Context) {
+	returnError := curryReturnError(c, false)
+
+	var data *model.EmailConfirmDTO
+	if !bindJSON(c, &data) {
+		return
+	}
+
+	payload, err := authHandler.LinkSigner.Verify(data.Token, model.PurposeEmailChange)
+	if err != nil {
+		returnError(errInvalidVerificationToken)
+		return
+	}
+
+	var user *model.User
+	err = authHandler.TxService.Transaction(c.Request.Context(), func(tx *service.TxServices) error {
+		if err := useLinkToken(c.Request.Context(), tx, payload); err != nil {
+			return err
+		}
+
+		pending, err := tx.UserService.GetUser(c.Request.Context(), int(payload.UserID))
+		if err != nil {
+			return err
+		}
+		if pending.PendingEmail == "" || !payload.BoundTo(string(pending.PendingEmail)) {
+			return errInvalidVerificationToken
+		}
+
+		user, err = tx.UserService.ConfirmPendingEmail(c.Request.Context(), int(payload.UserID))
+		return err
+	})
+	if errors.Is(err, errInvalidVerificationToken) || errors.Is(err, service.ErrUserNotFound) {
+		returnError(errInvalidVerificationToken)
+		return
+	}
+	if errors.Is(err, service.ErrEmailTaken) {
+		respondError(c, http.StatusConflict, emailTakenMessage)
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to confirm email change", err)
+		return
+	}
+
+	respond(c, 200, user.ToResponse())
+}
+
+// useLinkToken records the emailed token as used within the transaction, errInvalidVerificationToken if it already is.
+// The tokens signed without an ID can't be recorded, they are rejected.
+func useLinkToken(ctx context.Context, tx *service.TxServices, payload *tokenutil.Payload) error {
+	if payload.ID == "" {
+		return errInvalidVerificationToken
+	}
+	err := tx.UsedTokenService.Use(ctx, payload.ID, payload.Purpose, time.Unix(payload.ExpiresAt, 0))
+	if errors.Is(err, service.ErrTokenUsed) {
+		return errInvalidVerificationToken
+	}
+
+	return err
+}
+
+// sendEmail renders the named template for the token and sends it to email.
+func (authHandler *AuthHandler) sendEmail(template string, email string, token string) error {
+	return authHandler.MailTemplates.Send(authHandler.Mailer, template, mailer.TemplateData{
+		Email:  email,
+		Token:  token,
+		AppURL: authHandler.APP_URL,
+	})
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+func TestConfirmEmail(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, token := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+
+	changeEmail := func(email string) string {
+		w := s.do(t, "PUT", "/api/v1/user/email", token, model.EmailChangeDTO{Email: email, Password: testutil.DefaultPassword})
+		expectStatus(t, w, http.StatusAccepted)
+		return s.mailer.emailedToken(t, email)
+	}
+
+	// Only the token of the latest request is valid, it is bound to the pending email
+	replaced := changeEmail("alice@example.org")
+	confirmation := changeEmail("alice@example.net")
+	w := s.do(t, "POST", "/api/v1/user/email/confirm", "", model.EmailConfirmDTO{Token: replaced})
+	expectStatus(t, w, http.StatusBadRequest)
+
+	w = s.do(t, "POST", "/api/v1/user/email/confirm", "", model.EmailConfirmDTO{Token: confirmation})
+	expectStatus(t, w, http.StatusOK)
+	var user model.UserResponseDTO
+	testutil.DecodeJSON(t, w, &user)
+	if user.Email != "alice@example.net" {
+		t.Errorf("email = %s, want the confirmed one", user.Email)
+	}
+
+	// The confirmation clears the pending email, the token can't be used twice
+	w = s.do(t, "POST", "/api/v1/user/email/confirm", "", model.EmailConfirmDTO{Token: confirmation})
+	expectStatus(t, w, http.StatusBadRequest)
+}
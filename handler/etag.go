@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+jsonWithETag writes obj as a JSON response along with an ETag computed from its serialized
+form, so that it changes with any field of the response. When the request's If-None-Match
+header matches that ETag, a 304 Not Modified without body is written instead.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - obj (any): the response body
+*/
+func jsonWithETag(c *gin.Context, obj any) {
+	body, err := json.Marshal(responseBody(c, obj))
+	if err != nil {
+		respondInternalError(c, "failed to serialize response", err)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// etagMatches reports whether the If-None-Match header lists etag, comparing weakly as RFC 9110 requires.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
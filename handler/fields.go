@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unselectableFields can never be selected with ?fields=, should a response ever carry them
+var unselectableFields = map[string]bool{
+	"password":     true,
+	"passwordHash": true,
+	"totpSecret":   true,
+	"tokenVersion": true,
+}
+
+/*
+selectFields restricts obj, a response object or a list of them, to the JSON fields listed
+in the fields query parameter, e.g. ?fields=id,email,createdAt. The unknown names are
+ignored, and the unselectableFields are never kept. Only the serialized response is
+filtered, the data is still loaded as a whole.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - obj (any): the response body, serialized as a JSON object or array of objects
+
+Returns:
+  - (any): obj itself without the fields parameter, its filtered copy otherwise
+  - (bool): false if obj couldn't be filtered, in which case a 500 has been written
+*/
+func selectFields(c *gin.Context, obj any) (any, bool) {
+	raw, ok := c.GetQuery("fields")
+	if !ok {
+		return obj, true
+	}
+
+	selected := map[string]bool{}
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name != "" && !unselectableFields[name] {
+			selected[name] = true
+		}
+	}
+
+	body, err := json.Marshal(obj)
+	if err == nil {
+		var list []map[string]json.RawMessage
+		if json.Unmarshal(body, &list) == nil {
+			for i := range list {
+				list[i] = filterFields(list[i], selected)
+			}
+			return list, true
+		}
+
+		var object map[string]json.RawMessage
+		if err = json.Unmarshal(body, &object); err == nil {
+			return filterFields(object, selected), true
+		}
+	}
+
+	respondInternalError(c, "failed to select the response fields", err)
+	return nil, false
+}
+
+func filterFields(object map[string]json.RawMessage, selected map[string]bool) map[string]json.RawMessage {
+	for name := range object {
+		if !selected[name] {
+			delete(object, name)
+		}
+	}
+
+	return object
+}
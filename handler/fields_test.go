@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSelectFields(t *testing.T) {
+	obj := gin.H{"id": 1, "email": "alice@example.com", "password": "hash", "totpSecret": "secret"}
+
+	tests := []struct {
+		name  string
+		url   string
+		obj   any
+		want  []string
+		whole bool
+	}{
+		{"no fields", "/", obj, nil, true},
+		{"selected", "/?fields=id,email", obj, []string{"email", "id"}, false},
+		{"unknown ignored", "/?fields=id,%20nickname", obj, []string{"id"}, false},
+		{"sensitive never selected", "/?fields=id,password,totpSecret", obj, []string{"id"}, false},
+		{"list", "/?fields=email", []gin.H{obj, obj}, []string{"email"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", tt.url, nil)
+
+			got, ok := selectFields(c, tt.obj)
+			if !ok {
+				t.Fatal("selectFields() failed")
+			}
+			if tt.whole {
+				if !reflect.DeepEqual(got, tt.obj) {
+					t.Errorf("selectFields() = %v, want the object as is", got)
+				}
+				return
+			}
+
+			body, _ := json.Marshal(got)
+			var objects []map[string]any
+			if err := json.Unmarshal(body, &objects); err != nil {
+				var object map[string]any
+				json.Unmarshal(body, &object)
+				objects = []map[string]any{object}
+			}
+			for _, object := range objects {
+				names := make([]string, 0, len(object))
+				for name := range object {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				if !reflect.DeepEqual(names, tt.want) {
+					t.Errorf("fields = %v, want %v", names, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// IdempotencyKeyHeader lets clients safely retry a user creation, a request repeated with the same key returns the first result
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotencyKeyTTL is how long a key is remembered
+	idempotencyKeyTTL = 24 * time.Hour
+
+	// Idempotency keys are scoped per endpoint
+	idempotencyEndpointCreateUser = "user.create"
+	idempotencyEndpointRegister   = "auth.register"
+)
+
+// idempotencyFingerprint identifies a user creation request, so that a key reused for another user is rejected.
+func idempotencyFingerprint(data *model.UserCreateDTO) string {
+	return service.HashToken(strings.ToLower(data.Email))
+}
+
+/*
+lookupIdempotentUser returns the user created by a previous request sent with the same
+Idempotency-Key header on the endpoint.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - idempotencyService (*service.IdempotencyService): the service storing the keys
+  - userService (*service.UserService): the service used to fetch the user
+  - endpoint (string): the endpoint the key is scoped to
+  - fingerprint (string): the fingerprint of the current request
+
+Returns:
+  - (*model.User): the user of the first request, nil if there is no key or it hasn't been used yet
+  - (bool): false if the request must stop, in which case an error has been written
+*/
+func lookupIdempotentUser(c *gin.Context, idempotencyService *service.IdempotencyService, userService *service.UserService, endpoint, fingerprint string) (*model.User, bool) {
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if key == "" {
+		return nil, true
+	}
+	if len(key) > 191 {
+		respondError(c, http.StatusBadRequest, "the Idempotency-Key header must not exceed 191 characters")
+		return nil, false
+	}
+
+	record, err := idempotencyService.Find(c.Request.Context(), endpoint, key)
+	if errors.Is(err, service.ErrIdempotencyKeyNotFound) {
+		return nil, true
+	}
+	if err != nil {
+		respondInternalError(c, "failed to find idempotency key", err)
+		return nil, false
+	}
+
+	if record.Fingerprint != fingerprint {
+		respondError(c, http.StatusUnprocessableEntity, "the Idempotency-Key has already been used for another request")
+		return nil, false
+	}
+
+	user, err := userService.GetUser(c.Request.Context(), record.UserId)
+	if errors.Is(err, service.ErrUserNotFound) {
+		respondError(c, http.StatusNotFound, "the user created with this Idempotency-Key no longer exists")
+		return nil, false
+	}
+	if err != nil {
+		respondInternalError(c, "failed to get idempotent user", err)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// saveIdempotencyKey records the user created by the request, if it was sent with an Idempotency-Key header.
+func saveIdempotencyKey(c *gin.Context, idempotencyService *service.IdempotencyService, endpoint, fingerprint string, user *model.User) error {
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if key == "" {
+		return nil
+	}
+
+	return idempotencyService.Save(c.Request.Context(), endpoint, key, fingerprint, int(user.ID), idempotencyKeyTTL)
+}
+
+// writeIdempotencyConflict writes a 409 if err is an idempotency key conflict, and reports whether it did.
+func writeIdempotencyConflict(c *gin.Context, err error) bool {
+	if !errors.Is(err, service.ErrIdempotencyKeyConflict) {
+		return false
+	}
+
+	respondError(c, http.StatusConflict, "a request with this Idempotency-Key is already being processed")
+	return true
+}
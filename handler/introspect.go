@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"strconv"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Introspect godoc
+// @Summary      Introspect a token
+// @Description  tell a resource server whether a jwt is active, like RFC 7662: its signature, expiry and revocation are checked, along with its user who must still exist and not be suspended. An inactive token is a 200 with only active false, never an error. The permissions are the current ones of the user, a revoke applies before the jwt expires. Requires an API key with the token:introspect scope. The token is sent as a form, like the RFC, or as JSON
+// @Tags         Auth
+// @Accept       x-www-form-urlencoded
+// @Accept       json
+// @Produce      json
+// @Param        X-API-Key        header    string  true   "API key with the token:introspect scope"
+// @Param        token            formData  string  true   "The jwt to introspect"
+// @Param        token_type_hint  formData  string  false  "Ignored, only the jwt are introspected"
+// @Success      200  {object}  model.IntrospectionResponseDTO
+// @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      422  {object}  ValidationErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /auth/introspect [post]
+func (authHandler *AuthHandler) Introspect(c *gin.Context) {
+	data := &model.IntrospectionDTO{}
+	bind := bindJSON
+	if c.ContentType() == binding.MIMEPOSTForm {
+		bind = bindForm
+	}
+	if !bind(c, data) {
+		return
+	}
+
+	// The introspection result must not be cached, the token could be revoked right after
+	c.Header("Cache-Control", "no-store")
+
+	user, claims, err := authHandler.Authenticate(c.Request.Context(), data.Token)
+	if err != nil {
+		GetLogger(c).Info("introspected an inactive token", "reason", err)
+		respond(c, 200, &model.IntrospectionResponseDTO{Active: false})
+		return
+	}
+
+	// The permissions revoked since the jwt was issued must not be reported
+	permissions, err := authHandler.EffectivePermissions(c.Request.Context(), user, claims)
+	if err != nil {
+		respondInternalError(c, "failed to load permissions", err)
+		return
+	}
+
+	response := &model.IntrospectionResponseDTO{
+		Active:             true,
+		TokenType:          "access_token",
+		Sub:                strconv.FormatUint(uint64(user.ID), 10),
+		UserID:             user.ID,
+		Iss:                claims.Issuer,
+		Aud:                claims.Audience,
+		Jti:                claims.ID,
+		Role:               user.Role,
+		OrgID:              claims.OrgID,
+		Permissions:        permissions,
+		MustChangePassword: claims.MustChangePassword,
+	}
+	if user.Username != nil {
+		response.Username = *user.Username
+	}
+	if claims.ExpiresAt != nil {
+		response.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.Iat = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		response.Nbf = claims.NotBefore.Unix()
+	}
+
+	respond(c, 200, response)
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/auth"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+func TestIntrospect(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+	ctx := context.Background()
+
+	introspector, err := service.NewApiKeyService(s.db).Create(ctx, int(alice.ID), &model.ApiKeyCreateDTO{Name: "resource-server", Scopes: []string{model.ScopeTokenIntrospect}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := service.NewApiKeyService(s.db).Create(ctx, int(alice.ID), &model.ApiKeyCreateDTO{Name: "reader", Scopes: []string{model.ScopeUserRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, _, err := auth.NewTokenManager(testutil.JWTSecret, -time.Minute, auth.TokenOptions{}).Generate(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedClaims, err := s.auth.TokenManager.Generate(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.auth.RevokedTokenService.Revoke(ctx, revokedClaims.ID, revokedClaims.ExpiresAt.Time); err != nil {
+		t.Fatal(err)
+	}
+
+	malformed := "not a jwt"
+
+	tests := []struct {
+		name       string
+		apiKey     string
+		token      *string
+		form       bool
+		wantStatus int
+		wantActive bool
+	}{
+		{"active token", introspector.Key, &aliceToken, false, http.StatusOK, true},
+		{"active token as a form", introspector.Key, &aliceToken, true, http.StatusOK, true},
+		{"expired token", introspector.Key, &expired, false, http.StatusOK, false},
+		{"revoked token", introspector.Key, &revoked, true, http.StatusOK, false},
+		{"malformed token", introspector.Key, &malformed, false, http.StatusOK, false},
+		{"missing token", introspector.Key, nil, false, http.StatusUnprocessableEntity, false},
+		{"no API key", "", &aliceToken, false, http.StatusUnauthorized, false},
+		{"API key without the scope", reader.Key, &aliceToken, false, http.StatusForbidden, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			if tt.form {
+				form := url.Values{}
+				if tt.token != nil {
+					form.Set("token", *tt.token)
+				}
+				req, _ = http.NewRequest("POST", "/api/v1/auth/introspect", strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				body := map[string]string{}
+				if tt.token != nil {
+					body["token"] = *tt.token
+				}
+				req = testutil.JSONRequest(t, "POST", "/api/v1/auth/introspect", body)
+			}
+			if tt.apiKey != "" {
+				req.Header.Set(ApiKeyHeader, tt.apiKey)
+			}
+			w := testutil.Do(s.router, req)
+
+			expectStatus(t, w, tt.wantStatus)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+			var got map[string]any
+			testutil.DecodeJSON(t, w, &got)
+			if got["active"] != tt.wantActive {
+				t.Fatalf("active = %v, want %v", got["active"], tt.wantActive)
+			}
+			if !tt.wantActive {
+				// Nothing is told about an inactive token
+				if len(got) != 1 {
+					t.Errorf("response = %v, want only active", got)
+				}
+				return
+			}
+			if got["user_id"] != float64(alice.ID) || got["exp"] == nil || got["token_type"] != "access_token" {
+				t.Errorf("response = %v, want the user_id, exp and token_type of the token", got)
+			}
+		})
+	}
+}
+
+func TestIntrospectPermissions(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+	ctx := context.Background()
+	introspector, err := service.NewApiKeyService(s.db).Create(ctx, int(alice.ID), &model.ApiKeyCreateDTO{Name: "resource-server", Scopes: []string{model.ScopeTokenIntrospect}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.auth.PermissionService.GrantToUser(ctx, int(alice.ID), "users:export"); err != nil {
+		t.Fatal(err)
+	}
+	token := login(t, s, "alice@example.com", testutil.DefaultPassword)
+
+	introspect := func() []string {
+		t.Helper()
+		req := testutil.JSONRequest(t, "POST", "/api/v1/auth/introspect", map[string]string{"token": token})
+		req.Header.Set(ApiKeyHeader, introspector.Key)
+		w := testutil.Do(s.router, req)
+		expectStatus(t, w, http.StatusOK)
+		var got model.IntrospectionResponseDTO
+		testutil.DecodeJSON(t, w, &got)
+		if !got.Active {
+			t.Fatalf("response = %+v, want an active token", got)
+		}
+		return got.Permissions
+	}
+
+	if got := introspect(); !slices.Contains(got, "users:export") {
+		t.Errorf("permissions = %v, want users:export", got)
+	}
+
+	// The jwt still embeds the revoked permission, its version tells it is stale
+	if err := s.auth.PermissionService.RevokeFromUser(ctx, int(alice.ID), "users:export"); err != nil {
+		t.Fatal(err)
+	}
+	if got := introspect(); slices.Contains(got, "users:export") {
+		t.Errorf("permissions = %v, want users:export revoked", got)
+	}
+}
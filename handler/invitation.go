@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/MohammadBnei/gorm-user-auth/mailer"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/gin-gonic/gin"
+)
+
+type InvitationHandler struct {
+	authHandler       *AuthHandler
+	invitationService *service.InvitationService
+}
+
+/*
+NewInvitationHandler returns a new InvitationHandler.
+
+Parameters:
+- authHandler (*AuthHandler): The AuthHandler whose mailer, templates and config are used to send the invitations.
+- invitationService (*service.InvitationService): The service storing the invitations.
+
+Returns:
+- (*InvitationHandler): A pointer to the newly created InvitationHandler instance.
+*/
+func NewInvitationHandler(authHandler *AuthHandler, invitationService *service.InvitationService) *InvitationHandler {
+	return &InvitationHandler{
+		authHandler:       authHandler,
+		invitationService: invitationService,
+	}
+}
+
+// CreateInvitation godoc
+// @Summary      Invite someone to register
+// @Description  create an invitation for the email, valid INVITATION_TTL, and email it. Admin only. The invited user registers with POST /auth/register?invite=token, even when the public registration is closed, and joins the organization of the admin. The token is only returned in this response
+// @Tags         Invitation
+// @Accept       json
+// @Produce      json
+// @Param        invitation  body      model.InvitationCreateDTO  true  "Email to invite"
+// @Success      201         {object}  model.InvitationResponseDTO
+// @Failure      400         {object}  ErrorResponse
+// @Failure      401         {object}  ErrorResponse
+// @Failure      403         {object}  ErrorResponse
+// @Failure      409         {object}  ErrorResponse
+// @Failure      422         {object}  ValidationErrorResponse
+// @Router       /invitations [post]
+func (h *InvitationHandler) CreateInvitation(c *gin.Context) {
+	inviter, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "no user in the context")
+		return
+	}
+
+	var data *model.InvitationCreateDTO
+	if !bindJSON(c, &data) {
+		return
+	}
+
+	invitation, err := h.invitationService.Create(c.Request.Context(), data.Email, int(inviter.ID), callerOrgScope(c).OrgID, h.authHandler.INVITATION_TTL)
+	if errors.Is(err, service.ErrEmailTaken) {
+		respondError(c, http.StatusConflict, emailTakenMessage)
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to create invitation", err)
+		return
+	}
+
+	err = h.authHandler.MailTemplates.Send(h.authHandler.Mailer, mailer.InvitationTemplate, mailer.TemplateData{
+		Email:  invitation.Email,
+		Token:  invitation.Token,
+		AppURL: h.authHandler.APP_URL,
+	})
+	if err != nil {
+		GetLogger(c).Error("failed to send the invitation email", "error", err)
+	}
+
+	response := &model.InvitationResponseDTO{Invitation: invitation, Token: invitation.Token}
+	if h.authHandler.APP_URL != "" {
+		response.Link = h.authHandler.APP_URL + "/register?invite=" + invitation.Token
+	}
+
+	respond(c, http.StatusCreated, response)
+}
+
+/*
+writeInvitationError answers a registration whose invitation can't be accepted.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - err (error): the error returned by the registration
+
+Returns:
+  - (bool): true if err was an invitation error and the response has been written
+*/
+func writeInvitationError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, service.ErrInvitationNotFound):
+		respondError(c, http.StatusNotFound, err.Error())
+	case errors.Is(err, service.ErrInvitationExpired):
+		respondError(c, http.StatusGone, err.Error())
+	case errors.Is(err, service.ErrInvitationAccepted):
+		respondError(c, http.StatusConflict, err.Error())
+	case errors.Is(err, service.ErrInvitationEmailMismatch):
+		respondError(c, http.StatusForbidden, err.Error())
+	default:
+		return false
+	}
+
+	return true
+}
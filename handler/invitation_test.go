@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"github.com/gin-gonic/gin"
+)
+
+func TestInvitations(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) { conf.REGISTRATION_ENABLED = false })
+	admin, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+	_, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+
+	invite := func(t *testing.T, email string) string {
+		t.Helper()
+
+		w := s.do(t, "POST", "/api/v1/invitations", adminToken, gin.H{"email": email})
+		expectStatus(t, w, http.StatusCreated)
+		var response model.InvitationResponseDTO
+		testutil.DecodeJSON(t, w, &response)
+		if response.Token == "" || response.InviterId != int(admin.ID) || !strings.HasSuffix(response.Link, "/register?invite="+response.Token) {
+			t.Fatalf("invitation = %+v, want a token, the inviter and the link", response)
+		}
+
+		return response.Token
+	}
+	register := func(t *testing.T, token, email string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		return s.do(t, "POST", "/api/v1/auth/register?invite="+token, "", gin.H{"email": email, "password": "password"})
+	}
+
+	token := invite(t, "bob@example.com")
+	if len(s.mailer.sent) != 1 || s.mailer.sent[0].To != "bob@example.com" || !strings.Contains(s.mailer.sent[0].Body, token) {
+		t.Fatalf("sent emails = %+v, want the invitation sent to bob", s.mailer.sent)
+	}
+
+	expectStatus(t, register(t, token, "carol@example.com"), http.StatusForbidden)
+	expectStatus(t, register(t, token, "Bob@example.com"), http.StatusCreated)
+	expectStatus(t, register(t, token, "bob@example.com"), http.StatusConflict)
+	login(t, s, "Bob@example.com", "password")
+
+	expired := invite(t, "carol@example.com")
+	s.db.Model(&model.Invitation{}).Where("email = ?", "carol@example.com").Update("expires_at", time.Now().Add(-time.Minute))
+	expectStatus(t, register(t, expired, "carol@example.com"), http.StatusGone)
+	expectStatus(t, register(t, "unknown", "carol@example.com"), http.StatusNotFound)
+
+	// The public registration stays closed without an invite
+	expectStatus(t, register(t, "", "carol@example.com"), http.StatusForbidden)
+
+	expectStatus(t, s.do(t, "POST", "/api/v1/invitations", adminToken, gin.H{"email": "alice@example.com"}), http.StatusConflict)
+	expectStatus(t, s.do(t, "POST", "/api/v1/invitations", aliceToken, gin.H{"email": "dave@example.com"}), http.StatusForbidden)
+}
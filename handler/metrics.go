@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+Metrics is a middleware recording the duration of every request in the
+http_request_duration_seconds histogram.
+
+The route label is the matched route pattern (e.g. /api/v1/user/:id) rather than the
+raw path, so that IDs don't create a new series for every user.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		metrics.HTTPRequestDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsHandler serves the Prometheus metrics.
+func MetricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
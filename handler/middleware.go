@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kjk/betterguid"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+
+	requestIDKey = "requestId"
+	loggerKey    = "logger"
+)
+
+/*
+RequestLogger is a middleware that assigns a request ID to every request, injects a
+request-scoped logger into the gin context and logs the request once it has been handled.
+
+An incoming X-Request-ID header is reused when present so that IDs can be correlated
+across services, otherwise a new one is generated. The ID is always echoed back in the
+X-Request-ID response header.
+
+Parameters:
+- logger (*slog.Logger): The application logger the request-scoped logger derives from.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func RequestLogger(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := c.GetHeader(RequestIDHeader)
+		if requestID == "" || len(requestID) > 64 {
+			requestID = betterguid.New()
+		}
+
+		c.Set(requestIDKey, requestID)
+		c.Header(RequestIDHeader, requestID)
+
+		reqLogger := logger.With(
+			slog.String("requestId", requestID),
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+		)
+		c.Set(loggerKey, reqLogger)
+
+		c.Next()
+
+		attrs := []any{
+			slog.Int("status", c.Writer.Status()),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("clientIp", c.ClientIP()),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+
+		reqLogger.Info("request handled", attrs...)
+	}
+}
+
+// GetLogger returns the request-scoped logger set by RequestLogger, or the default logger if there is none.
+func GetLogger(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Get(loggerKey); ok {
+		if l, ok := logger.(*slog.Logger); ok {
+			return l
+		}
+	}
+
+	return slog.Default()
+}
+
+// GetRequestID returns the ID assigned to the current request by RequestLogger.
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+AllowNetworks is a middleware only letting through the clients whose IP, as returned by
+c.ClientIP() and so only read from X-Forwarded-For behind the TRUSTED_PROXIES, is in one
+of the networks. The others are rejected with a 403. It must come before the AuthMiddleware,
+so that the routes it protects don't even check the credentials of the outsiders.
+
+Parameters:
+- networks ([]*net.IPNet): The allowed IPv4 and IPv6 networks, see config.AdminAllowedNetworks. Empty to allow every client.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func AllowNetworks(networks []*net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(networks) == 0 {
+			c.Next()
+			return
+		}
+
+		if ip := net.ParseIP(c.ClientIP()); ip != nil {
+			for _, network := range networks {
+				if network.Contains(ip) {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		GetLogger(c).Warn("request from a network not allowed", "ip", c.ClientIP())
+		abortWithError(c, http.StatusForbidden, "access denied from this network")
+	}
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+func TestAdminAllowedNetworks(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidrs    []string
+		ip       string
+		withAuth bool
+		path     string
+		want     int
+	}{
+		{"ipv4 in range", []string{"192.0.2.0/24", "2001:db8::/32"}, "192.0.2.10", true, "/api/v1/user/", http.StatusOK},
+		{"ipv6 in range", []string{"192.0.2.0/24", "2001:db8::/32"}, "2001:db8::1", true, "/api/v1/user/", http.StatusOK},
+		{"single ip", []string{"198.51.100.7"}, "198.51.100.7", true, "/api/v1/user/", http.StatusOK},
+		{"ipv4 out of range", []string{"192.0.2.0/24", "2001:db8::/32"}, "198.51.100.1", true, "/api/v1/user/", http.StatusForbidden},
+		{"ipv6 out of range", []string{"192.0.2.0/24", "2001:db8::/32"}, "2001:db9::1", true, "/api/v1/user/", http.StatusForbidden},
+		{"out of range before auth", []string{"192.0.2.0/24"}, "198.51.100.1", false, "/api/v1/user/", http.StatusForbidden},
+		{"in range still authenticated", []string{"192.0.2.0/24"}, "192.0.2.10", false, "/api/v1/user/", http.StatusUnauthorized},
+		{"audit out of range", []string{"192.0.2.0/24"}, "198.51.100.1", true, "/api/v1/audit", http.StatusForbidden},
+		{"empty list allows all", nil, "198.51.100.1", true, "/api/v1/user/", http.StatusOK},
+		{"non admin route unaffected", []string{"192.0.2.0/24"}, "198.51.100.1", true, "/api/v1/user/1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(conf *config.Config) {
+				conf.ADMIN_ALLOWED_CIDRS = tt.cidrs
+			})
+			_, token := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+
+			req := testutil.JSONRequest(t, "GET", tt.path, nil)
+			req.RemoteAddr = net.JoinHostPort(tt.ip, "12345")
+			if tt.withAuth {
+				testutil.WithBearer(req, token)
+			}
+			w := testutil.Do(s.router, req)
+
+			expectStatus(t, w, tt.want)
+		})
+	}
+}
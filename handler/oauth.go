@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/webhook"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+// oauthProfile is the account information fetched from an OAuth provider
+type oauthProfile struct {
+	ID            string
+	Email         string
+	EmailVerified bool
+}
+
+type oauthProvider struct {
+	config       *oauth2.Config
+	fetchProfile func(ctx context.Context, client *http.Client) (*oauthProfile, error)
+}
+
+type OAuthHandler struct {
+	authHandler *AuthHandler
+	providers   map[string]*oauthProvider
+}
+
+/*
+NewOAuthHandler returns a new OAuthHandler with the providers configured in conf.
+A provider is only enabled when its client ID is set.
+
+Parameters:
+- authHandler (*AuthHandler): The AuthHandler used to find the users and issue the sessions.
+- conf (*config.Config): A pointer to the Config struct containing the OAUTH_* configuration.
+
+Returns:
+- (*OAuthHandler): A pointer to the newly created OAuthHandler instance.
+*/
+func NewOAuthHandler(authHandler *AuthHandler, conf *config.Config) *OAuthHandler {
+	providers := map[string]*oauthProvider{}
+
+	if conf.OAUTH_GOOGLE_CLIENT_ID != "" {
+		providers["google"] = &oauthProvider{
+			config: &oauth2.Config{
+				ClientID:     conf.OAUTH_GOOGLE_CLIENT_ID,
+				ClientSecret: conf.OAUTH_GOOGLE_CLIENT_SECRET,
+				RedirectURL:  conf.OAUTH_GOOGLE_REDIRECT_URL,
+				Endpoint:     endpoints.Google,
+				Scopes:       []string{"openid", "email"},
+			},
+			fetchProfile: fetchGoogleProfile,
+		}
+	}
+
+	if conf.OAUTH_GITHUB_CLIENT_ID != "" {
+		providers["github"] = &oauthProvider{
+			config: &oauth2.Config{
+				ClientID:     conf.OAUTH_GITHUB_CLIENT_ID,
+				ClientSecret: conf.OAUTH_GITHUB_CLIENT_SECRET,
+				RedirectURL:  conf.OAUTH_GITHUB_REDIRECT_URL,
+				Endpoint:     endpoints.GitHub,
+				Scopes:       []string{"user:email"},
+			},
+			fetchProfile: fetchGitHubProfile,
+		}
+	}
+
+	return &OAuthHandler{
+		authHandler: authHandler,
+		providers:   providers,
+	}
+}
+
+// OAuthLogin godoc
+// @Summary      Log in with an OAuth provider
+// @Description  redirect to the provider's consent page. The CSRF state is kept in an HttpOnly cookie
+// @Tags         Auth
+// @Param        provider  path  string  true  "OAuth provider"  Enums(google, github)
+// @Success      302
+// @Failure      404  {object}  ErrorResponse
+// @Router       /auth/oauth/{provider}/login [get]
+func (h *OAuthHandler) Login(c *gin.Context) {
+	provider, ok := h.provider(c)
+	if !ok {
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		respondInternalError(c, "failed to generate oauth state", err)
+		return
+	}
+
+	h.authHandler.setCookie(c, oauthStateCookie, state, 600, true)
+	c.Redirect(http.StatusFound, provider.config.AuthCodeURL(state))
+}
+
+// OAuthCallback godoc
+// @Summary      OAuth provider callback
+// @Description  exchange the authorization code, find or create the user by its verified email and log it in. No user is created when the registration is closed
+// @Tags         Auth
+// @Produce      json
+// @Param        provider  path      string  true  "OAuth provider"  Enums(google, github)
+// @Param        code      query     string  true  "Authorization code"
+// @Param        state     query     string  true  "CSRF state"
+// @Success      200       {object}  model.LoginResponseDTO
+// @Failure      400       {object}  ErrorResponse
+// @Failure      403       {object}  ErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Router       /auth/oauth/{provider}/callback [get]
+/*
+Callback handles the redirection from the provider. The state parameter must match the
+one stored in the cookie by Login, otherwise the request may have been forged. The profile
+fetched from the provider must have a verified email, which is used to link the account
+to an existing user or to create a new one, unless REGISTRATION_ENABLED is off. The session
+is then issued like Login does.
+*/
+func (h *OAuthHandler) Callback(c *gin.Context) {
+	provider, ok := h.provider(c)
+	if !ok {
+		return
+	}
+
+	returnError := curryReturnError(c, false)
+
+	state := h.authHandler.cookie(c, oauthStateCookie)
+	h.authHandler.setCookie(c, oauthStateCookie, "", -1, true)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		returnError(errors.New("invalid oauth state"))
+		return
+	}
+
+	if reason := c.Query("error"); reason != "" {
+		returnError(fmt.Errorf("oauth authorization failed: %s", reason))
+		return
+	}
+
+	token, err := provider.config.Exchange(c.Request.Context(), c.Query("code"))
+	if err != nil {
+		GetLogger(c).Warn("failed to exchange oauth code", "error", err)
+		returnError(errors.New("invalid authorization code"))
+		return
+	}
+
+	profile, err := provider.fetchProfile(c.Request.Context(), provider.config.Client(c.Request.Context(), token))
+	if err != nil {
+		respondInternalError(c, "failed to fetch oauth profile", err)
+		return
+	}
+
+	// Accounts are linked by email, an unverified one could be used to take over an existing user
+	if profile.Email == "" || !profile.EmailVerified {
+		returnError(errors.New("the provider account has no verified email"))
+		return
+	}
+
+	user, created, err := h.authHandler.UserService.FindOrCreateOAuthUser(c.Request.Context(), c.Param("provider"), profile.ID, profile.Email, h.authHandler.REGISTRATION_ENABLED)
+	if errors.Is(err, service.ErrUserNotFound) {
+		respondError(c, http.StatusForbidden, registrationClosedMessage)
+		return
+	}
+	if errors.Is(err, service.ErrEmailTaken) {
+		respondError(c, http.StatusConflict, emailTakenMessage)
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to find or create oauth user", err)
+		return
+	}
+	if created {
+		h.authHandler.Webhooks.Send(webhook.EventUserCreated, user.ToResponse())
+	}
+
+	if user.IsSuspended() {
+		writeAccountSuspended(c)
+		return
+	}
+
+	h.authHandler.recordLogin(c, user)
+
+	response, err := h.authHandler.createSession(c, h.authHandler.RTService, user, false)
+	if errors.Is(err, service.ErrTooManySessions) {
+		respondError(c, http.StatusForbidden, tooManySessionsMessage)
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to create the oauth session", err)
+		return
+	}
+	h.authHandler.setSessionCookies(c, response, false)
+	recordAudit(c, h.authHandler.AuditService, int(user.ID), model.AuditLogin, "oauth "+c.Param("provider"))
+
+	respond(c, 200, response)
+}
+
+// provider returns the provider named by the path, writing a 404 if it is unknown or not configured.
+func (h *OAuthHandler) provider(c *gin.Context) (*oauthProvider, bool) {
+	provider, ok := h.providers[c.Param("provider")]
+	if !ok {
+		respondError(c, http.StatusNotFound, "unknown oauth provider")
+		return nil, false
+	}
+
+	return provider, true
+}
+
+func fetchGoogleProfile(ctx context.Context, client *http.Client) (*oauthProfile, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &info); err != nil {
+		return nil, err
+	}
+
+	return &oauthProfile{
+		ID:            info.Sub,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+	}, nil
+}
+
+func fetchGitHubProfile(ctx context.Context, client *http.Client) (*oauthProfile, error) {
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &user); err != nil {
+		return nil, err
+	}
+
+	// The public email of the profile may be empty or unverified, the primary one is used instead
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return nil, err
+	}
+
+	profile := &oauthProfile{ID: strconv.FormatInt(user.ID, 10)}
+	for _, email := range emails {
+		if email.Primary {
+			profile.Email = email.Email
+			profile.EmailVerified = email.Verified
+		}
+	}
+
+	return profile, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
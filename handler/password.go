@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/MohammadBnei/gorm-user-auth/mailer"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/tokenutil"
+	"github.com/MohammadBnei/gorm-user-auth/webhook"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ForgotPassword godoc
+// @Summary      Request a password reset
+// @Description  send a password reset token to the email if it belongs to a user. The response is the same whether it does or not
+// @Tags         Auth
+// @Accept       json
+// @Produce      json
+// @Param        email  body      model.PasswordForgotDTO  true  "Email of the account"
+// @Success      202    {object}  MessageResponse
+// @Failure      400    {object}  ErrorResponse
+// @Router       /auth/password/forgot [post]
+/*
+ForgotPassword sends a password reset token to the user owning the email. To avoid
+disclosing which emails are registered, the same response is returned when there is
+no such user, and the email is sent in the background so that the SMTP round trip
+doesn't give the registered emails away by their response time.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) ForgotPassword(c *gin.Context) {
+	var data *model.PasswordForgotDTO
+	if !bindJSON(c, &data) {
+		return
+	}
+
+	accepted := func() {
+		respond(c, http.StatusAccepted, gin.H{
+			"message": "If the email belongs to an account, a reset token has been sent to it",
+		})
+	}
+
+	user, err := authHandler.UserService.GetUserByEmail(c.Request.Context(), data.Email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		accepted()
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to get user by email", err)
+		return
+	}
+
+	// Bound to the password hash, the token stops working once the password is changed
+	token, err := authHandler.LinkSigner.Sign(tokenutil.Payload{UserID: user.ID, Purpose: model.PurposePasswordReset}, authHandler.RESET_TOKEN_TTL, user.Password)
+	if err != nil {
+		respondInternalError(c, "failed to create password reset token", err)
+		return
+	}
+
+	logger := GetLogger(c)
+	go func() {
+		if err := authHandler.sendEmail(mailer.PasswordResetTemplate, user.Email, token); err != nil {
+			logger.Error("failed to send the password reset email", "error", err)
+		}
+	}()
+
+	accepted()
+}
+
+// ResetPassword godoc
+// @Summary      Reset a forgotten password
+// @Description  set a new password with the token sent by email. Every session of the user is revoked
+// @Tags         Auth
+// @Accept       json
+// @Produce      json
+// @Param        reset  body      model.PasswordResetDTO  true  "Reset token and new password"
+// @Success      200    {object}  MessageResponse
+// @Failure      400    {object}  ErrorResponse
+// @Failure      422    {object}  ErrorResponse
+// @Router       /auth/password/reset [post]
+/*
+ResetPassword verifies the reset token, updates the password and revokes all the user's
+refresh tokens in a single transaction, like ChangePassword does. The token is bound to the
+password it was issued for, and recorded as used in the transaction: of two concurrent resets
+with the same token, only one changes the password.
+
+@param authHandler *AuthHandler: an instance of the AuthHandler struct
+@param c *gin.Context: the current request context
+
+@return none
+*/
+func (authHandler *AuthHandler) ResetPassword(c *gin.Context) {
+	returnError := curryReturnError(c, false)
+
+	var data *model.PasswordResetDTO
+	if !bindJSON(c, &data) {
+		return
+	}
+
+	if data.NewPassword == "" {
+		returnError(errors.New("new password is required"))
+		return
+	}
+
+	payload, err := authHandler.LinkSigner.Verify(data.Token, model.PurposePasswordReset)
+	if err != nil {
+		returnError(errInvalidVerificationToken)
+		return
+	}
+	userId := int(payload.UserID)
+
+	err = authHandler.TxService.Transaction(c.Request.Context(), func(tx *service.TxServices) error {
+		if err := useLinkToken(c.Request.Context(), tx, payload); err != nil {
+			return err
+		}
+
+		user, err := tx.UserService.GetUser(c.Request.Context(), userId)
+		if errors.Is(err, service.ErrUserNotFound) || err == nil && !payload.BoundTo(user.Password) {
+			return errInvalidVerificationToken
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.UserService.UpdatePassword(c.Request.Context(), userId, data.NewPassword); err != nil {
+			return err
+		}
+
+		_, err = tx.RTService.RevokeAllForUser(c.Request.Context(), userId)
+		return err
+	})
+	// The token is only used up with the password change, rolled back here, the user can pick another password
+	if errors.Is(err, service.ErrPasswordReused) {
+		respondError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if errors.Is(err, errInvalidVerificationToken) {
+		returnError(err)
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to reset password", err)
+		return
+	}
+	authHandler.Webhooks.Send(webhook.EventUserPasswordChanged, gin.H{
+		"userId": userId,
+	})
+	recordAudit(c, authHandler.AuditService, userId, model.AuditPasswordChanged, "reset with an emailed token")
+
+	respond(c, 200, gin.H{
+		"message": "Password reset successfully, please log in",
+	})
+}
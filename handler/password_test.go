@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+// withPasswordHistory sets model.PasswordHistorySize for the duration of the test.
+func withPasswordHistory(t *testing.T, size int) {
+	previous := model.PasswordHistorySize
+	model.PasswordHistorySize = size
+	t.Cleanup(func() { model.PasswordHistorySize = previous })
+}
+
+func TestChangePasswordHistory(t *testing.T) {
+	withPasswordHistory(t, 2)
+	s := newTestServer(t, nil)
+	user, _ := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com", Password: "first password"})
+
+	steps := []struct {
+		name       string
+		current    string
+		new        string
+		wantStatus int
+	}{
+		{"new password", "first password", "second password", http.StatusOK},
+		{"immediately previous password", "second password", "first password", http.StatusUnprocessableEntity},
+		{"current password", "second password", "second password", http.StatusUnprocessableEntity},
+		{"another new password", "second password", "third password", http.StatusOK},
+		{"still remembered password", "third password", "first password", http.StatusUnprocessableEntity},
+		{"yet another new password", "third password", "fourth password", http.StatusOK},
+		// Only the 2 previous passwords are remembered
+		{"forgotten password", "fourth password", "first password", http.StatusOK},
+	}
+	for _, step := range steps {
+		// Every change revokes the tokens, each step logs in again
+		token, err := s.auth.GenerateToken(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := s.do(t, "PUT", "/api/v1/auth/password", token, model.PasswordChangeDTO{CurrentPassword: step.current, NewPassword: step.new})
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d, body: %s", step.name, w.Code, step.wantStatus, w.Body.String())
+		}
+	}
+
+	var remembered int64
+	s.db.Model(&model.PasswordHistory{}).Where("user_id = ?", user.ID).Count(&remembered)
+	if remembered != 2 {
+		t.Errorf("%d remembered passwords, want the history pruned to 2", remembered)
+	}
+}
+
+func TestChangePasswordWithoutHistory(t *testing.T) {
+	withPasswordHistory(t, 0)
+	s := newTestServer(t, nil)
+	_, token := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+
+	w := s.do(t, "PUT", "/api/v1/auth/password", token, model.PasswordChangeDTO{CurrentPassword: testutil.DefaultPassword, NewPassword: testutil.DefaultPassword})
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestPasswordChangeGate(t *testing.T) {
+	tests := []struct {
+		name         string
+		gate         bool
+		wantMeStatus int
+	}{
+		{"gate enabled", true, http.StatusForbidden},
+		{"gate disabled", false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(conf *config.Config) {
+				conf.PASSWORD_CHANGE_GATE = tt.gate
+			})
+			user := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+			if err := s.auth.UserService.SetMustChangePassword(context.Background(), int(user.ID), true); err != nil {
+				t.Fatal(err)
+			}
+
+			token := login(t, s, "alice@example.com", testutil.DefaultPassword)
+			if claims, _ := s.auth.TokenManager.Parse(token); !claims.MustChangePassword {
+				t.Error("chpwd claim = false, want true")
+			}
+			expectStatus(t, s.do(t, "GET", "/api/v1/auth/me", token, nil), tt.wantMeStatus)
+
+			// The password change is always allowed, and lifts the gate
+			w := s.do(t, "PUT", "/api/v1/auth/password", token, model.PasswordChangeDTO{CurrentPassword: testutil.DefaultPassword, NewPassword: "n3w password"})
+			expectStatus(t, w, http.StatusOK)
+
+			token = login(t, s, "alice@example.com", "n3w password")
+			if claims, _ := s.auth.TokenManager.Parse(token); claims.MustChangePassword {
+				t.Error("chpwd claim = true after the change, want none")
+			}
+			expectStatus(t, s.do(t, "GET", "/api/v1/auth/me", token, nil), http.StatusOK)
+		})
+	}
+}
+
+func TestNewPasswordTooLong(t *testing.T) {
+	s := newTestServer(t, nil)
+	tooLong := strings.Repeat("a", model.PasswordMaxBytes+1)
+
+	_, token := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com", Password: "first password"})
+	w := s.do(t, "PUT", "/api/v1/auth/password", token, model.PasswordChangeDTO{CurrentPassword: "first password", NewPassword: tooLong})
+	expectStatus(t, w, http.StatusUnprocessableEntity)
+
+	w = s.do(t, "POST", "/api/v1/auth/password/forgot", "", model.PasswordForgotDTO{Email: "alice@example.com"})
+	expectStatus(t, w, http.StatusAccepted)
+	reset := s.mailer.emailedToken(t, "alice@example.com")
+	w = s.do(t, "POST", "/api/v1/auth/password/reset", "", model.PasswordResetDTO{Token: reset, NewPassword: tooLong})
+	expectStatus(t, w, http.StatusUnprocessableEntity)
+
+	// The password is unchanged and the token still usable
+	w = s.do(t, "POST", "/api/v1/auth/password/reset", "", model.PasswordResetDTO{Token: reset, NewPassword: strings.Repeat("a", model.PasswordMaxBytes)})
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestResetPassword(t *testing.T) {
+	s := newTestServer(t, nil)
+	user := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+
+	w := s.do(t, "POST", "/api/v1/auth/password/forgot", "", model.PasswordForgotDTO{Email: "alice@example.com"})
+	expectStatus(t, w, http.StatusAccepted)
+	token := s.mailer.emailedToken(t, "alice@example.com")
+
+	w = s.do(t, "POST", "/api/v1/auth/password/forgot", "", model.PasswordForgotDTO{Email: "alice@example.com"})
+	expectStatus(t, w, http.StatusAccepted)
+	other := s.mailer.emailedToken(t, "alice@example.com")
+
+	// A tampered token isn't accepted
+	w = s.do(t, "POST", "/api/v1/auth/password/reset", "", model.PasswordResetDTO{Token: token + "x", NewPassword: "new password"})
+	expectStatus(t, w, http.StatusBadRequest)
+
+	w = s.do(t, "POST", "/api/v1/auth/password/reset", "", model.PasswordResetDTO{Token: token, NewPassword: "new password"})
+	expectStatus(t, w, http.StatusOK)
+	login(t, s, user.Email, "new password")
+
+	// The password change uses up every token issued for the previous password
+	for _, used := range []string{token, other} {
+		w = s.do(t, "POST", "/api/v1/auth/password/reset", "", model.PasswordResetDTO{Token: used, NewPassword: "another password"})
+		expectStatus(t, w, http.StatusBadRequest)
+	}
+}
+
+// blockingMailer holds every email until released, like a slow SMTP server
+type blockingMailer struct {
+	release chan struct{}
+	next    *recordingMailer
+}
+
+func (m blockingMailer) Send(to, subject, body string) error {
+	<-m.release
+	return m.next.Send(to, subject, body)
+}
+
+func TestForgotPasswordDoesNotWaitForTheEmail(t *testing.T) {
+	s := newTestServer(t, nil)
+	testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+	release := make(chan struct{})
+	s.auth.Mailer = blockingMailer{release: release, next: s.mailer}
+
+	// A registered email answers as fast as an unknown one, before the email is sent
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		done := make(chan int)
+		go func() {
+			done <- s.do(t, "POST", "/api/v1/auth/password/forgot", "", model.PasswordForgotDTO{Email: email}).Code
+		}()
+		select {
+		case status := <-done:
+			if status != http.StatusAccepted {
+				t.Fatalf("%s: status = %d, want %d", email, status, http.StatusAccepted)
+			}
+		case <-time.After(time.Second):
+			close(release)
+			t.Fatalf("%s: the response waits for the email", email)
+		}
+	}
+
+	close(release)
+	s.mailer.emailedToken(t, "alice@example.com")
+}
+
+func TestResetPasswordTokenTTL(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) { conf.RESET_TOKEN_TTL = 10 * time.Minute })
+	testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+
+	before := time.Now()
+	w := s.do(t, "POST", "/api/v1/auth/password/forgot", "", model.PasswordForgotDTO{Email: "alice@example.com"})
+	expectStatus(t, w, http.StatusAccepted)
+	payload, err := s.auth.LinkSigner.Verify(s.mailer.emailedToken(t, "alice@example.com"), model.PurposePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Unix(payload.ExpiresAt, 0)
+	if expiresAt.Before(before.Add(10*time.Minute).Truncate(time.Second)) || expiresAt.After(time.Now().Add(10*time.Minute)) {
+		t.Errorf("token expires at %s, want RESET_TOKEN_TTL after %s", expiresAt, before)
+	}
+}
+
+func TestResetPasswordConcurrently(t *testing.T) {
+	s := newTestServer(t, nil)
+	user := testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+
+	w := s.do(t, "POST", "/api/v1/auth/password/forgot", "", model.PasswordForgotDTO{Email: "alice@example.com"})
+	expectStatus(t, w, http.StatusAccepted)
+	token := s.mailer.emailedToken(t, "alice@example.com")
+
+	// Every request reads the same password hash, only one of them may use the token
+	const attempts = 8
+	statuses := make([]int, attempts)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			statuses[i] = s.do(t, "POST", "/api/v1/auth/password/reset", "", model.PasswordResetDTO{Token: token, NewPassword: fmt.Sprintf("new password %d", i)}).Code
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	winner := -1
+	for i, status := range statuses {
+		if status == http.StatusOK {
+			if winner >= 0 {
+				t.Fatalf("statuses = %v, want a single reset", statuses)
+			}
+			winner = i
+		}
+	}
+	if winner < 0 {
+		t.Fatalf("statuses = %v, want one reset", statuses)
+	}
+	login(t, s, user.Email, fmt.Sprintf("new password %d", winner))
+
+	var used int64
+	s.db.Model(&model.UsedToken{}).Count(&used)
+	if used != 1 {
+		t.Errorf("%d used tokens, want the token recorded once", used)
+	}
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateWindow counts the requests of a client in the current window
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+/*
+RateLimit is a middleware allowing each client IP, as returned by c.ClientIP(), at most
+limit requests per window. The next ones are rejected with a 429 and a Retry-After header
+until the window is over. The counters are kept in memory, each instance of the service
+limits on its own.
+
+Parameters:
+- limit (int): The number of requests allowed per window. 0 disables the middleware.
+- window (time.Duration): The duration of a window.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func RateLimit(limit int, window time.Duration) gin.HandlerFunc {
+	var mu sync.Mutex
+	windows := map[string]*rateWindow{}
+	lastSweep := time.Now()
+
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+
+		now := time.Now()
+		mu.Lock()
+		// The windows of the clients gone quiet are dropped, once per window
+		if now.Sub(lastSweep) >= window {
+			for ip, w := range windows {
+				if now.Sub(w.start) >= window {
+					delete(windows, ip)
+				}
+			}
+			lastSweep = now
+		}
+
+		w, ok := windows[c.ClientIP()]
+		if !ok || now.Sub(w.start) >= window {
+			w = &rateWindow{start: now}
+			windows[c.ClientIP()] = w
+		}
+		w.count++
+		count, retryAfter := w.count, window-now.Sub(w.start)
+		mu.Unlock()
+
+		if count > limit {
+			GetLogger(c).Warn("rate limit exceeded", "ip", c.ClientIP())
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			abortWithError(c, http.StatusTooManyRequests, "too many requests, retry later")
+			return
+		}
+
+		c.Next()
+	}
+}
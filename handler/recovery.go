@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+// internalErrorMessage is the only detail of an unexpected failure the clients get
+const internalErrorMessage = "internal server error"
+
+/*
+Recovery is a middleware recovering from the panics of the next handlers. The panic is logged
+with its stack trace through the request-scoped logger, and the client gets a JSON 500 with
+the request ID to report, never the stack trace. It must come after RequestLogger.
+
+A panic caused by the client closing the connection is only logged, as nothing can be
+written to it anymore.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func Recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			if err, ok := recovered.(error); ok && (errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)) {
+				GetLogger(c).Warn("connection closed by the client", "error", err)
+				c.Abort()
+				return
+			}
+
+			GetLogger(c).Error("panic recovered", "panic", recovered, "stack", string(debug.Stack()))
+
+			// Part of the response has been sent already, the status can't be changed
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, &EnvelopeError{
+				Message:   internalErrorMessage,
+				RequestID: GetRequestID(c),
+			}))
+		}()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRecovery(t *testing.T) {
+	tests := []struct {
+		name        string
+		envelope    bool
+		compression bool
+	}{
+		{"raw", false, false},
+		{"enveloped", true, false},
+		{"compressed", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			r := gin.New()
+			r.Use(RequestLogger(slog.New(slog.NewJSONHandler(&logs, nil))), Recovery(), ResponseFormat(tt.envelope))
+			if tt.compression {
+				r.Use(Compression(0))
+			}
+			r.GET("/panic", func(c *gin.Context) {
+				panic("something went wrong")
+			})
+
+			req := testutil.JSONRequest(t, "GET", "/panic", nil)
+			req.Header.Set(RequestIDHeader, "request-1")
+			req.Header.Set("Accept-Encoding", "gzip")
+			w := testutil.Do(r, req)
+
+			expectStatus(t, w, http.StatusInternalServerError)
+			if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+				t.Errorf("Content-Encoding = %q, want the error uncompressed", encoding)
+			}
+			body, _ := io.ReadAll(w.Body)
+			if strings.Contains(string(body), "something went wrong") || strings.Contains(string(body), "goroutine") {
+				t.Errorf("body = %s, want neither the panic nor the stack trace", body)
+			}
+
+			var got struct {
+				Error     any    `json:"error"`
+				RequestID string `json:"requestId"`
+			}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("body %s isn't JSON: %v", body, err)
+			}
+			if tt.envelope {
+				envelope, _ := got.Error.(map[string]any)
+				if envelope["message"] != internalErrorMessage || envelope["requestId"] != "request-1" {
+					t.Errorf("error = %v, want the generic message and the request ID", got.Error)
+				}
+			} else if got.Error != internalErrorMessage || got.RequestID != "request-1" {
+				t.Errorf("body = %s, want the generic message and the request ID", body)
+			}
+
+			if !strings.Contains(logs.String(), "something went wrong") || !strings.Contains(logs.String(), "recovery_test.go") {
+				t.Errorf("logs = %s, want the panic and its stack trace", logs.String())
+			}
+		})
+	}
+}
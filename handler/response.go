@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	envelopeKey     = "envelope"
+	metaKey         = "meta"
+	errorDetailsKey = "errorDetails"
+)
+
+// Envelope is the shape of every response body when RESPONSE_ENVELOPE is enabled.
+type Envelope struct {
+	Data  any            `json:"data"`
+	Error *EnvelopeError `json:"error"`
+	Meta  map[string]any `json:"meta,omitempty"`
+}
+
+// EnvelopeError describes the failure of an enveloped response.
+type EnvelopeError struct {
+	Message string `json:"message" example:"record not found"`
+	// Fields are the validation failures of the request body, by JSON field name
+	Fields map[string]string `json:"fields,omitempty"`
+	// RequestID identifies the request in the logs, it is only set on the unexpected failures
+	RequestID string `json:"requestId,omitempty" example:"-NU2m1f8k0XqQ9aLcB1z"`
+}
+
+/*
+ResponseFormat is a middleware selecting the shape of the response bodies written by the
+handlers. Raw, the default, writes the objects as is and the failures as {"error": message}.
+Enveloped, every body is {"data": ..., "error": ..., "meta": ...}, the list endpoints put
+their pagination in meta.
+
+Parameters:
+- envelope (bool): Whether the responses are enveloped, from RESPONSE_ENVELOPE.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func ResponseFormat(envelope bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(envelopeKey, envelope)
+		c.Next()
+	}
+}
+
+/*
+ErrorDetails is a middleware selecting whether the messages of the 5xx responses reach the
+clients. Without details, the default, they are replaced by the status text, e.g. "internal
+server error", along with the request ID to report, while the handlers log the full error
+with the same request ID. The 4xx messages, describing what is wrong with the request, are
+always returned.
+
+Parameters:
+- enabled (bool): Whether the details are returned, from config.ErrorDetails.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func ErrorDetails(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(errorDetailsKey, enabled)
+		c.Next()
+	}
+}
+
+// respond writes data with the status, enveloped if the ResponseFormat asks for it.
+func respond(c *gin.Context, status int, data any) {
+	c.JSON(status, responseBody(c, data))
+}
+
+// respondError writes the failure message with the status, as {"error": message} or enveloped.
+// The message of a 5xx is only returned with ErrorDetails.
+func respondError(c *gin.Context, status int, message string) {
+	c.JSON(status, errorBody(c, failure(c, status, message)))
+}
+
+// abortWithError is respondError for the middlewares, nothing after them runs.
+func abortWithError(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, errorBody(c, failure(c, status, message)))
+}
+
+// respondInternalError logs the unexpected err with message and answers a 500, which only carries err with ErrorDetails.
+func respondInternalError(c *gin.Context, message string, err error) {
+	GetLogger(c).Error(message, "error", err)
+	respondError(c, http.StatusInternalServerError, err.Error())
+}
+
+// failure is the EnvelopeError of a failure. A 5xx gets the request ID, and the status text unless ErrorDetails.
+func failure(c *gin.Context, status int, message string) *EnvelopeError {
+	if status < http.StatusInternalServerError {
+		return &EnvelopeError{Message: message}
+	}
+	if !c.GetBool(errorDetailsKey) {
+		message = strings.ToLower(http.StatusText(status))
+	}
+
+	return &EnvelopeError{Message: message, RequestID: GetRequestID(c)}
+}
+
+// respondValidationError writes the validation failures of the request body with a 422.
+func respondValidationError(c *gin.Context, fields map[string]string) {
+	c.JSON(http.StatusUnprocessableEntity, errorBody(c, &EnvelopeError{Message: "validation failed", Fields: fields}))
+}
+
+// setMeta adds an entry to the meta of the enveloped response, e.g. the pagination of a list.
+// It is ignored by the raw responses, which carry it in headers instead.
+func setMeta(c *gin.Context, key string, value any) {
+	meta, _ := c.Get(metaKey)
+	m, ok := meta.(map[string]any)
+	if !ok {
+		m = map[string]any{}
+		c.Set(metaKey, m)
+	}
+	m[key] = value
+}
+
+func enveloped(c *gin.Context) bool {
+	return c.GetBool(envelopeKey)
+}
+
+func responseBody(c *gin.Context, data any) any {
+	if !enveloped(c) {
+		return data
+	}
+
+	meta, _ := c.Get(metaKey)
+	m, _ := meta.(map[string]any)
+
+	return &Envelope{Data: data, Meta: m}
+}
+
+func errorBody(c *gin.Context, err *EnvelopeError) any {
+	if !enveloped(c) {
+		body := gin.H{"error": err.Message}
+		if err.Fields != nil {
+			body["fields"] = err.Fields
+		}
+		if err.RequestID != "" {
+			body["requestId"] = err.RequestID
+		}
+		return body
+	}
+
+	return &Envelope{Error: err}
+}
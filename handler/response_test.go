@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"github.com/gin-gonic/gin"
+)
+
+func TestErrorDetails(t *testing.T) {
+	tests := []struct {
+		name        string
+		details     bool
+		status      int
+		wantMessage string
+		wantID      bool
+	}{
+		{"internal error hidden", false, http.StatusInternalServerError, internalErrorMessage, true},
+		{"internal error detailed", true, http.StatusInternalServerError, "database is locked", true},
+		{"unavailable hidden", false, http.StatusServiceUnavailable, "service unavailable", true},
+		{"client error kept", false, http.StatusBadRequest, "database is locked", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			r := gin.New()
+			r.Use(RequestLogger(slog.New(slog.NewJSONHandler(&logs, nil))), ResponseFormat(false), ErrorDetails(tt.details))
+			r.GET("/fail", func(c *gin.Context) {
+				err := errors.New("database is locked")
+				if tt.status == http.StatusInternalServerError {
+					respondInternalError(c, "failed to load", err)
+					return
+				}
+				respondError(c, tt.status, err.Error())
+			})
+
+			req := testutil.JSONRequest(t, "GET", "/fail", nil)
+			req.Header.Set(RequestIDHeader, "request-1")
+			w := testutil.Do(r, req)
+
+			expectStatus(t, w, tt.status)
+			var got struct {
+				Error     string `json:"error"`
+				RequestID string `json:"requestId"`
+			}
+			testutil.DecodeJSON(t, w, &got)
+			if got.Error != tt.wantMessage {
+				t.Errorf("error = %q, want %q", got.Error, tt.wantMessage)
+			}
+			if gotID := got.RequestID == "request-1"; gotID != tt.wantID {
+				t.Errorf("requestId = %q, want it set: %v", got.RequestID, tt.wantID)
+			}
+
+			// The details are always logged, with the request ID to find them from the response
+			if tt.status == http.StatusInternalServerError && (!strings.Contains(logs.String(), "database is locked") || !strings.Contains(logs.String(), "request-1")) {
+				t.Errorf("logs = %s, want the error and the request ID", logs.String())
+			}
+		})
+	}
+}
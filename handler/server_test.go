@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/mailer"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/storage"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"github.com/gin-gonic/gin"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+	"gorm.io/gorm"
+)
+
+// testServer is the application wired like main does, on top of a test database
+type testServer struct {
+	db     *gorm.DB
+	router *gin.Engine
+	auth   *AuthHandler
+	mailer *recordingMailer
+	files  *storage.MemoryStorage
+}
+
+// newTestServer returns a testServer configured by testutil.Config, changed by configure if not nil.
+func newTestServer(t *testing.T, configure func(conf *config.Config)) *testServer {
+	t.Helper()
+
+	conf := testutil.Config()
+	if configure != nil {
+		configure(conf)
+	}
+
+	db := testutil.NewDB(t)
+	templates, err := mailer.LoadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &recordingMailer{}
+
+	userService := service.NewUserService(db)
+	idempotencyService := service.NewIdempotencyService(db)
+	txService := service.NewTxService(db)
+	auditService := service.NewAuditService(db)
+	userHandler := NewUserHandler(userService, idempotencyService, txService, nil, auditService, conf)
+	authHandler := NewAuthHandler(service.NewRTService(db), userService, service.NewRevokedTokenService(db), idempotencyService, txService, m, templates, nil, auditService, service.NewPermissionService(db), conf)
+	apiKeyHandler := NewApiKeyHandler(service.NewApiKeyService(db))
+	files := storage.NewMemoryStorage("https://files.example.com")
+
+	r := gin.New()
+	r.Use(RequestLogger(slog.New(slog.NewTextHandler(io.Discard, nil))), Recovery(), ResponseFormat(conf.RESPONSE_ENVELOPE), ErrorDetails(conf.ErrorDetails()))
+	if conf.COMPRESSION_ENABLED {
+		r.Use(Compression(conf.COMPRESSION_MIN_SIZE))
+	}
+	r.Use(Timeout(conf.REQUEST_TIMEOUT, "/api/v1/user/bulk"))
+	if conf.SWAGGER_ENABLED {
+		r.GET("/swagger/*any", BasicAuth("swagger", conf.SWAGGER_USER, conf.SWAGGER_PASS), ginSwagger.WrapHandler(swaggerFiles.Handler))
+	}
+
+	read, write := RequireScope(model.ScopeUserRead), RequireScope(model.ScopeUserWrite)
+	userAuth := []gin.HandlerFunc{apiKeyHandler.ApiKeyOr(authHandler.AuthMiddleware()), authHandler.CSRFMiddleware()}
+	userApi := r.Group("/api/v1/user", userAuth...)
+	userApi.GET("/:id", read, userHandler.GetUser)
+	userApi.PUT("/email", write, authHandler.ChangeEmail)
+	userApi.POST("/avatar", write, NewAvatarHandler(userService, files, conf).UploadAvatar)
+	userApi.PUT("/:id", write, userHandler.UpdateUser)
+	userApi.DELETE("/:id", write, userHandler.DeleteUser)
+	adminNetworks := AllowNetworks(conf.AdminAllowedNetworks())
+	adminUserApi := r.Group("/api/v1/user", append([]gin.HandlerFunc{adminNetworks}, userAuth...)...)
+	adminUserApi.GET("/search", read, authHandler.RequireAdmin(), userHandler.SearchUsers)
+	adminUserApi.GET("/", read, authHandler.RequireAdmin(), userHandler.GetUsers)
+	adminUserApi.POST("/", write, authHandler.RequireAdmin(), userHandler.CreateUser)
+	r.GET("/api/v1/user/check-username", userHandler.CheckUsername)
+	r.GET("/api/v1/user/check-email", RateLimit(conf.CHECK_EMAIL_RATE_LIMIT, time.Minute), userHandler.CheckEmail)
+	r.POST("/api/v1/user/email/confirm", authHandler.ConfirmEmail)
+
+	authApi := r.Group("/api/v1/auth")
+	authApi.POST("/login", authHandler.Login)
+	authApi.POST("/register", authHandler.Register)
+	authApi.GET("/me", authHandler.AuthMiddleware(), authHandler.Me)
+	authApi.DELETE("/me", authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.DeleteMe)
+	authApi.POST("/logout", authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.Logout)
+	authApi.PUT("/password", authHandler.AllowPasswordChange(), authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.ChangePassword)
+	authApi.POST("/introspect", apiKeyHandler.ApiKeyMiddleware(), RequireScope(model.ScopeTokenIntrospect), authHandler.Introspect)
+	authApi.POST("/password/forgot", authHandler.ForgotPassword)
+	authApi.POST("/password/reset", authHandler.ResetPassword)
+	authApi.GET("/sessions", authHandler.AuthMiddleware(), authHandler.ListSessions)
+	authApi.DELETE("/sessions", authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.RevokeAllSessions)
+	authApi.DELETE("/sessions/:id", authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.RevokeSession)
+	r.POST("/api/v1/invitations", adminNetworks, authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.RequireAdmin(), NewInvitationHandler(authHandler, service.NewInvitationService(db)).CreateInvitation)
+	r.GET("/api/v1/audit", adminNetworks, authHandler.AuthMiddleware(), authHandler.RequireAdmin(), NewAuditHandler(auditService).ListAuditLogs)
+
+	return &testServer{
+		db:     db,
+		router: r,
+		auth:   authHandler,
+		mailer: m,
+		files:  files,
+	}
+}
+
+// do sends the JSON request, authenticated by token unless it is empty.
+func (s *testServer) do(t *testing.T, method, path, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := testutil.JSONRequest(t, method, path, body)
+	if token != "" {
+		testutil.WithBearer(req, token)
+	}
+
+	return testutil.Do(s.router, req)
+}
+
+// seedUser seeds the user of the fixture and returns it with a valid jwt.
+func (s *testServer) seedUser(t *testing.T, fixture testutil.UserFixture) (*model.User, string) {
+	t.Helper()
+
+	user := testutil.SeedUser(t, s.db, fixture)
+	token, err := s.auth.GenerateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, token
+}
+
+// login logs the user in and returns its jwt.
+func login(t *testing.T, s *testServer, email, password string) string {
+	t.Helper()
+
+	w := s.do(t, "POST", "/api/v1/auth/login", "", model.LoginDTO{Email: email, Password: password})
+	expectStatus(t, w, http.StatusOK)
+	var response model.LoginResponseDTO
+	testutil.DecodeJSON(t, w, &response)
+
+	return response.Token
+}
+
+// emailedToken returns the token of the link in the last email sent to. Some emails are sent
+// in the background, it waits a bit for one newer than the email of the previous call.
+func (m *recordingMailer) emailedToken(t *testing.T, to string) string {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if token, ok := m.lastToken(to); ok {
+			return token
+		}
+	}
+	t.Fatalf("no token emailed to %s", to)
+
+	return ""
+}
+
+func (m *recordingMailer) lastToken(to string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.sent) - 1; i >= m.read; i-- {
+		if m.sent[i].To != to {
+			continue
+		}
+		if match := emailedTokenPattern.FindStringSubmatch(m.sent[i].Body); match != nil {
+			m.read = i + 1
+			return match[1], true
+		}
+	}
+
+	return "", false
+}
+
+var emailedTokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_.-]+)`)
+
+// expectStatus fails the test if the response doesn't have the wanted status.
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d, body: %s", w.Code, want, w.Body.String())
+	}
+}
+
+// recordingMailer keeps the emails sent instead of sending them
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []sentEmail
+	// read is the index following the last email emailedToken returned the token of
+	read int
+}
+
+type sentEmail struct {
+	To, Subject, Body string
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, sentEmail{To: to, Subject: subject, Body: body})
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Timeout is a middleware giving each request a deadline. Once it is exceeded, the context of
+the request is cancelled, which stops the database queries and the calls made with it, and
+the client gets a 503 instead of whatever the handler wrote. The response is buffered until
+the handler returns so that it can still be replaced. The handler isn't moved to another
+goroutine, gin's context can't be shared across them: a handler ignoring its context is only
+cut off once it returns.
+
+Parameters:
+- timeout (time.Duration): The deadline of the requests, from REQUEST_TIMEOUT. 0 disables the middleware.
+- excludedPrefixes (...string): The paths left alone, e.g. the long-running endpoints.
+
+Returns:
+- gin.HandlerFunc: A function that handles the middleware.
+*/
+func Timeout(timeout time.Duration, excludedPrefixes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+		for _, prefix := range excludedPrefixes {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) {
+				c.Next()
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		// The status starts as the one set by gin, e.g. the 404 of an unknown route
+		writer := &timeoutResponseWriter{ResponseWriter: c.Writer, header: c.Writer.Header().Clone(), status: c.Writer.Status()}
+		c.Writer = writer
+		handled := false
+		defer func() {
+			// On a panic, the buffered response is dropped and the Recovery writes its error
+			if !handled {
+				c.Writer = writer.ResponseWriter
+			}
+		}()
+
+		c.Next()
+		handled = true
+		c.Writer = writer.ResponseWriter
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			GetLogger(c).Warn("request timed out", "timeout", timeout)
+			abortWithError(c, http.StatusServiceUnavailable, "the request timed out")
+			return
+		}
+		writer.flush()
+	}
+}
+
+// timeoutResponseWriter holds the headers and the body until the handler returns
+type timeoutResponseWriter struct {
+	gin.ResponseWriter
+	header  http.Header
+	status  int
+	written bool
+	buffer  bytes.Buffer
+}
+
+func (w *timeoutResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutResponseWriter) WriteHeader(status int) {
+	if status > 0 && !w.written {
+		w.status = status
+	}
+}
+
+// WriteHeaderNow is delayed to flush, the response may still be replaced by the 503
+func (w *timeoutResponseWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *timeoutResponseWriter) Write(data []byte) (int, error) {
+	w.written = true
+	return w.buffer.Write(data)
+}
+
+func (w *timeoutResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *timeoutResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *timeoutResponseWriter) Size() int {
+	if !w.written {
+		return -1
+	}
+	return w.buffer.Len()
+}
+
+func (w *timeoutResponseWriter) Written() bool {
+	return w.written
+}
+
+// flush sends the buffered response to the underlying writer
+func (w *timeoutResponseWriter) flush() {
+	header := w.ResponseWriter.Header()
+	for key := range header {
+		if _, ok := w.header[key]; !ok {
+			header.Del(key)
+		}
+	}
+	for key, values := range w.header {
+		header[key] = values
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buffer.Len() > 0 {
+		w.ResponseWriter.Write(w.buffer.Bytes())
+	} else if w.written {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"github.com/gin-gonic/gin"
+)
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		path       string
+		delay      time.Duration
+		want       int
+		wantHeader string
+	}{
+		{"fast handler", 50 * time.Millisecond, "/work", 0, http.StatusOK, "done"},
+		{"slow handler cut off", 50 * time.Millisecond, "/work", time.Second, http.StatusServiceUnavailable, ""},
+		{"excluded path", 50 * time.Millisecond, "/long/work", 100 * time.Millisecond, http.StatusOK, "done"},
+		{"disabled", 0, "/work", 100 * time.Millisecond, http.StatusOK, "done"},
+		{"unknown route keeps its 404", 50 * time.Millisecond, "/unknown", 0, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(Timeout(tt.timeout, "/long"))
+			handler := func(c *gin.Context) {
+				// A slow handler stops once its request context is cancelled
+				select {
+				case <-time.After(tt.delay):
+				case <-c.Request.Context().Done():
+				}
+				c.Header("X-Work", "done")
+				c.JSON(http.StatusOK, gin.H{"status": "done"})
+			}
+			r.GET("/work", handler)
+			r.GET("/long/work", handler)
+
+			start := time.Now()
+			w := testutil.Do(r, testutil.JSONRequest(t, "GET", tt.path, nil))
+
+			expectStatus(t, w, tt.want)
+			if got := w.Header().Get("X-Work"); got != tt.wantHeader {
+				t.Errorf("X-Work = %q, want %q", got, tt.wantHeader)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second/2 {
+				t.Errorf("request took %s, want the slow handler cut off", elapsed)
+			}
+		})
+	}
+}
@@ -1,49 +1,164 @@
 package handler
 
 import (
-	"log"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"strconv"
-	"time"
+	"strings"
 
+	"github.com/MohammadBnei/gorm-user-auth/config"
 	"github.com/MohammadBnei/gorm-user-auth/model"
 	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/webhook"
 	"github.com/gin-gonic/gin"
 )
 
 type UserHandler struct {
-	userService *service.UserService
+	userService        *service.UserService
+	idempotencyService *service.IdempotencyService
+	txService          *service.TxService
+	webhooks           *webhook.WebhookService
+	auditService       *service.AuditService
+	conf               *config.Config
 }
 
-func NewUserHandler(userService *service.UserService) *UserHandler {
+func NewUserHandler(userService *service.UserService, idempotencyService *service.IdempotencyService, txService *service.TxService, webhooks *webhook.WebhookService, auditService *service.AuditService, conf *config.Config) *UserHandler {
 	return &UserHandler{
-		userService: userService,
+		userService:        userService,
+		idempotencyService: idempotencyService,
+		txService:          txService,
+		webhooks:           webhooks,
+		auditService:       auditService,
+		conf:               conf,
 	}
 }
 
-type UserRespone struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
-}
+const (
+	// TotalCountHeader carries the total number of items of a list
+	TotalCountHeader = "X-Total-Count"
+	// NextCursorHeader carries the cursor of the next page of a list, it is absent on the last page
+	NextCursorHeader = "X-Next-Cursor"
+
+	emailTakenMessage    = "a user with this email already exists"
+	usernameTakenMessage = "a user with this username already exists"
+	// usernameInvalidReason describes model.ValidUsername
+	usernameInvalidReason = "must be 3 to 32 letters, digits, dots, dashes or underscores"
+)
 
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error string `json:"error" example:"record not found"`
+}
+
+// ValidationErrorResponse reports the fields of a body failing their validation rules
+type ValidationErrorResponse struct {
+	Error  string            `json:"error" example:"validation failed"`
+	Fields map[string]string `json:"fields"`
+}
+
+type MessageResponse struct {
+	Message string `json:"message" example:"User deleted successfully"`
+}
+
+/*
+authorizeOwner checks that the authenticated user is the user identified by id, or an admin.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - id (int): the ID of the user being accessed
+  - message (string): the error message returned on a 403
+
+Returns:
+  - (*model.User): the authenticated user
+  - (bool): false if the access is denied, in which case a 401 or 403 has been written
+*/
+func authorizeOwner(c *gin.Context, id int, message string) (*model.User, bool) {
+	currentUser, ok := CurrentUser(c)
+	if !ok {
+		respondError(c, 401, "no user in the context")
+		return nil, false
+	}
+
+	if !currentUser.IsAdmin() && int(currentUser.ID) != id {
+		respondError(c, 403, message)
+		return nil, false
+	}
+
+	return currentUser, true
+}
+
+/*
+callerOrgScope returns the organization the caller is scoped to, from the org claim of its
+jwt, or from its user when it is authenticated by an API key.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+
+Returns:
+  - (*model.OrgScope): the scope of the caller's queries, never nil
+*/
+func callerOrgScope(c *gin.Context) *model.OrgScope {
+	if claims, ok := CurrentClaims(c); ok {
+		return &model.OrgScope{OrgID: claims.OrgID}
+	}
+
+	if user, ok := CurrentUser(c); ok {
+		return &model.OrgScope{OrgID: user.OrgID}
+	}
+
+	return &model.OrgScope{}
+}
+
+/*
+requireUserInCallerOrg checks that the user identified by id belongs to the organization of
+the caller. A user of another organization gets the same 404 as a missing one, so that its
+existence isn't leaked.
+
+Parameters:
+  - c (*gin.Context): the context of the current HTTP request
+  - id (int): the ID of the user being accessed
+
+Returns:
+  - (bool): false if the user isn't in the organization, in which case a 404 or 400 has been written
+*/
+func (h *UserHandler) requireUserInCallerOrg(c *gin.Context, id int) bool {
+	_, err := h.userService.GetUserInOrg(c.Request.Context(), id, callerOrgScope(c))
+	if errors.Is(err, service.ErrUserNotFound) {
+		respondError(c, 404, err.Error())
+		return false
+	}
+	if err != nil {
+		respondInternalError(c, "failed to get user", err)
+		return false
+	}
+
+	return true
 }
 
 // GetUser godoc
 // @Summary      Get a User
-// @Description  get user by ID
+// @Description  get user by ID. Users can only get themselves, admins can get anyone. Admins can include the active sessions with include=sessions
 // @Tags         User
 // @Accept       json
 // @Produce      json
-// @Param        id   path      int  true  "User ID"
-// @Success      200  {object}  UserRespone
+// @Param        id       path      int     true   "User ID"
+// @Param        include  query     string  false  "Include the active sessions, admin only"  Enums(sessions)
+// @Param        fields   query     string  false  "Comma separated fields to return, e.g. id,email,createdAt"
+// @Param        If-None-Match  header  string  false  "ETag of a previous response"
+// @Success      200  {object}  model.UserResponseDTO
+// @Header       200  {string}  ETag  "Version of the user"
+// @Success      304  "The user wasn't modified since the If-None-Match ETag"
 // @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse
 // @Failure      500  {object}  ErrorResponse
 // @Router       /user/{id} [get]
 /*
-GetUser gets a user by their ID from the userService and returns it in the response body.
+GetUser gets a user by their ID from the userService and returns it in the response body,
+restricted to the requested fields if any. The response carries an ETag, a request whose
+If-None-Match matches it gets a 304 without body.
 
 Parameters:
   - c (*gin.Context): the context of the current HTTP request
@@ -51,135 +166,739 @@ Parameters:
 
 Errors:
   - 400 Bad Request: if the parameter id cannot be converted to an integer, or if there is an error retrieving the user
+  - 403 Forbidden: if a non admin user asks for the sessions
+  - 404 Not Found: if there is no user with this id
 */
 func (h *UserHandler) GetUser(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		log.Println(err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+	id, ok := parseIDParam(c, "id")
+	if !ok {
 		return
 	}
 
-	user, err := h.userService.GetUser(id)
+	currentUser, ok := authorizeOwner(c, id, "you can only access your own user")
+	if !ok {
+		return
+	}
+
+	scope := callerOrgScope(c)
+	getUser := func(ctx context.Context, id int) (*model.User, error) {
+		return h.userService.GetUserInOrg(ctx, id, scope)
+	}
+	// The sessions expose the IPs of the user, only admins can see them
+	if c.Query("include") == "sessions" {
+		if !currentUser.IsAdmin() {
+			respondError(c, 403, "admin role required to include the sessions")
+			return
+		}
+		getUser = func(ctx context.Context, id int) (*model.User, error) {
+			return h.userService.GetUserWithSessions(ctx, id, scope)
+		}
+	}
+
+	user, err := getUser(c.Request.Context(), id)
+	if errors.Is(err, service.ErrUserNotFound) {
+		respondError(c, 404, err.Error())
+		return
+	}
 	if err != nil {
-		log.Println(err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+		respondInternalError(c, "failed to get user", err)
 		return
 	}
 
-	c.JSON(200, user)
+	response, ok := selectFields(c, user.ToResponse())
+	if !ok {
+		return
+	}
+	jsonWithETag(c, response)
 }
 
 // GetUsers godoc
 // @Summary      Get all Users
-// @Description  get all users with no filter
+// @Description  get all users matching the filter. Admin only. The total count is set in the X-Total-Count header.
+// @Description  With ids, only the users with these IDs are returned, in the same order. The unknown IDs are left out
+// @Description  With page or pageSize, a page of the users is returned by ascending ID. With cursor, empty for the first page, the page following it is returned, the cursor of the next one being set in the X-Next-Cursor header (and the nextCursor meta). Unlike the pages, the cursors don't skip nor repeat a user created or deleted meanwhile
 // @Tags         User
 // @Accept       json
 // @Produce      json
-// @Success      200  {object}  UserRespone[]
+// @Param        role      query     string   false  "Filter by role"
+// @Param        ids       query     string   false  "Comma separated user IDs, up to USER_BATCH_MAX"
+// @Param        fields    query     string   false  "Comma separated fields of the users to return, e.g. id,email,createdAt"
+// @Param        cursor    query     string   false  "Cursor of the page, from the X-Next-Cursor header of the previous one"
+// @Param        page      query     integer  false  "Page number, from 1"
+// @Param        pageSize  query     integer  false  "Page size, up to 100"
+// @Success      200  {array}   model.UserResponseDTO
+// @Header       200  {integer}  X-Total-Count  "Total number of matching users"
+// @Header       200  {string}   X-Next-Cursor  "Cursor of the next page, absent on the last one"
 // @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      422  {object}  ValidationErrorResponse
 // @Failure      500  {object}  ErrorResponse
 // @Router       /user [get]
 func (h *UserHandler) GetUsers(c *gin.Context) {
-	users, err := h.userService.GetUsers()
+	if raw, ok := c.GetQuery("ids"); ok {
+		h.getUsersByIDs(c, raw)
+		return
+	}
+
+	filter, ok := bindUserFilter(c)
+	if !ok {
+		return
+	}
+
+	total, err := h.userService.CountUsers(c.Request.Context(), filter)
+	if err != nil {
+		respondInternalError(c, "failed to count users", err)
+		return
+	}
+
+	users, ok := h.listUsers(c, filter)
+	if !ok {
+		return
+	}
+
+	response, ok := selectFields(c, model.ToResponses(users))
+	if !ok {
+		return
+	}
+
+	c.Header(TotalCountHeader, strconv.FormatInt(total, 10))
+	setMeta(c, "total", total)
+	respond(c, 200, response)
+}
+
+// listUsers returns the users of the cursor or of the page requested by the query, every matching
+// user without any, writing the next cursor if there is one. It writes a 400 if the query is invalid.
+func (h *UserHandler) listUsers(c *gin.Context, filter *model.UserFilter) ([]*model.User, bool) {
+	raw, cursor := c.GetQuery("cursor")
+	_, paged := c.GetQuery("page")
+	_, sized := c.GetQuery("pageSize")
+
+	var users []*model.User
+	var err error
+	switch {
+	case cursor:
+		if paged {
+			respondError(c, 400, "cursor and page can't be combined")
+			return nil, false
+		}
+		afterID, cursorErr := decodeCursor(raw)
+		if cursorErr != nil {
+			respondError(c, 400, cursorErr.Error())
+			return nil, false
+		}
+		pagination := &model.PaginationQuery{}
+		if !bindQuery(c, pagination) {
+			return nil, false
+		}
+
+		var nextID uint
+		users, nextID, err = h.userService.ListUsers(c.Request.Context(), filter, model.CursorOptions{AfterID: afterID, Limit: pagination.PageSize})
+		if err != nil {
+			break
+		}
+		if nextID != 0 {
+			next := encodeCursor(nextID)
+			c.Header(NextCursorHeader, next)
+			setMeta(c, "nextCursor", next)
+		}
+	case paged || sized:
+		pagination := &model.PaginationQuery{}
+		if !bindQuery(c, pagination) {
+			return nil, false
+		}
+		users, err = h.userService.ListUsersPage(c.Request.Context(), filter, pagination.Options())
+	default:
+		users, err = h.userService.GetUsers(c.Request.Context(), filter)
+	}
+	if err != nil {
+		respondInternalError(c, "failed to get users", err)
+		return nil, false
+	}
+
+	return users, true
+}
+
+// encodeCursor returns the opaque cursor of the page following the user with the ID.
+func encodeCursor(afterID uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(afterID), 10)))
+}
+
+// decodeCursor returns the ID encoded in the cursor by encodeCursor, 0 for an empty cursor.
+func decodeCursor(cursor string) (uint, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("invalid cursor")
+	}
+	afterID, err := strconv.ParseUint(string(raw), 10, 0)
+	if err != nil || afterID == 0 {
+		return 0, errors.New("invalid cursor")
+	}
+
+	return uint(afterID), nil
+}
+
+// getUsersByIDs writes the users with the comma separated IDs of raw, found in the organization of the caller.
+func (h *UserHandler) getUsersByIDs(c *gin.Context, raw string) {
+	ids, err := parseIDList(raw, h.conf.USER_BATCH_MAX)
+	if err != nil {
+		respondError(c, 400, err.Error())
+		return
+	}
+
+	users, err := h.userService.GetUsersByIDs(c.Request.Context(), ids, callerOrgScope(c))
+	if err != nil {
+		respondInternalError(c, "failed to get users by ids", err)
+		return
+	}
+
+	response, ok := selectFields(c, model.ToResponses(users))
+	if !ok {
+		return
+	}
+
+	c.Header(TotalCountHeader, strconv.Itoa(len(users)))
+	setMeta(c, "total", len(users))
+	respond(c, 200, response)
+}
+
+/*
+parseIDList parses a comma separated list of positive IDs, dropping the duplicates.
+
+Parameters:
+- raw (string): The list, e.g. "1,2,3".
+- max (int): The maximum number of distinct IDs.
+
+Returns:
+- ([]int): The IDs, in their first order of appearance.
+- (error): An error if an ID is invalid, or if there are more than max of them.
+*/
+func parseIDList(raw string, max int) ([]int, error) {
+	seen := map[int]bool{}
+	ids := []int{}
+	for _, part := range strings.Split(raw, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id < 1 {
+			return nil, fmt.Errorf("invalid user id %q", part)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	if len(ids) > max {
+		return nil, fmt.Errorf("at most %d ids can be requested at once", max)
+	}
+
+	return ids, nil
+}
+
+// SearchUsers godoc
+// @Summary      Search Users
+// @Description  get a page of the users whose email contains q, ignoring the case. Admin only. The total count is set in the X-Total-Count header
+// @Tags         User
+// @Produce      json
+// @Param        q         query     string   true   "Text to search"
+// @Param        page      query     integer  false  "Page number, from 1"
+// @Param        pageSize  query     integer  false  "Page size, up to 100"
+// @Success      200  {array}   model.UserResponseDTO
+// @Header       200  {integer}  X-Total-Count  "Total number of matching users"
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      422  {object}  ValidationErrorResponse
+// @Router       /user/search [get]
+func (h *UserHandler) SearchUsers(c *gin.Context) {
+	// An empty search would match every user
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		respondError(c, 400, "q is required")
+		return
+	}
+
+	pagination := &model.PaginationQuery{}
+	if !bindQuery(c, pagination) {
+		return
+	}
+
+	users, total, err := h.userService.SearchUsers(c.Request.Context(), q, pagination.Options(), callerOrgScope(c))
+	if err != nil {
+		respondInternalError(c, "failed to search users", err)
+		return
+	}
+
+	c.Header(TotalCountHeader, strconv.FormatInt(total, 10))
+	setMeta(c, "total", total)
+	setMeta(c, "page", pagination.Page)
+	setMeta(c, "pageSize", pagination.PageSize)
+	respond(c, 200, model.ToResponses(users))
+}
+
+// CountUsers godoc
+// @Summary      Count Users
+// @Description  get the number of users matching the filter in the X-Total-Count header, with no body. Admin only
+// @Tags         User
+// @Param        role  query     string  false  "Filter by role"
+// @Success      200
+// @Header       200  {integer}  X-Total-Count  "Total number of matching users"
+// @Failure      400
+// @Failure      401
+// @Failure      403
+// @Router       /user [head]
+func (h *UserHandler) CountUsers(c *gin.Context) {
+	filter, ok := bindUserFilter(c)
+	if !ok {
+		return
+	}
+
+	total, err := h.userService.CountUsers(c.Request.Context(), filter)
+	if err != nil {
+		respondInternalError(c, "failed to count users", err)
+		return
+	}
+
+	c.Header(TotalCountHeader, strconv.FormatInt(total, 10))
+	c.Status(200)
+}
+
+// CheckUsername godoc
+// @Summary      Check a username
+// @Description  tell whether a username is free, for signup forms. The name is trimmed and lowercased like on creation
+// @Tags         User
+// @Produce      json
+// @Param        name  query     string  true  "Username to check"
+// @Success      200   {object}  model.UsernameAvailabilityDTO
+// @Failure      422   {object}  ValidationErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /user/check-username [get]
+func (h *UserHandler) CheckUsername(c *gin.Context) {
+	username := model.NormalizeUsername(c.Query("name"))
+	if !model.ValidUsername(username) {
+		respondValidationError(c, map[string]string{"name": usernameInvalidReason})
+		return
+	}
+
+	available, err := h.userService.UsernameAvailable(c.Request.Context(), username)
+	if err != nil {
+		respondInternalError(c, "failed to check username", err)
+		return
+	}
+
+	respond(c, 200, &model.UsernameAvailabilityDTO{
+		Username:  username,
+		Available: available,
+	})
+}
+
+// CheckEmail godoc
+// @Summary      Check an email
+// @Description  tell whether an email is free, for signup forms. The email is trimmed and lowercased. The endpoint is rate limited by client IP, it must not be usable to enumerate the accounts
+// @Tags         User
+// @Produce      json
+// @Param        email  query     string  true  "Email to check"
+// @Success      200    {object}  model.EmailAvailabilityDTO
+// @Failure      422    {object}  ValidationErrorResponse
+// @Failure      429    {object}  ErrorResponse
+// @Failure      500    {object}  ErrorResponse
+// @Router       /user/check-email [get]
+func (h *UserHandler) CheckEmail(c *gin.Context) {
+	email := model.NormalizeEmail(c.Query("email"))
+	if !validEmail(email) {
+		respondValidationError(c, map[string]string{"email": "must be a valid email"})
+		return
+	}
+
+	exists, err := h.userService.EmailExists(c.Request.Context(), email)
 	if err != nil {
-		log.Println(err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+		respondInternalError(c, "failed to check email", err)
 		return
 	}
 
-	c.JSON(200, users)
+	respond(c, 200, &model.EmailAvailabilityDTO{
+		Email:     email,
+		Available: !exists,
+	})
+}
+
+// bindUserFilter binds the list filter from the query string, writing a 400 on failure.
+func bindUserFilter(c *gin.Context) (*model.UserFilter, bool) {
+	filter := &model.UserFilter{}
+	if err := c.ShouldBindQuery(filter); err != nil {
+		GetLogger(c).Warn("invalid query", "error", err)
+		respondError(c, 400, err.Error())
+		return nil, false
+	}
+	filter.Org = callerOrgScope(c)
+
+	return filter, true
 }
 
 // PostUser godoc
 // @Summary      Create a User
+// @Description  create a new user with an email and a password. Admin only, public signup goes through /auth/register. A request retried with the same Idempotency-Key returns the user created the first time
 // @Tags         User
 // @Accept       json
 // @Produce      json
-// @Success      200  {object}  User
-// @Failure      400  {object}  ErrorResponse
-// @Failure      500  {object}  ErrorResponse
+// @Param        Idempotency-Key  header    string               false  "Key making retries safe"
+// @Param        user             body      model.UserCreateDTO  true   "User to create"
+// @Success      200              {object}  model.UserResponseDTO
+// @Failure      400              {object}  ErrorResponse
+// @Failure      401              {object}  ErrorResponse
+// @Failure      403              {object}  ErrorResponse
+// @Failure      409              {object}  ErrorResponse
+// @Failure      422              {object}  ValidationErrorResponse
+// @Failure      500              {object}  ErrorResponse
 // @Router       /user [post]
 func (h *UserHandler) CreateUser(c *gin.Context) {
 	data := &model.UserCreateDTO{}
 
-	if err := c.BindJSON(data); err != nil {
-		log.Println(err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+	if !bindJSON(c, data) {
+		return
+	}
+	// The user joins the organization of the admin creating it
+	data.OrgID = callerOrgScope(c).OrgID
+
+	fingerprint := idempotencyFingerprint(data)
+	user, ok := lookupIdempotentUser(c, h.idempotencyService, h.userService, idempotencyEndpointCreateUser, fingerprint)
+	if !ok {
+		return
+	}
+	if user != nil {
+		respond(c, 200, user.ToResponse())
+		return
+	}
+
+	// The key is recorded with the user, a failure to save it rolls the user back
+	err := h.txService.Transaction(c.Request.Context(), func(tx *service.TxServices) error {
+		var err error
+		user, err = tx.UserService.CreateUser(c.Request.Context(), data)
+		if err != nil {
+			return err
+		}
+
+		return saveIdempotencyKey(c, tx.IdempotencyService, idempotencyEndpointCreateUser, fingerprint, user)
+	})
+	if writeIdempotencyConflict(c, err) {
+		return
+	}
+	if errors.Is(err, service.ErrEmailTaken) {
+		respondError(c, 409, emailTakenMessage)
+		return
+	}
+	if errors.Is(err, service.ErrUsernameTaken) {
+		respondError(c, 409, usernameTakenMessage)
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to create user", err)
+		return
+	}
+	h.webhooks.Send(webhook.EventUserCreated, user.ToResponse())
+
+	respond(c, 200, user.ToResponse())
+}
+
+// ImportUsers godoc
+// @Summary      Bulk import Users
+// @Description  create many users in a single transaction. Admin only. By default the import is all-or-nothing, use mode=best-effort to commit the valid records only
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        mode   query     string                 false  "Transaction mode"  Enums(all-or-nothing, best-effort)
+// @Param        users  body      []model.UserCreateDTO  true   "Users to create"
+// @Success      200    {array}   model.UserImportResultDTO
+// @Failure      400    {object}  ErrorResponse
+// @Failure      401    {object}  ErrorResponse
+// @Failure      403    {object}  ErrorResponse
+// @Failure      422    {array}   model.UserImportResultDTO
+// @Router       /user/bulk [post]
+/*
+ImportUsers creates all the users of the JSON array in the request body and returns
+the outcome of each record. When an all-or-nothing import is rolled back, a 422 is
+returned and every record without its own error is marked as rolled back.
+*/
+func (h *UserHandler) ImportUsers(c *gin.Context) {
+	mode := c.DefaultQuery("mode", "all-or-nothing")
+	if mode != "all-or-nothing" && mode != "best-effort" {
+		respondError(c, 400, "mode must be all-or-nothing or best-effort")
 		return
 	}
 
-	user, err := h.userService.CreateUser(data)
+	var data []*model.UserCreateDTO
+	if !bindJSON(c, &data) {
+		return
+	}
+	// The users join the organization of the admin importing them
+	orgID := callerOrgScope(c).OrgID
+	for _, d := range data {
+		if d != nil {
+			d.OrgID = orgID
+		}
+	}
+
+	users, errs, err := h.userService.CreateUsers(c.Request.Context(), data, mode == "all-or-nothing")
+	if err != nil && !errors.Is(err, service.ErrImportRolledBack) {
+		respondInternalError(c, "failed to import users", err)
+		return
+	}
+
+	results := make([]*model.UserImportResultDTO, len(data))
+	for i := range data {
+		results[i] = &model.UserImportResultDTO{Index: i}
+		switch {
+		case errs[i] != nil:
+			results[i].Error = errs[i].Error()
+		case err != nil:
+			results[i].Error = err.Error()
+		default:
+			results[i].User = users[i].ToResponse()
+		}
+	}
+
 	if err != nil {
-		log.Println(err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+		respond(c, 422, results)
 		return
 	}
 
-	c.JSON(200, user)
+	for _, result := range results {
+		if result.User != nil {
+			h.webhooks.Send(webhook.EventUserCreated, result.User)
+		}
+	}
+
+	respond(c, 200, results)
 }
 
+// UpdateUser godoc
+// @Summary      Update a User
+// @Description  partially update a user by ID. Omitted fields are left unchanged. Users can only update themselves, and only admins can change the role. The profile fields (displayName, avatarUrl, locale, timezone, bio) are removed with an empty value. The email is changed through PUT /user/email
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        id    path      int                  true  "User ID"
+// @Param        user  body      model.UserUpdateDTO  true  "Fields to update"
+// @Success      200   {object}  model.UserResponseDTO
+// @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
+// @Failure      422   {object}  ValidationErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /user/{id} [put]
+// @Router       /user/{id} [patch]
 func (h *UserHandler) UpdateUser(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		log.Println(err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+	id, ok := parseIDParam(c, "id")
+	if !ok {
+		return
+	}
+
+	currentUser, ok := authorizeOwner(c, id, "you can only update your own user")
+	if !ok || !h.requireUserInCallerOrg(c, id) {
 		return
 	}
 
 	data := &model.UserUpdateDTO{}
-	if err := c.BindJSON(data); err != nil {
-		log.Println(err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+	if !bindJSON(c, data) {
+		return
+	}
+
+	// Only admins can change privileges, a user must not be able to promote itself
+	if !currentUser.IsAdmin() {
+		data.Role = nil
+	}
+
+	if err := data.Validate(); err != nil {
+		respondError(c, 400, err.Error())
 		return
 	}
 
-	user, err := h.userService.UpdateUser(id, data)
+	user, err := h.userService.UpdateUser(c.Request.Context(), id, data)
+	if errors.Is(err, service.ErrUserNotFound) {
+		respondError(c, 404, err.Error())
+		return
+	}
+	if errors.Is(err, service.ErrUsernameTaken) {
+		respondError(c, 409, usernameTakenMessage)
+		return
+	}
 	if err != nil {
-		log.Println(err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+		respondInternalError(c, "failed to update user", err)
 		return
 	}
 
-	c.JSON(200, user)
+	respond(c, 200, user.ToResponse())
 }
 
-func (h *UserHandler) DeleteUser(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+// SetUserStatus godoc
+// @Summary      Set the status of a User
+// @Description  activate, suspend or set pending a user by ID. Admin only. A suspended user is rejected even with a valid jwt
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        id      path      int                  true  "User ID"
+// @Param        status  body      model.UserStatusDTO  true  "New status"
+// @Success      200     {object}  model.UserResponseDTO
+// @Failure      400     {object}  ErrorResponse
+// @Failure      401     {object}  ErrorResponse
+// @Failure      403     {object}  ErrorResponse
+// @Failure      404     {object}  ErrorResponse
+// @Router       /user/{id}/status [put]
+func (h *UserHandler) SetUserStatus(c *gin.Context) {
+	id, ok := parseIDParam(c, "id")
+	if !ok {
+		return
+	}
+
+	// An admin suspending itself would lock itself out
+	if currentUser, ok := CurrentUser(c); ok && int(currentUser.ID) == id {
+		respondError(c, 400, "you can't change your own status")
+		return
+	}
+	if !h.requireUserInCallerOrg(c, id) {
+		return
+	}
+
+	data := &model.UserStatusDTO{}
+	if !bindJSON(c, data) {
+		return
+	}
+	if err := data.Validate(); err != nil {
+		respondError(c, 400, err.Error())
+		return
+	}
+
+	user, err := h.userService.SetStatus(c.Request.Context(), id, data.Status)
+	if errors.Is(err, service.ErrUserNotFound) {
+		respondError(c, 404, err.Error())
+		return
+	}
+	if err != nil {
+		respondInternalError(c, "failed to set user status", err)
+		return
+	}
+
+	respond(c, 200, user.ToResponse())
+}
+
+// ResetUserPassword godoc
+// @Summary      Reset the password of a User
+// @Description  set the password of a user by ID and revoke its sessions. Admin only. Without password, a random one is generated and returned once
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        id     path      int                          true  "User ID"
+// @Param        reset  body      model.AdminPasswordResetDTO  true  "New password, optional"
+// @Success      200    {object}  model.AdminPasswordResetResponseDTO
+// @Failure      400    {object}  ErrorResponse
+// @Failure      401    {object}  ErrorResponse
+// @Failure      403    {object}  ErrorResponse
+// @Failure      404    {object}  ErrorResponse
+// @Failure      422    {object}  ErrorResponse
+// @Router       /user/{id}/reset-password [post]
+func (h *UserHandler) ResetUserPassword(c *gin.Context) {
+	id, ok := parseIDParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if !h.requireUserInCallerOrg(c, id) {
+		return
+	}
+
+	data := &model.AdminPasswordResetDTO{}
+	if !bindJSON(c, data) {
+		return
+	}
+
+	response := &model.AdminPasswordResetResponseDTO{}
+	password := data.Password
+	var err error
+	if password == "" {
+		if password, err = randomToken(); err != nil {
+			respondInternalError(c, "failed to generate password", err)
+			return
+		}
+		response.Password = password
+	}
+
+	err = h.txService.Transaction(c.Request.Context(), func(tx *service.TxServices) error {
+		if _, err := tx.UserService.GetUser(c.Request.Context(), id); err != nil {
+			return err
+		}
+		if err := tx.UserService.UpdatePassword(c.Request.Context(), id, password); err != nil {
+			return err
+		}
+		if data.MustChangePassword {
+			if err := tx.UserService.SetMustChangePassword(c.Request.Context(), id, true); err != nil {
+				return err
+			}
+		}
+
+		response.RevokedSessions, err = tx.RTService.RevokeAllForUser(c.Request.Context(), id)
+		return err
+	})
+	if errors.Is(err, service.ErrUserNotFound) {
+		respondError(c, 404, err.Error())
+		return
+	}
+	if errors.Is(err, service.ErrPasswordReused) {
+		respondError(c, 422, err.Error())
+		return
+	}
 	if err != nil {
-		log.Println(err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+		respondInternalError(c, "failed to reset user password", err)
 		return
 	}
+	h.webhooks.Send(webhook.EventUserPasswordChanged, gin.H{
+		"userId": id,
+	})
+	recordAudit(c, h.auditService, id, model.AuditPasswordChanged, actorDetail(c, "reset"))
+
+	respond(c, 200, response)
+}
 
-	err = h.userService.DeleteUser(id)
+// DeleteUser godoc
+// @Summary      Delete a User
+// @Description  soft delete a user by ID. Users can only delete themselves, admins can delete anyone
+// @Tags         User
+// @Produce      json
+// @Param        id   path      int  true  "User ID"
+// @Success      200  {object}  MessageResponse
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /user/{id} [delete]
+func (h *UserHandler) DeleteUser(c *gin.Context) {
+	id, ok := parseIDParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if _, ok := authorizeOwner(c, id, "you can only delete your own user"); !ok || !h.requireUserInCallerOrg(c, id) {
+		return
+	}
+
+	err := h.userService.DeleteUser(c.Request.Context(), id)
+	if errors.Is(err, service.ErrUserNotFound) {
+		respondError(c, 404, err.Error())
+		return
+	}
 	if err != nil {
-		log.Println(err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+		respondInternalError(c, "failed to delete user", err)
 		return
 	}
+	recordAudit(c, h.auditService, id, model.AuditUserDeleted, actorDetail(c, "deleted"))
 
-	c.JSON(200, gin.H{
+	respond(c, 200, gin.H{
 		"message": "User deleted successfully",
 	})
 }
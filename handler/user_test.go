@@ -0,0 +1,512 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"github.com/gin-gonic/gin"
+)
+
+func TestUserCRUD(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+
+	w := s.do(t, "POST", "/api/v1/user/", adminToken, gin.H{"email": "alice@example.com", "password": "password"})
+	expectStatus(t, w, http.StatusOK)
+	var created model.UserResponseDTO
+	testutil.DecodeJSON(t, w, &created)
+	path := fmt.Sprintf("/api/v1/user/%d", created.ID)
+
+	w = s.do(t, "GET", path, adminToken, nil)
+	expectStatus(t, w, http.StatusOK)
+	var got model.UserResponseDTO
+	testutil.DecodeJSON(t, w, &got)
+	if got.Email != "alice@example.com" || got.Role != model.RoleUser {
+		t.Errorf("GET %s = %+v, want alice with the user role", path, got)
+	}
+
+	w = s.do(t, "PUT", path, adminToken, gin.H{"role": model.RoleAdmin, "username": "Alice"})
+	expectStatus(t, w, http.StatusOK)
+	var updated model.UserResponseDTO
+	testutil.DecodeJSON(t, w, &updated)
+	if updated.Role != model.RoleAdmin || updated.Username == nil || *updated.Username != "alice" {
+		t.Errorf("PUT %s = %+v, want an admin named alice", path, updated)
+	}
+
+	expectStatus(t, s.do(t, "DELETE", path, adminToken, nil), http.StatusOK)
+	expectStatus(t, s.do(t, "GET", path, adminToken, nil), http.StatusNotFound)
+	expectStatus(t, s.do(t, "DELETE", path, adminToken, nil), http.StatusNotFound)
+}
+
+func TestUpdateUserProfile(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+	path := fmt.Sprintf("/api/v1/user/%d", alice.ID)
+
+	w := s.do(t, "PUT", path, aliceToken, gin.H{
+		"displayName": " Alice Smith ",
+		"avatarUrl":   "https://example.com/alice.png",
+		"locale":      "en_us",
+		"timezone":    "Europe/Paris",
+		"bio":         "Backend developer",
+	})
+	expectStatus(t, w, http.StatusOK)
+	var updated model.UserResponseDTO
+	testutil.DecodeJSON(t, w, &updated)
+	want := model.UserResponseDTO{DisplayName: "Alice Smith", AvatarURL: "https://example.com/alice.png", Locale: "en-US", Timezone: "Europe/Paris", Bio: "Backend developer"}
+	if updated.DisplayName != want.DisplayName || updated.AvatarURL != want.AvatarURL || updated.Locale != want.Locale || updated.Timezone != want.Timezone || updated.Bio != want.Bio {
+		t.Errorf("PUT %s = %+v, want the profile %+v", path, updated, want)
+	}
+
+	tests := []struct {
+		name      string
+		body      gin.H
+		wantField string
+	}{
+		{"invalid timezone", gin.H{"timezone": "Mars/Olympus_Mons"}, "timezone"},
+		{"invalid locale", gin.H{"locale": "not a locale"}, "locale"},
+		{"invalid avatar", gin.H{"avatarUrl": "ftp://example.com/alice.png"}, "avatarUrl"},
+		{"display name too long", gin.H{"displayName": strings.Repeat("a", 65)}, "displayName"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do(t, "PUT", path, aliceToken, tt.body)
+			expectStatus(t, w, http.StatusUnprocessableEntity)
+			var got ValidationErrorResponse
+			testutil.DecodeJSON(t, w, &got)
+			if got.Fields[tt.wantField] == "" {
+				t.Errorf("fields = %v, want a failure of %s", got.Fields, tt.wantField)
+			}
+		})
+	}
+
+	// An empty value removes a field, the others are left as they are
+	w = s.do(t, "PUT", path, aliceToken, gin.H{"bio": ""})
+	expectStatus(t, w, http.StatusOK)
+	updated = model.UserResponseDTO{}
+	testutil.DecodeJSON(t, w, &updated)
+	if updated.Bio != "" || updated.Timezone != "Europe/Paris" {
+		t.Errorf("PUT %s = %+v, want no bio and the Europe/Paris timezone", path, updated)
+	}
+}
+
+func TestUserAuthorization(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+	bob, _ := s.seedUser(t, testutil.UserFixture{Email: "bob@example.com"})
+	alicePath, bobPath := fmt.Sprintf("/api/v1/user/%d", alice.ID), fmt.Sprintf("/api/v1/user/%d", bob.ID)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       any
+		wantStatus int
+	}{
+		{"unauthenticated", "GET", alicePath, "", nil, http.StatusUnauthorized},
+		{"get itself", "GET", alicePath, aliceToken, nil, http.StatusOK},
+		{"get another user", "GET", bobPath, aliceToken, nil, http.StatusForbidden},
+		{"list users", "GET", "/api/v1/user/", aliceToken, nil, http.StatusForbidden},
+		{"create a user", "POST", "/api/v1/user/", aliceToken, gin.H{"email": "carol@example.com", "password": "password"}, http.StatusForbidden},
+		{"update another user", "PUT", bobPath, aliceToken, gin.H{"username": "bobby"}, http.StatusForbidden},
+		{"delete another user", "DELETE", bobPath, aliceToken, nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, s.do(t, tt.method, tt.path, tt.token, tt.body), tt.wantStatus)
+		})
+	}
+
+	// A user can't promote itself, the role is ignored
+	w := s.do(t, "PUT", alicePath, aliceToken, gin.H{"role": model.RoleAdmin})
+	expectStatus(t, w, http.StatusOK)
+	var updated model.UserResponseDTO
+	testutil.DecodeJSON(t, w, &updated)
+	if updated.Role != model.RoleUser {
+		t.Errorf("role = %s, want the user role to be kept", updated.Role)
+	}
+}
+
+func TestCreateUserConflicts(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin, Username: "admin"})
+	bob, _ := s.seedUser(t, testutil.UserFixture{Email: "bob@example.com"})
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        any
+		wantStatus  int
+		wantMessage string
+	}{
+		{"duplicate email", "POST", "/api/v1/user/", gin.H{"email": "bob@example.com", "password": "password"}, http.StatusConflict, emailTakenMessage},
+		{"duplicate username", "POST", "/api/v1/user/", gin.H{"email": "carol@example.com", "password": "password", "username": "Admin"}, http.StatusConflict, usernameTakenMessage},
+		{"username taken on update", "PUT", fmt.Sprintf("/api/v1/user/%d", bob.ID), gin.H{"username": "admin"}, http.StatusConflict, usernameTakenMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do(t, tt.method, tt.path, adminToken, tt.body)
+			expectStatus(t, w, tt.wantStatus)
+
+			var response ErrorResponse
+			testutil.DecodeJSON(t, w, &response)
+			if response.Error != tt.wantMessage {
+				t.Errorf("error = %q, want %q", response.Error, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestCreateUserTrimsIdentifiers(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+
+	w := s.do(t, "POST", "/api/v1/user/", adminToken, gin.H{"email": " carol@example.com ", "username": " carol ", "password": " s3cret "})
+	expectStatus(t, w, http.StatusOK)
+	var created model.UserResponseDTO
+	testutil.DecodeJSON(t, w, &created)
+	if created.Email != "carol@example.com" || created.Username == nil || *created.Username != "carol" {
+		t.Errorf("created = %q, %v, want carol@example.com and carol", created.Email, created.Username)
+	}
+
+	// The spaces of the password are kept, only the email is trimmed
+	login(t, s, " carol@example.com", " s3cret ")
+	w = s.do(t, "POST", "/api/v1/auth/login", "", model.LoginDTO{Email: "carol@example.com", Password: "s3cret"})
+	expectStatus(t, w, http.StatusUnauthorized)
+
+	// The trimmed email is a duplicate like any other
+	w = s.do(t, "POST", "/api/v1/user/", adminToken, gin.H{"email": "carol@example.com ", "password": "password"})
+	expectStatus(t, w, http.StatusConflict)
+}
+
+func TestCheckUsername(t *testing.T) {
+	s := newTestServer(t, nil)
+	testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com", Username: "alice"})
+
+	tests := []struct {
+		name          string
+		query         string
+		wantStatus    int
+		wantAvailable bool
+	}{
+		{"taken", "alice", http.StatusOK, false},
+		{"taken once normalized", "%20ALICE%20", http.StatusOK, false},
+		{"available", "bob", http.StatusOK, true},
+		{"invalid", "a!", http.StatusUnprocessableEntity, false},
+		{"missing", "", http.StatusUnprocessableEntity, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do(t, "GET", "/api/v1/user/check-username?name="+tt.query, "", nil)
+			expectStatus(t, w, tt.wantStatus)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var response model.UsernameAvailabilityDTO
+			testutil.DecodeJSON(t, w, &response)
+			if response.Available != tt.wantAvailable {
+				t.Errorf("available = %v, want %v", response.Available, tt.wantAvailable)
+			}
+		})
+	}
+}
+
+func TestCheckEmail(t *testing.T) {
+	s := newTestServer(t, nil)
+	testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "alice@example.com"})
+
+	tests := []struct {
+		name          string
+		query         string
+		wantStatus    int
+		wantAvailable bool
+	}{
+		{"taken", "alice@example.com", http.StatusOK, false},
+		{"taken once normalized", "%20Alice@Example.com%20", http.StatusOK, false},
+		{"available", "bob@example.com", http.StatusOK, true},
+		{"invalid", "alice", http.StatusUnprocessableEntity, false},
+		{"missing", "", http.StatusUnprocessableEntity, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do(t, "GET", "/api/v1/user/check-email?email="+tt.query, "", nil)
+			expectStatus(t, w, tt.wantStatus)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var response model.EmailAvailabilityDTO
+			testutil.DecodeJSON(t, w, &response)
+			if response.Available != tt.wantAvailable {
+				t.Errorf("available = %v, want %v", response.Available, tt.wantAvailable)
+			}
+		})
+	}
+}
+
+func TestCheckEmailRateLimit(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.CHECK_EMAIL_RATE_LIMIT = 2
+	})
+
+	check := func(ip string) *httptest.ResponseRecorder {
+		req := testutil.JSONRequest(t, "GET", "/api/v1/user/check-email?email=bob@example.com", nil)
+		req.RemoteAddr = ip + ":12345"
+		return testutil.Do(s.router, req)
+	}
+
+	expectStatus(t, check("192.0.2.1"), http.StatusOK)
+	expectStatus(t, check("192.0.2.1"), http.StatusOK)
+	w := check("192.0.2.1")
+	expectStatus(t, w, http.StatusTooManyRequests)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After header is missing")
+	}
+
+	// The limit is per client IP
+	expectStatus(t, check("192.0.2.2"), http.StatusOK)
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.RESPONSE_ENVELOPE = true
+	})
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+
+	w := s.do(t, "GET", "/api/v1/user/", adminToken, nil)
+	expectStatus(t, w, http.StatusOK)
+	var list struct {
+		Data  []model.UserResponseDTO `json:"data"`
+		Error *EnvelopeError          `json:"error"`
+		Meta  map[string]any          `json:"meta"`
+	}
+	testutil.DecodeJSON(t, w, &list)
+	if len(list.Data) != 1 || list.Error != nil || list.Meta["total"] != float64(1) {
+		t.Errorf("enveloped list = %+v, want the admin and a total of 1", list)
+	}
+
+	w = s.do(t, "GET", "/api/v1/user/999", adminToken, nil)
+	expectStatus(t, w, http.StatusNotFound)
+	var failure Envelope
+	testutil.DecodeJSON(t, w, &failure)
+	if failure.Data != nil || failure.Error == nil || failure.Error.Message == "" {
+		t.Errorf("enveloped failure = %+v, want an error message and no data", failure)
+	}
+}
+
+func TestGetUsersByIDs(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) { conf.USER_BATCH_MAX = 3 })
+	admin, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+	alice, aliceToken := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+	bob, _ := s.seedUser(t, testutil.UserFixture{Email: "bob@example.com"})
+
+	tests := []struct {
+		name       string
+		ids        string
+		token      string
+		wantStatus int
+		wantIDs    []uint
+	}{
+		{"found in order", fmt.Sprintf("%d,%d", bob.ID, alice.ID), adminToken, http.StatusOK, []uint{bob.ID, alice.ID}},
+		{"duplicates and spaces", fmt.Sprintf("%d,%%20%d,%d", alice.ID, alice.ID, bob.ID), adminToken, http.StatusOK, []uint{alice.ID, bob.ID}},
+		{"missing ids left out", fmt.Sprintf("%d,9999", admin.ID), adminToken, http.StatusOK, []uint{admin.ID}},
+		{"duplicates don't count toward the max", fmt.Sprintf("%d,%d,%d,%d", alice.ID, alice.ID, bob.ID, admin.ID), adminToken, http.StatusOK, []uint{alice.ID, bob.ID, admin.ID}},
+		{"too many ids", fmt.Sprintf("%d,%d,%d,9999", alice.ID, bob.ID, admin.ID), adminToken, http.StatusBadRequest, nil},
+		{"invalid id", "1,abc", adminToken, http.StatusBadRequest, nil},
+		{"empty", "", adminToken, http.StatusBadRequest, nil},
+		{"admin only", fmt.Sprint(alice.ID), aliceToken, http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do(t, "GET", "/api/v1/user/?ids="+tt.ids, tt.token, nil)
+			expectStatus(t, w, tt.wantStatus)
+			if tt.wantIDs == nil {
+				return
+			}
+
+			var users []model.UserResponseDTO
+			testutil.DecodeJSON(t, w, &users)
+			got := []uint{}
+			for _, user := range users {
+				got = append(got, user.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantIDs) {
+				t.Errorf("ids = %v, want %v", got, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestUserFields(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+	alice, _ := s.seedUser(t, testutil.UserFixture{Email: "alice@example.com"})
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"single user", fmt.Sprintf("/api/v1/user/%d?fields=id,email", alice.ID), fmt.Sprintf(`{"email":"alice@example.com","id":%d}`, alice.ID)},
+		{"unknown and sensitive ignored", fmt.Sprintf("/api/v1/user/%d?fields=email,password,nickname", alice.ID), `{"email":"alice@example.com"}`},
+		{"list", "/api/v1/user/?fields=email", `[{"email":"admin@example.com"},{"email":"alice@example.com"}]`},
+		{"batch", fmt.Sprintf("/api/v1/user/?ids=%d&fields=role", alice.ID), `[{"role":"user"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do(t, "GET", tt.path, adminToken, nil)
+			expectStatus(t, w, http.StatusOK)
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetUsersPagination(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+	for i := 1; i <= 4; i++ {
+		testutil.SeedUser(t, s.db, testutil.UserFixture{Email: fmt.Sprintf("user%d@example.com", i)})
+	}
+
+	list := func(t *testing.T, query string) ([]uint, string) {
+		t.Helper()
+
+		w := s.do(t, "GET", "/api/v1/user/"+query, adminToken, nil)
+		expectStatus(t, w, http.StatusOK)
+		var users []model.UserResponseDTO
+		testutil.DecodeJSON(t, w, &users)
+		ids := []uint{}
+		for _, user := range users {
+			ids = append(ids, user.ID)
+		}
+
+		return ids, w.Header().Get(NextCursorHeader)
+	}
+
+	t.Run("cursor", func(t *testing.T) {
+		ids, next := list(t, "?cursor=&pageSize=2")
+		if fmt.Sprint(ids) != "[1 2]" || next == "" {
+			t.Fatalf("first page = %v, next cursor %q, want [1 2] and a next cursor", ids, next)
+		}
+
+		// A user created meanwhile is listed once, at the end
+		testutil.SeedUser(t, s.db, testutil.UserFixture{Email: "user5@example.com"})
+		var all []uint
+		all = append(all, ids...)
+		for next != "" {
+			ids, next = list(t, "?pageSize=2&cursor="+next)
+			all = append(all, ids...)
+		}
+		if fmt.Sprint(all) != "[1 2 3 4 5 6]" {
+			t.Errorf("users = %v, want every user once", all)
+		}
+	})
+
+	t.Run("offset", func(t *testing.T) {
+		ids, next := list(t, "?page=2&pageSize=2")
+		if fmt.Sprint(ids) != "[3 4]" || next != "" {
+			t.Errorf("page 2 = %v, next cursor %q, want [3 4] and no cursor", ids, next)
+		}
+	})
+
+	t.Run("everything by default", func(t *testing.T) {
+		if ids, _ := list(t, ""); len(ids) != 6 {
+			t.Errorf("users = %v, want the 6 users", ids)
+		}
+	})
+
+	for name, query := range map[string]string{
+		"invalid cursor":  "?cursor=not-a-cursor",
+		"cursor of id 0":  "?cursor=" + encodeCursor(0),
+		"cursor and page": "?cursor=&page=2",
+	} {
+		t.Run(name, func(t *testing.T) {
+			expectStatus(t, s.do(t, "GET", "/api/v1/user/"+query, adminToken, nil), http.StatusBadRequest)
+		})
+	}
+
+	t.Run("page size too large", func(t *testing.T) {
+		expectStatus(t, s.do(t, "GET", "/api/v1/user/?cursor=&pageSize=1000", adminToken, nil), http.StatusUnprocessableEntity)
+	})
+}
+
+func TestPaginationQuery(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.RESPONSE_ENVELOPE = true
+	})
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+	for i := 1; i <= 3; i++ {
+		s.seedUser(t, testutil.UserFixture{Email: fmt.Sprintf("user%d@example.com", i)})
+	}
+
+	tests := []struct {
+		name         string
+		query        string
+		wantStatus   int
+		wantPage     float64
+		wantPageSize float64
+		wantCount    int
+		wantField    string
+	}{
+		{"defaults", "", http.StatusOK, 1, 20, 4, ""},
+		{"page and size", "&page=2&pageSize=3", http.StatusOK, 2, 3, 1, ""},
+		{"largest page size", "&pageSize=100", http.StatusOK, 1, 100, 4, ""},
+		{"page 0", "&page=0", http.StatusUnprocessableEntity, 0, 0, 0, "page"},
+		{"page size 0", "&pageSize=0", http.StatusUnprocessableEntity, 0, 0, 0, "pageSize"},
+		{"page size too large", "&pageSize=101", http.StatusUnprocessableEntity, 0, 0, 0, "pageSize"},
+		{"page not a number", "&page=second", http.StatusUnprocessableEntity, 0, 0, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do(t, "GET", "/api/v1/user/search?q=example"+tt.query, adminToken, nil)
+			expectStatus(t, w, tt.wantStatus)
+
+			var got struct {
+				Data  []model.UserResponseDTO `json:"data"`
+				Error *EnvelopeError          `json:"error"`
+				Meta  map[string]any          `json:"meta"`
+			}
+			testutil.DecodeJSON(t, w, &got)
+			if tt.wantStatus != http.StatusOK {
+				if got.Error == nil || (tt.wantField != "" && got.Error.Fields[tt.wantField] == "") {
+					t.Errorf("error = %+v, want a failure of %q", got.Error, tt.wantField)
+				}
+				return
+			}
+			if got.Meta["page"] != tt.wantPage || got.Meta["pageSize"] != tt.wantPageSize || len(got.Data) != tt.wantCount {
+				t.Errorf("meta = %v with %d users, want page %v of size %v with %d users", got.Meta, len(got.Data), tt.wantPage, tt.wantPageSize, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestInvalidIDParam(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, adminToken := s.seedUser(t, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		for _, id := range []string{"abc", "0", "-1", "1.5", "99999999999999999999"} {
+			t.Run(method+" "+id, func(t *testing.T) {
+				w := s.do(t, method, "/api/v1/user/"+id, adminToken, model.UserUpdateDTO{})
+				expectStatus(t, w, http.StatusBadRequest)
+
+				var body ErrorResponse
+				testutil.DecodeJSON(t, w, &body)
+				if body.Error != "id must be a positive integer" {
+					t.Errorf("error = %q, want the message of parseIDParam", body.Error)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+// Mailer sends an email. Implement it to plug any delivery service (SendGrid, SES...).
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends plain text emails through an SMTP server.
+type SMTPMailer struct {
+	Host string
+	Port int
+	User string
+	Pass string
+	From string
+}
+
+/*
+NewSMTPMailer returns a Mailer sending through the given SMTP server. The connection is
+upgraded with STARTTLS when the server supports it, and authenticated when user is set.
+
+Parameters:
+- host (string): The SMTP server host.
+- port (int): The SMTP server port.
+- user (string): The SMTP user, empty for no authentication.
+- pass (string): The SMTP password.
+- from (string): The sender address.
+
+Returns:
+- (*SMTPMailer): A pointer to the newly created SMTPMailer instance.
+*/
+func NewSMTPMailer(host string, port int, user, pass, from string) *SMTPMailer {
+	return &SMTPMailer{
+		Host: host,
+		Port: port,
+		User: user,
+		Pass: pass,
+		From: from,
+	}
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	// Header values must not contain line breaks, they would allow injecting headers
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	var auth smtp.Auth
+	if m.User != "" {
+		auth = smtp.PlainAuth("", m.User, m.Pass, m.Host)
+	}
+
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+
+	return smtp.SendMail(m.Host+":"+strconv.Itoa(m.Port), auth, m.From, []string{to}, []byte(msg))
+}
+
+// LogMailer doesn't send anything and only logs the emails, for development and tests.
+type LogMailer struct {
+	Logger *slog.Logger
+}
+
+/*
+NewLogMailer returns a Mailer that logs the emails instead of sending them.
+
+Parameters:
+- logger (*slog.Logger): The logger the emails are written to, the default logger if nil.
+
+Returns:
+- (*LogMailer): A pointer to the newly created LogMailer instance.
+*/
+func NewLogMailer(logger *slog.Logger) *LogMailer {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &LogMailer{
+		Logger: logger,
+	}
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	m.Logger.Info("email not sent, no mailer configured", "to", to, "subject", subject, "body", body)
+
+	return nil
+}
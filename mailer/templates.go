@@ -0,0 +1,145 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+const (
+	// EmailVerificationTemplate is the name of the template sent to confirm an email change
+	EmailVerificationTemplate = "email_verification"
+	// PasswordResetTemplate is the name of the template sent to reset a forgotten password
+	PasswordResetTemplate = "password_reset"
+	// InvitationTemplate is the name of the template inviting someone to register
+	InvitationTemplate = "invitation"
+)
+
+// TemplateData is the data the email templates are executed with.
+type TemplateData struct {
+	Email string
+	Token string
+	// AppURL is the base URL of the application, to build links. It may be empty.
+	AppURL string
+}
+
+// defaultTemplates each define a "subject" and a "body" template
+var defaultTemplates = map[string]string{
+	EmailVerificationTemplate: `{{define "subject"}}Confirm your new email{{end}}
+{{- define "body"}}Hello,
+
+A change of the email of your account to {{.Email}} has been requested.
+{{if .AppURL}}Confirm it by opening {{.AppURL}}/confirm-email?token={{.Token}}
+{{else}}Confirm it with this token: {{.Token}}
+{{end}}
+If you didn't request it, you can ignore this email.
+{{end}}`,
+	PasswordResetTemplate: `{{define "subject"}}Reset your password{{end}}
+{{- define "body"}}Hello,
+
+A password reset has been requested for your account.
+{{if .AppURL}}Choose a new password by opening {{.AppURL}}/reset-password?token={{.Token}}
+{{else}}Reset it with this token: {{.Token}}
+{{end}}
+If you didn't request it, you can ignore this email.
+{{end}}`,
+	InvitationTemplate: `{{define "subject"}}You have been invited{{end}}
+{{- define "body"}}Hello,
+
+You have been invited to create an account with {{.Email}}.
+{{if .AppURL}}Register by opening {{.AppURL}}/register?invite={{.Token}}
+{{else}}Register with this invitation token: {{.Token}}
+{{end}}
+If you weren't expecting it, you can ignore this email.
+{{end}}`,
+}
+
+// Templates renders the emails. Each template defines a "subject" and a "body" template.
+type Templates struct {
+	templates map[string]*template.Template
+}
+
+/*
+LoadTemplates parses the default templates, overridden by the <name>.tmpl files found in dir.
+
+Parameters:
+- dir (string): The directory of the overriding templates, empty to only use the defaults.
+
+Returns:
+- (*Templates): The parsed templates.
+- (error): An error if a template can't be read or parsed.
+*/
+func LoadTemplates(dir string) (*Templates, error) {
+	templates := &Templates{templates: map[string]*template.Template{}}
+
+	for name, text := range defaultTemplates {
+		if dir != "" {
+			content, err := os.ReadFile(filepath.Join(dir, name+".tmpl"))
+			if err == nil {
+				text = string(content)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+
+		if err := templates.Set(name, text); err != nil {
+			return nil, err
+		}
+	}
+
+	return templates, nil
+}
+
+/*
+Set overrides the named template.
+
+Parameters:
+- name (string): The name of the template, e.g. EmailVerificationTemplate.
+- text (string): The template, defining a "subject" and a "body" template.
+
+Returns:
+- (error): An error if the template can't be parsed or doesn't define both templates.
+*/
+func (t *Templates) Set(name, text string) error {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return fmt.Errorf("failed to parse the %s template: %w", name, err)
+	}
+	if tmpl.Lookup("subject") == nil || tmpl.Lookup("body") == nil {
+		return fmt.Errorf("the %s template must define a subject and a body", name)
+	}
+
+	t.templates[name] = tmpl
+
+	return nil
+}
+
+/*
+Send renders the named template with data and sends it to data.Email through m.
+
+Parameters:
+- m (Mailer): The mailer used to send the email.
+- name (string): The name of the template.
+- data (TemplateData): The data of the template, data.Email is the recipient.
+
+Returns:
+- (error): An error if the rendering or the sending failed.
+*/
+func (t *Templates) Send(m Mailer, name string, data TemplateData) error {
+	tmpl, ok := t.templates[name]
+	if !ok {
+		return fmt.Errorf("unknown email template %s", name)
+	}
+
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return err
+	}
+
+	return m.Send(data.Email, subject.String(), body.String())
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"os"
+	"time"
 
 	"github.com/MohammadBnei/gorm-user-auth/config"
 	_ "github.com/MohammadBnei/gorm-user-auth/docs"
+	"github.com/MohammadBnei/gorm-user-auth/grpcserver"
 	"github.com/MohammadBnei/gorm-user-auth/handler"
+	"github.com/MohammadBnei/gorm-user-auth/mailer"
+	"github.com/MohammadBnei/gorm-user-auth/metrics"
 	"github.com/MohammadBnei/gorm-user-auth/model"
 	"github.com/MohammadBnei/gorm-user-auth/service"
+	"github.com/MohammadBnei/gorm-user-auth/storage"
+	"github.com/MohammadBnei/gorm-user-auth/webhook"
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -19,35 +30,246 @@ import (
 
 //	@BasePath	/api/v1
 func main() {
-	conf := config.InitConfig()
-	db, err := config.InitDB(conf)
+	cmd, err := parseCommand(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("invalid command line", "error", err)
+		os.Exit(2)
+	}
+
+	conf, err := config.InitConfig()
 	if err != nil {
-		log.Fatalln(err)
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	logger := config.InitLogger(conf)
+	model.BcryptCost = conf.BCRYPT_COST
+	if conf.PASSWORD_HASHER == config.PasswordHasherArgon2id {
+		model.PasswordHasher = model.Argon2idHasher{
+			Memory:      uint32(conf.ARGON2_MEMORY),
+			Iterations:  uint32(conf.ARGON2_ITERATIONS),
+			Parallelism: uint8(conf.ARGON2_PARALLELISM),
+		}
+	}
+	model.PasswordHistorySize = conf.PASSWORD_HISTORY
+	model.DefaultRole = conf.DEFAULT_ROLE
+	if conf.FIELD_ENCRYPTION_KEY != "" {
+		if model.FieldEncryption, err = model.NewFieldKeyring(conf.FIELD_ENCRYPTION_KEY_VERSION, conf.FieldEncryptionKeys()); err != nil {
+			logger.Error("invalid field encryption keys", "error", err)
+			os.Exit(1)
+		}
 	}
 
-	db.AutoMigrate(&model.User{}, &model.RefreshToken{})
+	db, err := config.InitDB(conf, logger)
+	if err != nil {
+		logger.Error("failed to connect to the database", "error", err)
+		os.Exit(1)
+	}
+
+	// Rolling deploys run migrate once, then start the instances with -skip-migrate
+	switch {
+	case cmd.name == commandMigrate:
+		if err := migrate(db); err != nil {
+			logger.Error("failed to migrate the database", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("migrated the database")
+		return
+	case cmd.skipMigrate:
+		logger.Info("skipping the database migration")
+	default:
+		if err := migrate(db); err != nil {
+			logger.Error("failed to migrate the database", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	userService := service.NewUserService(db)
+	// The rotations of FIELD_ENCRYPTION_KEY run reencrypt, then retire the previous keys
+	if cmd.name == commandReencrypt {
+		if err := reencrypt(userService, logger); err != nil {
+			logger.Error("failed to re-encrypt the users", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if conf.ADMIN_EMAIL != "" {
+		seedAdmin(userService, conf, logger)
+	}
 	rtService := service.NewRTService(db)
-	userHandler := handler.NewUserHandler(userService)
-	authHandler := handler.NewAuthHandler(rtService, userService, conf)
+	revokedTokenService := service.NewRevokedTokenService(db)
+	usedTokenService := service.NewUsedTokenService(db)
+
+	mailTemplates, err := mailer.LoadTemplates(conf.MAIL_TEMPLATES_DIR)
+	if err != nil {
+		logger.Error("failed to load the email templates", "error", err)
+		os.Exit(1)
+	}
+	var m mailer.Mailer = mailer.NewLogMailer(logger)
+	if conf.SMTP_HOST != "" {
+		m = mailer.NewSMTPMailer(conf.SMTP_HOST, conf.SMTP_PORT, conf.SMTP_USER, conf.SMTP_PASS, conf.MAIL_FROM)
+	} else {
+		logger.Warn("SMTP_HOST is not set, emails will only be logged")
+	}
+
+	idempotencyService := service.NewIdempotencyService(db)
+	txService := service.NewTxService(db)
+	webhooks := webhook.NewWebhookService(conf.WEBHOOK_URLS, conf.WEBHOOK_SECRET, logger)
+	auditService := service.NewAuditService(db)
+	permissionService := service.NewPermissionService(db)
+	userHandler := handler.NewUserHandler(userService, idempotencyService, txService, webhooks, auditService, conf)
+	authHandler := handler.NewAuthHandler(rtService, userService, revokedTokenService, idempotencyService, txService, m, mailTemplates, webhooks, auditService, permissionService, conf)
+	oauthHandler := handler.NewOAuthHandler(authHandler, conf)
+	apiKeyHandler := handler.NewApiKeyHandler(service.NewApiKeyService(db))
+	auditHandler := handler.NewAuditHandler(auditService)
+	invitationHandler := handler.NewInvitationHandler(authHandler, service.NewInvitationService(db))
+
+	var files storage.Storage = storage.NewLocalStorage(conf.STORAGE_LOCAL_DIR, conf.StoragePublicURL())
+	if conf.STORAGE_DRIVER == config.StorageS3 {
+		files = storage.NewS3Storage(conf.S3_ENDPOINT, conf.S3_REGION, conf.S3_BUCKET, conf.S3_ACCESS_KEY, conf.S3_SECRET_KEY, conf.STORAGE_PUBLIC_URL)
+	}
+	avatarHandler := handler.NewAvatarHandler(userService, files, conf)
+
+	// The internal services can skip HTTP/JSON, the gRPC API shares the sessions of the REST one
+	if conf.GRPC_ENABLED {
+		listener, err := net.Listen("tcp", conf.GRPC_ADDR)
+		if err != nil {
+			logger.Error("failed to listen on GRPC_ADDR", "error", err)
+			os.Exit(1)
+		}
+		grpcServer := grpcserver.New(authHandler, logger)
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				logger.Error("the gRPC server stopped", "error", err)
+				os.Exit(1)
+			}
+		}()
+		logger.Info("serving the gRPC API", "addr", listener.Addr().String())
+	}
+
+	// Denylist entries, used tokens and idempotency keys are useless once expired, purge them regularly
+	go func() {
+		for range time.Tick(time.Hour) {
+			purged, err := revokedTokenService.PurgeExpired(context.Background())
+			if err != nil {
+				logger.Error("failed to purge revoked tokens", "error", err)
+			} else {
+				logger.Debug("purged revoked tokens", "count", purged)
+			}
+
+			purged, err = usedTokenService.PurgeExpired(context.Background())
+			if err != nil {
+				logger.Error("failed to purge used tokens", "error", err)
+			} else {
+				logger.Debug("purged used tokens", "count", purged)
+			}
 
-	r := gin.Default()
+			purged, err = idempotencyService.PurgeExpired(context.Background())
+			if err != nil {
+				logger.Error("failed to purge idempotency keys", "error", err)
+			} else {
+				logger.Debug("purged idempotency keys", "count", purged)
+			}
+		}
+	}()
+
+	r := gin.New()
+	// X-Forwarded-For is only honored from the trusted proxies, anyone else could spoof the client IP
+	if err := r.SetTrustedProxies(conf.TRUSTED_PROXIES); err != nil {
+		logger.Error("invalid TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
+	r.Use(handler.RequestLogger(logger), handler.Recovery(), handler.CORS(conf), handler.BodyLimit(conf.MAX_BODY_BYTES, handler.AvatarPath), handler.ResponseFormat(conf.RESPONSE_ENVELOPE), handler.ErrorDetails(conf.ErrorDetails()))
 
-	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	if conf.COMPRESSION_ENABLED {
+		// The metrics endpoint compresses its own responses
+		r.Use(handler.Compression(conf.COMPRESSION_MIN_SIZE, "/metrics"))
+	}
 
-	userApi := r.Group("/api/v1/user")
-	userApi.GET("/:id", userHandler.GetUser)
-	userApi.GET("/", userHandler.GetUsers)
-	userApi.POST("/", userHandler.CreateUser)
-	userApi.PUT("/:id", userHandler.UpdateUser)
-	userApi.DELETE("/:id", userHandler.DeleteUser)
+	// The bulk import may take longer than the other requests, it is left without a deadline
+	r.Use(handler.Timeout(conf.REQUEST_TIMEOUT, "/api/v1/user/bulk"))
+
+	if conf.METRICS_ENABLED {
+		metrics.RegisterActiveSessions(func() float64 {
+			count, err := rtService.CountActive(context.Background())
+			if err != nil {
+				logger.Error("failed to count active sessions", "error", err)
+			}
+			return float64(count)
+		})
+		r.Use(handler.Metrics())
+		r.GET("/metrics", handler.MetricsHandler())
+	}
+
+	// The uploaded files of the local storage are public, their keys aren't guessable
+	if conf.STORAGE_DRIVER == config.StorageLocal {
+		r.Static(config.LocalStoragePath, conf.STORAGE_LOCAL_DIR)
+	}
+
+	// Without SWAGGER_ENABLED, /swagger/ is a 404 like any unknown route
+	if conf.SWAGGER_ENABLED {
+		r.GET("/swagger/*any", handler.BasicAuth("swagger", conf.SWAGGER_USER, conf.SWAGGER_PASS), ginSwagger.WrapHandler(swaggerFiles.Handler))
+	}
+
+	// Every user route requires authentication, public signup goes through /auth/register.
+	// Server-to-server integrations can authenticate with an API key instead of a jwt
+	read, write := handler.RequireScope(model.ScopeUserRead), handler.RequireScope(model.ScopeUserWrite)
+	userAuth := []gin.HandlerFunc{apiKeyHandler.ApiKeyOr(authHandler.AuthMiddleware()), authHandler.CSRFMiddleware()}
+	userApi := r.Group("/api/v1/user", userAuth...)
+	userApi.GET("/:id", read, userHandler.GetUser)
+	userApi.PUT("/email", write, authHandler.ChangeEmail)
+	userApi.POST("/avatar", write, avatarHandler.UploadAvatar)
+	userApi.PUT("/:id", write, userHandler.UpdateUser)
+	userApi.PATCH("/:id", write, userHandler.UpdateUser)
+	userApi.DELETE("/:id", write, userHandler.DeleteUser)
+
+	// The admin routes are only reachable from ADMIN_ALLOWED_CIDRS, checked before any authentication
+	adminNetworks := handler.AllowNetworks(conf.AdminAllowedNetworks())
+	adminUserApi := r.Group("/api/v1/user", append([]gin.HandlerFunc{adminNetworks}, userAuth...)...)
+	adminUserApi.GET("/search", read, authHandler.RequireAdmin(), userHandler.SearchUsers)
+	adminUserApi.GET("/", read, authHandler.RequireAdmin(), userHandler.GetUsers)
+	adminUserApi.HEAD("/", read, authHandler.RequireAdmin(), userHandler.CountUsers)
+	adminUserApi.POST("/", write, authHandler.RequireAdmin(), userHandler.CreateUser)
+	adminUserApi.POST("/bulk", write, authHandler.RequireAdmin(), userHandler.ImportUsers)
+	adminUserApi.PUT("/:id/status", write, authHandler.RequireAdmin(), userHandler.SetUserStatus)
+	adminUserApi.POST("/:id/reset-password", write, authHandler.RequireAdmin(), userHandler.ResetUserPassword)
+
+	// Signup forms check the usernames before having an account
+	r.GET("/api/v1/user/check-username", userHandler.CheckUsername)
+	r.GET("/api/v1/user/check-email", handler.RateLimit(conf.CHECK_EMAIL_RATE_LIMIT, time.Minute), userHandler.CheckEmail)
+	// The confirmation link may be opened without a session, the token is enough
+	r.POST("/api/v1/user/email/confirm", authHandler.ConfirmEmail)
 
 	authApi := r.Group("/api/v1/auth")
 	authApi.POST("/login", authHandler.Login)
+	authApi.POST("/register", authHandler.Register)
+	authApi.GET("/me", authHandler.AuthMiddleware(), authHandler.Me)
+	authApi.DELETE("/me", authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.DeleteMe)
+	authApi.POST("/logout", authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.Logout)
+	authApi.PUT("/password", authHandler.AllowPasswordChange(), authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.ChangePassword)
+	authApi.GET("/sessions", authHandler.AuthMiddleware(), authHandler.ListSessions)
+	authApi.DELETE("/sessions", authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.RevokeAllSessions)
+	authApi.DELETE("/sessions/:id", authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.RevokeSession)
+	// The resource servers delegate the validation of the jwt with an API key
+	authApi.POST("/introspect", apiKeyHandler.ApiKeyMiddleware(), handler.RequireScope(model.ScopeTokenIntrospect), authHandler.Introspect)
+	authApi.POST("/password/forgot", authHandler.ForgotPassword)
+	authApi.POST("/password/reset", authHandler.ResetPassword)
+	authApi.GET("/oauth/:provider/login", oauthHandler.Login)
+	authApi.GET("/oauth/:provider/callback", oauthHandler.Callback)
+	// The API keys are managed with a jwt only, a key can't mint other keys
+	authApi.POST("/api-keys", authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), apiKeyHandler.CreateApiKey)
+	authApi.GET("/api-keys", authHandler.AuthMiddleware(), apiKeyHandler.ListApiKeys)
+	authApi.DELETE("/api-keys/:id", authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), apiKeyHandler.RevokeApiKey)
+
+	r.POST("/api/v1/invitations", adminNetworks, authHandler.AuthMiddleware(), authHandler.CSRFMiddleware(), authHandler.RequireAdmin(), invitationHandler.CreateInvitation)
+
+	// The audit trail is for the admins only, it isn't exposed to the API keys
+	r.GET("/api/v1/audit", adminNetworks, authHandler.AuthMiddleware(), authHandler.RequireAdmin(), auditHandler.ListAuditLogs)
 
 	r.GET("/test/auth", authHandler.AuthMiddleware(), func(c *gin.Context) {
-		user, exist := c.Get("user")
+		user, exist := handler.CurrentUser(c)
 
 		if !exist {
 			c.JSON(401, gin.H{
@@ -55,8 +277,9 @@ func main() {
 			})
 			return
 		}
+
 		c.JSON(200, gin.H{
-			"user": user,
+			"user": user.ToResponse(),
 		})
 	})
 
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "user_auth"
+
+var (
+	// LoginAttempts counts the login attempts, by result (success or failure)
+	LoginAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_attempts_total",
+		Help:      "Number of login attempts, by result.",
+	}, []string{"result"})
+
+	// TokenRefreshes counts the automatic jwt refreshes done by the AuthMiddleware, by result (success or failure)
+	TokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshes_total",
+		Help:      "Number of jwt refreshes through a refresh token, by result.",
+	}, []string{"result"})
+
+	// HTTPRequestDuration observes the duration of the HTTP requests, by method, route and status
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of the HTTP requests, by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// UserOperationDuration observes the duration of the UserService operations, by operation and result (success or error)
+	UserOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "user_operation_duration_seconds",
+		Help:      "Duration of the user service operations, by operation and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+)
+
+// Result returns the result label matching ok.
+func Result(ok bool) string {
+	if ok {
+		return "success"
+	}
+
+	return "failure"
+}
+
+/*
+ObserveUserOperation records the duration of a UserService operation. It is meant to be
+deferred at the start of the operation, with a pointer to its named error result:
+
+	defer metrics.ObserveUserOperation("get", time.Now(), &err)
+
+Parameters:
+- operation (string): The name of the operation.
+- start (time.Time): The instant the operation started.
+- err (*error): A pointer to the error returned by the operation.
+*/
+func ObserveUserOperation(operation string, start time.Time, err *error) {
+	result := "success"
+	if *err != nil {
+		result = "error"
+	}
+
+	UserOperationDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+/*
+RegisterActiveSessions registers the active sessions gauge, computed by count on every scrape.
+
+Parameters:
+- count (func() float64): A function returning the current number of active sessions.
+*/
+func RegisterActiveSessions(count func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_sessions",
+		Help:      "Number of refresh tokens that have not expired yet.",
+	}, count)
+}
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// ScopeUserRead allows the API key to read the users
+	ScopeUserRead = "user:read"
+	// ScopeUserWrite allows the API key to create, update and delete the users
+	ScopeUserWrite = "user:write"
+	// ScopeTokenIntrospect allows the API key to introspect the jwt of the users, see POST /auth/introspect
+	ScopeTokenIntrospect = "token:introspect"
+)
+
+// ApiKeyScopes are the scopes an API key can be granted
+var ApiKeyScopes = []string{ScopeUserRead, ScopeUserWrite, ScopeTokenIntrospect}
+
+// ApiKey is a long-lived credential for server-to-server integrations, acting on behalf of its owner
+// within its scopes. Like the refresh tokens, only the SHA-256 digest of the key is stored.
+type ApiKey struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	User      User   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserId    int    `gorm:"index"`
+	Name      string `gorm:"size:64"`
+	// Prefix is the beginning of the key, it lets the owner tell the keys apart
+	Prefix string `gorm:"size:16"`
+	Hash   string `gorm:"size:64;uniqueIndex"`
+	// Scopes are space separated, like OAuth scopes
+	Scopes string `gorm:"size:255"`
+	// ExpiresAt is nil for a key that never expires
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	// Key is the plaintext key. It is only set on creation and never stored.
+	Key string `gorm:"-"`
+}
+
+// HasScope reports whether the key was granted scope.
+func (k *ApiKey) HasScope(scope string) bool {
+	for _, s := range strings.Fields(k.Scopes) {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ToResponse maps the key to its response DTO, without the plaintext key.
+func (k *ApiKey) ToResponse() *ApiKeyResponseDTO {
+	return &ApiKeyResponseDTO{
+		ID:         k.ID,
+		Name:       k.Name,
+		Prefix:     k.Prefix,
+		Scopes:     strings.Fields(k.Scopes),
+		CreatedAt:  k.CreatedAt,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+	}
+}
+
+type ApiKeyCreateDTO struct {
+	Name   string   `json:"name" example:"billing-service" binding:"required,max=64"`
+	Scopes []string `json:"scopes" example:"user:read" binding:"required,min=1"`
+	// ExpiresAt is optional, the key never expires without it
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+/*
+Validate checks that the key has a name, known scopes and an expiry in the future.
+
+Returns:
+
+	(error): the validation error, nil if the DTO is valid.
+*/
+func (data *ApiKeyCreateDTO) Validate() error {
+	if data.Name == "" || len(data.Name) > 64 {
+		return errors.New("name is required and must be at most 64 characters")
+	}
+	if len(data.Scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range data.Scopes {
+		known := false
+		for _, s := range ApiKeyScopes {
+			known = known || s == scope
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q, expected one of %s", scope, strings.Join(ApiKeyScopes, ", "))
+		}
+	}
+	if data.ExpiresAt != nil && !data.ExpiresAt.After(time.Now()) {
+		return errors.New("expiresAt must be in the future")
+	}
+
+	return nil
+}
+
+type ApiKeyResponseDTO struct {
+	ID         uint       `json:"id" example:"1"`
+	Name       string     `json:"name" example:"billing-service"`
+	Prefix     string     `json:"prefix" example:"ak_3kTq9"`
+	Scopes     []string   `json:"scopes" example:"user:read"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// ApiKeyCreatedResponseDTO is only returned on creation, the plaintext key can't be retrieved afterwards
+type ApiKeyCreatedResponseDTO struct {
+	ApiKeyResponseDTO
+	Key string `json:"key" example:"ak_3kTq9b3JkZXItcGxhY2Vob2xkZXItdG9rZW4"`
+}
@@ -0,0 +1,49 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The actions recorded in the audit trail
+const (
+	AuditLogin           = "user.login"
+	AuditLoginFailed     = "user.login_failed"
+	AuditPasswordChanged = "user.password_changed"
+	AuditSessionRevoked  = "session.revoked"
+	AuditUserDeleted     = "user.deleted"
+)
+
+// ErrAuditLogImmutable is returned when an audit log entry is updated or deleted.
+var ErrAuditLogImmutable = errors.New("audit logs can't be modified")
+
+// AuditLog is an entry of the trail of the security sensitive actions. The entries are never
+// updated nor deleted, and outlive the users they are about: UserId isn't a foreign key.
+// swagger:model
+type AuditLog struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"createdAt" gorm:"index"`
+	// UserId is the user the action is about, 0 when unknown, e.g. a login with an unknown email
+	UserId int    `json:"userId" gorm:"index"`
+	Action string `json:"action" gorm:"size:64;index" example:"user.login"`
+	Detail string `json:"detail" gorm:"size:255" example:"password"`
+	Ip     string `json:"ip" gorm:"size:45"`
+}
+
+func (*AuditLog) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditLogImmutable
+}
+
+func (*AuditLog) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditLogImmutable
+}
+
+// AuditFilter restricts the audit logs listed. Empty fields don't filter.
+type AuditFilter struct {
+	UserId int    `form:"userId"`
+	Action string `form:"action"`
+	// Org is set by the handlers, from the organization of the caller
+	Org *OrgScope `form:"-"`
+}
@@ -1,6 +1,119 @@
 package model
 
+import (
+	"errors"
+	"net/mail"
+	"time"
+)
+
 type LoginDTO struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	// Identifier is the email or the username of the user
+	Identifier string `json:"identifier,omitempty" example:"alice" binding:"required_without=Email"`
+	// Email is still accepted in place of the identifier, for the clients written before it
+	Email    string `json:"email,omitempty" example:"alice@example.com" binding:"omitempty,email"`
+	Password string `json:"password" example:"sup3rs3cret" binding:"required"`
+	// RememberMe issues a long lived refresh token and persistent cookies instead of session ones
+	RememberMe bool `json:"rememberMe" example:"false"`
+	// TokensOnly omits the user from the response, for the clients getting it from GET /auth/me
+	TokensOnly bool `json:"tokensOnly" example:"false"`
+}
+
+// LoginIdentifier returns the identifier of the user logging in, its email if no identifier is given.
+func (data *LoginDTO) LoginIdentifier() string {
+	if data.Identifier != "" {
+		return data.Identifier
+	}
+
+	return data.Email
+}
+
+type LoginResponseDTO struct {
+	// Token and RefreshToken are omitted with TOKEN_IN_BODY off, they are then only set as cookies.
+	// SessionID identifies the session in GET /auth/sessions and DELETE /auth/sessions/{id}.
+	// User is omitted from the login with tokensOnly or LOGIN_RESPONSE_USER off
+	Token                 string           `json:"token,omitempty" example:"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9..."`
+	RefreshToken          string           `json:"refreshToken,omitempty" example:"-NU2m1f8k0XqQ9aLcB1z"`
+	RefreshTokenExpiresAt time.Time        `json:"refreshTokenExpiresAt"`
+	SessionID             uint             `json:"sessionId" example:"42"`
+	User                  *UserResponseDTO `json:"user,omitempty"`
+}
+
+// IntrospectionDTO is the introspection request of RFC 7662, sent as a form or as JSON
+type IntrospectionDTO struct {
+	Token string `json:"token" form:"token" example:"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9..." binding:"required"`
+	// TokenTypeHint is accepted for the clients following the RFC, only the jwt are introspected
+	TokenTypeHint string `json:"token_type_hint,omitempty" form:"token_type_hint" example:"access_token"`
+}
+
+// IntrospectionResponseDTO describes a token like RFC 7662, with the snake_case names of the RFC.
+// Only active is set for a token which is invalid, expired or revoked
+type IntrospectionResponseDTO struct {
+	Active    bool     `json:"active" example:"true"`
+	TokenType string   `json:"token_type,omitempty" example:"access_token"`
+	Sub       string   `json:"sub,omitempty" example:"1"`
+	UserID    uint     `json:"user_id,omitempty" example:"1"`
+	Username  string   `json:"username,omitempty" example:"alice"`
+	Exp       int64    `json:"exp,omitempty" example:"1700000000"`
+	Iat       int64    `json:"iat,omitempty" example:"1699996400"`
+	Nbf       int64    `json:"nbf,omitempty" example:"1699996400"`
+	Iss       string   `json:"iss,omitempty" example:"https://auth.example.com"`
+	Aud       []string `json:"aud,omitempty"`
+	Jti       string   `json:"jti,omitempty" example:"-NU2m1f8k0XqQ9aLcB1z"`
+	// The claims of this service, the role is the current one of the user
+	Role               string   `json:"role,omitempty" example:"user"`
+	OrgID              *uint    `json:"org_id,omitempty" example:"1"`
+	Permissions        []string `json:"permissions,omitempty"`
+	MustChangePassword bool     `json:"must_change_password,omitempty" example:"false"`
+}
+
+type PasswordChangeDTO struct {
+	CurrentPassword string `json:"currentPassword" example:"sup3rs3cret" binding:"required"`
+	NewPassword     string `json:"newPassword" example:"n3ws3cret" binding:"required,password"`
+}
+
+// EmailChangeDTO requests an email change, confirmed with the current password
+type EmailChangeDTO struct {
+	Email    string `json:"email" example:"alice@example.org" binding:"required,email"`
+	Password string `json:"password" example:"sup3rs3cret" binding:"required"`
+}
+
+/*
+Validate checks that the new email is a valid address.
+
+Returns:
+
+	(error): the validation error, nil if the DTO is valid.
+*/
+func (data *EmailChangeDTO) Validate() error {
+	if data.Email == "" {
+		return errors.New("email is required")
+	}
+	if _, err := mail.ParseAddress(data.Email); err != nil {
+		return errors.New("email is invalid")
+	}
+
+	return nil
+}
+
+// EmailConfirmDTO holds the verification token sent to the new email
+type EmailConfirmDTO struct {
+	Token string `json:"token" example:"b3JkZXItcGxhY2Vob2xkZXItdG9rZW4" binding:"required"`
+}
+
+type PasswordForgotDTO struct {
+	Email string `json:"email" example:"alice@example.com" binding:"required,email"`
+}
+
+type PasswordResetDTO struct {
+	Token       string `json:"token" example:"b3JkZXItcGxhY2Vob2xkZXItdG9rZW4" binding:"required"`
+	NewPassword string `json:"newPassword" example:"n3ws3cret" binding:"required,password"`
+}
+
+type SessionsRevokedResponseDTO struct {
+	Message         string `json:"message" example:"Logged out of every session"`
+	RevokedSessions int64  `json:"revokedSessions" example:"3"`
+}
+
+type AccountDeleteDTO struct {
+	Password string `json:"password" example:"sup3rs3cret" binding:"required"`
 }
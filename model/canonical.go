@@ -0,0 +1,48 @@
+package model
+
+import "strings"
+
+// Canonicalizer is implemented by the DTOs whose fields are canonicalized once decoded, before
+// their validation and any lookup: " Alice@example.com" then finds the account of alice@example.com.
+// The fields are listed one by one below, the passwords are never among them as their spaces are significant.
+type Canonicalizer interface {
+	Canonicalize()
+}
+
+// Canonicalize trims the identifier and normalizes the email, not the password.
+func (data *LoginDTO) Canonicalize() {
+	data.Identifier = strings.TrimSpace(data.Identifier)
+	data.Email = NormalizeEmail(data.Email)
+}
+
+// Canonicalize normalizes the email and trims the username, not the password.
+func (data *UserCreateDTO) Canonicalize() {
+	data.Email = NormalizeEmail(data.Email)
+	if data.Username != nil {
+		*data.Username = strings.TrimSpace(*data.Username)
+	}
+}
+
+// Canonicalize trims the username and the profile fields.
+func (data *UserUpdateDTO) Canonicalize() {
+	for _, field := range []*string{data.Username, data.DisplayName, data.AvatarURL, data.Locale, data.Timezone, data.Bio} {
+		if field != nil {
+			*field = strings.TrimSpace(*field)
+		}
+	}
+}
+
+// Canonicalize normalizes the new email, not the password.
+func (data *EmailChangeDTO) Canonicalize() {
+	data.Email = NormalizeEmail(data.Email)
+}
+
+// Canonicalize normalizes the email.
+func (data *PasswordForgotDTO) Canonicalize() {
+	data.Email = NormalizeEmail(data.Email)
+}
+
+// Canonicalize normalizes the email.
+func (data *InvitationCreateDTO) Canonicalize() {
+	data.Email = NormalizeEmail(data.Email)
+}
@@ -0,0 +1,166 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix starts the encrypted values, enc:<key version>:<base64 of the nonce and the sealed value>
+const encryptedPrefix = "enc:"
+
+var (
+	// ErrFieldKeyMissing is returned when reading an encrypted value without FieldEncryption
+	ErrFieldKeyMissing = errors.New("the value is encrypted but no field encryption key is configured")
+	// ErrUnknownFieldKey is returned for a value encrypted with a key version the keyring doesn't have
+	ErrUnknownFieldKey = errors.New("the value is encrypted with an unknown key version")
+	// ErrInvalidCiphertext is returned for an encrypted value which is malformed or was tampered with
+	ErrInvalidCiphertext = errors.New("invalid encrypted value")
+)
+
+// FieldEncryption encrypts the EncryptedString columns. It is set from the FIELD_ENCRYPTION_KEY config
+// at startup, nil stores them in plaintext.
+var FieldEncryption *FieldKeyring
+
+// FieldKeyring encrypts with AES-GCM under its current key, and decrypts with any of its keys. The
+// encrypted values carry the version of their key, so that the previous keys keep decrypting the
+// values written before a rotation.
+type FieldKeyring struct {
+	version string
+	keys    map[string]cipher.AEAD
+}
+
+/*
+NewFieldKeyring creates a keyring encrypting with the key of version.
+
+Parameters:
+  - version (string): The version of the current key, it must be one of keys.
+  - keys (map[string][]byte): The AES keys by version, 16, 24 or 32 bytes long.
+
+Returns:
+  - (*FieldKeyring): The keyring.
+  - (error): An error if the current key is missing, or a version or a key invalid.
+*/
+func NewFieldKeyring(version string, keys map[string][]byte) (*FieldKeyring, error) {
+	if _, ok := keys[version]; !ok {
+		return nil, fmt.Errorf("no field encryption key of the current version %q", version)
+	}
+
+	keyring := &FieldKeyring{version: version, keys: make(map[string]cipher.AEAD, len(keys))}
+	for v, key := range keys {
+		if v == "" || strings.Contains(v, ":") {
+			return nil, fmt.Errorf("invalid field encryption key version %q", v)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("field encryption key %s: %w", v, err)
+		}
+		if keyring.keys[v], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	return keyring, nil
+}
+
+// Encrypt encrypts the plaintext with the current key, under a random nonce.
+func (k *FieldKeyring) Encrypt(plaintext string) (string, error) {
+	aead := k.keys[k.version]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return encryptedPrefix + k.version + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value returned by Encrypt. A plaintext value, written before the encryption was
+// configured, is returned as is.
+func (k *FieldKeyring) Decrypt(value string) (string, error) {
+	version, encoded, ok := parseEncrypted(value)
+	if !ok {
+		return value, nil
+	}
+	aead, ok := k.keys[version]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownFieldKey, version)
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrInvalidCiphertext
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+
+	return string(plaintext), nil
+}
+
+// Stale reports whether a stored value isn't encrypted with the current key: it is in plaintext or
+// encrypted with a previous one. The empty values are never encrypted.
+func (k *FieldKeyring) Stale(value string) bool {
+	version, _, ok := parseEncrypted(value)
+
+	return value != "" && (!ok || version != k.version)
+}
+
+// parseEncrypted splits an encrypted value into its key version and its encoded ciphertext, ok is false for a plaintext one.
+func parseEncrypted(value string) (version, encoded string, ok bool) {
+	rest, found := strings.CutPrefix(value, encryptedPrefix)
+	if !found {
+		return "", "", false
+	}
+
+	return strings.Cut(rest, ":")
+}
+
+// EncryptedString is a string column encrypted with FieldEncryption at rest, and decrypted when read.
+// It is in plaintext without FieldEncryption, the empty string is stored as is. The values converted
+// to it in the maps given to Updates are encrypted too, unlike plain strings.
+type EncryptedString string
+
+// Value encrypts the string for the database.
+func (s EncryptedString) Value() (driver.Value, error) {
+	if s == "" || FieldEncryption == nil {
+		return string(s), nil
+	}
+
+	return FieldEncryption.Encrypt(string(s))
+}
+
+// Scan decrypts the value read from the database.
+func (s *EncryptedString) Scan(src any) error {
+	var value string
+	switch src := src.(type) {
+	case nil:
+	case string:
+		value = src
+	case []byte:
+		value = string(src)
+	default:
+		return fmt.Errorf("cannot scan %T into an EncryptedString", src)
+	}
+
+	if FieldEncryption == nil {
+		if _, _, encrypted := parseEncrypted(value); encrypted {
+			return ErrFieldKeyMissing
+		}
+		*s = EncryptedString(value)
+		return nil
+	}
+	plaintext, err := FieldEncryption.Decrypt(value)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+
+	return nil
+}
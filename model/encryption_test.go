@@ -0,0 +1,104 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFieldKeyring(t *testing.T) {
+	previousKey := []byte("0123456789abcdef")
+	currentKey := []byte("0123456789abcdef0123456789abcdef")
+	previous, err := NewFieldKeyring("1", map[string][]byte{"1": previousKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := NewFieldKeyring("2", map[string][]byte{"1": previousKey, "2": currentKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := current.Encrypt("203.0.113.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := current.Encrypt("203.0.113.7")
+	if !strings.HasPrefix(encrypted, "enc:2:") || strings.Contains(encrypted, "203.0.113.7") || encrypted == again {
+		t.Errorf("Encrypt() = %q and %q, want distinct ciphertexts of the version 2", encrypted, again)
+	}
+	oldEncrypted, _ := previous.Encrypt("203.0.113.7")
+
+	tampered := []byte(encrypted)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name      string
+		value     string
+		want      string
+		wantErr   error
+		wantStale bool
+	}{
+		{"current key", encrypted, "203.0.113.7", nil, false},
+		{"previous key", oldEncrypted, "203.0.113.7", nil, true},
+		{"plaintext", "203.0.113.7", "203.0.113.7", nil, true},
+		{"empty", "", "", nil, false},
+		{"unknown version", "enc:3:" + strings.TrimPrefix(encrypted, "enc:2:"), "", ErrUnknownFieldKey, true},
+		{"tampered", string(tampered), "", ErrInvalidCiphertext, false},
+		{"not base64", "enc:2:not base64!", "", ErrInvalidCiphertext, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := current.Decrypt(tt.value)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("Decrypt() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+			if stale := current.Stale(tt.value); stale != tt.wantStale {
+				t.Errorf("Stale() = %v, want %v", stale, tt.wantStale)
+			}
+		})
+	}
+
+	// The previous keyring can't read what the rotated one wrote
+	if _, err := previous.Decrypt(encrypted); !errors.Is(err, ErrUnknownFieldKey) {
+		t.Errorf("Decrypt() with the previous keyring error = %v, want ErrUnknownFieldKey", err)
+	}
+
+	if _, err := NewFieldKeyring("2", map[string][]byte{"1": previousKey}); err == nil {
+		t.Error("NewFieldKeyring() without the current key must fail")
+	}
+	if _, err := NewFieldKeyring("1", map[string][]byte{"1": []byte("short")}); err == nil {
+		t.Error("NewFieldKeyring() with a short key must fail")
+	}
+}
+
+func TestEncryptedString(t *testing.T) {
+	keyring, err := NewFieldKeyring("1", map[string][]byte{"1": []byte("0123456789abcdef0123456789abcdef")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { FieldEncryption = nil })
+
+	FieldEncryption = keyring
+	value, err := EncryptedString("alice@example.com").Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := value.(string); !strings.HasPrefix(stored, "enc:1:") {
+		t.Fatalf("Value() = %v, want a ciphertext", value)
+	}
+	var scanned EncryptedString
+	if err := scanned.Scan([]byte(value.(string))); err != nil || scanned != "alice@example.com" {
+		t.Errorf("Scan() = %q, %v, want the plaintext", scanned, err)
+	}
+	if value, _ := EncryptedString("").Value(); value != "" {
+		t.Errorf("Value() of the empty string = %v, want it empty", value)
+	}
+
+	// Without a key, the values are in plaintext and the encrypted ones can't be read
+	FieldEncryption = nil
+	if value, _ := EncryptedString("alice@example.com").Value(); value != "alice@example.com" {
+		t.Errorf("Value() without a key = %v, want the plaintext", value)
+	}
+	if err := scanned.Scan(value); !errors.Is(err, ErrFieldKeyMissing) {
+		t.Errorf("Scan() without a key error = %v, want ErrFieldKeyMissing", err)
+	}
+}
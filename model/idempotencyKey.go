@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// IdempotencyKey records the user created by a request sent with an Idempotency-Key header,
+// so that a retry of the same request returns it instead of creating a second user.
+// Keys are scoped by endpoint and only kept until ExpiresAt.
+type IdempotencyKey struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Endpoint  string `gorm:"size:64;uniqueIndex:idx_idempotency_keys_endpoint_key"`
+	Key       string `gorm:"column:idempotency_key;size:191;uniqueIndex:idx_idempotency_keys_endpoint_key"`
+	// Fingerprint is a digest of the request, a key reused for another request is rejected
+	Fingerprint string `gorm:"size:64"`
+	UserId      int
+	ExpiresAt   time.Time `gorm:"index"`
+}
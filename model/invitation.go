@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// Invitation lets the owner of an email register while the public signup is closed. Like the
+// refresh tokens, only the SHA-256 digest of its token is stored.
+// swagger:model
+type Invitation struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"createdAt"`
+	Email     string    `json:"email" gorm:"size:191;index"`
+	Hash      string    `json:"-" gorm:"size:64;uniqueIndex"`
+	Inviter   User      `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	InviterId int       `json:"inviterId"`
+	// OrgID is the organization of the inviter, the invited user joins it
+	OrgID     *uint     `json:"-"`
+	ExpiresAt time.Time `json:"expiresAt" gorm:"index"`
+	Accepted  bool      `json:"accepted"`
+	// Token is the plaintext token. It is only set on creation and never stored.
+	Token string `json:"-" gorm:"-"`
+}
+
+type InvitationCreateDTO struct {
+	Email string `json:"email" example:"bob@example.com" binding:"required,email"`
+}
+
+// InvitationResponseDTO is returned once, on creation: the token can't be retrieved later
+type InvitationResponseDTO struct {
+	*Invitation
+	Token string `json:"token" example:"b3JkZXItcGxhY2Vob2xkZXItdG9rZW4"`
+	// Link is the registration link of the front-end, when APP_URL is set
+	Link string `json:"link,omitempty" example:"https://app.example.com/register?invite=b3JkZXItcGxhY2Vob2xkZXItdG9rZW4"`
+}
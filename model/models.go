@@ -0,0 +1,7 @@
+package model
+
+// Models returns every model of the schema, in an order AutoMigrate can create their tables
+// in: a table referenced by a foreign key comes before the tables referencing it.
+func Models() []any {
+	return []any{&Organization{}, &Permission{}, &User{}, &RolePermission{}, &RefreshToken{}, &RevokedToken{}, &UsedToken{}, &IdempotencyKey{}, &ApiKey{}, &PasswordHistory{}, &AuditLog{}, &Invitation{}}
+}
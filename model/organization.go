@@ -0,0 +1,15 @@
+package model
+
+import "gorm.io/gorm"
+
+// Organization is a tenant. Its users can only see each other, see OrgScope.
+type Organization struct {
+	gorm.Model
+	Name string `json:"name" gorm:"size:191;uniqueIndex"`
+}
+
+// OrgScope restricts the queries to the users of an organization, or to the users without
+// organization when OrgID is nil. A nil *OrgScope doesn't restrict anything.
+type OrgScope struct {
+	OrgID *uint
+}
@@ -0,0 +1,210 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrPasswordMismatch is returned by the hashers when the password doesn't match the hash.
+// It is bcrypt's error, the code comparing with bcrypt.ErrMismatchedHashAndPassword keeps working.
+var ErrPasswordMismatch = bcrypt.ErrMismatchedHashAndPassword
+
+// ErrUnknownPasswordHash is returned when a stored hash was produced by no known algorithm
+var ErrUnknownPasswordHash = errors.New("unknown password hash format")
+
+// PasswordMaxBytes bounds the new passwords, bcrypt can't hash the longer ones. It holds whatever the
+// PasswordHasher, so that a password stays valid when PASSWORD_HASHER changes.
+const PasswordMaxBytes = 72
+
+// ErrPasswordTooLong is returned for a new password longer than PasswordMaxBytes
+var ErrPasswordTooLong = fmt.Errorf("password must be at most %d bytes", PasswordMaxBytes)
+
+// ValidPassword reports whether a new password fits in PasswordMaxBytes, whatever its characters.
+func ValidPassword(password string) bool {
+	return len(password) <= PasswordMaxBytes
+}
+
+// Hasher hashes the passwords and compares them with their hash.
+type Hasher interface {
+	// Hash returns the encoded hash of the password, carrying its algorithm and parameters
+	Hash(password string) (string, error)
+	// Compare returns nil if the password matches the hash, ErrPasswordMismatch otherwise
+	Compare(hash, password string) error
+}
+
+// PasswordHasher hashes the new passwords. It is set from the PASSWORD_HASHER config at startup,
+// the existing hashes are still verified with the algorithm that produced them, see ComparePassword.
+var PasswordHasher Hasher = BcryptHasher{}
+
+// BcryptCost is the cost used to hash passwords with bcrypt. It is set from the BCRYPT_COST config at startup.
+var BcryptCost = bcrypt.DefaultCost
+
+// BcryptHasher hashes with bcrypt, using BcryptCost. A password longer than PasswordMaxBytes is rejected
+// with bcrypt.ErrPasswordTooLong, the DTOs check ValidPassword before.
+type BcryptHasher struct{}
+
+func (BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (BcryptHasher) Compare(hash, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+// The default parameters of Argon2idHasher, the OWASP recommendation
+const (
+	DefaultArgon2Memory      = 19 * 1024
+	DefaultArgon2Iterations  = 2
+	DefaultArgon2Parallelism = 1
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+	argon2idPrefix   = "$argon2id$"
+)
+
+// Argon2idHasher hashes with Argon2id, memory-hard and without bcrypt's length limit. The hashes
+// are encoded in the PHC string format, $argon2id$v=19$m=19456,t=2,p=1$salt$key, and compared
+// with their own parameters, so that changing them doesn't break the existing hashes.
+type Argon2idHasher struct {
+	// Memory is in KiB, DefaultArgon2Memory if 0
+	Memory uint32
+	// Iterations is DefaultArgon2Iterations if 0
+	Iterations uint32
+	// Parallelism is DefaultArgon2Parallelism if 0
+	Parallelism uint8
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	memory, iterations, parallelism := h.Memory, h.Iterations, h.Parallelism
+	if memory == 0 {
+		memory = DefaultArgon2Memory
+	}
+	if iterations == 0 {
+		iterations = DefaultArgon2Iterations
+	}
+	if parallelism == 0 {
+		parallelism = DefaultArgon2Parallelism
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, argon2KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, memory, iterations, parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (Argon2idHasher) Compare(hash, password string) error {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return ErrPasswordMismatch
+	}
+
+	return nil
+}
+
+// parseArgon2id decodes the parameters, the salt and the key of an Argon2id hash in the PHC string format
+func parseArgon2id(hash string) (params Argon2idHasher, salt, key []byte, err error) {
+	var version int
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || "$"+parts[1]+"$" != argon2idPrefix {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	return params, salt, key, nil
+}
+
+// hasherOf returns the hasher of the algorithm that produced the hash, nil if none did or the hash is malformed.
+// The Argon2idHasher reads its parameters from the hash, the zero value compares any Argon2id hash.
+func hasherOf(hash string) Hasher {
+	if _, _, _, err := parseArgon2id(hash); err == nil {
+		return Argon2idHasher{}
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err == nil {
+		return BcryptHasher{}
+	}
+
+	return nil
+}
+
+// HashPassword hashes the plaintext password with the PasswordHasher.
+func HashPassword(password string) (string, error) {
+	return PasswordHasher.Hash(password)
+}
+
+// ComparePassword compares the password with a hash of any known algorithm, e.g. a bcrypt hash stored before
+// the PasswordHasher became Argon2id. It returns nil if they match, ErrPasswordMismatch otherwise.
+func ComparePassword(hash, password string) error {
+	hasher := hasherOf(hash)
+	if hasher == nil {
+		return ErrUnknownPasswordHash
+	}
+
+	return hasher.Compare(hash, password)
+}
+
+// IsPasswordHash reports whether the password is already a hash of a known algorithm, which mustn't be hashed again.
+func IsPasswordHash(password string) bool {
+	return hasherOf(password) != nil
+}
+
+// NeedsRehash reports whether the hash was produced by another algorithm than the PasswordHasher,
+// in which case it should be replaced by a new hash the next time the plaintext password is known.
+// A change of the BCRYPT_COST or of the ARGON2_* parameters alone doesn't require one.
+func NeedsRehash(hash string) bool {
+	return reflect.TypeOf(hasherOf(hash)) != reflect.TypeOf(PasswordHasher)
+}
+
+// hashPassword returns the value to store for the password: its hash, or the password itself if it is already one.
+func hashPassword(password string) (string, error) {
+	if IsPasswordHash(password) {
+		return password, nil
+	}
+
+	return HashPassword(password)
+}
+
+// dummyPasswordHash is a hash of no user's password, computed once with the PasswordHasher
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := PasswordHasher.Hash("dummy password")
+	return hash
+})
+
+// CheckDummyPassword runs a password comparison that always fails, so that a login with an
+// unknown email takes as long as one with a wrong password and doesn't disclose which emails exist.
+func CheckDummyPassword(password string) {
+	PasswordHasher.Compare(dummyPasswordHash(), password)
+}
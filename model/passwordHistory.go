@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// PasswordHistorySize is the number of previous passwords of a user that can't be reused, on top
+// of the current one. It is set from the PASSWORD_HISTORY config at startup, 0 disables the history.
+var PasswordHistorySize = 0
+
+// PasswordHistory is a previous password of a user, kept to prevent its reuse.
+type PasswordHistory struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	User      User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserId    int  `gorm:"index"`
+	// Hash is the hash the password had while it was in use
+	Hash string
+}
@@ -0,0 +1,92 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2id keeps the tests fast, the parameters are read back from the hash anyway
+var testArgon2id = Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}
+
+func usePasswordHasher(t *testing.T, hasher Hasher) {
+	previous := PasswordHasher
+	PasswordHasher = hasher
+	t.Cleanup(func() { PasswordHasher = previous })
+}
+
+func TestHasher(t *testing.T) {
+	tests := []struct {
+		name       string
+		hasher     Hasher
+		wantPrefix string
+	}{
+		{"bcrypt", BcryptHasher{}, "$2a$"},
+		{"argon2id", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := tt.hasher.Hash("sup3rs3cret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(hash, tt.wantPrefix) {
+				t.Errorf("Hash() = %q, want the %q prefix", hash, tt.wantPrefix)
+			}
+			if other, _ := tt.hasher.Hash("sup3rs3cret"); other == hash {
+				t.Error("Hash() returned the same hash twice, the salt isn't random")
+			}
+
+			if err := tt.hasher.Compare(hash, "sup3rs3cret"); err != nil {
+				t.Errorf("Compare() with the password error = %v", err)
+			}
+			if err := tt.hasher.Compare(hash, "wrong password"); !errors.Is(err, ErrPasswordMismatch) {
+				t.Errorf("Compare() with a wrong password error = %v, want ErrPasswordMismatch", err)
+			}
+			if err := ComparePassword(hash, "sup3rs3cret"); err != nil {
+				t.Errorf("ComparePassword() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestComparePasswordLegacyHash(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("sup3rs3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usePasswordHasher(t, testArgon2id)
+
+	user := &User{Password: string(legacy)}
+	if err := user.CheckPassword("sup3rs3cret"); err != nil {
+		t.Errorf("CheckPassword() of a bcrypt hash under argon2id error = %v", err)
+	}
+	if err := user.CheckPassword("wrong password"); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("CheckPassword() with a wrong password error = %v, want ErrPasswordMismatch", err)
+	}
+	if !user.NeedsRehash() {
+		t.Error("NeedsRehash() = false for a bcrypt hash under argon2id")
+	}
+
+	if user.Password, err = HashPassword("sup3rs3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if user.NeedsRehash() {
+		t.Error("NeedsRehash() = true for an argon2id hash under argon2id")
+	}
+
+	// Going back to bcrypt, the argon2id hashes still work with their own parameters
+	usePasswordHasher(t, BcryptHasher{})
+	if err := user.CheckPassword("sup3rs3cret"); err != nil {
+		t.Errorf("CheckPassword() of an argon2id hash under bcrypt error = %v", err)
+	}
+	if !user.NeedsRehash() {
+		t.Error("NeedsRehash() = false for an argon2id hash under bcrypt")
+	}
+
+	if err := ComparePassword("sup3rs3cret", "sup3rs3cret"); !errors.Is(err, ErrUnknownPasswordHash) {
+		t.Errorf("ComparePassword() of a plaintext password error = %v, want ErrUnknownPasswordHash", err)
+	}
+}
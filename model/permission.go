@@ -0,0 +1,16 @@
+package model
+
+// Permission is a fine-grained right, e.g. "invoices:write", granted to roles and to users on
+// top of their role. The admins hold every permission.
+// swagger:model
+type Permission struct {
+	ID   uint   `json:"id" gorm:"primarykey"`
+	Name string `json:"name" gorm:"size:64;uniqueIndex" example:"invoices:write"`
+}
+
+// RolePermission grants the permission to every user of the role.
+type RolePermission struct {
+	Role         string     `gorm:"size:32;primaryKey"`
+	PermissionID uint       `gorm:"primaryKey"`
+	Permission   Permission `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"errors"
+	"net/url"
+	"time"
+	// The runtime images may have no zoneinfo, the timezones of the profiles are checked against the embedded one
+	_ "time/tzdata"
+
+	"golang.org/x/text/language"
+)
+
+// The maximum lengths of the profile fields, in characters
+const (
+	DisplayNameMaxLength = 64
+	AvatarURLMaxLength   = 512
+	BioMaxLength         = 500
+)
+
+var (
+	errAvatarURLInvalid = errors.New("avatarUrl must be an http or https URL")
+	errLocaleInvalid    = errors.New("locale must be a BCP 47 language tag, e.g. en-US")
+	errTimezoneInvalid  = errors.New("timezone must be an IANA time zone, e.g. Europe/Paris")
+)
+
+// ValidAvatarURL reports whether the avatar URL is an absolute http or https URL.
+func ValidAvatarURL(avatarURL string) bool {
+	u, err := url.Parse(avatarURL)
+
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// ValidLocale reports whether the locale is a well formed BCP 47 language tag, e.g. "fr" or "en-US".
+func ValidLocale(locale string) bool {
+	_, err := language.Parse(locale)
+
+	return err == nil
+}
+
+// NormalizeLocale returns the canonical form of a valid locale, e.g. "en-US" for "en_us".
+func NormalizeLocale(locale string) string {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return locale
+	}
+
+	return tag.String()
+}
+
+// ValidTimezone reports whether the timezone is a name of the IANA time zone database, e.g. "Europe/Paris".
+func ValidTimezone(timezone string) bool {
+	// LoadLocation maps them to the UTC and the local time, they aren't zone names
+	if timezone == "" || timezone == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(timezone)
+
+	return err == nil
+}
@@ -0,0 +1,9 @@
+package model
+
+// The purposes of the tokens of the emailed links, see tokenutil.Payload
+const (
+	// PurposeEmailChange is the purpose of the tokens confirming a user's pending email
+	PurposeEmailChange = "email_change"
+	// PurposePasswordReset is the purpose of the tokens resetting a forgotten password
+	PurposePasswordReset = "password_reset"
+)
@@ -11,7 +11,23 @@ type RefreshToken struct {
 	User   User   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
 	UserId int    `json:"userId" gorm:"<-:create"`
 	Ip     string `json:"ip" gorm:"<-:create"`
-	Hash   string `json:"hash" gorm:"<-:create unique"`
+	// Hash is the SHA-256 digest of the token, the token itself is never stored
+	Hash string `json:"-" gorm:"<-:create;size:64;uniqueIndex"`
+	// ExpiresAt is the instant after which the token can't be used to refresh the session anymore
+	ExpiresAt time.Time `json:"expiresAt" gorm:"index"`
+	// Token is the plaintext token. It is only set on creation, to be handed to the client
+	Token string `json:"-" gorm:"-"`
+}
+
+// ToSessionResponse maps the RefreshToken to its SessionResponseDTO, current if it is the session of the request.
+func (rt *RefreshToken) ToSessionResponse(current bool) *SessionResponseDTO {
+	return &SessionResponseDTO{
+		ID:        rt.ID,
+		Ip:        rt.Ip,
+		CreatedAt: rt.CreatedAt,
+		ExpiresAt: rt.ExpiresAt,
+		Current:   current,
+	}
 }
 
 func (rt *RefreshToken) BeforeCreate(tx *gorm.DB) (err error) {
@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// RevokedToken is a denylist entry for a jwt that must be rejected before its expiry.
+// Entries are only needed until the token's own expiry and can be purged past it.
+type RevokedToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Jti       string    `gorm:"size:64;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"index"`
+}
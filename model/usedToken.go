@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// UsedToken records the ID of an emailed link token once it has been used, so that it is rejected
+// afterwards. The unique Jti lets only one of two concurrent requests use the token. Like the
+// RevokedToken entries, they are only needed until the token's own expiry and can be purged past it.
+type UsedToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Jti       string `gorm:"size:64;uniqueIndex"`
+	// Purpose is the purpose of the token, e.g. PurposePasswordReset
+	Purpose   string    `gorm:"size:32"`
+	ExpiresAt time.Time `gorm:"index"`
+}
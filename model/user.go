@@ -1,22 +1,127 @@
 package model
 
 import (
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Roles are the roles a user can have
+var Roles = []string{RoleUser, RoleAdmin}
+
+// DefaultRole is the role of the new users created without one, e.g. by the public signup. It is
+// set from the DEFAULT_ROLE config at startup, which can't be an elevated role.
+var DefaultRole = RoleUser
+
+// ValidRole reports whether the role is one of Roles.
+func ValidRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
+
+// ElevatedRole reports whether the role grants administrative privileges, which no one can give
+// to themselves through the public signup.
+func ElevatedRole(role string) bool {
+	return role == RoleAdmin
+}
+
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	// StatusPending users can use their current tokens, but can't refresh them
+	StatusPending = "pending"
+)
+
+// usernamePattern allows 3 to 32 lowercase letters, digits, dots, dashes and underscores, starting with a letter or a digit
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{2,31}$`)
+
+// NormalizeUsername trims and lowercases the username, so that "Alice " and "alice" are the same one.
+func NormalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// NormalizeEmail trims and lowercases the email. It is the canonical form the users are created and looked
+// up with, so that matching an email doesn't depend on the collation of the database.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// ValidUsername reports whether the normalized username is acceptable.
+func ValidUsername(username string) bool {
+	return usernamePattern.MatchString(username)
+}
+
 // swagger:model
 type User struct {
 	gorm.Model
-	Email    string `json:"email"`
-	Password string `json:"-"`
+	Email string `json:"email" gorm:"size:191;uniqueIndex"`
+	// Username is optional and unique, it is stored normalized. nil, i.e. NULL, doesn't collide with other users without one
+	Username *string `json:"username,omitempty" gorm:"size:32;uniqueIndex"`
+	Password string  `json:"-"`
+	Role     string  `json:"role" gorm:"size:32;default:user"`
+	Status   string  `json:"status" gorm:"size:16;default:active"`
+	// Provider and ProviderID link the user to an external OAuth account (google, github...)
+	Provider   string `json:"provider,omitempty" gorm:"size:32;index:idx_users_provider"`
+	ProviderID string `json:"-" gorm:"size:191;index:idx_users_provider"`
+	// PendingEmail is the new email requested by the user, it replaces Email once verified. Encrypted at rest, it is only looked up by ID
+	PendingEmail EncryptedString `json:"-" gorm:"size:512"`
+	// TokensValidAfter invalidates every token issued before it, logging the user out everywhere
+	TokensValidAfter *time.Time `json:"-"`
+	// MustChangePassword is set when an admin resets the password, the user has to pick its own
+	MustChangePassword bool `json:"mustChangePassword" gorm:"default:false"`
+	// LastLoginAt and LastLoginIP are set on every successful login, the IP is encrypted at rest
+	LastLoginAt *time.Time      `json:"lastLoginAt"`
+	LastLoginIP EncryptedString `json:"lastLoginIp" gorm:"size:191"`
+	// DisplayName, AvatarURL, Locale, Timezone and Bio are the optional profile of the user, set through UserUpdateDTO
+	DisplayName string `json:"displayName,omitempty" gorm:"size:64"`
+	AvatarURL   string `json:"avatarUrl,omitempty" gorm:"size:512"`
+	Locale      string `json:"locale,omitempty" gorm:"size:35"`
+	Timezone    string `json:"timezone,omitempty" gorm:"size:64"`
+	Bio         string `json:"bio,omitempty" gorm:"size:500"`
+	// OrgID is the organization (tenant) of the user, nil for a user without organization
+	OrgID        *uint         `json:"orgId,omitempty" gorm:"index"`
+	Organization *Organization `json:"-" gorm:"foreignKey:OrgID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+	// RefreshTokens are the sessions of the user, only loaded on demand
+	RefreshTokens []RefreshToken `json:"-" gorm:"foreignKey:UserId;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	// GrantedPermissions are granted to the user itself, on top of the permissions of its role. Only loaded on demand
+	GrantedPermissions []Permission `json:"-" gorm:"many2many:user_permissions;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	// PermissionsVersion is incremented whenever the effective permissions of the user change, the
+	// permissions embedded in the tokens issued with a previous version are stale
+	PermissionsVersion uint `json:"-" gorm:"not null;default:0"`
+	// Permissions are the effective permissions of the user, set by PermissionService.Load to be embedded in its tokens
+	Permissions []string `json:"-" gorm:"-"`
+}
+
+// IsAdmin reports whether the user has the admin role.
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// IsActive reports whether the user has the active status.
+func (u *User) IsActive() bool {
+	return u.Status == StatusActive
+}
+
+// IsSuspended reports whether the user has been suspended, it must not be authenticated at all.
+func (u *User) IsSuspended() bool {
+	return u.Status == StatusSuspended
+}
+
+// AcceptsTokenIssuedAt reports whether a token issued at issuedAt is still valid, i.e. not issued before TokensValidAfter.
+func (u *User) AcceptsTokenIssuedAt(issuedAt time.Time) bool {
+	return u.TokensValidAfter == nil || !issuedAt.Before(*u.TokensValidAfter)
 }
 
 /*
 BeforeCreate sets the CreatedAt and UpdatedAt fields to the current time,
-hashes the user's password, and stores the hashed password in the Password field.
+hashes the user's password unless it already is a hash, and stores the hashed password in the Password field.
 
 Args:
 
@@ -31,20 +136,19 @@ func (u *User) BeforeCreate(tx *gorm.DB) (err error) {
 	u.CreatedAt = time.Now()
 	u.UpdatedAt = time.Now()
 
-	// hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
-	if err != nil {
-		return
-	}
-
-	u.Password = string(hashedPassword)
+	// hash password, unless BeforeSave already did
+	u.Password, err = hashPassword(u.Password)
 
 	return
 }
 
 /*
 BeforeSave is a function that updates the User's update time and hashes
-the password if it has been changed before saving to the database.
+the password before saving to the database, so that no code path can store
+a plaintext password. The password is hashed wherever the updated values
+are: in the model, in the map given to Updates or in another *User. A password
+which is already a hash is left as is, so that saving a loaded user
+doesn't hash it again.
 
 Args:
 
@@ -58,22 +162,34 @@ Returns:
 func (u *User) BeforeSave(tx *gorm.DB) (err error) {
 	u.UpdatedAt = time.Now()
 
-	if tx.Statement.Changed("Password") {
-		hashedPassword, error := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
-		if error != nil {
-			err = error
-			return
+	switch dest := tx.Statement.Dest.(type) {
+	case map[string]interface{}:
+		for _, key := range []string{"password", "Password"} {
+			if password, ok := dest[key].(string); ok {
+				if dest[key], err = hashPassword(password); err != nil {
+					return
+				}
+			}
+		}
+	case *User:
+		if dest != u && dest.Password != "" {
+			if dest.Password, err = hashPassword(dest.Password); err != nil {
+				return
+			}
 		}
+	}
 
-		u.Password = string(hashedPassword)
+	// Empty when the model is only used to name the table, e.g. Model(&User{}).Where(...)
+	if u.Password != "" {
+		u.Password, err = hashPassword(u.Password)
 	}
 
 	return
 }
 
 /*
-CheckPassword takes a password string as input and compares it to the hashed password stored in the User struct.
-It returns an error if the comparison fails.
+CheckPassword takes a password string as input and compares it to the hashed password stored in the User struct,
+whichever of bcrypt or Argon2id produced it. It returns an error if the comparison fails.
 
 Args:
 
@@ -86,5 +202,70 @@ Returns:
 	(error): An error if the password comparison fails.
 */
 func (u *User) CheckPassword(password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	return ComparePassword(u.Password, password)
+}
+
+// NeedsRehash reports whether the user's password was hashed with another algorithm than the PasswordHasher.
+func (u *User) NeedsRehash() bool {
+	return NeedsRehash(u.Password)
+}
+
+/*
+ToResponse maps the User to its public UserResponseDTO representation.
+
+Returns:
+
+	(*UserResponseDTO): the sanitized user, safe to be sent to clients.
+*/
+func (u *User) ToResponse() *UserResponseDTO {
+	response := &UserResponseDTO{
+		ID:        u.ID,
+		Email:     u.Email,
+		Username:  u.Username,
+		Role:      u.Role,
+		Status:    u.Status,
+		OrgID:     u.OrgID,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+
+		MustChangePassword: u.MustChangePassword,
+		LastLoginAt:        u.LastLoginAt,
+		LastLoginIP:        string(u.LastLoginIP),
+
+		DisplayName: u.DisplayName,
+		AvatarURL:   u.AvatarURL,
+		Locale:      u.Locale,
+		Timezone:    u.Timezone,
+		Bio:         u.Bio,
+	}
+
+	// The sessions are only set when they have been preloaded
+	if u.RefreshTokens != nil {
+		response.Sessions = make([]*SessionResponseDTO, 0, len(u.RefreshTokens))
+		for _, rt := range u.RefreshTokens {
+			response.Sessions = append(response.Sessions, rt.ToSessionResponse(false))
+		}
+	}
+
+	return response
+}
+
+/*
+ToResponses maps a slice of users to their public UserResponseDTO representation.
+
+Args:
+
+	users ([]*User): the users to map.
+
+Returns:
+
+	([]*UserResponseDTO): the sanitized users, never nil.
+*/
+func ToResponses(users []*User) []*UserResponseDTO {
+	responses := make([]*UserResponseDTO, 0, len(users))
+	for _, u := range users {
+		responses = append(responses, u.ToResponse())
+	}
+
+	return responses
 }
@@ -1,10 +1,302 @@
 package model
 
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
 type UserCreateDTO struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email" example:"alice@example.com" binding:"required,email"`
+	Password string `json:"password" example:"sup3rs3cret" binding:"required,password"`
+	// Username is optional, it is trimmed and lowercased before being stored
+	Username *string `json:"username,omitempty" example:"alice" binding:"omitempty,username"`
+	// Role is only set by the admins creating the user, the public signup ignores it. DefaultRole when nil
+	Role *string `json:"role,omitempty" example:"user" binding:"omitempty,oneof=user admin"`
+	// OrgID is set by the handlers, to the organization of the admin creating the user
+	OrgID *uint `json:"-"`
+}
+
+/*
+Validate checks that the DTO holds a well formed email, a non empty password of at most PasswordMaxBytes
+and, if any, a valid username.
+
+Returns:
+
+	(error): the first validation error found, nil if the DTO is valid.
+*/
+func (data *UserCreateDTO) Validate() error {
+	if data.Email == "" {
+		return errors.New("email is required")
+	}
+	if _, err := mail.ParseAddress(data.Email); err != nil {
+		return errors.New("email is invalid")
+	}
+	if data.Password == "" {
+		return errors.New("password is required")
+	}
+	if !ValidPassword(data.Password) {
+		return ErrPasswordTooLong
+	}
+	if data.Username != nil && *data.Username != "" && !ValidUsername(NormalizeUsername(*data.Username)) {
+		return errUsernameInvalid
+	}
+	if data.Role != nil && !ValidRole(*data.Role) {
+		return errRoleInvalid
+	}
+
+	return nil
+}
+
+// AssignedRole returns the role of the new user: its Role, or DefaultRole without one.
+func (data *UserCreateDTO) AssignedRole() string {
+	if data.Role == nil {
+		return DefaultRole
+	}
+
+	return *data.Role
+}
+
+// errUsernameInvalid describes the usernamePattern
+var errUsernameInvalid = errors.New("username must be 3 to 32 letters, digits, dots, dashes or underscores")
+
+// errRoleInvalid lists the Roles
+var errRoleInvalid = errors.New("role must be user or admin")
+
+/*
+NormalizedUsername returns the username to store, nil when none or an empty one is given.
+
+Returns:
+
+	(*string): the trimmed and lowercased username.
+*/
+func (data *UserCreateDTO) NormalizedUsername() *string {
+	return normalizedUsername(data.Username)
 }
 
+func normalizedUsername(username *string) *string {
+	if username == nil {
+		return nil
+	}
+	normalized := NormalizeUsername(*username)
+	if normalized == "" {
+		return nil
+	}
+
+	return &normalized
+}
+
+// UserUpdateDTO holds the fields of a partial update. A nil field is left unchanged,
+// while a non nil one, even pointing to a zero value, is written.
+// The email can't be updated this way, it has to be verified through the email change flow.
 type UserUpdateDTO struct {
-	Email string `json:"email"`
+	// Role can only be changed by an admin, it is ignored otherwise
+	Role *string `json:"role,omitempty" example:"user" binding:"omitempty,oneof=user admin"`
+	// Username is trimmed and lowercased, an empty one removes the username of the user
+	Username *string `json:"username,omitempty" example:"alice" binding:"omitempty,username"`
+	// The profile fields are trimmed, an empty one removes it from the profile
+	DisplayName *string `json:"displayName,omitempty" example:"Alice Smith" binding:"omitempty,max=64"`
+	AvatarURL   *string `json:"avatarUrl,omitempty" example:"https://example.com/alice.png" binding:"omitempty,max=512,avatar_url"`
+	// Locale is a BCP 47 language tag, stored in its canonical form
+	Locale *string `json:"locale,omitempty" example:"en-US" binding:"omitempty,locale"`
+	// Timezone is a name of the IANA time zone database
+	Timezone *string `json:"timezone,omitempty" example:"Europe/Paris" binding:"omitempty,timezone"`
+	Bio      *string `json:"bio,omitempty" example:"Backend developer" binding:"omitempty,max=500"`
+}
+
+/*
+Validate checks that the provided fields hold acceptable values.
+
+Returns:
+
+	(error): the first validation error found, nil if the DTO is valid.
+*/
+func (data *UserUpdateDTO) Validate() error {
+	if data.Role != nil && !ValidRole(*data.Role) {
+		return errRoleInvalid
+	}
+	if username := normalizedUsername(data.Username); username != nil && !ValidUsername(*username) {
+		return errUsernameInvalid
+	}
+	if data.DisplayName != nil && utf8.RuneCountInString(*data.DisplayName) > DisplayNameMaxLength {
+		return fmt.Errorf("displayName must be at most %d characters", DisplayNameMaxLength)
+	}
+	if data.AvatarURL != nil && *data.AvatarURL != "" && (len(*data.AvatarURL) > AvatarURLMaxLength || !ValidAvatarURL(*data.AvatarURL)) {
+		return errAvatarURLInvalid
+	}
+	if data.Locale != nil && *data.Locale != "" && !ValidLocale(*data.Locale) {
+		return errLocaleInvalid
+	}
+	if data.Timezone != nil && *data.Timezone != "" && !ValidTimezone(*data.Timezone) {
+		return errTimezoneInvalid
+	}
+	if data.Bio != nil && utf8.RuneCountInString(*data.Bio) > BioMaxLength {
+		return fmt.Errorf("bio must be at most %d characters", BioMaxLength)
+	}
+
+	return nil
+}
+
+/*
+Updates returns the columns to update, built only from the non nil fields.
+
+Returns:
+
+	(map[string]interface{}): the column names mapped to their new values.
+*/
+func (data *UserUpdateDTO) Updates() map[string]interface{} {
+	updates := map[string]interface{}{}
+	if data.Role != nil {
+		updates["role"] = *data.Role
+		// The permissions of the previous role embedded in the tokens are stale
+		updates["permissions_version"] = gorm.Expr("permissions_version + 1")
+	}
+	if data.Username != nil {
+		// A nil *string is written as NULL
+		updates["username"] = normalizedUsername(data.Username)
+	}
+	if data.DisplayName != nil {
+		updates["display_name"] = *data.DisplayName
+	}
+	if data.AvatarURL != nil {
+		updates["avatar_url"] = *data.AvatarURL
+	}
+	if data.Locale != nil {
+		updates["locale"] = NormalizeLocale(*data.Locale)
+	}
+	if data.Timezone != nil {
+		updates["timezone"] = *data.Timezone
+	}
+	if data.Bio != nil {
+		updates["bio"] = *data.Bio
+	}
+
+	return updates
+}
+
+// UserStatusDTO changes the status of a user
+type UserStatusDTO struct {
+	Status string `json:"status" example:"suspended" binding:"required,oneof=active suspended pending"`
+}
+
+/*
+Validate checks that the status is a known one.
+
+Returns:
+
+	(error): the validation error, nil if the DTO is valid.
+*/
+func (data *UserStatusDTO) Validate() error {
+	switch data.Status {
+	case StatusActive, StatusSuspended, StatusPending:
+		return nil
+	default:
+		return errors.New("status must be active, suspended or pending")
+	}
+}
+
+// AdminPasswordResetDTO sets the password of a user out-of-band
+type AdminPasswordResetDTO struct {
+	// Password is generated when omitted
+	Password string `json:"password,omitempty" example:"sup3rs3cret" binding:"omitempty,password"`
+	// MustChangePassword requires the user to change the password after logging in with it
+	MustChangePassword bool `json:"mustChangePassword" example:"true"`
+}
+
+type AdminPasswordResetResponseDTO struct {
+	// Password is only returned when generated, it can't be retrieved afterwards
+	Password        string `json:"password,omitempty" example:"b3JkZXItcGxhY2Vob2xkZXItdG9rZW4"`
+	RevokedSessions int64  `json:"revokedSessions" example:"2"`
+}
+
+// UserResponseDTO is the public representation of a User. Handlers must
+// return this instead of the User model so that no sensitive column
+// (password hash, ...) is ever serialized.
+type UserResponseDTO struct {
+	ID        uint      `json:"id" example:"1"`
+	Email     string    `json:"email" example:"alice@example.com"`
+	Username  *string   `json:"username,omitempty" example:"alice"`
+	Role      string    `json:"role" example:"user"`
+	Status    string    `json:"status" example:"active"`
+	OrgID     *uint     `json:"orgId,omitempty" example:"1"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	MustChangePassword bool       `json:"mustChangePassword" example:"false"`
+	LastLoginAt        *time.Time `json:"lastLoginAt,omitempty"`
+	LastLoginIP        string     `json:"lastLoginIp,omitempty" example:"203.0.113.7"`
+
+	DisplayName string `json:"displayName,omitempty" example:"Alice Smith"`
+	AvatarURL   string `json:"avatarUrl,omitempty" example:"https://example.com/alice.png"`
+	Locale      string `json:"locale,omitempty" example:"en-US"`
+	Timezone    string `json:"timezone,omitempty" example:"Europe/Paris"`
+	Bio         string `json:"bio,omitempty" example:"Backend developer"`
+	// Sessions are only returned to admins, on demand
+	Sessions []*SessionResponseDTO `json:"sessions,omitempty"`
+}
+
+// UsernameAvailabilityDTO tells a signup form whether a username can be picked
+type UsernameAvailabilityDTO struct {
+	Username  string `json:"username" example:"alice"`
+	Available bool   `json:"available" example:"true"`
+}
+
+// EmailAvailabilityDTO tells a signup form whether an email can be registered
+type EmailAvailabilityDTO struct {
+	Email     string `json:"email" example:"alice@example.com"`
+	Available bool   `json:"available" example:"true"`
+}
+
+// SessionResponseDTO is the metadata of an active session, i.e. of a refresh token. The token itself is never returned.
+type SessionResponseDTO struct {
+	ID        uint      `json:"id" example:"1"`
+	Ip        string    `json:"ip" example:"203.0.113.7"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Current is set, in GET /auth/sessions, on the session of the refresh token sent with the request
+	Current bool `json:"current,omitempty"`
+}
+
+// UserImportResultDTO is the outcome of a single record of a bulk user import.
+type UserImportResultDTO struct {
+	Index int              `json:"index" example:"0"`
+	User  *UserResponseDTO `json:"user,omitempty"`
+	Error string           `json:"error,omitempty" example:"email already taken"`
+}
+
+// PageOptions selects a page of a list.
+type PageOptions struct {
+	Limit  int
+	Offset int
+}
+
+// PaginationQuery is the page and pageSize query parameters of the paginated lists, see PageOptions.
+type PaginationQuery struct {
+	// Page is the page number, from 1, the first one by default
+	Page int `form:"page,default=1" json:"page" binding:"min=1"`
+	// PageSize is the number of items of a page, up to 100, 20 by default
+	PageSize int `form:"pageSize,default=20" json:"pageSize" binding:"min=1,max=100"`
+}
+
+// Options returns the PageOptions of the requested page.
+func (q *PaginationQuery) Options() PageOptions {
+	return PageOptions{Limit: q.PageSize, Offset: (q.Page - 1) * q.PageSize}
+}
+
+// CursorOptions selects the page of a list following the item with the AfterID, 0 for the first page.
+// Unlike an offset, the cursor is stable while items are inserted or deleted between two pages.
+type CursorOptions struct {
+	AfterID uint
+	Limit   int
+}
+
+// UserFilter restricts the users listed or counted. Empty fields don't filter.
+type UserFilter struct {
+	Role string `form:"role" example:"admin"`
+	// Org is set by the handlers, from the organization of the caller
+	Org *OrgScope `form:"-"`
 }
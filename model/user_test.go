@@ -0,0 +1,92 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUsername(t *testing.T) {
+	tests := []struct {
+		raw       string
+		want      string
+		wantValid bool
+	}{
+		{"alice", "alice", true},
+		{"  Alice.B ", "alice.b", true},
+		{"bob_42-x", "bob_42-x", true},
+		{"ab", "ab", false},
+		{"_alice", "_alice", false},
+		{"alice smith", "alice smith", false},
+		{"al!ce", "al!ce", false},
+		{"a23456789012345678901234567890123", "a23456789012345678901234567890123", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got := NormalizeUsername(tt.raw)
+			if got != tt.want {
+				t.Errorf("NormalizeUsername(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+			if valid := ValidUsername(got); valid != tt.wantValid {
+				t.Errorf("ValidUsername(%q) = %v, want %v", got, valid, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestIsPasswordHash(t *testing.T) {
+	hash, err := HashPassword("sup3rs3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2idHash, err := testArgon2id.Hash("sup3rs3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for password, want := range map[string]bool{
+		hash:                                true,
+		argon2idHash:                        true,
+		"sup3rs3cret":                       false,
+		"":                                  false,
+		hash[:30]:                           false,
+		argon2idHash[:len(argon2idHash)-44]: false,
+		"$argon2id$v=19$m=64,t=1,p=1$$":     false,
+	} {
+		if got := IsPasswordHash(password); got != want {
+			t.Errorf("IsPasswordHash(%q) = %v, want %v", password, got, want)
+		}
+	}
+}
+
+func TestUserUpdateDTOProfile(t *testing.T) {
+	ptr := func(s string) *string { return &s }
+
+	tests := []struct {
+		name    string
+		data    UserUpdateDTO
+		wantErr bool
+	}{
+		{"full profile", UserUpdateDTO{DisplayName: ptr("Alice Smith"), AvatarURL: ptr("https://example.com/alice.png"), Locale: ptr("en-US"), Timezone: ptr("Europe/Paris"), Bio: ptr("Backend developer")}, false},
+		{"cleared profile", UserUpdateDTO{DisplayName: ptr(""), AvatarURL: ptr(""), Locale: ptr(""), Timezone: ptr(""), Bio: ptr("")}, false},
+		{"language only locale", UserUpdateDTO{Locale: ptr("fr")}, false},
+		{"UTC", UserUpdateDTO{Timezone: ptr("UTC")}, false},
+		{"invalid locale", UserUpdateDTO{Locale: ptr("not a locale")}, true},
+		{"unknown timezone", UserUpdateDTO{Timezone: ptr("Mars/Olympus_Mons")}, true},
+		{"local timezone", UserUpdateDTO{Timezone: ptr("Local")}, true},
+		{"relative avatar", UserUpdateDTO{AvatarURL: ptr("/alice.png")}, true},
+		{"javascript avatar", UserUpdateDTO{AvatarURL: ptr("javascript:alert(1)")}, true},
+		{"display name too long", UserUpdateDTO{DisplayName: ptr(strings.Repeat("é", DisplayNameMaxLength+1))}, true},
+		{"bio too long", UserUpdateDTO{Bio: ptr(strings.Repeat("a", BioMaxLength+1))}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.data.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if got := (&UserUpdateDTO{Locale: ptr("en_us")}).Updates()["locale"]; got != "en-US" {
+		t.Errorf("locale update = %v, want the canonical en-US", got)
+	}
+}
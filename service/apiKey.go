@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"gorm.io/gorm"
+)
+
+// apiKeyPrefix marks the API keys, so that a leaked one is easy to recognize
+const apiKeyPrefix = "ak_"
+
+var (
+	// ErrInvalidApiKey is returned when an API key is unknown or expired
+	ErrInvalidApiKey = errors.New("invalid or expired api key")
+	// ErrApiKeyNotFound is returned when the user has no API key with the given ID
+	ErrApiKeyNotFound = errors.New("api key not found")
+)
+
+type ApiKeyService struct {
+	db *gorm.DB
+}
+
+func NewApiKeyService(db *gorm.DB) *ApiKeyService {
+	return &ApiKeyService{
+		db: db,
+	}
+}
+
+/*
+Create issues a new API key for the user.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userId (int): The ID of the owner of the key.
+  - data (*model.ApiKeyCreateDTO): The name, scopes and optional expiry of the key.
+
+Returns:
+  - (*model.ApiKey): The created key, with its plaintext in the Key field.
+  - (error): An error if one occurred during the generation or the save.
+*/
+func (s *ApiKeyService) Create(ctx context.Context, userId int, data *model.ApiKeyCreateDTO) (*model.ApiKey, error) {
+	raw, err := generateRandomToken()
+	if err != nil {
+		return nil, err
+	}
+	raw = apiKeyPrefix + raw
+
+	key := &model.ApiKey{
+		UserId:    userId,
+		Name:      data.Name,
+		Prefix:    raw[:len(apiKeyPrefix)+5],
+		Hash:      HashToken(raw),
+		Scopes:    strings.Join(data.Scopes, " "),
+		ExpiresAt: data.ExpiresAt,
+		Key:       raw,
+	}
+	if err := s.db.WithContext(ctx).Create(key).Error; err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+/*
+Authenticate looks up an unexpired API key by its plaintext value, along with its owner,
+and records its use.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - raw (string): The plaintext key sent by the client.
+
+Returns:
+  - (*model.ApiKey): The key, with its User preloaded.
+  - (error): ErrInvalidApiKey if there is no such key, or a query error.
+*/
+func (s *ApiKeyService) Authenticate(ctx context.Context, raw string) (*model.ApiKey, error) {
+	var key model.ApiKey
+	err := s.db.WithContext(ctx).Preload("User").
+		Where("hash = ? AND (expires_at IS NULL OR expires_at > ?)", HashToken(raw), time.Now()).
+		First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidApiKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The preload doesn't find soft deleted users, their keys must not authenticate
+	if key.User.ID == 0 {
+		return nil, ErrInvalidApiKey
+	}
+
+	now := time.Now()
+	if err := s.db.WithContext(ctx).Model(&key).UpdateColumn("last_used_at", now).Error; err != nil {
+		return nil, err
+	}
+	key.LastUsedAt = &now
+
+	return &key, nil
+}
+
+/*
+ListForUser retrieves the API keys of the user, expired ones included.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userId (int): The ID of the owner of the keys.
+
+Returns:
+  - ([]*model.ApiKey): The keys of the user, without their plaintext.
+  - (error): An error if one occurred during the query.
+*/
+func (s *ApiKeyService) ListForUser(ctx context.Context, userId int) ([]*model.ApiKey, error) {
+	keys := []*model.ApiKey{}
+	err := s.db.WithContext(ctx).Where("user_id = ?", userId).Order("id").Find(&keys).Error
+
+	return keys, err
+}
+
+/*
+Revoke deletes an API key of the user.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userId (int): The ID of the owner of the key, another user's key can't be revoked.
+  - id (uint): The ID of the key.
+
+Returns:
+  - (error): ErrApiKeyNotFound if the user has no such key, or a query error.
+*/
+func (s *ApiKeyService) Revoke(ctx context.Context, userId int, id uint) error {
+	result := s.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userId).Delete(&model.ApiKey{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrApiKeyNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"gorm.io/gorm"
+)
+
+// maxAuditDetail is the size of the detail column, longer details are truncated
+const maxAuditDetail = 255
+
+type AuditService struct {
+	db *gorm.DB
+}
+
+func NewAuditService(db *gorm.DB) *AuditService {
+	return &AuditService{
+		db: db,
+	}
+}
+
+/*
+Record appends an entry to the audit trail.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userID (int): The user the action is about, 0 when unknown.
+  - action (string): The action, one of the model.Audit* constants.
+  - detail (string): A free form detail, e.g. the login method. It is truncated to 255 bytes.
+  - ip (string): The IP address of the client.
+
+Returns:
+  - (error): An error if one occurred during database save.
+*/
+func (s *AuditService) Record(ctx context.Context, userID int, action, detail, ip string) error {
+	if len(detail) > maxAuditDetail {
+		detail = detail[:maxAuditDetail]
+	}
+
+	return s.db.WithContext(ctx).Create(&model.AuditLog{
+		UserId: userID,
+		Action: action,
+		Detail: detail,
+		Ip:     ip,
+	}).Error
+}
+
+/*
+List returns a page of the audit logs matching the filter, the most recent first, and their total count.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - filter (*model.AuditFilter): The filter to apply. With an Org, only the logs about the users of
+    the organization are listed, including the deleted ones. The logs about no known user are
+    only listed for the scope without organization.
+  - opts (model.PageOptions): The page to return.
+
+Returns:
+  - ([]*model.AuditLog): The page of audit logs.
+  - (int64): The number of audit logs matching the filter.
+  - (error): An error if one occurred during the query.
+*/
+func (s *AuditService) List(ctx context.Context, filter *model.AuditFilter, opts model.PageOptions) ([]*model.AuditLog, int64, error) {
+	query := s.db.WithContext(ctx).Model(&model.AuditLog{}).Scopes(auditFilterScope(s.db.WithContext(ctx), filter))
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	logs := []*model.AuditLog{}
+	err := query.Order("id DESC").Limit(opts.Limit).Offset(opts.Offset).Find(&logs).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return logs, total, nil
+}
+
+// auditFilterScope applies the non empty fields of the filter to the query, db being used to build the organization subquery.
+func auditFilterScope(db *gorm.DB, filter *model.AuditFilter) func(db *gorm.DB) *gorm.DB {
+	return func(query *gorm.DB) *gorm.DB {
+		if filter == nil {
+			return query
+		}
+		if filter.UserId != 0 {
+			query = query.Where("user_id = ?", filter.UserId)
+		}
+		if filter.Action != "" {
+			query = query.Where("action = ?", filter.Action)
+		}
+
+		if filter.Org != nil {
+			// Deleted users keep their trail
+			users := db.Unscoped().Model(&model.User{}).Select("id").Scopes(orgScope(filter.Org))
+			if filter.Org.OrgID == nil {
+				query = query.Where("user_id = 0 OR user_id IN (?)", users)
+			} else {
+				query = query.Where("user_id IN (?)", users)
+			}
+		}
+
+		return query
+	}
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+func TestAuditList(t *testing.T) {
+	db := testutil.NewDB(t)
+	org := model.Organization{Name: "acme"}
+	if err := db.Create(&org).Error; err != nil {
+		t.Fatal(err)
+	}
+	alice := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com"})
+	carol := testutil.SeedUser(t, db, testutil.UserFixture{Email: "carol@example.com", OrgID: &org.ID})
+	s := NewAuditService(db)
+
+	ctx := context.Background()
+	for _, entry := range []struct {
+		userID int
+		action string
+	}{
+		{int(alice.ID), model.AuditLogin},
+		{int(carol.ID), model.AuditLogin},
+		{0, model.AuditLoginFailed},
+		{int(carol.ID), model.AuditUserDeleted},
+	} {
+		if err := s.Record(ctx, entry.userID, entry.action, "", "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The deleted users keep their trail
+	if err := NewUserService(db).DeleteUser(ctx, int(carol.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		filter    *model.AuditFilter
+		wantTotal int64
+	}{
+		{"no filter", &model.AuditFilter{}, 4},
+		{"by user", &model.AuditFilter{UserId: int(carol.ID)}, 2},
+		{"by action", &model.AuditFilter{Action: model.AuditLogin}, 2},
+		{"without organization", &model.AuditFilter{Org: &model.OrgScope{}}, 2},
+		{"organization", &model.AuditFilter{Org: &model.OrgScope{OrgID: &org.ID}}, 2},
+		{"organization and action", &model.AuditFilter{Action: model.AuditLogin, Org: &model.OrgScope{OrgID: &org.ID}}, 1},
+		{"user of another organization", &model.AuditFilter{UserId: int(alice.ID), Org: &model.OrgScope{OrgID: &org.ID}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs, total, err := s.List(ctx, tt.filter, model.PageOptions{Limit: 10})
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			if total != tt.wantTotal || int64(len(logs)) != tt.wantTotal {
+				t.Errorf("List() = %d logs, total %d, want %d", len(logs), total, tt.wantTotal)
+			}
+		})
+	}
+
+	// The entries can't be tampered with
+	logs, _, _ := s.List(ctx, &model.AuditFilter{}, model.PageOptions{Limit: 1})
+	if err := db.Model(logs[0]).Update("action", model.AuditLogin).Error; !errors.Is(err, model.ErrAuditLogImmutable) {
+		t.Errorf("Update() error = %v, want ErrAuditLogImmutable", err)
+	}
+	if err := db.Delete(logs[0]).Error; !errors.Is(err, model.ErrAuditLogImmutable) {
+		t.Errorf("Delete() error = %v, want ErrAuditLogImmutable", err)
+	}
+}
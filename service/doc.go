@@ -0,0 +1,12 @@
+/*
+Package service holds the business logic on top of gorm: users, refresh tokens, revoked
+tokens, idempotency keys and the audit trail. It doesn't depend on gin, every method
+takes a context.Context and the services can be used from any application:
+
+	users := service.NewUserService(db)
+	user, err := users.CreateUser(ctx, &model.UserCreateDTO{Email: email, Password: password})
+
+TxService runs multi-step operations atomically, handing the callback services bound
+to a single transaction.
+*/
+package service
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrIdempotencyKeyNotFound is returned when no unexpired record matches the endpoint and key
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+	// ErrIdempotencyKeyConflict is returned when the key has been recorded by a concurrent request
+	ErrIdempotencyKeyConflict = errors.New("idempotency key already used")
+)
+
+type IdempotencyService struct {
+	db *gorm.DB
+}
+
+func NewIdempotencyService(db *gorm.DB) *IdempotencyService {
+	return &IdempotencyService{
+		db: db,
+	}
+}
+
+/*
+Find returns the unexpired record of the key for the endpoint.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - endpoint (string): The endpoint the key is scoped to.
+  - key (string): The Idempotency-Key sent by the client.
+
+Returns:
+  - (*model.IdempotencyKey): The record of the first request sent with the key.
+  - (error): ErrIdempotencyKeyNotFound if the key hasn't been used, or a query error.
+*/
+func (s *IdempotencyService) Find(ctx context.Context, endpoint, key string) (*model.IdempotencyKey, error) {
+	var record model.IdempotencyKey
+	err := s.db.WithContext(ctx).Where("endpoint = ? AND idempotency_key = ? AND expires_at > ?", endpoint, key, time.Now()).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+/*
+Save records the user created by the request sent with the key. An expired record of the
+same key is replaced.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - endpoint (string): The endpoint the key is scoped to.
+  - key (string): The Idempotency-Key sent by the client.
+  - fingerprint (string): A digest identifying the request.
+  - userId (int): The ID of the created user.
+  - ttl (time.Duration): How long the key is kept.
+
+Returns:
+  - (error): ErrIdempotencyKeyConflict if the key is already recorded, or a query error.
+*/
+func (s *IdempotencyService) Save(ctx context.Context, endpoint, key, fingerprint string, userId int, ttl time.Duration) error {
+	err := s.db.WithContext(ctx).Where("endpoint = ? AND idempotency_key = ? AND expires_at <= ?", endpoint, key, time.Now()).Delete(&model.IdempotencyKey{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = s.db.WithContext(ctx).Create(&model.IdempotencyKey{
+		Endpoint:    endpoint,
+		Key:         key,
+		Fingerprint: fingerprint,
+		UserId:      userId,
+		ExpiresAt:   time.Now().Add(ttl),
+	}).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrIdempotencyKeyConflict
+	}
+
+	return err
+}
+
+/*
+PurgeExpired deletes the records past their expiry.
+
+Args:
+  - ctx (context.Context): The context of the query.
+
+Returns:
+  - (int64): The number of deleted records.
+  - (error): An error if one occurred during the deletion.
+*/
+func (s *IdempotencyService) PurgeExpired(ctx context.Context) (int64, error) {
+	result := s.db.WithContext(ctx).Where("expires_at <= ?", time.Now()).Delete(&model.IdempotencyKey{})
+
+	return result.RowsAffected, result.Error
+}
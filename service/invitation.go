@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvitationNotFound is returned when no invitation has the token
+	ErrInvitationNotFound = errors.New("invitation not found")
+	// ErrInvitationExpired is returned when accepting an invitation past its expiry
+	ErrInvitationExpired = errors.New("invitation expired")
+	// ErrInvitationAccepted is returned when accepting an invitation a second time
+	ErrInvitationAccepted = errors.New("invitation already accepted")
+	// ErrInvitationEmailMismatch is returned when registering with another email than the invited one
+	ErrInvitationEmailMismatch = errors.New("the invitation was sent to another email")
+)
+
+type InvitationService struct {
+	db *gorm.DB
+}
+
+func NewInvitationService(db *gorm.DB) *InvitationService {
+	return &InvitationService{
+		db: db,
+	}
+}
+
+/*
+Create issues an invitation to register with the email.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - email (string): The email the invited user must register with.
+  - inviterId (int): The ID of the user sending the invitation.
+  - orgID (*uint): The organization the invited user joins, nil for none.
+  - ttl (time.Duration): The lifetime of the invitation.
+
+Returns:
+  - (*model.Invitation): The created invitation, with its plaintext token in the Token field.
+  - (error): ErrEmailTaken if a user, even deleted, already has the email, or an error if one occurred during the save.
+*/
+func (s *InvitationService) Create(ctx context.Context, email string, inviterId int, orgID *uint, ttl time.Duration) (*model.Invitation, error) {
+	var count int64
+	if err := s.db.WithContext(ctx).Unscoped().Model(&model.User{}).Where("email = ?", email).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrEmailTaken
+	}
+
+	raw, err := generateRandomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	invitation := &model.Invitation{
+		Email:     email,
+		Hash:      HashToken(raw),
+		InviterId: inviterId,
+		OrgID:     orgID,
+		ExpiresAt: time.Now().Add(ttl),
+		Token:     raw,
+	}
+	if err := s.db.WithContext(ctx).Create(invitation).Error; err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+/*
+Accept marks the invitation with the token as accepted, so that it can't be used twice. It
+is meant to run in the transaction creating the invited user.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - raw (string): The plaintext token of the invitation.
+  - email (string): The email the user registers with, compared to the invited one ignoring the case.
+
+Returns:
+  - (*model.Invitation): The accepted invitation.
+  - (error): ErrInvitationNotFound, ErrInvitationAccepted, ErrInvitationExpired or ErrInvitationEmailMismatch
+    if the invitation can't be accepted, or a query error.
+*/
+func (s *InvitationService) Accept(ctx context.Context, raw string, email string) (*model.Invitation, error) {
+	var invitation model.Invitation
+	err := s.db.WithContext(ctx).Where("hash = ?", HashToken(raw)).First(&invitation).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvitationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case invitation.Accepted:
+		return nil, ErrInvitationAccepted
+	case time.Now().After(invitation.ExpiresAt):
+		return nil, ErrInvitationExpired
+	case !strings.EqualFold(invitation.Email, strings.TrimSpace(email)):
+		return nil, ErrInvitationEmailMismatch
+	}
+
+	// Only one of two concurrent registrations can flip the flag
+	result := s.db.WithContext(ctx).Model(&invitation).Where("accepted = ?", false).Update("accepted", true)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvitationAccepted
+	}
+
+	return &invitation, nil
+}
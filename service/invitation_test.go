@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+func TestInvitationAccept(t *testing.T) {
+	db := testutil.NewDB(t)
+	org := model.Organization{Name: "acme"}
+	if err := db.Create(&org).Error; err != nil {
+		t.Fatal(err)
+	}
+	admin := testutil.SeedUser(t, db, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin, OrgID: &org.ID})
+	s := NewInvitationService(db)
+	ctx := context.Background()
+
+	if _, err := s.Create(ctx, "admin@example.com", int(admin.ID), nil, time.Hour); !errors.Is(err, ErrEmailTaken) {
+		t.Fatalf("Create() error = %v, want ErrEmailTaken for a registered email", err)
+	}
+
+	valid, err := s.Create(ctx, "bob@example.com", int(admin.ID), &org.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.Create(ctx, "carol@example.com", int(admin.ID), nil, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		email   string
+		wantErr error
+	}{
+		{"unknown token", "unknown", "bob@example.com", ErrInvitationNotFound},
+		{"expired", expired.Token, "carol@example.com", ErrInvitationExpired},
+		{"another email", valid.Token, "carol@example.com", ErrInvitationEmailMismatch},
+		{"valid", valid.Token, " BOB@example.com", nil},
+		{"already accepted", valid.Token, "bob@example.com", ErrInvitationAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invitation, err := s.Accept(ctx, tt.token, tt.email)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Accept() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (invitation.OrgID == nil || *invitation.OrgID != org.ID) {
+				t.Errorf("Accept() org = %v, want the organization of the inviter", invitation.OrgID)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type PermissionService struct {
+	db *gorm.DB
+}
+
+func NewPermissionService(db *gorm.DB) *PermissionService {
+	return &PermissionService{
+		db: db,
+	}
+}
+
+/*
+GetPermissions returns the effective permissions of the user: the ones granted to its role
+and to itself. The admins hold every permission, which isn't listed.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - user (*model.User): The user, its ID and role are used.
+
+Returns:
+  - ([]string): The names of the permissions, sorted.
+  - (error): An error if one occurred during the query.
+*/
+func (s *PermissionService) GetPermissions(ctx context.Context, user *model.User) ([]string, error) {
+	names := []string{}
+	err := s.db.WithContext(ctx).Model(&model.Permission{}).
+		Where("id IN (?) OR id IN (?)",
+			s.db.Table("user_permissions").Select("permission_id").Where("user_id = ?", user.ID),
+			s.db.Model(&model.RolePermission{}).Select("permission_id").Where("role = ?", user.Role),
+		).
+		Order("name").Pluck("name", &names).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+/*
+Load sets the effective permissions of the user in its Permissions field, to be embedded in its tokens.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - user (*model.User): The user to load the permissions of.
+
+Returns:
+  - (error): An error if one occurred during the query.
+*/
+func (s *PermissionService) Load(ctx context.Context, user *model.User) error {
+	permissions, err := s.GetPermissions(ctx, user)
+	if err != nil {
+		return err
+	}
+	user.Permissions = permissions
+
+	return nil
+}
+
+/*
+GrantToUser grants the permission, created if needed, to the user. Granting it again is a no-op.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userID (int): The ID of the user.
+  - name (string): The name of the permission.
+
+Returns:
+  - (error): ErrUserNotFound if there is no such user, or an error if one occurred during the save.
+*/
+func (s *PermissionService) GrantToUser(ctx context.Context, userID int, name string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		permission, err := findOrCreatePermission(tx, name)
+		if err != nil {
+			return err
+		}
+
+		user := &model.User{}
+		if err := tx.First(user, userID).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := tx.Model(user).Association("GrantedPermissions").Append(permission); err != nil {
+			return err
+		}
+
+		return bumpPermissionsVersion(tx.Where("id = ?", userID))
+	})
+}
+
+/*
+RevokeFromUser revokes the permission granted to the user itself. The permission may still be
+granted to its role.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userID (int): The ID of the user.
+  - name (string): The name of the permission.
+
+Returns:
+  - (error): An error if one occurred during the deletion.
+*/
+func (s *PermissionService) RevokeFromUser(ctx context.Context, userID int, name string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		permissions := tx.Model(&model.Permission{}).Select("id").Where("name = ?", name)
+		if err := tx.Table("user_permissions").Where("user_id = ? AND permission_id IN (?)", userID, permissions).Delete(nil).Error; err != nil {
+			return err
+		}
+
+		return bumpPermissionsVersion(tx.Where("id = ?", userID))
+	})
+}
+
+/*
+GrantToRole grants the permission, created if needed, to every user of the role. Granting it again is a no-op.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - role (string): The role, e.g. model.RoleUser.
+  - name (string): The name of the permission.
+
+Returns:
+  - (error): An error if one occurred during the save.
+*/
+func (s *PermissionService) GrantToRole(ctx context.Context, role, name string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		permission, err := findOrCreatePermission(tx, name)
+		if err != nil {
+			return err
+		}
+
+		grant := &model.RolePermission{Role: role, PermissionID: permission.ID}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(grant).Error; err != nil {
+			return err
+		}
+
+		return bumpPermissionsVersion(tx.Where("role = ?", role))
+	})
+}
+
+/*
+RevokeFromRole revokes the permission from the role. The users granted it themselves keep it.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - role (string): The role, e.g. model.RoleUser.
+  - name (string): The name of the permission.
+
+Returns:
+  - (error): An error if one occurred during the deletion.
+*/
+func (s *PermissionService) RevokeFromRole(ctx context.Context, role, name string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		permissions := tx.Model(&model.Permission{}).Select("id").Where("name = ?", name)
+		if err := tx.Where("role = ? AND permission_id IN (?)", role, permissions).Delete(&model.RolePermission{}).Error; err != nil {
+			return err
+		}
+
+		return bumpPermissionsVersion(tx.Where("role = ?", role))
+	})
+}
+
+func findOrCreatePermission(tx *gorm.DB, name string) (*model.Permission, error) {
+	permission := &model.Permission{}
+	if err := tx.Where(model.Permission{Name: name}).FirstOrCreate(permission).Error; err != nil {
+		return nil, err
+	}
+
+	return permission, nil
+}
+
+// bumpPermissionsVersion increments the PermissionsVersion of the users matched by query, so
+// that the permissions embedded in their tokens are reloaded.
+func bumpPermissionsVersion(query *gorm.DB) error {
+	return query.Model(&model.User{}).UpdateColumn("permissions_version", gorm.Expr("permissions_version + 1")).Error
+}
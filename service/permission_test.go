@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+)
+
+func TestPermissions(t *testing.T) {
+	db := testutil.NewDB(t)
+	alice := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com"})
+	bob := testutil.SeedUser(t, db, testutil.UserFixture{Email: "bob@example.com"})
+	s := NewPermissionService(db)
+	ctx := context.Background()
+
+	if err := s.GrantToUser(ctx, 999, "users:export"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("GrantToUser() error = %v, want ErrUserNotFound", err)
+	}
+
+	version := func(t *testing.T, user *model.User) uint {
+		t.Helper()
+
+		reloaded := &model.User{}
+		if err := db.First(reloaded, user.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		return reloaded.PermissionsVersion
+	}
+
+	tests := []struct {
+		name      string
+		change    func() error
+		wantAlice []string
+		wantBob   []string
+		// wantVersions are the PermissionsVersion of alice and bob after the change
+		wantVersions [2]uint
+	}{
+		{"grant to a user", func() error { return s.GrantToUser(ctx, int(alice.ID), "users:export") }, []string{"users:export"}, []string{}, [2]uint{1, 0}},
+		{"grant twice", func() error { return s.GrantToUser(ctx, int(alice.ID), "users:export") }, []string{"users:export"}, []string{}, [2]uint{2, 0}},
+		{"grant to a role", func() error { return s.GrantToRole(ctx, model.RoleUser, "reports:read") }, []string{"reports:read", "users:export"}, []string{"reports:read"}, [2]uint{3, 1}},
+		{"grant to a user and its role", func() error { return s.GrantToUser(ctx, int(bob.ID), "reports:read") }, []string{"reports:read", "users:export"}, []string{"reports:read"}, [2]uint{3, 2}},
+		{"revoke from a role", func() error { return s.RevokeFromRole(ctx, model.RoleUser, "reports:read") }, []string{"users:export"}, []string{"reports:read"}, [2]uint{4, 3}},
+		{"revoke from a user", func() error { return s.RevokeFromUser(ctx, int(alice.ID), "users:export") }, []string{}, []string{"reports:read"}, [2]uint{5, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.change(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range []struct {
+				user        *model.User
+				permissions []string
+				version     uint
+			}{{alice, tt.wantAlice, tt.wantVersions[0]}, {bob, tt.wantBob, tt.wantVersions[1]}} {
+				if err := s.Load(ctx, want.user); err != nil {
+					t.Fatal(err)
+				}
+				if fmt.Sprint(want.user.Permissions) != fmt.Sprint(want.permissions) {
+					t.Errorf("permissions of %s = %v, want %v", want.user.Email, want.user.Permissions, want.permissions)
+				}
+				if got := version(t, want.user); got != want.version {
+					t.Errorf("PermissionsVersion of %s = %d, want %d", want.user.Email, got, want.version)
+				}
+			}
+		})
+	}
+}
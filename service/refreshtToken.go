@@ -1,13 +1,25 @@
 package service
 
 import (
-	"fmt"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
 
 	"github.com/MohammadBnei/gorm-user-auth/model"
-	"github.com/kjk/betterguid"
 	"gorm.io/gorm"
 )
 
+var (
+	// ErrTooManySessions is returned when a user already has as many sessions as allowed
+	ErrTooManySessions = errors.New("too many active sessions")
+	// ErrSessionNotFound is returned for a session that doesn't exist, has expired or belongs to another user
+	ErrSessionNotFound = errors.New("session not found")
+)
+
 type RTService struct {
 	db *gorm.DB
 }
@@ -19,32 +31,42 @@ func NewRTService(db *gorm.DB) *RTService {
 }
 
 /*
-CreateRT creates a new refresh token with the provided IP address and user ID.
+CreateRT creates a new refresh token with the provided IP address, user ID and lifetime.
+The token is 32 random bytes, only its SHA-256 digest is stored in the database. The
+plaintext is returned in the Token field of the result and can't be retrieved later.
 
 Args:
+  - ctx (context.Context): The context of the query.
   - ip (string): The IP address associated with the token.
   - userId (int): The ID of the user associated with the token.
+  - ttl (time.Duration): The lifetime of the token.
 
 Returns:
   - (*model.RefreshToken): The newly created refresh token.
   - (error): An error if one occurred during database save.
 */
-func (rt *RTService) CreateRT(ip string, userId int) (*model.RefreshToken, error) {
-	hash := betterguid.New()
+func (rt *RTService) CreateRT(ctx context.Context, ip string, userId int, ttl time.Duration) (*model.RefreshToken, error) {
+	raw, err := generateRandomToken()
+	if err != nil {
+		return nil, err
+	}
+	hash := HashToken(raw)
 
 	token := &model.RefreshToken{
-		Hash:   hash,
-		Ip:     ip,
-		UserId: userId,
+		Hash:      hash,
+		Token:     raw,
+		Ip:        ip,
+		UserId:    userId,
+		ExpiresAt: time.Now().Add(ttl),
 	}
 
-	err := rt.db.Save(token).Error
+	err = rt.db.WithContext(ctx).Save(token).Error
 	if err != nil {
 		return nil, err
 	}
 
 	var previousTokens []model.RefreshToken
-	err = rt.db.Where("ip = ? AND user_id = ? AND NOT hash = ?", ip, userId, hash).Delete(previousTokens).Error
+	err = rt.db.WithContext(ctx).Where("ip = ? AND user_id = ? AND NOT hash = ?", ip, userId, hash).Delete(previousTokens).Error
 	if err != nil {
 		return nil, err
 	}
@@ -52,13 +74,224 @@ func (rt *RTService) CreateRT(ip string, userId int) (*model.RefreshToken, error
 	return token, nil
 }
 
-func (rt *RTService) GetRT(hash string) (*model.RefreshToken, error) {
+/*
+GetRT retrieves the refresh token, with its user preloaded, from the plaintext token presented by the client.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - raw (string): The plaintext refresh token, hashed before the lookup.
+
+Returns:
+  - (*model.RefreshToken): The refresh token.
+  - (error): An error if one occurred during the query, gorm.ErrRecordNotFound if there is no such token or it has expired.
+*/
+func (rt *RTService) GetRT(ctx context.Context, raw string) (*model.RefreshToken, error) {
 	var token model.RefreshToken
-	err := rt.db.Where("hash = ?", hash).Preload("User").First(&token).Error
-	fmt.Println(token, err)
+	err := rt.db.WithContext(ctx).Where("hash = ? AND expires_at > ?", HashToken(raw), time.Now()).Preload("User").First(&token).Error
 	if err != nil {
 		return nil, err
 	}
 
 	return &token, nil
 }
+
+/*
+ExtendRT slides the expiry of the refresh token after a successful refresh: the session then
+expires once unused for idle, but never later than absolute after its creation. The token is
+updated in place.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - token (*model.RefreshToken): The refresh token, as returned by GetRT.
+  - idle (time.Duration): The inactivity window, 0 to leave the expiry as is.
+  - absolute (time.Duration): The maximum lifetime of the session, 0 for no cap.
+
+Returns:
+  - (error): An error if one occurred during the update.
+*/
+func (rt *RTService) ExtendRT(ctx context.Context, token *model.RefreshToken, idle, absolute time.Duration) error {
+	if idle <= 0 {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(idle)
+	if absolute > 0 && expiresAt.After(token.CreatedAt.Add(absolute)) {
+		expiresAt = token.CreatedAt.Add(absolute)
+	}
+
+	err := rt.db.WithContext(ctx).Model(&model.RefreshToken{}).Where("id = ?", token.ID).UpdateColumn("expires_at", expiresAt).Error
+	if err != nil {
+		return err
+	}
+	token.ExpiresAt = expiresAt
+
+	return nil
+}
+
+/*
+DeleteRT deletes the refresh token matching the provided hash, closing the session.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - token (string): The plaintext refresh token.
+
+Returns:
+  - (error): An error if one occurred during the deletion.
+*/
+func (rt *RTService) DeleteRT(ctx context.Context, token string) error {
+	return rt.db.WithContext(ctx).Where("hash = ?", HashToken(token)).Delete(&model.RefreshToken{}).Error
+}
+
+// HashToken returns the hex encoded SHA-256 digest of a token, as stored in the database.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+CountActive counts the refresh tokens that have not expired yet, i.e. the active sessions.
+
+Args:
+  - ctx (context.Context): The context of the query.
+
+Returns:
+  - (int64): The number of active refresh tokens.
+  - (error): An error if one occurred during the query.
+*/
+func (rt *RTService) CountActive(ctx context.Context) (int64, error) {
+	var count int64
+	err := rt.db.WithContext(ctx).Model(&model.RefreshToken{}).Where("expires_at > ?", time.Now()).Count(&count).Error
+
+	return count, err
+}
+
+// generateRandomToken returns 32 bytes from crypto/rand, base64url encoded.
+func generateRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/*
+RevokeAllForUser deletes every refresh token of the user, closing all its sessions.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userId (int): The ID of the user.
+
+Returns:
+  - (int64): The number of revoked sessions.
+  - (error): An error if one occurred during the deletion.
+*/
+func (rt *RTService) RevokeAllForUser(ctx context.Context, userId int) (int64, error) {
+	result := rt.db.WithContext(ctx).Where("user_id = ?", userId).Delete(&model.RefreshToken{})
+
+	return result.RowsAffected, result.Error
+}
+
+/*
+CountForUser counts the active sessions of the user. The session of ip isn't counted, the
+next CreateRT from it replaces it rather than adding one.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userId (int): The ID of the user.
+  - ip (string): The IP address the next session is created from.
+
+Returns:
+  - (int64): The number of active sessions.
+  - (error): An error if one occurred during the query.
+*/
+func (rt *RTService) CountForUser(ctx context.Context, userId int, ip string) (int64, error) {
+	var count int64
+	err := rt.db.WithContext(ctx).Model(&model.RefreshToken{}).
+		Where("user_id = ? AND NOT ip = ? AND expires_at > ?", userId, ip, time.Now()).
+		Count(&count).Error
+
+	return count, err
+}
+
+/*
+RevokeOldestForUser deletes the oldest active sessions of the user, so that at most keep of
+them remain besides the session of ip, which is left alone like in CountForUser.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userId (int): The ID of the user.
+  - ip (string): The IP address the next session is created from.
+  - keep (int): The number of sessions to keep, the most recent ones.
+
+Returns:
+  - (int64): The number of revoked sessions.
+  - (error): An error if one occurred during the deletion.
+*/
+func (rt *RTService) RevokeOldestForUser(ctx context.Context, userId int, ip string, keep int) (int64, error) {
+	var ids []uint
+	err := rt.db.WithContext(ctx).Model(&model.RefreshToken{}).
+		Where("user_id = ? AND NOT ip = ? AND expires_at > ?", userId, ip, time.Now()).
+		Order("created_at DESC, id DESC").Pluck("id", &ids).Error
+	if err != nil || len(ids) <= keep {
+		return 0, err
+	}
+
+	result := rt.db.WithContext(ctx).Where("id IN ?", ids[max(keep, 0):]).Delete(&model.RefreshToken{})
+
+	return result.RowsAffected, result.Error
+}
+
+/*
+ListForUser lists a page of the active sessions of the user, the newest first.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userId (int): The ID of the user.
+  - opts (model.PageOptions): The page to return.
+
+Returns:
+  - ([]model.RefreshToken): The unexpired refresh tokens of the page, without their plaintext.
+  - (int64): The number of active sessions of the user, across every page.
+  - (error): An error if one occurred during the query.
+*/
+func (rt *RTService) ListForUser(ctx context.Context, userId int, opts model.PageOptions) ([]model.RefreshToken, int64, error) {
+	query := rt.db.WithContext(ctx).Model(&model.RefreshToken{}).Where("user_id = ? AND expires_at > ?", userId, time.Now())
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var tokens []model.RefreshToken
+	err := query.Order("created_at DESC, id DESC").Limit(opts.Limit).Offset(opts.Offset).Find(&tokens).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return tokens, total, nil
+}
+
+/*
+DeleteForUser deletes a session of the user by its ID, closing it.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - userId (int): The ID of the user owning the session.
+  - id (int): The ID of the refresh token.
+
+Returns:
+  - (error): ErrSessionNotFound if the user has no active session with this ID, or an error if one occurred during the deletion.
+*/
+func (rt *RTService) DeleteForUser(ctx context.Context, userId int, id int) error {
+	result := rt.db.WithContext(ctx).Where("id = ? AND user_id = ? AND expires_at > ?", id, userId, time.Now()).Delete(&model.RefreshToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
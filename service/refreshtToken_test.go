@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"gorm.io/gorm"
+)
+
+func TestRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.NewDB(t)
+	user := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com"})
+	s := NewRTService(db)
+
+	rt, err := s.CreateRT(ctx, "203.0.113.7", int(user.ID), time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRT() error = %v", err)
+	}
+	if rt.Hash != HashToken(rt.Token) {
+		t.Error("CreateRT() must only store the digest of the token")
+	}
+
+	got, err := s.GetRT(ctx, rt.Token)
+	if err != nil {
+		t.Fatalf("GetRT() error = %v", err)
+	}
+	if got.User.ID != user.ID {
+		t.Errorf("GetRT() user = %d, want the preloaded user %d", got.User.ID, user.ID)
+	}
+
+	tests := []struct {
+		name string
+		raw  func(t *testing.T) string
+	}{
+		{"unknown token", func(t *testing.T) string { return "unknown" }},
+		{"digest instead of the token", func(t *testing.T) string { return rt.Hash }},
+		{"expired token", func(t *testing.T) string {
+			expired, err := s.CreateRT(ctx, "198.51.100.1", int(user.ID), -time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return expired.Token
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.GetRT(ctx, tt.raw(t)); !errors.Is(err, gorm.ErrRecordNotFound) {
+				t.Errorf("GetRT() error = %v, want gorm.ErrRecordNotFound", err)
+			}
+		})
+	}
+
+	// A new session from the same IP replaces the previous one
+	replacing, err := s.CreateRT(ctx, "203.0.113.7", int(user.ID), time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRT() error = %v", err)
+	}
+	if _, err := s.GetRT(ctx, rt.Token); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("GetRT() of the replaced token error = %v, want gorm.ErrRecordNotFound", err)
+	}
+
+	// The digests are unique, a token can't back two sessions
+	duplicate := &model.RefreshToken{UserId: int(user.ID), Ip: "198.51.100.2", Hash: replacing.Hash, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := db.Create(duplicate).Error; !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Errorf("creating a session with the same digest error = %v, want gorm.ErrDuplicatedKey", err)
+	}
+
+	revoked, err := s.RevokeAllForUser(ctx, int(user.ID))
+	if err != nil {
+		t.Fatalf("RevokeAllForUser() error = %v", err)
+	}
+	if revoked != 2 {
+		t.Errorf("RevokeAllForUser() = %d, want the replacing and the expired sessions", revoked)
+	}
+	if _, err := s.GetRT(ctx, replacing.Token); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("GetRT() after revocation error = %v, want gorm.ErrRecordNotFound", err)
+	}
+}
+
+func TestExtendRT(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.NewDB(t)
+	user := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com"})
+	s := NewRTService(db)
+
+	tests := []struct {
+		name           string
+		idle, absolute time.Duration
+		// age is how long ago the token was created
+		age time.Duration
+		// want is how long the token has left after the extension
+		want time.Duration
+	}{
+		{"no sliding window", 0, 0, 0, 10 * time.Minute},
+		{"sliding window", time.Hour, 0, 0, time.Hour},
+		{"sliding window past the ttl", 2 * time.Hour, 0, 0, 2 * time.Hour},
+		{"capped by the absolute expiry", time.Hour, 2 * time.Hour, 90 * time.Minute, 30 * time.Minute},
+		{"below the absolute expiry", time.Hour, 2 * time.Hour, 30 * time.Minute, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, err := s.CreateRT(ctx, tt.name, int(user.ID), 10*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rt.CreatedAt = time.Now().Add(-tt.age)
+			if err := db.Model(rt).UpdateColumn("created_at", rt.CreatedAt).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.ExtendRT(ctx, rt, tt.idle, tt.absolute); err != nil {
+				t.Fatalf("ExtendRT() error = %v", err)
+			}
+			got, err := s.GetRT(ctx, rt.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if until := time.Until(got.ExpiresAt); until > tt.want || until < tt.want-time.Minute {
+				t.Errorf("token expires in %v, want %v", until, tt.want)
+			}
+			if !got.ExpiresAt.Equal(rt.ExpiresAt) {
+				t.Errorf("ExtendRT() set ExpiresAt = %v in place, stored %v", rt.ExpiresAt, got.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.NewDB(t)
+	user := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com"})
+	s := NewRTService(db)
+
+	var sessions []*model.RefreshToken
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		rt, err := s.CreateRT(ctx, ip, int(user.ID), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, rt)
+	}
+	if _, err := s.CreateRT(ctx, "192.0.2.4", int(user.ID), -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want int64
+	}{
+		{"198.51.100.1", 3},
+		// The session of the ip is replaced by the next one, it doesn't count
+		{"192.0.2.1", 2},
+	}
+	for _, tt := range tests {
+		count, err := s.CountForUser(ctx, int(user.ID), tt.ip)
+		if err != nil {
+			t.Fatalf("CountForUser() error = %v", err)
+		}
+		if count != tt.want {
+			t.Errorf("CountForUser(%s) = %d, want %d", tt.ip, count, tt.want)
+		}
+	}
+
+	revoked, err := s.RevokeOldestForUser(ctx, int(user.ID), "198.51.100.1", 1)
+	if err != nil {
+		t.Fatalf("RevokeOldestForUser() error = %v", err)
+	}
+	if revoked != 2 {
+		t.Errorf("RevokeOldestForUser() = %d, want the 2 oldest sessions", revoked)
+	}
+	for i, session := range sessions {
+		_, err := s.GetRT(ctx, session.Token)
+		if kept := err == nil; kept != (i == 2) {
+			t.Errorf("session %d kept = %v, want only the most recent one", i, kept)
+		}
+	}
+}
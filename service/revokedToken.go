@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RevokedTokenService struct {
+	db *gorm.DB
+}
+
+func NewRevokedTokenService(db *gorm.DB) *RevokedTokenService {
+	return &RevokedTokenService{
+		db: db,
+	}
+}
+
+/*
+Revoke adds the jwt identified by jti to the denylist. Revoking an already revoked token is a no-op.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - jti (string): The unique ID of the token (its jti claim).
+  - expiresAt (time.Time): The expiry of the token, after which the entry can be purged.
+
+Returns:
+  - (error): An error if one occurred during database save.
+*/
+func (s *RevokedTokenService) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&model.RevokedToken{
+		Jti:       jti,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+/*
+IsRevoked checks whether the jwt identified by jti is in the denylist.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - jti (string): The unique ID of the token (its jti claim).
+
+Returns:
+  - (bool): true if the token has been revoked.
+  - (error): An error if one occurred during the query.
+*/
+func (s *RevokedTokenService) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	var count int64
+	err := s.db.WithContext(ctx).Model(&model.RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+/*
+PurgeExpired deletes the denylist entries whose token has expired, as expired tokens are rejected anyway.
+
+Args:
+  - ctx (context.Context): The context of the query.
+
+Returns:
+  - (int64): The number of purged entries.
+  - (error): An error if one occurred during the deletion.
+*/
+func (s *RevokedTokenService) PurgeExpired(ctx context.Context) (int64, error) {
+	result := s.db.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&model.RevokedToken{})
+
+	return result.RowsAffected, result.Error
+}
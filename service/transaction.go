@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// TxServices are services bound to a single database transaction.
+type TxServices struct {
+	UserService        *UserService
+	RTService          *RTService
+	IdempotencyService *IdempotencyService
+	InvitationService  *InvitationService
+	UsedTokenService   *UsedTokenService
+}
+
+type TxService struct {
+	db *gorm.DB
+}
+
+func NewTxService(db *gorm.DB) *TxService {
+	return &TxService{
+		db: db,
+	}
+}
+
+/*
+Transaction runs fn in a database transaction, handing it services bound to that transaction.
+Everything done through them is committed if fn returns nil, and rolled back otherwise.
+
+Args:
+  - ctx (context.Context): The context of the transaction.
+  - fn (func(*TxServices) error): The multi-step operation to run atomically.
+
+Returns:
+  - (error): The error returned by fn, or an error if the transaction failed to begin or commit.
+*/
+func (s *TxService) Transaction(ctx context.Context, fn func(tx *TxServices) error) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&TxServices{
+			UserService:        NewUserService(tx),
+			RTService:          NewRTService(tx),
+			IdempotencyService: NewIdempotencyService(tx),
+			InvitationService:  NewInvitationService(tx),
+			UsedTokenService:   NewUsedTokenService(tx),
+		})
+	})
+}
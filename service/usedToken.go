@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"gorm.io/gorm"
+)
+
+// ErrTokenUsed is returned by Use for a token which has already been used
+var ErrTokenUsed = errors.New("token already used")
+
+type UsedTokenService struct {
+	db *gorm.DB
+}
+
+func NewUsedTokenService(db *gorm.DB) *UsedTokenService {
+	return &UsedTokenService{
+		db: db,
+	}
+}
+
+/*
+Use records the single use token identified by jti as used. The insert is atomic: of two
+concurrent uses of the same token, only one succeeds. Called within the transaction the token
+is used in, a rolled back use leaves the token usable.
+
+Args:
+  - ctx (context.Context): The context of the query.
+  - jti (string): The unique ID of the token.
+  - purpose (string): The purpose of the token, e.g. model.PurposePasswordReset.
+  - expiresAt (time.Time): The expiry of the token, after which the entry can be purged.
+
+Returns:
+  - (error): ErrTokenUsed if the token has already been used, or an error if one occurred during database save.
+*/
+func (s *UsedTokenService) Use(ctx context.Context, jti string, purpose string, expiresAt time.Time) error {
+	err := s.db.WithContext(ctx).Create(&model.UsedToken{
+		Jti:       jti,
+		Purpose:   purpose,
+		ExpiresAt: expiresAt,
+	}).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrTokenUsed
+	}
+
+	return err
+}
+
+/*
+PurgeExpired deletes the entries whose token has expired, as expired tokens are rejected anyway.
+
+Args:
+  - ctx (context.Context): The context of the query.
+
+Returns:
+  - (int64): The number of purged entries.
+  - (error): An error if one occurred during the deletion.
+*/
+func (s *UsedTokenService) PurgeExpired(ctx context.Context) (int64, error) {
+	result := s.db.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&model.UsedToken{})
+
+	return result.RowsAffected, result.Error
+}
@@ -1,10 +1,32 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/metrics"
 	"github.com/MohammadBnei/gorm-user-auth/model"
 	"gorm.io/gorm"
 )
 
+var (
+	// ErrUserNotFound is returned when no user matches the given ID
+	ErrUserNotFound = errors.New("user not found")
+	// ErrEmailTaken is returned when creating or updating a user with an email already used by another user
+	ErrEmailTaken = errors.New("email already taken")
+	// ErrUsernameTaken is returned when creating or updating a user with a username already used by another user
+	ErrUsernameTaken = errors.New("username already taken")
+	// ErrPasswordReused is returned when changing a password to the current one or one of the PasswordHistorySize previous ones
+	ErrPasswordReused = errors.New("the password has already been used, pick a new one")
+	// ErrImportRolledBack is returned by CreateUsers in all-or-nothing mode when a record failed and nothing was imported
+	ErrImportRolledBack = errors.New("import rolled back, no user was created")
+	// ErrUserRequired is returned by CreateUsers for a null record
+	ErrUserRequired = errors.New("user is required")
+)
+
 type UserService struct {
 	db *gorm.DB
 }
@@ -33,16 +55,81 @@ GetUser retrieves a user by ID from the database.
 Parameters:
 
 	s - a pointer to a UserService instance
+	ctx - the context of the query
+	id - the ID of the user to retrieve
+
+Return values:
+
+	*model.User - a pointer to the retrieved user object
+	error - if any error occurs while retrieving the user, it is returned here. ErrUserNotFound if there is no such user
+*/
+func (s *UserService) GetUser(ctx context.Context, id int) (_ *model.User, err error) {
+	defer metrics.ObserveUserOperation("get", time.Now(), &err)
+
+	var user model.User
+	err = s.db.WithContext(ctx).First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+/*
+GetUserInOrg retrieves a user by ID, as long as it belongs to the scoped organization. A
+user of another organization is reported as not found, so that its existence isn't leaked.
+
+Parameters:
+
+	ctx - the context of the query
 	id - the ID of the user to retrieve
+	scope - the organization of the caller
 
 Return values:
 
 	*model.User - a pointer to the retrieved user object
-	error - if any error occurs while retrieving the user, it is returned here
+	error - if any error occurs while retrieving the user, it is returned here. ErrUserNotFound if there is no such user in the organization
 */
-func (s *UserService) GetUser(id int) (*model.User, error) {
+func (s *UserService) GetUserInOrg(ctx context.Context, id int, scope *model.OrgScope) (_ *model.User, err error) {
+	defer metrics.ObserveUserOperation("get", time.Now(), &err)
+
 	var user model.User
-	err := s.db.First(&user, id).Error
+	err = s.db.WithContext(ctx).Scopes(orgScope(scope)).First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+/*
+GetUserWithSessions retrieves a user by ID along with its active sessions, i.e. its unexpired refresh tokens.
+
+Parameters:
+
+	ctx - the context of the query
+	id - the ID of the user to retrieve
+	scope - the organization of the caller, like GetUserInOrg
+
+Return values:
+
+	*model.User - a pointer to the retrieved user object, with its RefreshTokens loaded
+	error - if any error occurs while retrieving the user, it is returned here. ErrUserNotFound if there is no such user
+*/
+func (s *UserService) GetUserWithSessions(ctx context.Context, id int, scope *model.OrgScope) (_ *model.User, err error) {
+	defer metrics.ObserveUserOperation("get", time.Now(), &err)
+
+	user := model.User{RefreshTokens: []model.RefreshToken{}}
+	err = s.db.WithContext(ctx).Scopes(orgScope(scope)).Preload("RefreshTokens", "expires_at > ?", time.Now()).First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -51,16 +138,23 @@ func (s *UserService) GetUser(id int) (*model.User, error) {
 }
 
 /*
-GetUsers retrieves all users from the database.
+GetUsers retrieves all users matching the filter from the database.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query.
+  - filter (*model.UserFilter): the filter to apply.
 
 Returns:
 
   - []*model.User: A slice of user objects.
   - error: An error object if the query fails.
 */
-func (s *UserService) GetUsers() ([]*model.User, error) {
+func (s *UserService) GetUsers(ctx context.Context, filter *model.UserFilter) (_ []*model.User, err error) {
+	defer metrics.ObserveUserOperation("list", time.Now(), &err)
+
 	var users []*model.User
-	err := s.db.Find(&users).Error
+	err = s.db.WithContext(ctx).Scopes(userFilterScope(filter)).Find(&users).Error
 	if err != nil {
 		return nil, err
 	}
@@ -68,10 +162,213 @@ func (s *UserService) GetUsers() ([]*model.User, error) {
 	return users, nil
 }
 
+/*
+ListUsersPage retrieves a page of the users matching the filter, by ascending ID.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query.
+  - filter (*model.UserFilter): the filter to apply.
+  - opts (model.PageOptions): the page to retrieve.
+
+Returns:
+
+  - []*model.User: The matching users of the page, empty if none matches.
+  - error: An error object if the query fails.
+*/
+func (s *UserService) ListUsersPage(ctx context.Context, filter *model.UserFilter, opts model.PageOptions) (_ []*model.User, err error) {
+	defer metrics.ObserveUserOperation("list", time.Now(), &err)
+
+	users := []*model.User{}
+	err = s.db.WithContext(ctx).Scopes(userFilterScope(filter)).Order("id").Limit(opts.Limit).Offset(opts.Offset).Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+/*
+ListUsers retrieves the users matching the filter with an ID greater than opts.AfterID, by
+ascending ID. Paging with the ID of the last user seen doesn't skip nor repeat a user when
+users are created or deleted in between, as an offset does.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query.
+  - filter (*model.UserFilter): the filter to apply.
+  - opts (model.CursorOptions): the page to retrieve.
+
+Returns:
+
+  - []*model.User: The matching users of the page, empty if none matches.
+  - uint: The AfterID of the next page, 0 if this page is the last one.
+  - error: An error object if the query fails.
+*/
+func (s *UserService) ListUsers(ctx context.Context, filter *model.UserFilter, opts model.CursorOptions) (_ []*model.User, _ uint, err error) {
+	defer metrics.ObserveUserOperation("list", time.Now(), &err)
+
+	// One more user than the page tells whether there is a next page
+	users := []*model.User{}
+	err = s.db.WithContext(ctx).Scopes(userFilterScope(filter)).Where("id > ?", opts.AfterID).Order("id").Limit(opts.Limit + 1).Find(&users).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(users) <= opts.Limit {
+		return users, 0, nil
+	}
+	users = users[:opts.Limit]
+
+	return users, users[len(users)-1].ID, nil
+}
+
+/*
+GetUsersByIDs retrieves the users with the given IDs in a single query. The IDs that match
+no user, or a user outside the organization of the caller, are left out of the result.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query.
+  - ids ([]int): the IDs of the users, without duplicates.
+  - scope (*model.OrgScope): the organization of the caller, like GetUserInOrg.
+
+Returns:
+
+  - []*model.User: The users found, in the order of ids.
+  - error: An error object if the query fails.
+*/
+func (s *UserService) GetUsersByIDs(ctx context.Context, ids []int, scope *model.OrgScope) (_ []*model.User, err error) {
+	defer metrics.ObserveUserOperation("get_batch", time.Now(), &err)
+
+	if len(ids) == 0 {
+		return []*model.User{}, nil
+	}
+
+	var found []*model.User
+	err = s.db.WithContext(ctx).Scopes(orgScope(scope)).Where("id IN ?", ids).Find(&found).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]*model.User, len(found))
+	for _, user := range found {
+		byID[int(user.ID)] = user
+	}
+
+	users := make([]*model.User, 0, len(found))
+	for _, id := range ids {
+		if user, ok := byID[id]; ok {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+/*
+CountUsers counts the users matching the filter, without fetching them.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query.
+  - filter (*model.UserFilter): the filter to apply.
+
+Returns:
+
+  - int64: The number of matching users.
+  - error: An error object if the query fails.
+*/
+func (s *UserService) CountUsers(ctx context.Context, filter *model.UserFilter) (_ int64, err error) {
+	defer metrics.ObserveUserOperation("count", time.Now(), &err)
+
+	var count int64
+	err = s.db.WithContext(ctx).Model(&model.User{}).Scopes(userFilterScope(filter)).Count(&count).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+/*
+SearchUsers retrieves a page of the users whose email contains q, ignoring the case.
+The % and _ wildcards of q are matched literally.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query.
+  - q (string): the text to search, it must not be empty.
+  - opts (model.PageOptions): the page to retrieve.
+  - scope (*model.OrgScope): the organization the users are searched in.
+
+Returns:
+
+  - []*model.User: The matching users of the page, empty if none matches.
+  - int64: The total number of matching users.
+  - error: An error object if the query fails.
+*/
+func (s *UserService) SearchUsers(ctx context.Context, q string, opts model.PageOptions, scope *model.OrgScope) (_ []*model.User, _ int64, err error) {
+	defer metrics.ObserveUserOperation("search", time.Now(), &err)
+
+	pattern := "%" + escapeLike(strings.ToLower(q)) + "%"
+	query := s.db.WithContext(ctx).Model(&model.User{}).Scopes(orgScope(scope)).Where("LOWER(email) LIKE ? ESCAPE '!'", pattern)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	users := []*model.User{}
+	err = query.Order("id").Limit(opts.Limit).Offset(opts.Offset).Find(&users).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+// likeEscaper escapes the LIKE wildcards with !, which unlike \ means the same in every SQL dialect
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// escapeLike escapes s so that it is matched literally in a LIKE pattern with ESCAPE '!'.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// userFilterScope applies the non empty fields of the filter to the query.
+func userFilterScope(filter *model.UserFilter) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if filter == nil {
+			return db
+		}
+		if filter.Role != "" {
+			db = db.Where("role = ?", filter.Role)
+		}
+
+		return db.Scopes(orgScope(filter.Org))
+	}
+}
+
+// orgScope restricts the query to the users of the scoped organization.
+func orgScope(scope *model.OrgScope) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		switch {
+		case scope == nil:
+			return db
+		case scope.OrgID == nil:
+			return db.Where("org_id IS NULL")
+		default:
+			return db.Where("org_id = ?", *scope.OrgID)
+		}
+	}
+}
+
 /*
 GetUserByEmail retrieves a user from the database by their email address.
 
 Parameters:
+- ctx (context.Context): the context of the query.
 - email (string): the email address of the user to retrieve.
 
 Returns:
@@ -79,7 +376,7 @@ Returns:
 - (error): an error object, which is non-nil if an error occurred during the retrieval.
 
 Example usage:
-u, err := userService.GetUserByEmail("alice@example.com")
+u, err := userService.GetUserByEmail(ctx, "alice@example.com")
 
 	if err != nil {
 		log.Fatalf("Failed to retrieve user: %v", err)
@@ -87,9 +384,9 @@ u, err := userService.GetUserByEmail("alice@example.com")
 
 fmt.Printf("Retrieved user: %#v\n", u)
 */
-func (s *UserService) GetUserByEmail(email string) (*model.User, error) {
+func (s *UserService) GetUserByEmail(ctx context.Context, email string) (*model.User, error) {
 	var user model.User
-	err := s.db.Where("email = ?", email).First(&user).Error
+	err := s.db.WithContext(ctx).Where("email = ?", email).First(&user).Error
 	if err != nil {
 		return nil, err
 	}
@@ -97,25 +394,269 @@ func (s *UserService) GetUserByEmail(email string) (*model.User, error) {
 	return &user, nil
 }
 
+/*
+GetUserByIdentifier retrieves a user by its email or, if no user has this email, by its username.
+Both are normalized first, "Alice" finds the user "alice" and "Alice@example.com" alice@example.com.
+
+Parameters:
+- ctx (context.Context): the context of the query.
+- identifier (string): the email address or the username of the user to retrieve.
+
+Returns:
+- (*model.User): a pointer to the User object representing the retrieved user.
+- (error): gorm.ErrRecordNotFound if neither matches, or an error if one occurred during the retrieval.
+*/
+func (s *UserService) GetUserByIdentifier(ctx context.Context, identifier string) (*model.User, error) {
+	user, err := s.GetUserByEmail(ctx, model.NormalizeEmail(identifier))
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, err
+	}
+
+	// An email can't be a valid username, no need to look it up
+	username := model.NormalizeUsername(identifier)
+	if !model.ValidUsername(username) {
+		return nil, err
+	}
+
+	user = &model.User{}
+	if err := s.db.WithContext(ctx).Where("username = ?", username).First(user).Error; err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
 /*
 CreateUser creates a new user in the UserService database.
 
 Args:
 
   - s (*UserService): A pointer to the UserService instance.
-  - data (*model.UserCreateDTO): A pointer to the data used to create the new user.
+  - ctx (context.Context): The context of the query.
+  - data (*model.UserCreateDTO): A pointer to the data used to create the new user, with model.DefaultRole unless it has a role.
+    Its email is normalized, like by UpsertByEmail.
 
 Returns:
 
   - (*model.User): A pointer to the newly created user.
-  - (error): An error if the creation failed.
+  - (error): An error if the creation failed, ErrEmailTaken or ErrUsernameTaken if the email or the username is already used.
 */
-func (s *UserService) CreateUser(data *model.UserCreateDTO) (*model.User, error) {
+func (s *UserService) CreateUser(ctx context.Context, data *model.UserCreateDTO) (_ *model.User, err error) {
+	defer metrics.ObserveUserOperation("create", time.Now(), &err)
+
 	user := &model.User{
-		Email:    data.Email,
+		Email:    model.NormalizeEmail(data.Email),
+		Username: data.NormalizedUsername(),
 		Password: data.Password,
+		Role:     data.AssignedRole(),
+		OrgID:    data.OrgID,
+	}
+	err = s.db.WithContext(ctx).Save(&user).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, s.duplicateError(ctx, user.Username)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+/*
+UpsertByEmail returns the user with the normalized email, creating it from defaults if there is
+none. Two concurrent upserts of the same email both try to create the user: the unique email
+index rejects the second insert, which then returns the user created by the first one. It must
+run on the database rather than a transaction, where the rejected insert aborts the transaction
+with some databases.
+
+Args:
+
+  - ctx (context.Context): The context of the queries.
+  - email (string): The email of the user, normalized.
+  - defaults (*model.UserCreateDTO): The username, password, role and organization of a new user, its email is ignored.
+    A new user without password gets a random one, it can't log in with a password until it resets it.
+
+Returns:
+
+  - (*model.User): The found or created user.
+  - (bool): Whether the user was created, e.g. to send it a welcome email.
+  - (error): An error if a query failed, ErrUsernameTaken if the username of defaults is used by
+    another user, ErrEmailTaken if the email is held by a deleted user.
+*/
+func (s *UserService) UpsertByEmail(ctx context.Context, email string, defaults *model.UserCreateDTO) (_ *model.User, created bool, err error) {
+	defer metrics.ObserveUserOperation("upsert", time.Now(), &err)
+
+	email = model.NormalizeEmail(email)
+	user, err := s.GetUserByEmail(ctx, email)
+	if err == nil {
+		return user, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	if defaults == nil {
+		defaults = &model.UserCreateDTO{}
+	}
+	password := defaults.Password
+	if password == "" {
+		if password, err = generateRandomToken(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	user = &model.User{
+		Email:    email,
+		Username: defaults.NormalizedUsername(),
+		Password: password,
+		Role:     defaults.AssignedRole(),
+		OrgID:    defaults.OrgID,
+	}
+	err = s.db.WithContext(ctx).Create(user).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// Created by a concurrent upsert since the lookup, unless the duplicate is the username
+		// or a deleted user holding the email
+		existing, getErr := s.GetUserByEmail(ctx, email)
+		if getErr == nil {
+			return existing, false, nil
+		}
+		return nil, false, s.duplicateError(ctx, user.Username)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return user, true, nil
+}
+
+/*
+CreateUsers creates many users in a single transaction, as used by the bulk import.
+
+Every record is validated first. In all-or-nothing mode, nothing is inserted if any
+record is invalid, and the whole transaction is rolled back on the first insert failure.
+In best-effort mode, each insert runs behind a savepoint so a failing record is rolled
+back on its own while the valid ones are committed.
+
+Passwords are hashed by the User's BeforeCreate hook before insert, and the emails normalized like
+by CreateUser and UpsertByEmail. The records don't go through UpsertByEmail though: an import
+creates users, an email already taken is reported as ErrEmailTaken rather than returning the
+existing user, and each insert must run in the transaction, behind its savepoint.
+
+Args:
+
+  - ctx (context.Context): The context of the query.
+  - data ([]*model.UserCreateDTO): The users to create.
+  - allOrNothing (bool): Whether a single failure rolls back the whole import.
+
+Returns:
+
+  - ([]*model.User): The created users, indexed like data. nil entries failed (or all of them when rolled back).
+  - ([]error): The per record errors, indexed like data. ErrEmailTaken and ErrUsernameTaken for duplicated emails and usernames,
+    ErrUserRequired for a nil record.
+  - (error): ErrImportRolledBack if the import was rolled back, or a transaction error.
+*/
+func (s *UserService) CreateUsers(ctx context.Context, data []*model.UserCreateDTO, allOrNothing bool) (_ []*model.User, _ []error, err error) {
+	defer metrics.ObserveUserOperation("import", time.Now(), &err)
+
+	users := make([]*model.User, len(data))
+	errs := make([]error, len(data))
+
+	invalid := false
+	for i, d := range data {
+		if d == nil {
+			errs[i] = ErrUserRequired
+			invalid = true
+			continue
+		}
+		if err := d.Validate(); err != nil {
+			errs[i] = err
+			invalid = true
+		}
+	}
+	if invalid && allOrNothing {
+		return make([]*model.User, len(data)), errs, ErrImportRolledBack
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i, d := range data {
+			if errs[i] != nil {
+				continue
+			}
+
+			savepoint := fmt.Sprintf("import_%d", i)
+			if !allOrNothing {
+				if err := tx.SavePoint(savepoint).Error; err != nil {
+					return err
+				}
+			}
+
+			user := &model.User{
+				Email:    model.NormalizeEmail(d.Email),
+				Username: d.NormalizedUsername(),
+				Password: d.Password,
+				Role:     d.AssignedRole(),
+				OrgID:    d.OrgID,
+			}
+			err := tx.Create(user).Error
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				err = duplicateError(tx, user.Username)
+			}
+			if err != nil {
+				errs[i] = err
+				if allOrNothing {
+					return ErrImportRolledBack
+				}
+				if err := tx.RollbackTo(savepoint).Error; err != nil {
+					return err
+				}
+				continue
+			}
+
+			users[i] = user
+		}
+
+		return nil
+	})
+	if err != nil {
+		return make([]*model.User, len(data)), errs, err
+	}
+
+	return users, errs, nil
+}
+
+/*
+SeedAdmin creates an admin with email and password, unless an admin already exists. It runs
+at every startup with ADMIN_EMAIL and ADMIN_PASSWORD, so that the first admin can be created
+without going through the admin routes, and does nothing once there is one.
+
+Args:
+
+  - ctx (context.Context): The context of the query.
+  - email (string): The email of the admin, normalized.
+  - password (string): The plaintext password of the admin, hashed by the BeforeCreate hook.
+
+Returns:
+
+  - (*model.User): The created admin, nil if an admin already existed.
+  - (error): An error if the creation failed, ErrEmailTaken if the email belongs to a user who isn't an admin.
+*/
+func (s *UserService) SeedAdmin(ctx context.Context, email, password string) (*model.User, error) {
+	var admins int64
+	err := s.db.WithContext(ctx).Model(&model.User{}).Where("role = ?", model.RoleAdmin).Count(&admins).Error
+	if err != nil || admins > 0 {
+		return nil, err
+	}
+
+	user := &model.User{Email: model.NormalizeEmail(email), Password: password, Role: model.RoleAdmin}
+	err = s.db.WithContext(ctx).Create(user).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// Another instance starting at the same time may have seeded it first
+		existing, getErr := s.GetUserByEmail(ctx, user.Email)
+		if getErr == nil && existing.IsAdmin() {
+			return nil, nil
+		}
+		return nil, ErrEmailTaken
 	}
-	err := s.db.Save(&user).Error
 	if err != nil {
 		return nil, err
 	}
@@ -123,34 +664,513 @@ func (s *UserService) CreateUser(data *model.UserCreateDTO) (*model.User, error)
 	return user, nil
 }
 
-func (s *UserService) DeleteUser(id int) error {
-	return s.db.Delete(&model.User{}, id).Error
+/*
+UsernameAvailable reports whether no user, even a deleted one still holding the unique
+index, has the normalized username.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - username (string): the normalized username
+
+Returns:
+
+  - bool: whether the username can be used by a new user
+  - error: if any error occurred during the query
+*/
+func (s *UserService) UsernameAvailable(ctx context.Context, username string) (bool, error) {
+	taken, err := usernameTaken(s.db.WithContext(ctx), username)
+	return !taken, err
+}
+
+/*
+EmailExists reports whether a user, even a deleted one still holding the unique index, has
+the email. Only the rows are counted, no user is loaded.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - email (string): the normalized email, see model.NormalizeEmail
+
+Returns:
+
+  - bool: whether the email is already taken
+  - error: if any error occurred during the query
+*/
+func (s *UserService) EmailExists(ctx context.Context, email string) (bool, error) {
+	var count int64
+	err := s.db.WithContext(ctx).Unscoped().Model(&model.User{}).Where("email = ?", email).Count(&count).Error
+	return count > 0, err
+}
+
+func usernameTaken(db *gorm.DB, username string) (bool, error) {
+	var count int64
+	err := db.Unscoped().Model(&model.User{}).Where("username = ?", username).Count(&count).Error
+	return count > 0, err
+}
+
+// duplicateError tells which unique column a gorm.ErrDuplicatedKey is about, the translated
+// error doesn't say. The username is checked, any other duplicate is the email.
+func (s *UserService) duplicateError(ctx context.Context, username *string) error {
+	return duplicateError(s.db.WithContext(ctx), username)
+}
+
+func duplicateError(db *gorm.DB, username *string) error {
+	if username != nil {
+		if taken, err := usernameTaken(db, *username); err == nil && taken {
+			return ErrUsernameTaken
+		}
+	}
+
+	return ErrEmailTaken
+}
+
+/*
+UpdatePassword hashes the new password and stores it for the user with the given id.
+Every token issued before the change is invalidated, as if InvalidateTokens was called,
+and MustChangePassword is cleared.
+
+With a model.PasswordHistorySize, the new password must differ from the current one and
+from the remembered previous ones. The replaced password is then remembered, and the
+history pruned to its size.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - id (int): the id of the User
+  - password (string): the new plaintext password
+
+Returns:
+
+  - error: if any error occurred while hashing or during the update, ErrPasswordReused if
+    the password has already been used
+*/
+func (s *UserService) UpdatePassword(ctx context.Context, id int, password string) error {
+	if model.PasswordHistorySize > 0 {
+		if err := s.rememberPassword(ctx, id, password); err != nil {
+			return err
+		}
+	}
+
+	// The password is hashed by the BeforeSave hook
+	return s.db.WithContext(ctx).Model(&model.User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"password":             password,
+		"tokens_valid_after":   tokensValidAfterNow(),
+		"must_change_password": false,
+		"updated_at":           time.Now(),
+	}).Error
+}
+
+// rememberPassword checks that password isn't reused, then moves the current password of the user to its history.
+func (s *UserService) rememberPassword(ctx context.Context, id int, password string) error {
+	db := s.db.WithContext(ctx)
+
+	var user model.User
+	err := db.Select("id", "password").First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var history []model.PasswordHistory
+	err = db.Where("user_id = ?", id).Order("id DESC").Limit(model.PasswordHistorySize).Find(&history).Error
+	if err != nil {
+		return err
+	}
+
+	if user.CheckPassword(password) == nil {
+		return ErrPasswordReused
+	}
+	for _, previous := range history {
+		if model.ComparePassword(previous.Hash, password) == nil {
+			return ErrPasswordReused
+		}
+	}
+
+	if err := db.Create(&model.PasswordHistory{UserId: id, Hash: user.Password}).Error; err != nil {
+		return err
+	}
+
+	// The entries older than the PasswordHistorySize newest ones are forgotten
+	var oldest []uint
+	err = db.Model(&model.PasswordHistory{}).Where("user_id = ?", id).Order("id DESC").Offset(model.PasswordHistorySize-1).Limit(1).Pluck("id", &oldest).Error
+	if err != nil || len(oldest) == 0 {
+		return err
+	}
+
+	return db.Where("user_id = ? AND id < ?", id, oldest[0]).Delete(&model.PasswordHistory{}).Error
+}
+
+/*
+RecordLogin stores the instant and the IP of a successful login of the user.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - id (int): the id of the User
+  - ip (string): the IP the user logged in from
+
+Returns:
+
+  - time.Time: the recorded login instant
+  - error: if any error occurred during the update
+*/
+func (s *UserService) RecordLogin(ctx context.Context, id int, ip string) (time.Time, error) {
+	now := time.Now()
+
+	// UpdateColumns leaves updated_at alone, a login doesn't modify the user
+	err := s.db.WithContext(ctx).Model(&model.User{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+		"last_login_at": now,
+		"last_login_ip": model.EncryptedString(ip),
+	}).Error
+
+	return now, err
+}
+
+/*
+RehashPassword replaces the stored hash of the user's password with one of the
+model.PasswordHasher, e.g. a bcrypt hash once PASSWORD_HASHER is argon2id. It is
+called on login, the only time the plaintext password is known, so that the hashes
+migrate gradually. The password itself doesn't change: the tokens, the history and
+updated_at are left alone.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - id (int): the id of the User
+  - password (string): the plaintext password, already checked against the stored hash
+
+Returns:
+
+  - error: if any error occurred while hashing or during the update
+*/
+func (s *UserService) RehashPassword(ctx context.Context, id int, password string) error {
+	hash, err := model.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	// UpdateColumn skips the hooks, the password is already hashed
+	return s.db.WithContext(ctx).Model(&model.User{}).Where("id = ?", id).UpdateColumn("password", hash).Error
+}
+
+/*
+SetMustChangePassword flags, or unflags, the user as having to change its password.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - id (int): the id of the User
+  - mustChange (bool): whether the user must change its password
+
+Returns:
+
+  - error: if any error occurred during the update
+*/
+func (s *UserService) SetMustChangePassword(ctx context.Context, id int, mustChange bool) error {
+	return s.db.WithContext(ctx).Model(&model.User{}).Where("id = ?", id).UpdateColumn("must_change_password", mustChange).Error
+}
+
+/*
+InvalidateTokens rejects every token issued to the user until now, jwt and refresh tokens,
+by bumping its TokensValidAfter. The stateless jwt can't be revoked one by one otherwise.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - id (int): the id of the User
+
+Returns:
+
+  - error: if any error occurred during the update
+*/
+func (s *UserService) InvalidateTokens(ctx context.Context, id int) error {
+	return s.db.WithContext(ctx).Model(&model.User{}).Where("id = ?", id).UpdateColumn("tokens_valid_after", tokensValidAfterNow()).Error
+}
+
+// tokensValidAfterNow is now truncated to the second, the precision of the iat claim. Otherwise a
+// token issued right after the invalidation, in the same second, would be rejected.
+func tokensValidAfterNow() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+/*
+FindOrCreateOAuthUser returns the user linked to the external account, linking it by email
+to an existing user or creating a new one if needed.
+
+The user is looked up by provider and external ID first, then by email. An existing user
+found by email gets linked to the account. A new user is created with UpsertByEmail, safe
+against concurrent logins of the same account, and gets a random password so that it can
+only log in through the provider until it sets one. Without create, ErrUserNotFound is
+returned instead of creating it.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - provider (string): the name of the OAuth provider
+  - providerID (string): the ID of the account at the provider
+  - email (string): the verified email of the account
+  - create (bool): whether a new user can be created, e.g. false when the public signup is closed
+
+Returns:
+
+  - (*model.User): the linked user
+  - bool: whether the user was created
+  - error: if any error occurred during the lookup or the creation, ErrEmailTaken if the email
+    is held by a deleted user
+*/
+func (s *UserService) FindOrCreateOAuthUser(ctx context.Context, provider, providerID, email string, create bool) (*model.User, bool, error) {
+	var user model.User
+	err := s.db.WithContext(ctx).Where("provider = ? AND provider_id = ?", provider, providerID).First(&user).Error
+	if err == nil {
+		return &user, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	var existing *model.User
+	created := false
+	if create {
+		existing, created, err = s.UpsertByEmail(ctx, email, nil)
+	} else {
+		existing, err = s.GetUserByEmail(ctx, model.NormalizeEmail(email))
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, ErrUserNotFound
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = s.db.WithContext(ctx).Model(existing).Updates(map[string]interface{}{
+		"provider":    provider,
+		"provider_id": providerID,
+	}).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	return existing, created, nil
+}
+
+/*
+DeleteUser soft deletes the user with the given id.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - id (int): the id of the User to delete
+
+Returns:
+
+  - error: if any error occurred during the deletion, ErrUserNotFound if there is no such user
+*/
+func (s *UserService) DeleteUser(ctx context.Context, id int) (err error) {
+	defer metrics.ObserveUserOperation("delete", time.Now(), &err)
+
+	result := s.db.WithContext(ctx).Delete(&model.User{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
 }
 
 /*
 UpdateUser updates a User with the given id in the UserService's database.
+Only the fields provided in data are written, the others are left unchanged.
 
 Parameters:
 
+  - ctx (context.Context): the context of the query
   - id (int): the id of the User to update
   - data (*model.UserUpdateDTO): a pointer to a UserUpdateDTO containing the data to update the User with
 
 Returns:
 
-  - error: if any error occurred during the update
+  - error: if any error occurred during the update, ErrUserNotFound if there is no such user,
+    ErrUsernameTaken if the username is used by another user
 */
-func (s *UserService) UpdateUser(id int, data *model.UserUpdateDTO) (*model.User, error) {
-	user, err := s.GetUser(id)
+func (s *UserService) UpdateUser(ctx context.Context, id int, data *model.UserUpdateDTO) (_ *model.User, err error) {
+	defer metrics.ObserveUserOperation("update", time.Now(), &err)
+
+	var user *model.User
+	user, err = s.GetUser(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	user.Email = data.Email
+	updates := data.Updates()
+	if len(updates) == 0 {
+		return user, nil
+	}
 
-	err = s.db.Save(&user).Error
+	err = s.db.WithContext(ctx).Model(user).Updates(updates).Error
+	// The username is the only unique column that can be updated
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrUsernameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetUser(ctx, id)
+}
+
+/*
+SetStatus changes the status of the user, e.g. to suspend it.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - id (int): the id of the User
+  - status (string): the new status, model.StatusActive, model.StatusSuspended or model.StatusPending
+
+Returns:
+
+  - *model.User: the updated user
+  - error: if any error occurred during the update, ErrUserNotFound if there is no such user
+*/
+func (s *UserService) SetStatus(ctx context.Context, id int, status string) (*model.User, error) {
+	err := s.db.WithContext(ctx).Model(&model.User{}).Where("id = ?", id).Update("status", status).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Reading the user back also reports a missing one, RowsAffected is 0 as well for an unchanged status
+	return s.GetUser(ctx, id)
+}
+
+/*
+SetPendingEmail stores the email the user wants to change to, until it is verified.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - id (int): the id of the User
+  - email (string): the new, not yet verified, email
+
+Returns:
+
+  - error: if any error occurred during the update, ErrUserNotFound if there is no such user
+*/
+func (s *UserService) SetPendingEmail(ctx context.Context, id int, email string) error {
+	result := s.db.WithContext(ctx).Model(&model.User{}).Where("id = ?", id).Update("pending_email", model.EncryptedString(email))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+/*
+ConfirmPendingEmail replaces the email of the user by its verified pending email.
+
+Parameters:
+
+  - ctx (context.Context): the context of the query
+  - id (int): the id of the User
+
+Returns:
+
+  - (*model.User): the updated user
+  - error: if any error occurred during the update, ErrEmailTaken if the email has been used by another user
+    in the meantime, ErrUserNotFound if there is no such user or no pending email
+*/
+func (s *UserService) ConfirmPendingEmail(ctx context.Context, id int) (*model.User, error) {
+	user, err := s.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if user.PendingEmail == "" {
+		return nil, ErrUserNotFound
+	}
+
+	err = s.db.WithContext(ctx).Model(user).Updates(map[string]interface{}{
+		"email":         string(user.PendingEmail),
+		"pending_email": "",
+	}).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrEmailTaken
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	return user, nil
 }
+
+/*
+ReencryptFields encrypts the encrypted columns of the users with the current key of the keyring:
+the values written in plaintext, before the encryption was configured, and the ones encrypted with
+a previous key. The previous keys can be removed from the keyring once it is done. The deleted
+users are re-encrypted too.
+
+Parameters:
+
+  - ctx (context.Context): the context of the queries
+  - keyring (*model.FieldKeyring): the keyring, usually model.FieldEncryption
+
+Returns:
+
+  - int: the number of re-encrypted users
+  - error: if any error occurred, including a value which can't be decrypted by the keyring
+*/
+func (s *UserService) ReencryptFields(ctx context.Context, keyring *model.FieldKeyring) (int, error) {
+	// The raw values, scanned as plain strings so that they aren't decrypted
+	var rows []struct {
+		ID           uint
+		LastLoginIP  string
+		PendingEmail string
+	}
+	reencrypted := 0
+	err := s.db.WithContext(ctx).Unscoped().Model(&model.User{}).Select("id", "last_login_ip", "pending_email").FindInBatches(&rows, 100, func(tx *gorm.DB, batch int) error {
+		for _, row := range rows {
+			if !keyring.Stale(row.LastLoginIP) && !keyring.Stale(row.PendingEmail) {
+				continue
+			}
+			lastLoginIP, err := reencrypt(keyring, row.LastLoginIP)
+			if err != nil {
+				return fmt.Errorf("last_login_ip of the user %d: %w", row.ID, err)
+			}
+			pendingEmail, err := reencrypt(keyring, row.PendingEmail)
+			if err != nil {
+				return fmt.Errorf("pending_email of the user %d: %w", row.ID, err)
+			}
+
+			// Already encrypted, by the given keyring rather than model.FieldEncryption. UpdateColumns
+			// leaves updated_at alone, the user isn't modified
+			err = s.db.WithContext(ctx).Unscoped().Model(&model.User{}).Where("id = ?", row.ID).UpdateColumns(map[string]interface{}{
+				"last_login_ip": lastLoginIP,
+				"pending_email": pendingEmail,
+			}).Error
+			if err != nil {
+				return err
+			}
+			reencrypted++
+		}
+
+		return nil
+	}).Error
+
+	return reencrypted, err
+}
+
+// reencrypt decrypts the stored value and encrypts it again with the current key, the empty values stay empty
+func reencrypt(keyring *model.FieldKeyring, value string) (string, error) {
+	plaintext, err := keyring.Decrypt(value)
+	if err != nil || plaintext == "" {
+		return plaintext, err
+	}
+
+	return keyring.Encrypt(plaintext)
+}
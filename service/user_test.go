@@ -0,0 +1,766 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/MohammadBnei/gorm-user-auth/testutil"
+	"gorm.io/gorm"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestCreateUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     *model.UserCreateDTO
+		wantErr  error
+		wantName *string
+	}{
+		{
+			name: "new user",
+			data: &model.UserCreateDTO{Email: "bob@example.com", Password: "password"},
+		},
+		{
+			name:     "username is normalized",
+			data:     &model.UserCreateDTO{Email: "bob@example.com", Password: "password", Username: ptr("  Bob ")},
+			wantName: ptr("bob"),
+		},
+		{
+			name: "email is normalized",
+			data: &model.UserCreateDTO{Email: " Bob@Example.com ", Password: "password"},
+		},
+		{
+			name: "empty username is none",
+			data: &model.UserCreateDTO{Email: "bob@example.com", Password: "password", Username: ptr(" ")},
+		},
+		{
+			name:    "duplicate email",
+			data:    &model.UserCreateDTO{Email: "alice@example.com", Password: "password"},
+			wantErr: ErrEmailTaken,
+		},
+		{
+			name:    "duplicate email in another case",
+			data:    &model.UserCreateDTO{Email: " Alice@Example.com", Password: "password"},
+			wantErr: ErrEmailTaken,
+		},
+		{
+			name:    "duplicate username",
+			data:    &model.UserCreateDTO{Email: "bob@example.com", Password: "password", Username: ptr("ALICE")},
+			wantErr: ErrUsernameTaken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testutil.NewDB(t)
+			testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com", Username: "alice"})
+			s := NewUserService(db)
+
+			user, err := s.CreateUser(context.Background(), tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateUser() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if user.ID == 0 {
+				t.Error("CreateUser() returned a user without ID")
+			}
+			if user.Email != model.NormalizeEmail(tt.data.Email) {
+				t.Errorf("Email = %q, want the normalized %q", user.Email, model.NormalizeEmail(tt.data.Email))
+			}
+			if err := user.CheckPassword(tt.data.Password); err != nil {
+				t.Errorf("the password of the created user doesn't match: %v", err)
+			}
+			if (user.Username == nil) != (tt.wantName == nil) || (user.Username != nil && *user.Username != *tt.wantName) {
+				t.Errorf("Username = %v, want %v", user.Username, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestUserCRUD(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.NewDB(t)
+	s := NewUserService(db)
+
+	created, err := s.CreateUser(ctx, &model.UserCreateDTO{Email: "alice@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	id := int(created.ID)
+
+	got, err := s.GetUser(ctx, id)
+	if err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	if got.Email != "alice@example.com" || got.Role != model.RoleUser || got.Status != model.StatusActive {
+		t.Errorf("GetUser() = %+v, want the created user with the default role and status", got)
+	}
+
+	updated, err := s.UpdateUser(ctx, id, &model.UserUpdateDTO{Role: ptr(model.RoleAdmin), Username: ptr("Alice")})
+	if err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if updated.Role != model.RoleAdmin || updated.Username == nil || *updated.Username != "alice" {
+		t.Errorf("UpdateUser() = %+v, want an admin named alice", updated)
+	}
+
+	// An empty username removes it
+	updated, err = s.UpdateUser(ctx, id, &model.UserUpdateDTO{Username: ptr("")})
+	if err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if updated.Username != nil {
+		t.Errorf("Username = %q, want none", *updated.Username)
+	}
+
+	if err := s.DeleteUser(ctx, id); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if _, err := s.GetUser(ctx, id); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetUser() after delete error = %v, want ErrUserNotFound", err)
+	}
+	if err := s.DeleteUser(ctx, id); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("DeleteUser() twice error = %v, want ErrUserNotFound", err)
+	}
+	if _, err := s.UpdateUser(ctx, id, &model.UserUpdateDTO{Role: ptr(model.RoleUser)}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("UpdateUser() after delete error = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestPasswordHashingHooks(t *testing.T) {
+	db := testutil.NewDB(t)
+	user := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com"})
+
+	tests := []struct {
+		name     string
+		password string
+		write    func(password string) error
+		// email is the one of the user written, alice by default
+		email string
+	}{
+		{"create", "created password", func(password string) error {
+			return db.Create(&model.User{Email: "bob@example.com", Password: password}).Error
+		}, "bob@example.com"},
+		{"save", "saved password", func(password string) error {
+			user.Password = password
+			return db.Save(user).Error
+		}, ""},
+		{"save unchanged", "saved password", func(string) error {
+			loaded := &model.User{}
+			if err := db.First(loaded, user.ID).Error; err != nil {
+				return err
+			}
+			return db.Save(loaded).Error
+		}, ""},
+		{"updates with a map", "map password", func(password string) error {
+			return db.Model(&model.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{"password": password}).Error
+		}, ""},
+		{"updates with a struct", "struct password", func(password string) error {
+			return db.Model(&model.User{Model: gorm.Model{ID: user.ID}}).Updates(&model.User{Password: password}).Error
+		}, ""},
+		{"update of a column", "column password", func(password string) error {
+			return db.Model(&model.User{Model: gorm.Model{ID: user.ID}}).Update("password", password).Error
+		}, ""},
+		{"update password", "new password", func(password string) error {
+			return NewUserService(db).UpdatePassword(context.Background(), int(user.ID), password)
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.write(tt.password); err != nil {
+				t.Fatal(err)
+			}
+
+			email := user.Email
+			if tt.email != "" {
+				email = tt.email
+			}
+			stored := &model.User{}
+			if err := db.Where("email = ?", email).First(stored).Error; err != nil {
+				t.Fatal(err)
+			}
+			if !model.IsPasswordHash(stored.Password) {
+				t.Fatalf("stored password %q isn't a bcrypt hash", stored.Password)
+			}
+			// A hash hashed again wouldn't match the password anymore
+			if err := stored.CheckPassword(tt.password); err != nil {
+				t.Errorf("CheckPassword(%q) error = %v", tt.password, err)
+			}
+		})
+	}
+}
+
+func TestUpdateUserUsernameTaken(t *testing.T) {
+	db := testutil.NewDB(t)
+	testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com", Username: "alice"})
+	bob := testutil.SeedUser(t, db, testutil.UserFixture{Email: "bob@example.com"})
+
+	_, err := NewUserService(db).UpdateUser(context.Background(), int(bob.ID), &model.UserUpdateDTO{Username: ptr(" Alice")})
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("UpdateUser() error = %v, want ErrUsernameTaken", err)
+	}
+}
+
+func TestUsernameAvailable(t *testing.T) {
+	db := testutil.NewDB(t)
+	testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com", Username: "alice"})
+	deleted := testutil.SeedUser(t, db, testutil.UserFixture{Email: "carol@example.com", Username: "carol"})
+	s := NewUserService(db)
+	if err := s.DeleteUser(context.Background(), int(deleted.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		want     bool
+	}{
+		{"alice", false},
+		{"bob", true},
+		// The soft deleted users still hold their username in the unique index
+		{"carol", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			got, err := s.UsernameAvailable(context.Background(), tt.username)
+			if err != nil {
+				t.Fatalf("UsernameAvailable() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("UsernameAvailable(%q) = %v, want %v", tt.username, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmailExists(t *testing.T) {
+	db := testutil.NewDB(t)
+	testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com"})
+	deleted := testutil.SeedUser(t, db, testutil.UserFixture{Email: "carol@example.com"})
+	s := NewUserService(db)
+	if err := s.DeleteUser(context.Background(), int(deleted.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"alice@example.com", true},
+		{"bob@example.com", false},
+		// The soft deleted users still hold their email in the unique index
+		{"carol@example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			got, err := s.EmailExists(context.Background(), tt.email)
+			if err != nil {
+				t.Fatalf("EmailExists() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("EmailExists(%q) = %v, want %v", tt.email, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeedAdmin(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing are the users there before seeding
+		existing    []testutil.UserFixture
+		email       string
+		wantCreated bool
+		wantErr     error
+	}{
+		{"no user", nil, "root@example.com", true, nil},
+		{"no admin", []testutil.UserFixture{{Email: "alice@example.com"}}, " Root@Example.com", true, nil},
+		{"admin already seeded", []testutil.UserFixture{{Email: "root@example.com", Role: model.RoleAdmin}}, "root@example.com", false, nil},
+		{"another admin", []testutil.UserFixture{{Email: "bob@example.com", Role: model.RoleAdmin}}, "root@example.com", false, nil},
+		{"email of a user", []testutil.UserFixture{{Email: "root@example.com"}}, "root@example.com", false, ErrEmailTaken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testutil.NewDB(t)
+			for _, fixture := range tt.existing {
+				testutil.SeedUser(t, db, fixture)
+			}
+			s := NewUserService(db)
+
+			admin, err := s.SeedAdmin(context.Background(), tt.email, "sup3rs3cret")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SeedAdmin() error = %v, want %v", err, tt.wantErr)
+			}
+			if created := admin != nil; created != tt.wantCreated {
+				t.Fatalf("SeedAdmin() created = %v, want %v", created, tt.wantCreated)
+			}
+			if !tt.wantCreated {
+				return
+			}
+
+			stored, err := s.GetUserByEmail(context.Background(), "root@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stored.IsAdmin() {
+				t.Errorf("seeded role = %q, want admin", stored.Role)
+			}
+			if err := stored.CheckPassword("sup3rs3cret"); err != nil {
+				t.Errorf("CheckPassword() error = %v", err)
+			}
+
+			// The next startups leave it alone
+			if again, err := s.SeedAdmin(context.Background(), tt.email, "another password"); err != nil || again != nil {
+				t.Errorf("second SeedAdmin() = %v, %v, want nothing created", again, err)
+			}
+		})
+	}
+}
+
+func TestGetUserByIdentifier(t *testing.T) {
+	db := testutil.NewDB(t)
+	alice := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com", Username: "alice"})
+	bob := testutil.SeedUser(t, db, testutil.UserFixture{Email: "bob@example.com"})
+	s := NewUserService(db)
+
+	tests := []struct {
+		identifier string
+		wantID     uint
+	}{
+		{"alice@example.com", alice.ID},
+		{"alice", alice.ID},
+		{"ALICE ", alice.ID},
+		{"bob@example.com", bob.ID},
+		{"bob", 0},
+		{"nobody@example.com", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.identifier, func(t *testing.T) {
+			user, err := s.GetUserByIdentifier(context.Background(), tt.identifier)
+			if tt.wantID == 0 {
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					t.Errorf("GetUserByIdentifier(%q) error = %v, want gorm.ErrRecordNotFound", tt.identifier, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetUserByIdentifier(%q) error = %v", tt.identifier, err)
+			}
+			if user.ID != tt.wantID {
+				t.Errorf("GetUserByIdentifier(%q) = user %d, want %d", tt.identifier, user.ID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	db := testutil.NewDB(t)
+	s := NewUserService(db)
+	ctx := context.Background()
+	seed := func(email string) *model.User {
+		return testutil.SeedUser(t, db, testutil.UserFixture{Email: email})
+	}
+	first := seed("user1@example.com")
+	for i := 2; i <= 5; i++ {
+		seed(fmt.Sprintf("user%d@example.com", i))
+	}
+
+	page, next, err := s.ListUsers(ctx, nil, model.CursorOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[uint]bool{}
+	for _, user := range page {
+		seen[user.ID] = true
+	}
+
+	// The rows change between two pages: an offset would repeat user3 after the deletion
+	if err := s.DeleteUser(ctx, int(first.ID)); err != nil {
+		t.Fatal(err)
+	}
+	created := seed("user6@example.com")
+
+	for next != 0 {
+		page, next, err = s.ListUsers(ctx, nil, model.CursorOptions{AfterID: next, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range page {
+			if seen[user.ID] {
+				t.Errorf("user %d listed twice", user.ID)
+			}
+			seen[user.ID] = true
+		}
+	}
+
+	if len(seen) != 6 || !seen[created.ID] {
+		t.Errorf("listed users %v, want the 5 first ones and the one created meanwhile", seen)
+	}
+
+	// The last page has no next cursor, even when it is full
+	page, next, err = s.ListUsers(ctx, nil, model.CursorOptions{AfterID: created.ID - 2, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || next != 0 {
+		t.Errorf("ListUsers() of the last page = %d users and next %d, want 2 and 0", len(page), next)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	db := testutil.NewDB(t)
+	for _, email := range []string{"alice@example.com", "ALICE.b@example.com", "bob@example.com", "under_score@example.com", "underXscore@example.com"} {
+		testutil.SeedUser(t, db, testutil.UserFixture{Email: email})
+	}
+	s := NewUserService(db)
+
+	tests := []struct {
+		name      string
+		q         string
+		opts      model.PageOptions
+		wantTotal int64
+		wantLen   int
+	}{
+		{"case insensitive", "alice", model.PageOptions{Limit: 10}, 2, 2},
+		{"paginated", "example", model.PageOptions{Limit: 2, Offset: 4}, 5, 1},
+		{"wildcards matched literally", "under_", model.PageOptions{Limit: 10}, 1, 1},
+		{"no match", "nobody", model.PageOptions{Limit: 10}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, total, err := s.SearchUsers(context.Background(), tt.q, tt.opts, nil)
+			if err != nil {
+				t.Fatalf("SearchUsers() error = %v", err)
+			}
+			if total != tt.wantTotal || len(users) != tt.wantLen {
+				t.Errorf("SearchUsers() = %d users, total %d, want %d users, total %d", len(users), total, tt.wantLen, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestGetUsersByIDs(t *testing.T) {
+	db := testutil.NewDB(t)
+	org := model.Organization{Name: "acme"}
+	if err := db.Create(&org).Error; err != nil {
+		t.Fatal(err)
+	}
+	alice := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com"})
+	bob := testutil.SeedUser(t, db, testutil.UserFixture{Email: "bob@example.com"})
+	carol := testutil.SeedUser(t, db, testutil.UserFixture{Email: "carol@example.com", OrgID: &org.ID})
+	s := NewUserService(db)
+
+	tests := []struct {
+		name  string
+		ids   []int
+		scope *model.OrgScope
+		want  []uint
+	}{
+		{"requested order", []int{int(bob.ID), int(alice.ID)}, nil, []uint{bob.ID, alice.ID}},
+		{"missing ids left out", []int{int(alice.ID), 9999}, nil, []uint{alice.ID}},
+		{"other organization left out", []int{int(alice.ID), int(carol.ID)}, &model.OrgScope{}, []uint{alice.ID}},
+		{"organization scope", []int{int(alice.ID), int(carol.ID)}, &model.OrgScope{OrgID: &org.ID}, []uint{carol.ID}},
+		{"no ids", nil, nil, []uint{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := s.GetUsersByIDs(context.Background(), tt.ids, tt.scope)
+			if err != nil {
+				t.Fatalf("GetUsersByIDs() error = %v", err)
+			}
+			got := []uint{}
+			for _, user := range users {
+				got = append(got, user.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("GetUsersByIDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindOrCreateOAuthUser(t *testing.T) {
+	db := testutil.NewDB(t)
+	alice := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com"})
+	s := NewUserService(db)
+	ctx := context.Background()
+
+	// Existing users are linked whether or not new ones can be created
+	user, created, err := s.FindOrCreateOAuthUser(ctx, "github", "1", "alice@example.com", false)
+	if err != nil || user.ID != alice.ID || created {
+		t.Fatalf("FindOrCreateOAuthUser() = %v, %v, %v, want alice linked", user, created, err)
+	}
+	if user, _, err = s.FindOrCreateOAuthUser(ctx, "github", "1", "other@example.com", false); err != nil || user.ID != alice.ID {
+		t.Fatalf("FindOrCreateOAuthUser() = %v, %v, want alice found by provider ID", user, err)
+	}
+
+	if _, _, err := s.FindOrCreateOAuthUser(ctx, "github", "2", "bob@example.com", false); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("FindOrCreateOAuthUser() error = %v, want ErrUserNotFound without create", err)
+	}
+	bob, created, err := s.FindOrCreateOAuthUser(ctx, "github", "2", "bob@example.com", true)
+	if err != nil || bob.Email != "bob@example.com" || !created {
+		t.Errorf("FindOrCreateOAuthUser() = %v, %v, %v, want bob created", bob, created, err)
+	}
+	if user, created, err = s.FindOrCreateOAuthUser(ctx, "github", "2", "bob@example.com", true); err != nil || user.ID != bob.ID || created {
+		t.Errorf("FindOrCreateOAuthUser() = %v, %v, %v, want bob found", user, created, err)
+	}
+}
+
+func TestUpsertByEmail(t *testing.T) {
+	db := testutil.NewDB(t)
+	alice := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com", Username: "alice"})
+	deleted := testutil.SeedUser(t, db, testutil.UserFixture{Email: "deleted@example.com"})
+	s := NewUserService(db)
+	ctx := context.Background()
+	if err := s.DeleteUser(ctx, int(deleted.ID)); err != nil {
+		t.Fatal(err)
+	}
+	// A signup and an OAuth login of the same email find the same user
+	signedUp, err := s.CreateUser(ctx, &model.UserCreateDTO{Email: "Erin@Example.com", Password: "erin password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		email       string
+		defaults    *model.UserCreateDTO
+		wantID      uint
+		wantCreated bool
+		wantErr     error
+	}{
+		{"existing user", " Alice@Example.com ", &model.UserCreateDTO{Password: "ignored"}, alice.ID, false, nil},
+		{"user created by signup", "erin@example.com", nil, signedUp.ID, false, nil},
+		{"new user", "Bob@example.com", &model.UserCreateDTO{Password: "bob password", Username: ptr("Bob")}, 0, true, nil},
+		{"new user without defaults", "carol@example.com", nil, 0, true, nil},
+		{"username taken", "dave@example.com", &model.UserCreateDTO{Username: ptr("alice")}, 0, false, ErrUsernameTaken},
+		{"email of a deleted user", "deleted@example.com", nil, 0, false, ErrEmailTaken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, created, err := s.UpsertByEmail(ctx, tt.email, tt.defaults)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UpsertByEmail() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if created != tt.wantCreated || tt.wantID != 0 && user.ID != tt.wantID || user.Email != model.NormalizeEmail(tt.email) {
+				t.Errorf("UpsertByEmail() = %+v, created %v, want user %d created %v", user, created, tt.wantID, tt.wantCreated)
+			}
+			// The password of a new user is its default one, or a random one
+			if tt.defaults != nil && tt.defaults.Password != "" && created && user.CheckPassword(tt.defaults.Password) != nil {
+				t.Errorf("UpsertByEmail() created a user without the default password")
+			}
+		})
+	}
+}
+
+func TestCreateUsers(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []*model.UserCreateDTO
+		allOrNothing bool
+		wantErr      error
+		wantErrs     []error
+		wantCreated  []bool
+	}{
+		{
+			name:         "valid",
+			data:         []*model.UserCreateDTO{{Email: "alice@example.com", Password: "alice password"}},
+			allOrNothing: true,
+			wantErrs:     []error{nil},
+			wantCreated:  []bool{true},
+		},
+		{
+			name:        "null record best effort",
+			data:        []*model.UserCreateDTO{nil, {Email: "alice@example.com", Password: "alice password"}},
+			wantErrs:    []error{ErrUserRequired, nil},
+			wantCreated: []bool{false, true},
+		},
+		{
+			name:         "null record all or nothing",
+			data:         []*model.UserCreateDTO{nil, {Email: "alice@example.com", Password: "alice password"}},
+			allOrNothing: true,
+			wantErr:      ErrImportRolledBack,
+			wantErrs:     []error{ErrUserRequired, nil},
+			wantCreated:  []bool{false, false},
+		},
+		{
+			name:        "duplicated email best effort",
+			data:        []*model.UserCreateDTO{{Email: "alice@example.com", Password: "alice password"}, {Email: "Alice@Example.com", Password: "alice password"}},
+			wantErrs:    []error{nil, ErrEmailTaken},
+			wantCreated: []bool{true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewUserService(testutil.NewDB(t))
+
+			users, errs, err := s.CreateUsers(context.Background(), tt.data, tt.allOrNothing)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateUsers() error = %v, want %v", err, tt.wantErr)
+			}
+			for i := range tt.data {
+				if !errors.Is(errs[i], tt.wantErrs[i]) {
+					t.Errorf("CreateUsers() errs[%d] = %v, want %v", i, errs[i], tt.wantErrs[i])
+				}
+				if created := users[i] != nil; created != tt.wantCreated[i] {
+					t.Errorf("CreateUsers() users[%d] = %+v, want created %v", i, users[i], tt.wantCreated[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUpsertByEmailConcurrently(t *testing.T) {
+	db := testutil.NewDB(t)
+	s := NewUserService(db)
+
+	const upserts = 8
+	users := make([]*model.User, upserts)
+	created := make([]bool, upserts)
+	errs := make([]error, upserts)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			users[i], created[i], errs[i] = s.UpsertByEmail(context.Background(), "alice@example.com", &model.UserCreateDTO{Password: "password"})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	creations := 0
+	for i := range users {
+		if errs[i] != nil {
+			t.Fatalf("UpsertByEmail() error = %v", errs[i])
+		}
+		if users[i].ID != users[0].ID {
+			t.Errorf("UpsertByEmail() = user %d, want the same user %d for every upsert", users[i].ID, users[0].ID)
+		}
+		if created[i] {
+			creations++
+		}
+	}
+	if creations != 1 {
+		t.Errorf("%d upserts created the user, want 1", creations)
+	}
+	var count int64
+	db.Model(&model.User{}).Where("email = ?", "alice@example.com").Count(&count)
+	if count != 1 {
+		t.Errorf("%d users with the email, want 1", count)
+	}
+
+	// The database may serialize the upserts above, this one loses the race for sure: another
+	// upsert creates the user between its lookup and its insert
+	var bob *model.User
+	err := db.Callback().Create().Before("gorm:create").Register("test:concurrent_upsert", func(tx *gorm.DB) {
+		if user, ok := tx.Statement.Dest.(*model.User); ok && user.Email == "bob@example.com" && bob == nil {
+			bob = &model.User{Email: "bob@example.com", Password: "password"}
+			// Outside of the transaction of the insert, which is rolled back
+			if err := db.Create(bob).Error; err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, bobCreated, err := s.UpsertByEmail(context.Background(), "bob@example.com", nil)
+	if err != nil || bobCreated || bob == nil || user.ID != bob.ID {
+		t.Errorf("UpsertByEmail() = %v, %v, %v, want bob created by the other upsert", user, bobCreated, err)
+	}
+}
+
+func TestFieldEncryption(t *testing.T) {
+	db := testutil.NewDB(t)
+	s := NewUserService(db)
+	ctx := context.Background()
+	alice := testutil.SeedUser(t, db, testutil.UserFixture{Email: "alice@example.com"})
+	bob := testutil.SeedUser(t, db, testutil.UserFixture{Email: "bob@example.com"})
+	t.Cleanup(func() { model.FieldEncryption = nil })
+
+	// raw reads the stored columns, without decrypting them
+	raw := func(id uint) (lastLoginIP, pendingEmail, email string) {
+		t.Helper()
+		row := db.Raw("SELECT last_login_ip, pending_email, email FROM users WHERE id = ?", id).Row()
+		if err := row.Scan(&lastLoginIP, &pendingEmail, &email); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// Bob logged in before the encryption was configured
+	if _, err := s.RecordLogin(ctx, int(bob.ID), "198.51.100.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	firstKey := []byte("0123456789abcdef0123456789abcdef")
+	keyring, err := model.NewFieldKeyring("1", map[string][]byte{"1": firstKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	model.FieldEncryption = keyring
+	if _, err := s.RecordLogin(ctx, int(alice.ID), "203.0.113.7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPendingEmail(ctx, int(alice.ID), "alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	lastLoginIP, pendingEmail, _ := raw(alice.ID)
+	if !strings.HasPrefix(lastLoginIP, "enc:1:") || !strings.HasPrefix(pendingEmail, "enc:1:") {
+		t.Fatalf("stored last_login_ip = %q and pending_email = %q, want ciphertexts", lastLoginIP, pendingEmail)
+	}
+
+	got, err := s.GetUser(ctx, int(alice.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LastLoginIP != "203.0.113.7" || got.PendingEmail != "alice@example.org" {
+		t.Errorf("GetUser() = %q and %q, want the decrypted values", got.LastLoginIP, got.PendingEmail)
+	}
+	if got, err := s.GetUser(ctx, int(bob.ID)); err != nil || got.LastLoginIP != "198.51.100.1" {
+		t.Errorf("GetUser() of the plaintext user = %+v, %v, want its IP", got, err)
+	}
+
+	// The rotation re-encrypts the old values and the plaintext ones with the new key
+	keyring, err = model.NewFieldKeyring("2", map[string][]byte{"1": firstKey, "2": []byte("fedcba9876543210")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	model.FieldEncryption = keyring
+	count, err := s.ReencryptFields(ctx, keyring)
+	if err != nil || count != 2 {
+		t.Fatalf("ReencryptFields() = %d, %v, want 2 users", count, err)
+	}
+	for _, user := range []*model.User{alice, bob} {
+		if lastLoginIP, _, _ := raw(user.ID); !strings.HasPrefix(lastLoginIP, "enc:2:") {
+			t.Errorf("stored last_login_ip of %s = %q, want a ciphertext of the new key", user.Email, lastLoginIP)
+		}
+	}
+	if count, err := s.ReencryptFields(ctx, keyring); err != nil || count != 0 {
+		t.Errorf("ReencryptFields() again = %d, %v, want nothing left", count, err)
+	}
+
+	// The confirmed email is decrypted, the email column isn't encrypted
+	if _, err := s.ConfirmPendingEmail(ctx, int(alice.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if _, pendingEmail, email := raw(alice.ID); email != "alice@example.org" || pendingEmail != "" {
+		t.Errorf("stored email = %q and pending_email = %q, want the plaintext email and no pending one", email, pendingEmail)
+	}
+}
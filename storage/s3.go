@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	s3Service   = "s3"
+	// s3DateFormat is the ISO 8601 basic format of x-amz-date
+	s3DateFormat = "20060102T150405Z"
+)
+
+// S3Storage stores the files in a bucket of an S3-compatible service, the requests being signed
+// with AWS Signature Version 4. The bucket is addressed with path-style URLs,
+// Endpoint/Bucket/key, which every S3-compatible service supports.
+type S3Storage struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// BaseURL is the public URL of the files, the bucket URL when empty
+	BaseURL string
+
+	client *http.Client
+	now    func() time.Time
+}
+
+/*
+NewS3Storage returns a Storage uploading the files to bucket. The files must be readable
+through baseURL, with a public bucket policy or a CDN in front of it.
+
+Parameters:
+- endpoint (string): The URL of the S3 service, e.g. https://s3.eu-west-3.amazonaws.com.
+- region (string): The region of the bucket, e.g. us-east-1.
+- bucket (string): The bucket name.
+- accessKey (string): The access key ID.
+- secretKey (string): The secret access key.
+- baseURL (string): The public URL of the files, the bucket URL when empty.
+
+Returns:
+- (*S3Storage): A pointer to the newly created S3Storage instance.
+*/
+func NewS3Storage(endpoint, region, bucket, accessKey, secretKey, baseURL string) *S3Storage {
+	return &S3Storage{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		BaseURL:   baseURL,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		now:       time.Now,
+	}
+}
+
+func (s *S3Storage) Put(ctx context.Context, key, contentType string, content []byte) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	return s.do(req, content)
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	// S3 answers a missing object with a 204 too
+	return s.do(req, nil)
+}
+
+func (s *S3Storage) URL(key string) string {
+	if s.BaseURL != "" {
+		return joinURL(s.BaseURL, key)
+	}
+
+	return s.objectURL(key)
+}
+
+// objectURL returns the path-style URL of the object of key.
+func (s *S3Storage) objectURL(key string) string {
+	return s.Endpoint + "/" + uriEncode(s.Bucket, false) + "/" + uriEncode(key, true)
+}
+
+// do signs and sends the request, any status but a 2xx is an error.
+func (s *S3Storage) do(req *http.Request, payload []byte) error {
+	s.sign(req, payload, s.now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		// The body is an XML error document, e.g. <Code>AccessDenied</Code>
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, res.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+// sign sets the x-amz-date, x-amz-content-sha256 and Authorization headers of the request,
+// signing the host and every header already set.
+func (s *S3Storage) sign(req *http.Request, payload []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3DateFormat)
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	date := now.Format("20060102")
+	scope := date + "/" + s.Region + "/" + s3Service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	for _, part := range []string{s.Region, s3Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", s3Algorithm+" Credential="+s.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode percent-encodes every byte but the unreserved characters, and the slashes when keepSlash is set,
+// as the canonical requests expect.
+func uriEncode(value string, keepSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && keepSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return encoded.String()
+}
@@ -0,0 +1,194 @@
+// Package storage stores the uploaded files, e.g. the avatars, on the local disk or in an S3-compatible bucket.
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidKey is returned for a key which is empty, absolute or escaping its directory with ".."
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// Storage stores the files under slash separated keys, e.g. "avatars/1.png". Implement it to plug any
+// other backend (GCS, Azure...).
+type Storage interface {
+	// Put stores the content under key, replacing any previous one
+	Put(ctx context.Context, key, contentType string, content []byte) error
+	// Delete removes the file of key, a missing one isn't an error
+	Delete(ctx context.Context, key string) error
+	// URL returns the public URL of the file of key
+	URL(key string) string
+}
+
+// validKey reports whether key is a relative slash separated path staying in its directory.
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// joinURL appends key to the base URL.
+func joinURL(baseURL, key string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + key
+}
+
+// LocalStorage stores the files in a directory, served by the application under BaseURL.
+type LocalStorage struct {
+	Dir     string
+	BaseURL string
+}
+
+/*
+NewLocalStorage returns a Storage writing the files under dir. The directories are created
+when needed.
+
+Parameters:
+- dir (string): The root directory of the files.
+- baseURL (string): The URL dir is served on, e.g. /uploads.
+
+Returns:
+- (*LocalStorage): A pointer to the newly created LocalStorage instance.
+*/
+func NewLocalStorage(dir, baseURL string) *LocalStorage {
+	return &LocalStorage{
+		Dir:     dir,
+		BaseURL: baseURL,
+	}
+}
+
+func (s *LocalStorage) Put(_ context.Context, key, _ string, content []byte) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	path := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Written aside then renamed, a file being served is never seen half written
+	file, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func (s *LocalStorage) Delete(_ context.Context, key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	err := os.Remove(filepath.Join(s.Dir, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *LocalStorage) URL(key string) string {
+	return joinURL(s.BaseURL, key)
+}
+
+// Object is a file kept by a MemoryStorage.
+type Object struct {
+	ContentType string
+	Content     []byte
+}
+
+// MemoryStorage keeps the files in memory, for development and tests.
+type MemoryStorage struct {
+	BaseURL string
+
+	mu      sync.Mutex
+	objects map[string]Object
+}
+
+/*
+NewMemoryStorage returns a Storage keeping the files in memory, they are lost on restart.
+
+Parameters:
+- baseURL (string): The base URL of the files.
+
+Returns:
+- (*MemoryStorage): A pointer to the newly created MemoryStorage instance.
+*/
+func NewMemoryStorage(baseURL string) *MemoryStorage {
+	return &MemoryStorage{
+		BaseURL: baseURL,
+		objects: map[string]Object{},
+	}
+}
+
+func (s *MemoryStorage) Put(_ context.Context, key, contentType string, content []byte) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = Object{ContentType: contentType, Content: append([]byte(nil), content...)}
+
+	return nil
+}
+
+func (s *MemoryStorage) Delete(_ context.Context, key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+
+	return nil
+}
+
+func (s *MemoryStorage) URL(key string) string {
+	return joinURL(s.BaseURL, key)
+}
+
+// Get returns the file of key, false if there is none.
+func (s *MemoryStorage) Get(key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[key]
+
+	return object, ok
+}
+
+// Keys returns the keys of the stored files, in no particular order.
+func (s *MemoryStorage) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
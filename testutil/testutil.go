@@ -0,0 +1,245 @@
+/*
+Package testutil is the harness of the tests: an in-memory SQLite database migrated like the
+real one, fixtures seeding it, and helpers sending JSON requests to a gin engine.
+
+	db := testutil.NewDB(t)
+	admin := testutil.SeedUser(t, db, testutil.UserFixture{Email: "admin@example.com", Role: model.RoleAdmin})
+
+	w := testutil.Do(router, testutil.JSONRequest(t, "POST", "/api/v1/auth/login", body))
+*/
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MohammadBnei/gorm-user-auth/config"
+	"github.com/MohammadBnei/gorm-user-auth/model"
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DefaultPassword is the password of the seeded users that don't set one
+const DefaultPassword = "sup3rs3cret"
+
+// JWTSecret signs the tokens of the test Config
+const JWTSecret = "test-secret-at-least-32-bytes-long!"
+
+var dbCount atomic.Int64
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	// The default cost makes every seeded user take tens of milliseconds
+	model.BcryptCost = bcrypt.MinCost
+}
+
+/*
+NewDB opens a new in-memory SQLite database, private to the test, and migrates every model
+into it. It is closed when the test ends.
+
+Parameters:
+  - t (testing.TB): the test owning the database.
+
+Returns:
+  - (*gorm.DB): the migrated database.
+*/
+func NewDB(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	// A named shared cache lets the connections of the pool see the same database, a plain
+	// :memory: one would give each connection its own
+	dsn := fmt.Sprintf("file:testdb%d?mode=memory&cache=shared&_pragma=foreign_keys(1)", dbCount.Add(1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		TranslateError: true,
+		Logger:         logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("failed to open the test database: %v", err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get the test database: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(model.Models()...); err != nil {
+		t.Fatalf("failed to migrate the test database: %v", err)
+	}
+
+	return db
+}
+
+/*
+Config returns a valid configuration for the tests, with the defaults of config.InitConfig
+and no external service. Tests change the fields they need on the returned copy.
+
+Returns:
+  - (*config.Config): the test configuration.
+*/
+func Config() *config.Config {
+	return &config.Config{
+		JWT_SECRET:             JWTSecret,
+		LOG_LEVEL:              "error",
+		ENV:                    config.EnvProduction,
+		PASSWORD_HASHER:        config.PasswordHasherBcrypt,
+		BCRYPT_COST:            bcrypt.MinCost,
+		ARGON2_MEMORY:          19 * 1024,
+		ARGON2_ITERATIONS:      2,
+		ARGON2_PARALLELISM:     1,
+		RT_SESSION_EXPIRY:      24 * time.Hour,
+		RT_REMEMBER_ME_EXPIRY:  30 * 24 * time.Hour,
+		SESSION_LIMIT_POLICY:   config.SessionLimitEvictOldest,
+		TOKEN_SOURCES:          []string{config.TokenSourceCookie, config.TokenSourceHeader},
+		TOKEN_IN_BODY:          true,
+		LOGIN_RESPONSE_USER:    true,
+		SWAGGER_ENABLED:        true,
+		MAX_BODY_BYTES:         1 << 20,
+		STORAGE_DRIVER:         config.StorageLocal,
+		STORAGE_LOCAL_DIR:      "uploads",
+		S3_REGION:              "us-east-1",
+		AVATAR_MAX_BYTES:       2 << 20,
+		CSRF_ENABLED:           true,
+		REGISTRATION_ENABLED:   true,
+		DEFAULT_ROLE:           model.RoleUser,
+		INVITATION_TTL:         7 * 24 * time.Hour,
+		RESET_TOKEN_TTL:        time.Hour,
+		VERIFY_TOKEN_TTL:       24 * time.Hour,
+		CHECK_EMAIL_RATE_LIMIT: 10,
+		PASSWORD_CHANGE_GATE:   true,
+		COOKIE_PATH:            "/",
+		COOKIE_SAMESITE:        config.CookieSameSiteLax,
+		COMPRESSION_MIN_SIZE:   1024,
+		REQUEST_TIMEOUT:        30 * time.Second,
+		USER_BATCH_MAX:         100,
+		APP_URL:                "http://localhost:8080",
+	}
+}
+
+// UserFixture describes a user to seed. Its zero fields get a default value.
+type UserFixture struct {
+	Email string
+	// Password defaults to DefaultPassword
+	Password string
+	// Role defaults to model.RoleUser
+	Role string
+	// Status defaults to model.StatusActive
+	Status   string
+	Username string
+	OrgID    *uint
+}
+
+/*
+SeedUser inserts the user described by the fixture, its password hashed like on signup.
+
+Parameters:
+  - t (testing.TB): the test seeding the user.
+  - db (*gorm.DB): the database of the test.
+  - fixture (UserFixture): the user to insert.
+
+Returns:
+  - (*model.User): the inserted user, with its ID and hashed password.
+*/
+func SeedUser(t testing.TB, db *gorm.DB, fixture UserFixture) *model.User {
+	t.Helper()
+
+	user := &model.User{
+		Email:    fixture.Email,
+		Password: fixture.Password,
+		Role:     fixture.Role,
+		Status:   fixture.Status,
+		OrgID:    fixture.OrgID,
+	}
+	if user.Password == "" {
+		user.Password = DefaultPassword
+	}
+	if user.Role == "" {
+		user.Role = model.RoleUser
+	}
+	if user.Status == "" {
+		user.Status = model.StatusActive
+	}
+	if fixture.Username != "" {
+		username := model.NormalizeUsername(fixture.Username)
+		user.Username = &username
+	}
+
+	if err := db.Create(user).Error; err != nil {
+		t.Fatalf("failed to seed user %s: %v", fixture.Email, err)
+	}
+
+	return user
+}
+
+/*
+JSONRequest builds a request with body serialized as JSON. A nil body sends no body, a
+string or []byte one is sent as is, e.g. to send malformed JSON.
+
+Parameters:
+  - t (testing.TB): the test sending the request.
+  - method (string): the HTTP method.
+  - path (string): the path, with its query string.
+  - body (any): the body, serialized with encoding/json.
+
+Returns:
+  - (*http.Request): the request, with its Content-Type set to application/json.
+*/
+func JSONRequest(t testing.TB, method, path string, body any) *http.Request {
+	t.Helper()
+
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = bytes.NewBufferString(b)
+	case []byte:
+		reader = bytes.NewBuffer(b)
+	default:
+		raw, err := json.Marshal(b)
+		if err != nil {
+			t.Fatalf("failed to serialize the request body: %v", err)
+		}
+		reader = bytes.NewBuffer(raw)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return req
+}
+
+// WithBearer sets the token of the request's Authorization header and returns the request.
+func WithBearer(req *http.Request, token string) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return req
+}
+
+// Do serves the request with handler and returns the recorded response.
+func Do(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+// DecodeJSON decodes the body of the recorded response into v, failing the test if it isn't valid JSON.
+func DecodeJSON(t testing.TB, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Package tokenutil generates and verifies opaque, HMAC signed and time limited tokens, e.g.
+for the links sent by email. The token carries its payload, so verifying it needs no
+database lookup:
+
+	signer := tokenutil.NewSigner(key)
+	token, err := signer.Sign(tokenutil.Payload{UserID: user.ID, Purpose: "password_reset"}, time.Hour, user.Password)
+	payload, err := signer.Verify(token, "password_reset")
+	if err == nil && payload.BoundTo(user.Password) { ... }
+
+A token can't be revoked, it is only invalidated by its expiry, or by a change of the state
+it is bound to: a password reset token bound to the password hash stops verifying once the
+password is changed. Each token has a random ID, which the caller records once the token is
+used to make it strictly single use, even against concurrent requests.
+*/
+package tokenutil
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned by Verify for a malformed or tampered token, or one issued for another purpose
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned by Verify for a valid but expired token
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Payload is the data carried by a token.
+type Payload struct {
+	// ID is set by Sign, unique to the token
+	ID      string `json:"jti"`
+	UserID  uint   `json:"uid"`
+	Purpose string `json:"purpose"`
+	// ExpiresAt is set by Sign, in seconds since the epoch
+	ExpiresAt int64 `json:"exp"`
+	// State is the digest of the state the token was bound to by Sign, see BoundTo
+	State string `json:"state,omitempty"`
+}
+
+// BoundTo reports whether the token was signed for this state, i.e. whether the state hasn't changed since.
+func (p *Payload) BoundTo(state string) bool {
+	return hmac.Equal([]byte(p.State), []byte(stateDigest(state)))
+}
+
+// Signer signs and verifies the tokens with an HMAC-SHA256 key.
+type Signer struct {
+	key []byte
+}
+
+/*
+NewSigner returns a Signer using key.
+
+Parameters:
+- key (string): The HMAC key, at least 32 bytes long, shared by every instance verifying the tokens.
+
+Returns:
+- (*Signer): A pointer to the newly created Signer instance.
+*/
+func NewSigner(key string) *Signer {
+	return &Signer{key: []byte(key)}
+}
+
+/*
+Sign returns the token of the payload, valid for ttl.
+
+Parameters:
+- payload (Payload): The user and purpose of the token, its ID is random, its ExpiresAt and State are set from ttl and state.
+- ttl (time.Duration): The lifetime of the token.
+- state (string): The state the token is bound to, e.g. the password hash, checked with Payload.BoundTo. Empty for none.
+
+Returns:
+- (string): The token, URL safe.
+- (error): An error if the ID couldn't be generated or the payload serialized.
+*/
+func (s *Signer) Sign(payload Payload, ttl time.Duration, state string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	payload.ID = base64.RawURLEncoding.EncodeToString(id)
+	payload.ExpiresAt = time.Now().Add(ttl).Unix()
+	payload.State = ""
+	if state != "" {
+		payload.State = stateDigest(state)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded)), nil
+}
+
+/*
+Verify checks the signature and the expiry of the token, and that it was issued for the purpose.
+
+Parameters:
+- token (string): The token, as returned by Sign.
+- purpose (string): The purpose the token must have been issued for.
+
+Returns:
+- (*Payload): The payload of the token.
+- (error): ErrInvalidToken if the token is malformed, tampered or for another purpose, ErrTokenExpired if it has expired.
+*/
+func (s *Signer) Verify(token, purpose string) (*Payload, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.mac(encoded)) {
+		return nil, ErrInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var payload Payload
+	if err := json.Unmarshal(data, &payload); err != nil || payload.Purpose != purpose {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= payload.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	return &payload, nil
+}
+
+func (s *Signer) mac(encoded string) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(encoded))
+
+	return h.Sum(nil)
+}
+
+// stateDigest keeps the bound state, e.g. a password hash, out of the readable payload
+func stateDigest(state string) string {
+	sum := sha256.Sum256([]byte(state))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
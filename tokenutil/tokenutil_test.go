@@ -0,0 +1,97 @@
+package tokenutil
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKey = "test-link-signing-key-of-32-bytes!"
+
+func TestSignVerify(t *testing.T) {
+	signer := NewSigner(testKey)
+	valid, err := signer.Sign(Payload{UserID: 7, Purpose: "password_reset"}, time.Hour, "password hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := signer.Sign(Payload{UserID: 7, Purpose: "password_reset"}, -time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, signature, _ := strings.Cut(valid, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"uid":1,"purpose":"password_reset","exp":4102444800}`))
+
+	tests := []struct {
+		name    string
+		signer  *Signer
+		token   string
+		purpose string
+		wantErr error
+	}{
+		{"valid", signer, valid, "password_reset", nil},
+		{"expired", signer, expired, "password_reset", ErrTokenExpired},
+		{"other purpose", signer, valid, "email_change", ErrInvalidToken},
+		{"other key", NewSigner("another-link-signing-key-32-bytes!"), valid, "password_reset", ErrInvalidToken},
+		{"tampered payload", signer, forged + "." + signature, "password_reset", ErrInvalidToken},
+		{"tampered signature", signer, encoded + "." + base64.RawURLEncoding.EncodeToString([]byte("signature")), "password_reset", ErrInvalidToken},
+		{"unsigned", signer, encoded, "password_reset", ErrInvalidToken},
+		{"malformed", signer, "not.a token", "password_reset", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := tt.signer.Verify(tt.token, tt.purpose)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && payload.UserID != 7 {
+				t.Errorf("Verify() user = %d, want 7", payload.UserID)
+			}
+		})
+	}
+}
+
+func TestSignID(t *testing.T) {
+	signer := NewSigner(testKey)
+	ids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		token, err := signer.Sign(Payload{ID: "chosen", UserID: 7, Purpose: "password_reset"}, time.Hour, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := signer.Verify(token, "password_reset")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[payload.ID] = true
+	}
+
+	// The same payloads get distinct random IDs, the given one is replaced
+	if len(ids) != 2 || ids["chosen"] || ids[""] {
+		t.Errorf("Verify() IDs = %v, want two distinct random IDs", ids)
+	}
+}
+
+func TestBoundTo(t *testing.T) {
+	signer := NewSigner(testKey)
+	token, err := signer.Sign(Payload{UserID: 7, Purpose: "email_change"}, time.Hour, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := signer.Verify(token, "email_change")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !payload.BoundTo("alice@example.com") {
+		t.Error("BoundTo() = false for the state the token was signed for")
+	}
+	if payload.BoundTo("mallory@example.com") {
+		t.Error("BoundTo() = true for a changed state")
+	}
+	encoded, _, _ := strings.Cut(token, ".")
+	if data, _ := base64.RawURLEncoding.DecodeString(encoded); strings.Contains(string(data), "alice") {
+		t.Errorf("payload %s, want only a digest of the state", data)
+	}
+}
@@ -0,0 +1,172 @@
+// Package webhook notifies external services of the auth events, by POSTing signed JSON payloads.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/kjk/betterguid"
+)
+
+// The events sent to the webhooks
+const (
+	EventUserCreated         = "user.created"
+	EventUserLogin           = "user.login"
+	EventUserPasswordChanged = "user.password_changed"
+	EventSessionRevoked      = "session.revoked"
+)
+
+const (
+	// SignatureHeader carries the hex encoded HMAC-SHA256 of the body, keyed with the shared secret
+	SignatureHeader = "X-Webhook-Signature"
+	// EventHeader carries the type of the event, also found in the payload
+	EventHeader = "X-Webhook-Event"
+
+	maxAttempts = 3
+)
+
+// Event is the JSON payload POSTed to the webhooks.
+type Event struct {
+	// ID is unique per event, receivers can use it to ignore the retried deliveries they already handled
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	Data      any       `json:"data"`
+}
+
+// WebhookService delivers the events to the configured URLs, in the background.
+type WebhookService struct {
+	urls   []string
+	secret []byte
+	client *http.Client
+	logger *slog.Logger
+	// backoff is the delay before the first retry, doubled on every attempt
+	backoff time.Duration
+}
+
+/*
+NewWebhookService returns a WebhookService POSTing the events to urls. It sends nothing
+when urls is empty, so that it can be used unconditionally.
+
+Parameters:
+- urls ([]string): The URLs subscribed to the events.
+- secret (string): The secret shared with the receivers, used to sign the payloads.
+- logger (*slog.Logger): The logger the delivery failures are reported to.
+
+Returns:
+- (*WebhookService): A pointer to the newly created WebhookService instance.
+*/
+func NewWebhookService(urls []string, secret string, logger *slog.Logger) *WebhookService {
+	return &WebhookService{
+		urls:    urls,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  logger,
+		backoff: time.Second,
+	}
+}
+
+/*
+Send delivers the event to every URL asynchronously, so that it never blocks nor fails the
+request it is fired from. A delivery failing with a network error, a 429 or a 5xx is retried
+up to 3 times with an exponential backoff, then logged.
+
+Parameters:
+- eventType (string): The type of the event, e.g. EventUserCreated.
+- data (any): The JSON serializable details of the event.
+*/
+func (s *WebhookService) Send(eventType string, data any) {
+	if s == nil || len(s.urls) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(&Event{
+		ID:        betterguid.New(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		s.logger.Error("failed to serialize webhook event", "event", eventType, "error", err)
+		return
+	}
+	signature := Sign(s.secret, body)
+
+	for _, url := range s.urls {
+		go func(url string) {
+			if err := s.deliver(url, eventType, body, signature); err != nil {
+				s.logger.Error("failed to deliver webhook event", "event", eventType, "url", url, "error", err)
+			}
+		}(url)
+	}
+}
+
+func (s *WebhookService) deliver(url, eventType string, body []byte, signature string) error {
+	backoff := s.backoff
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		var retry bool
+		retry, err = s.post(url, eventType, body, signature)
+		if err == nil || !retry {
+			return err
+		}
+
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", maxAttempts, err)
+}
+
+// post sends the payload once, and reports whether a failure is worth retrying.
+func (s *WebhookService) post(url, eventType string, body []byte, signature string) (bool, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, eventType)
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
+
+/*
+Sign returns the signature of a payload, as sent in the X-Webhook-Signature header. Receivers
+compute it over the raw body and compare it in constant time, e.g. with hmac.Equal.
+
+Parameters:
+- secret ([]byte): The shared secret.
+- body ([]byte): The raw payload.
+
+Returns:
+- (string): The signature, "sha256=" followed by the hex encoded HMAC-SHA256.
+*/
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
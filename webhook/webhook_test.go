@@ -0,0 +1,140 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver answers the deliveries with the statuses in order, the last one repeated, and records them
+type receiver struct {
+	mu         sync.Mutex
+	statuses   []int
+	deliveries []*http.Request
+	bodies     [][]byte
+	received   chan struct{}
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *httptest.Server) {
+	r := &receiver{statuses: statuses, received: make(chan struct{}, 16)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		r.mu.Lock()
+		status := r.statuses[min(len(r.deliveries), len(r.statuses)-1)]
+		r.deliveries = append(r.deliveries, req)
+		r.bodies = append(r.bodies, body)
+		r.mu.Unlock()
+
+		w.WriteHeader(status)
+		r.received <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+
+	return r, server
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.deliveries)
+}
+
+func newTestService(urls ...string) *WebhookService {
+	s := NewWebhookService(urls, "shared secret", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.backoff = time.Millisecond
+
+	return s
+}
+
+func TestSign(t *testing.T) {
+	got := Sign([]byte("shared secret"), []byte(`{"id":"1"}`))
+	if want := "sha256=22a6fcdc4316578e5dd849c1fe2a41d64c53b9428c7b84f12e12863b99bae8a0"; got != want {
+		t.Errorf("Sign() = %q, want %q", got, want)
+	}
+	if other := Sign([]byte("other secret"), []byte(`{"id":"1"}`)); other == got {
+		t.Error("Sign() must depend on the secret")
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"delivered", []int{http.StatusNoContent}, 1, false},
+		{"delivered after a server error", []int{http.StatusServiceUnavailable, http.StatusOK}, 2, false},
+		{"delivered after a rate limit", []int{http.StatusTooManyRequests, http.StatusOK}, 2, false},
+		{"server errors until giving up", []int{http.StatusInternalServerError}, maxAttempts, true},
+		{"client error not retried", []int{http.StatusBadRequest}, 1, true},
+		{"gone not retried", []int{http.StatusGone}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, server := newReceiver(t, tt.statuses...)
+			s := newTestService(server.URL)
+
+			body := []byte(`{"id":"1"}`)
+			err := s.deliver(server.URL, EventUserLogin, body, Sign(s.secret, body))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deliver() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := r.count(); got != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	first, firstServer := newReceiver(t, http.StatusOK)
+	second, secondServer := newReceiver(t, http.StatusOK)
+	s := newTestService(firstServer.URL, secondServer.URL)
+
+	s.Send(EventUserCreated, map[string]string{"email": "alice@example.com"})
+
+	for _, r := range []*receiver{first, second} {
+		select {
+		case <-r.received:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the event wasn't delivered to every URL")
+		}
+
+		r.mu.Lock()
+		req, body := r.deliveries[0], r.bodies[0]
+		r.mu.Unlock()
+
+		if got := req.Header.Get(SignatureHeader); got != Sign(s.secret, body) {
+			t.Errorf("%s = %q, want the signature of the body", SignatureHeader, got)
+		}
+		if got := req.Header.Get(EventHeader); got != EventUserCreated {
+			t.Errorf("%s = %q, want %q", EventHeader, got, EventUserCreated)
+		}
+		if got := req.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.ID == "" || event.Type != EventUserCreated || event.CreatedAt.IsZero() {
+			t.Errorf("event = %+v, want an identified %s event", event, EventUserCreated)
+		}
+	}
+}
+
+func TestSendWithoutURLs(t *testing.T) {
+	// Neither a service without URLs nor a nil one send anything, nor panic
+	newTestService().Send(EventUserLogin, nil)
+	var s *WebhookService
+	s.Send(EventUserLogin, nil)
+}